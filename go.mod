@@ -4,8 +4,6 @@ go 1.24.4
 
 require (
 	github.com/krolaw/dhcp4 v0.0.0-20190909130307-a50d88189771
-	github.com/pin/tftp/v3 v3.1.0
+	golang.org/x/net v0.27.0
 	golang.org/x/sys v0.35.0
 )
-
-require golang.org/x/net v0.27.0 // indirect
@@ -0,0 +1,239 @@
+// Package jumpstart installs Solaris 10 over the network as a JumpStart
+// install server does. A SPARC client booting with "boot net - install"
+// finds its address with RARP, loads inetboot over TFTP and asks
+// bootparamd where its install lives:
+//
+//	root=server:<media>/Solaris_10/Tools/Boot     the miniroot it boots
+//	install=server:<media>                        the install image
+//	boottype=:in                                  an install, not a diskless boot
+//	sysid_config=server:<config>/clients/<host>   the directory of its sysidcfg
+//	install_config=server:<config>[/<profile>]    the directory of rules.ok
+//
+// all of which it mounts over NFS.
+package jumpstart
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+
+	"ofw-install-server/utils"
+)
+
+// bootDir is the miniroot of an install image, relative to it.
+const bootDir = "Solaris_10/Tools/Boot"
+
+// Install is a Solaris 10 install image and a JumpStart directory below
+// the root of the NFS export.
+type Install struct {
+	// Root is the directory the NFS export serves; Media and Config are
+	// dirpaths below it, "/" being Root itself.
+	Root   string
+	Media  string
+	Config string
+	// ServerName and ServerIP are this server, which clients mount from.
+	ServerName string
+	ServerIP   net.IP
+	// Router is the default route of generated sysidcfg files, none if nil.
+	Router net.IP
+	// Allocator gives the address and profile of a client by hostname.
+	Allocator *utils.IPv4Allocator
+	// NISDomain, when set, is the name service of generated sysidcfg
+	// files, served by this server; else they have none.
+	NISDomain string
+
+	mu sync.Mutex // serializes writing sysidcfg files
+}
+
+// NewInstall returns the install of the image at media, a dirpath below
+// root holding Solaris_10, with the JumpStart directory config.
+func NewInstall(root, media, config string) (*Install, error) {
+	i := &Install{Root: root, Media: cleanDirpath(media), Config: cleanDirpath(config)}
+	if fi, err := os.Stat(i.path(i.Media, bootDir)); err != nil {
+		return nil, fmt.Errorf("install image %s: %w", i.Media, err)
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("install image %s: %s is not a directory", i.Media, bootDir)
+	}
+	if fi, err := os.Stat(i.path(i.Config)); err != nil {
+		return nil, fmt.Errorf("jumpstart directory %s: %w", i.Config, err)
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("jumpstart directory %s is not a directory", i.Config)
+	}
+	return i, nil
+}
+
+func cleanDirpath(dirpath string) string {
+	return path.Clean("/" + dirpath)
+}
+
+// path returns the file of the export at the dirpath made of elems.
+func (i *Install) path(elems ...string) string {
+	return filepath.Join(append([]string{i.Root}, elems...)...)
+}
+
+// Paths returns the dirpaths clients mount: the install image and the
+// JumpStart directory.
+func (i *Install) Paths() []string {
+	return []string{i.Media, i.Config}
+}
+
+// Inetboot returns the inetboot of the image for platform karch, e.g.
+// sun4u or sun4v: the program OBP loads over TFTP.
+func (i *Install) Inetboot(karch string) (string, error) {
+	p := i.path(i.Media, bootDir, "platform", karch, "inetboot")
+	if _, err := os.Stat(p); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// Bootparams returns the bootparams entries of client, as key →
+// server:path; WriteSysidcfg writes the sysidcfg they name. Clients the
+// Allocator does not know have none.
+func (i *Install) Bootparams(client string) map[string]string {
+	c, ok := i.lookupClient(client)
+	if !ok || !validName(client) {
+		return nil
+	}
+	server := i.ServerName + ":"
+	return map[string]string{
+		"root":           server + path.Join(i.Media, bootDir),
+		"install":        server + i.Media,
+		"boottype":       ":in",
+		"sysid_config":   server + i.sysidConfig(c),
+		"install_config": server + i.installConfig(c),
+	}
+}
+
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\x00")
+}
+
+// lookupClient returns what the Allocator knows of the client called name.
+func (i *Install) lookupClient(name string) (utils.Client, bool) {
+	if i.Allocator == nil {
+		return utils.Client{}, false
+	}
+	for _, c := range i.Allocator.Clients() {
+		if c.Hostname == name {
+			return c, true
+		}
+	}
+	return utils.Client{}, false
+}
+
+// installConfig returns the directory of the rules.ok that c installs by:
+// the directory of the JumpStart directory named by its profile if it has
+// one, else the JumpStart directory itself.
+func (i *Install) installConfig(c utils.Client) string {
+	if validName(c.Profile) {
+		dir := path.Join(i.Config, c.Profile)
+		if _, err := os.Stat(i.path(dir, "rules.ok")); err == nil {
+			return dir
+		}
+	}
+	return i.Config
+}
+
+// sysidConfig returns the directory of the sysidcfg of c, clients/
+// <hostname> of the JumpStart directory.
+func (i *Install) sysidConfig(c utils.Client) string {
+	return path.Join(i.Config, "clients", c.Hostname)
+}
+
+// sysidcfgFacts is the data sysidcfg files are written with.
+type sysidcfgFacts struct {
+	Hostname   string
+	IP         net.IP // nil without a lease
+	Netmask    net.IP
+	Router     net.IP
+	NISDomain  string
+	ServerName string
+	ServerIP   net.IP
+}
+
+// sysidcfgTemplate answers the questions of the Solaris installer that
+// need no one at the console; root_password is left out, so that it is
+// asked for.
+var sysidcfgTemplate = template.Must(template.New("sysidcfg").Parse(`# sysidcfg of {{.Hostname}}, written by ofw-install-server; edit to taste.
+system_locale=C
+terminal=vt100
+timezone=UTC
+timeserver=localhost
+security_policy=NONE
+nfs4_domain=dynamic
+network_interface=primary {hostname={{.Hostname}}
+{{- with .IP}} ip_address={{.}}{{end}}
+{{- with .Netmask}} netmask={{.}}{{end}} protocol_ipv6=no
+{{- with .Router}} default_route={{.}}{{end}}}
+{{if .NISDomain -}}
+name_service=NIS {domain_name={{.NISDomain}} name_server={{.ServerName}}({{.ServerIP}})}
+{{- else -}}
+name_service=NONE
+{{- end}}
+`))
+
+// WriteSysidcfg writes the sysidcfg of client from what is known of it,
+// unless there is one, which the administrator may have edited. It is
+// written as root into the export, which clients may be able to change: no
+// symlink is followed on the way.
+func (i *Install) WriteSysidcfg(client string) error {
+	c, ok := i.lookupClient(client)
+	if !ok || !validName(client) {
+		return nil
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	root, err := os.OpenRoot(i.Root)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	dir := strings.TrimPrefix(i.sysidConfig(c), "/")
+	if err := mkdirAll(root, dir); err != nil {
+		return err
+	}
+	f, err := root.OpenFile(path.Join(dir, "sysidcfg"), os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	facts := sysidcfgFacts{Hostname: c.Hostname, IP: c.IP, Router: i.Router.To4(),
+		NISDomain: i.NISDomain, ServerName: i.ServerName, ServerIP: i.ServerIP.To4()}
+	if subnet := i.Allocator.Subnet(); subnet != nil {
+		facts.Netmask = net.IP(subnet.Mask)
+	}
+	err = sysidcfgTemplate.Execute(f, facts)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// mkdirAll makes the directories of dir below root, refusing anything but
+// a directory in the way.
+func mkdirAll(root *os.Root, dir string) error {
+	cur := ""
+	for _, name := range strings.Split(dir, "/") {
+		cur = path.Join(cur, name)
+		if err := root.Mkdir(cur, 0o755); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+		if fi, err := root.Lstat(cur); err != nil {
+			return err
+		} else if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", cur)
+		}
+	}
+	return nil
+}
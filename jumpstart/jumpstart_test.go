@@ -0,0 +1,159 @@
+package jumpstart
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ofw-install-server/utils"
+)
+
+// testInstall returns an install of a fake image at /install with the
+// JumpStart directory /jumpstart, which has a profile directory "ws", and
+// the clients sparky, with profile ws, and ofw-010203.
+func testInstall(t *testing.T) *Install {
+	t.Helper()
+	root := t.TempDir()
+	for _, p := range []string{
+		"install/Solaris_10/Tools/Boot/platform/sun4u/inetboot",
+		"jumpstart/rules.ok",
+		"jumpstart/ws/rules.ok",
+	} {
+		p = filepath.Join(root, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(p, nil, 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	i, err := NewInstall(root, "install", "/jumpstart/")
+	if err != nil {
+		t.Fatalf("NewInstall: %v", err)
+	}
+	alloc, err := utils.NewIPv4AllocatorFromCIDR("10.1.0.0/24")
+	if err != nil {
+		t.Fatalf("allocator: %v", err)
+	}
+	sparky := [6]byte{8, 0, 0x20, 0xaa, 0xbb, 0xcc}
+	alloc.SetHost(sparky, utils.HostInfo{Hostname: "sparky", Profile: "ws"})
+	alloc.AllocateForMAC(sparky)
+	alloc.AllocateForMAC([6]byte{8, 0, 0x20, 1, 2, 3})
+	i.Allocator = alloc
+	i.ServerName, i.ServerIP, i.Router = "installer", net.IPv4(10, 1, 0, 254), net.IPv4(10, 1, 0, 254)
+	return i
+}
+
+func TestNewInstall(t *testing.T) {
+	i := testInstall(t)
+	if paths := i.Paths(); len(paths) != 2 || paths[0] != "/install" || paths[1] != "/jumpstart" {
+		t.Fatalf("Paths %q", paths)
+	}
+	if p, err := i.Inetboot("sun4u"); err != nil || p != filepath.Join(i.Root, "install", bootDir, "platform/sun4u/inetboot") {
+		t.Fatalf("Inetboot sun4u %q %v", p, err)
+	}
+	if _, err := i.Inetboot("sun4v"); err == nil {
+		t.Fatalf("Inetboot of a missing platform")
+	}
+	if _, err := NewInstall(i.Root, "/jumpstart", "/jumpstart"); err == nil {
+		t.Fatalf("image without %s accepted", bootDir)
+	}
+	if _, err := NewInstall(i.Root, "/install", "/nosuchdir"); err == nil {
+		t.Fatalf("missing jumpstart directory accepted")
+	}
+}
+
+func TestBootparams(t *testing.T) {
+	i := testInstall(t)
+	i.NISDomain = "lab"
+	got := i.Bootparams("sparky")
+	for key, want := range map[string]string{
+		"root":           "installer:/install/Solaris_10/Tools/Boot",
+		"install":        "installer:/install",
+		"boottype":       ":in",
+		"sysid_config":   "installer:/jumpstart/clients/sparky",
+		"install_config": "installer:/jumpstart/ws",
+	} {
+		if got[key] != want {
+			t.Errorf("sparky %s=%q, want %q", key, got[key], want)
+		}
+	}
+	if got := i.Bootparams("ofw-010203"); got["install_config"] != "installer:/jumpstart" {
+		t.Errorf("ofw-010203 install_config=%q", got["install_config"])
+	}
+	if got := i.Bootparams("stranger"); got != nil {
+		t.Errorf("unknown client got %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(i.Root, "jumpstart/clients")); !os.IsNotExist(err) {
+		t.Fatalf("Bootparams wrote sysidcfg files: %v", err)
+	}
+}
+
+func TestWriteSysidcfg(t *testing.T) {
+	i := testInstall(t)
+	i.NISDomain = "lab"
+	for _, client := range []string{"sparky", "ofw-010203", "stranger"} {
+		if err := i.WriteSysidcfg(client); err != nil {
+			t.Fatalf("WriteSysidcfg %s: %v", client, err)
+		}
+	}
+	sysidcfg := filepath.Join(i.Root, "jumpstart/clients/sparky/sysidcfg")
+	data, err := os.ReadFile(sysidcfg)
+	if err != nil {
+		t.Fatalf("sysidcfg: %v", err)
+	}
+	for _, line := range []string{
+		"network_interface=primary {hostname=sparky ip_address=10.1.0.1 netmask=255.255.255.0 protocol_ipv6=no default_route=10.1.0.254}\n",
+		"\nname_service=NIS {domain_name=lab name_server=installer(10.1.0.254)}\n",
+	} {
+		if !strings.Contains(string(data), line) {
+			t.Errorf("sysidcfg without %q:\n%s", line, data)
+		}
+	}
+	// An edited sysidcfg is kept.
+	if err := os.WriteFile(sysidcfg, []byte("edited\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := i.WriteSysidcfg("sparky"); err != nil {
+		t.Fatalf("WriteSysidcfg again: %v", err)
+	}
+	if data, _ := os.ReadFile(sysidcfg); string(data) != "edited\n" {
+		t.Fatalf("sysidcfg rewritten: %q", data)
+	}
+	data, _ = os.ReadFile(filepath.Join(i.Root, "jumpstart/clients/ofw-010203/sysidcfg"))
+	if !strings.Contains(string(data), "\nname_service=NIS") {
+		t.Errorf("ofw-010203 sysidcfg:\n%s", data)
+	}
+	if _, err := os.Stat(filepath.Join(i.Root, "jumpstart/clients/stranger")); !os.IsNotExist(err) {
+		t.Errorf("sysidcfg of an unknown client: %v", err)
+	}
+}
+
+func TestWriteSysidcfgSymlink(t *testing.T) {
+	i := testInstall(t)
+	outside := t.TempDir()
+	clients := filepath.Join(i.Root, "jumpstart/clients")
+	if err := os.Mkdir(clients, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	// A client of a writable export plants its directory, or its
+	// sysidcfg, as a symlink out of the export.
+	if err := os.Symlink(outside, filepath.Join(clients, "sparky")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if err := i.WriteSysidcfg("sparky"); err == nil {
+		t.Fatalf("sysidcfg written through a symlinked directory")
+	}
+	if err := os.Mkdir(filepath.Join(clients, "ofw-010203"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "sysidcfg"), filepath.Join(clients, "ofw-010203", "sysidcfg")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	_ = i.WriteSysidcfg("ofw-010203")
+	if names, _ := os.ReadDir(outside); len(names) != 0 {
+		t.Fatalf("written outside the export: %v", names)
+	}
+}
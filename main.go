@@ -6,43 +6,95 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 
 	"ofw-install-server/bootp"
 	httpx "ofw-install-server/http"
+	"ofw-install-server/jumpstart"
 	"ofw-install-server/nfs"
+	"ofw-install-server/nis"
+	"ofw-install-server/oncrpc"
 	"ofw-install-server/rarp"
 	"ofw-install-server/tftp"
+	"ofw-install-server/utils"
 )
 
 func main() {
 	iface := flag.String("iface", "enp0s25", "interface to bind")
+	stateDir := flag.String("state-dir", "/var/lib/ofw-install-server", "directory of the state kept across restarts, such as the NFS handle key")
+	var hostSpecs []string
+	flag.Func("host", "known client as MAC,hostname[,profile] (repeatable)", func(v string) error {
+		hostSpecs = append(hostSpecs, v)
+		return nil
+	})
 	rarpEnable := flag.Bool("rarp", false, "Enable built-in RARP server")
 	// TFTP flags
 	tftpEnable := flag.Bool("tftp", false, "Enable built-in TFTP")
 	tftpFile := flag.String("tftp-file", "", "file to serve using TFTP (step 1)")
+	tftpDefaults := tftp.DefaultPolicy()
+	tftpBlksize := flag.Int("tftp-blksize", tftpDefaults.MaxBlockSize, "maximum TFTP blksize to negotiate (512 disables the option)")
+	tftpWindowsize := flag.Int("tftp-windowsize", tftpDefaults.WindowSize, "maximum TFTP windowsize to negotiate (1 disables the option)")
+	tftpTsize := flag.Bool("tftp-tsize", tftpDefaults.HonorTsize, "answer the TFTP tsize option")
+	tftpTimeout := flag.Duration("tftp-timeout", tftpDefaults.Timeout, "TFTP retransmission timeout")
+	tftpHonorTimeout := flag.Bool("tftp-honor-timeout", tftpDefaults.HonorTimeout, "accept the timeout proposed by TFTP clients")
+	tftpRetries := flag.Int("tftp-retries", tftpDefaults.Retries, "TFTP retransmissions before giving up")
+	tftpStallThreshold := flag.Int("tftp-stall-threshold", 2, "stalls at the same block before a TFTP client falls back to safer options (0 disables)")
+	var tftpTemplates []string
+	flag.Func("tftp-template", "virtual TFTP path rendered from a Go template, as path=template-file (repeatable)", func(v string) error {
+		tftpTemplates = append(tftpTemplates, v)
+		return nil
+	})
+	tftpTemplateDir := flag.String("tftp-template-dir", "", "directory of Go templates served as virtual TFTP paths relative to it")
+	tftpFanOut := flag.Bool("tftp-fanout", true, "share file reads between concurrent TFTP transfers of the same file")
+	tftpMulticast := flag.String("tftp-multicast", "", "first multicast group:port for RFC 2090 TFTP, e.g. 239.255.69.1:1758 (disabled if empty)")
+	var tftpPolicies []string
+	flag.Func("tftp-policy", "per-client TFTP policy, e.g. oui=08:00:20,blksize=512,windowsize=1 (repeatable)", func(v string) error {
+		tftpPolicies = append(tftpPolicies, v)
+		return nil
+	})
 	// BOOTP/DHCP flags
 	bootpEnable := flag.Bool("bootp", false, "Enable built-in BOOTP/DHCP server")
 	bootpRootPath := flag.String("bootp-rootpath", "", "Root-path option (optional)")
 	bootpFilename := flag.String("bootp-filename", "", "Filename/bootfile option (optional)")
 	bootpDNS := flag.String("bootp-dns", "", "Optional single IPv4 DNS for DHCP option 6 (default 9.9.9.9)")
 	// NFS/portmap flags
-	nfsEnable := flag.Bool("nfs", false, "enable minimal NFSv2 Server")
-	nfsFile := flag.String("nfs-file", "", "file to server using NFSv2 (step 2)")
+	nfsEnable := flag.Bool("nfs", false, "enable minimal NFSv2/v3 server")
+	nfsFile := flag.String("nfs-file", "", "file to server using NFSv2 (step 2), answered for every LOOKUP")
+	nfsRoot := flag.String("nfs-root", "", "directory tree to export over NFSv2 (takes precedence over -nfs-file)")
+	nfsTCP := flag.Bool("nfs-tcp", true, "also serve portmap, MOUNT and NFS over TCP")
+	nfsHandleKey := flag.String("nfs-handle-key", "", "file holding the key that signs NFS file handles, created if missing (default: nfs-handle-key in -state-dir)")
+	nfsAllSquash := flag.Bool("nfs-all-squash", false, "report every exported file as owned by -nfs-anonuid/-nfs-anongid")
+	nfsAnonUID := flag.Uint("nfs-anonuid", 65534, "uid of squashed and AUTH_NONE NFS callers, reported with -nfs-all-squash")
+	nfsAnonGID := flag.Uint("nfs-anongid", 65534, "gid of squashed and AUTH_NONE NFS callers, reported with -nfs-all-squash")
+	nfsRW := flag.Bool("nfs-rw", false, "let the NFS clients -nfs-client admits read-write modify the -nfs-root tree")
+	var nfsExports []string
+	flag.Func("nfs-export", "directory below -nfs-root that clients may mount, named as they see it, e.g. /sparc64 (repeatable; default: /)", func(v string) error {
+		nfsExports = append(nfsExports, v)
+		return nil
+	})
+	var nfsClients []string
+	flag.Func("nfs-client", "NFS client allowed to mount, e.g. net=192.168.1.0/24,ro or mac=08:00:20:aa:bb:cc,no_root_squash (repeatable; default: everyone, read-only with root squashed)", func(v string) error {
+		nfsClients = append(nfsClients, v)
+		return nil
+	})
+	nfsDisklessTemplate := flag.String("nfs-diskless-template", "", "directory below -nfs-root shared read-only as the root of every diskless client, e.g. /sparc64/root (enables per-client roots)")
+	nfsDisklessDir := flag.String("nfs-diskless-dir", "/diskless", "directory below -nfs-root holding the root changes and swap file of each diskless client")
+	nfsSwapSize := flag.Int64("nfs-swap-size", 64<<20, "size in bytes of the sparse swap file of each diskless client (0: none)")
+	jumpstartMedia := flag.String("jumpstart-media", "", "Solaris 10 install image below -nfs-root, the directory holding Solaris_10, e.g. /install/sol10 (enables JumpStart)")
+	jumpstartConfig := flag.String("jumpstart-config", "/jumpstart", "JumpStart directory below -nfs-root holding rules.ok, profiles and clients/<hostname>/sysidcfg")
+	jumpstartKarch := flag.String("jumpstart-karch", "sun4u", "platform of the install image's inetboot served over TFTP with -jumpstart-media")
+	bootparamsFile := flag.String("bootparams", "", "bootparams(5) file of root/swap/dump entries per client, answered by bootparamd with -nfs (default: * root=<server>:<first -nfs-export>)")
+	domain := flag.String("domain", "", "domain name answered to bootparamd WHOAMI, and the NIS domain served with -nis")
+	nisEnable := flag.Bool("nis", false, "serve the NIS (YP) domain -domain, with ethers, hosts and bootparams maps of the known clients (needs -nfs)")
 	// HTTP flags
 	httpEnable := flag.Bool("http", false, "Enable built-in HTTP server")
 	httpFile := flag.String("http-file", "", "file to serve for all HTTP requests")
 
 	flag.Parse()
-
-	// Start TFTP server
-	if *tftpEnable {
-		loggerTFTP := log.New(os.Stdout, "tftp ", log.LstdFlags)
-		_, err := tftp.StartTFTPServer(":69", *tftpFile, loggerTFTP)
-
-		if err != nil {
-			log.Fatalf("start tftp failure: %v", err)
-		}
+	if *nisEnable && !*nfsEnable {
+		log.Fatalf("-nis needs -nfs, which runs rpcbind")
 	}
 
 	// Start HTTP server if enabled
@@ -60,25 +112,213 @@ func main() {
 	// Start RARP allocator and discover server IP early (used by other services)
 	loggerRARP := log.New(os.Stdout, "rarp ", log.LstdFlags)
 	allocator, serverIP, err := rarp.StartRARPServer(iface, loggerRARP)
+	for _, spec := range hostSpecs {
+		mac, info, err := utils.ParseHostSpec(spec)
+		if err != nil {
+			log.Fatalf("invalid -host: %v", err)
+		}
+		if allocator != nil {
+			allocator.SetHost(mac, info)
+		}
+	}
+
+	// Open the JumpStart install, whose inetboot TFTP serves
+	var install *jumpstart.Install
+	if *jumpstartMedia != "" {
+		if !*nfsEnable || *nfsRoot == "" {
+			log.Fatalf("-jumpstart-media needs -nfs and -nfs-root")
+		}
+		var err error
+		if install, err = jumpstart.NewInstall(*nfsRoot, *jumpstartMedia, *jumpstartConfig); err != nil {
+			log.Fatalf("jumpstart failure: %v", err)
+		}
+		if *tftpFile == "" {
+			if *tftpFile, err = install.Inetboot(*jumpstartKarch); err != nil {
+				log.Fatalf("jumpstart inetboot failure: %v", err)
+			}
+		}
+	}
 
-	// Optionally start minimal portmap and UDP proxies for mountd/nfs
+	// Start TFTP server
+	if *tftpEnable {
+		loggerTFTP := log.New(os.Stdout, "tftp ", log.LstdFlags)
+		policies := tftp.NewPolicySet(tftp.Policy{
+			MaxBlockSize: *tftpBlksize,
+			WindowSize:   *tftpWindowsize,
+			HonorTsize:   *tftpTsize,
+			HonorTimeout: *tftpHonorTimeout,
+			Timeout:      *tftpTimeout,
+			Retries:      *tftpRetries,
+			Multicast:    tftpDefaults.Multicast,
+		})
+		for _, spec := range tftpPolicies {
+			if err := policies.Add(spec); err != nil {
+				log.Fatalf("invalid -tftp-policy: %v", err)
+			}
+		}
+		templates := tftp.NewTemplates()
+		if *tftpTemplateDir != "" {
+			if err := templates.AddDir(*tftpTemplateDir); err != nil {
+				log.Fatalf("invalid -tftp-template-dir: %v", err)
+			}
+		}
+		for _, spec := range tftpTemplates {
+			name, file, ok := strings.Cut(spec, "=")
+			if !ok {
+				log.Fatalf("invalid -tftp-template %q: expected path=template-file", spec)
+			}
+			if err := templates.AddFile(name, file); err != nil {
+				log.Fatalf("invalid -tftp-template: %v", err)
+			}
+		}
+		var multicast *tftp.MulticastConfig
+		if *tftpMulticast != "" {
+			group, err := net.ResolveUDPAddr("udp4", *tftpMulticast)
+			if err != nil || !group.IP.IsMulticast() {
+				log.Fatalf("invalid -tftp-multicast %q: expected a multicast group:port", *tftpMulticast)
+			}
+			multicast = &tftp.MulticastConfig{Group: group}
+			if ifc, err := net.InterfaceByName(*iface); err == nil {
+				multicast.Interface = ifc
+			}
+		}
+		_, err := tftp.StartTFTPServer(":69", tftp.Config{
+			DefaultImage:   *tftpFile,
+			Allocator:      allocator,
+			Policies:       policies,
+			Templates:      templates,
+			ServerIP:       serverIP,
+			FanOut:         *tftpFanOut,
+			Multicast:      multicast,
+			StallThreshold: *tftpStallThreshold,
+		}, loggerTFTP)
+
+		if err != nil {
+			log.Fatalf("start tftp failure: %v", err)
+		}
+	}
+
+	// Optionally start rpcbind, MOUNT, NFS and bootparamd
 	if *nfsEnable {
 		loggerPM := log.New(os.Stdout, "rpc ", log.LstdFlags)
-		// Start local MOUNT and NFS servers serving from TFTP root by default
-		_, err := nfs.StartMountd(":20048", "/", loggerPM)
+		exportPath := *nfsFile
+		if *nfsRoot != "" {
+			exportPath = *nfsRoot
+		}
+		export, err := nfs.NewExport(exportPath)
+		if err != nil {
+			log.Fatalf("nfs export failure: %v", err)
+		}
+		export.Writable = *nfsRW
+		export.AllSquash = *nfsAllSquash
+		export.AnonUID, export.AnonGID = uint32(*nfsAnonUID), uint32(*nfsAnonGID)
+		export.Allocator = allocator
+		export.Paths = nfsExports
+		if install != nil && len(export.Paths) > 0 {
+			export.Paths = append(export.Paths, install.Paths()...)
+		}
+		for _, spec := range nfsClients {
+			rule, err := nfs.ParseClientRule(spec)
+			if err != nil {
+				log.Fatalf("invalid -nfs-client: %v", err)
+			}
+			export.Clients = append(export.Clients, rule)
+		}
+		if (export.Writable || *nfsDisklessTemplate != "") && len(export.Clients) == 0 {
+			loggerPM.Printf("no -nfs-client: clients are read-only until listed")
+		}
+		if *nfsDisklessTemplate != "" {
+			if err := export.EnableDiskless(*nfsDisklessTemplate, *nfsDisklessDir, *nfsSwapSize); err != nil {
+				log.Fatalf("nfs diskless failure: %v", err)
+			}
+		}
+		keyFile := *nfsHandleKey
+		if keyFile == "" {
+			keyFile = filepath.Join(*stateDir, "nfs-handle-key")
+		}
+		if export.HandleKey, err = nfs.LoadHandleKey(keyFile); err != nil {
+			log.Fatalf("nfs handle key failure: %v", err)
+		}
+		// Start local MOUNT and NFS servers sharing the export; each
+		// registers its ports with rpcbind.
+		reg := oncrpc.NewRegistry(serverIP)
+		_, err = nfs.StartMountd(":20048", export, reg, loggerPM)
 		if err != nil {
 			log.Fatalf("start mountd failure: %v", err)
 		}
-		_, err = nfs.StartNFSD(":2049", *nfsFile, loggerPM)
+		_, err = nfs.StartNFSD(":2049", export, reg, loggerPM)
 		if err != nil {
 			log.Fatalf("start nfsd failure: %v", err)
 		}
-		// Start local portmap that answers GETPORT for our services
-		_, err = nfs.StartPortmapServer(":111", 20048, 2049, 0, loggerPM)
+		if *nfsTCP {
+			if _, err = nfs.StartMountdTCP(":20048", export, reg, loggerPM); err != nil {
+				log.Fatalf("start mountd tcp failure: %v", err)
+			}
+			if _, err = nfs.StartNFSDTCP(":2049", export, reg, loggerPM); err != nil {
+				log.Fatalf("start nfsd tcp failure: %v", err)
+			}
+			if _, err = oncrpc.StartPortmapTCP(":111", reg, loggerPM); err != nil {
+				log.Fatalf("start portmap tcp failure: %v", err)
+			}
+		}
+		// Start the lock manager and status monitor on ports of their own
+		if _, err = nfs.StartLockd("", export, reg, loggerPM); err != nil {
+			log.Fatalf("start lockd failure: %v", err)
+		}
+		if *nfsTCP {
+			if _, err = nfs.StartLockdTCP("", export, reg, loggerPM); err != nil {
+				log.Fatalf("start lockd tcp failure: %v", err)
+			}
+		}
+		// Start bootparamd for clients booting after RARP
+		params := &nfs.BootParams{Allocator: allocator, ServerIP: serverIP, Domain: *domain, Router: serverIP}
+		params.ServerName, _ = os.Hostname()
+		params.Export = export
+		if install != nil {
+			install.ServerName, install.ServerIP, install.Router = params.ServerName, serverIP, serverIP
+			install.Allocator = allocator
+			if *nisEnable {
+				install.NISDomain = *domain
+			}
+			params.Install, params.Installing = install.Bootparams, install.WriteSysidcfg
+		}
+		if *bootparamsFile != "" {
+			if err := params.Load(*bootparamsFile); err != nil {
+				log.Fatalf("invalid -bootparams: %v", err)
+			}
+		} else {
+			root := "/"
+			if len(nfsExports) > 0 {
+				root = nfsExports[0]
+			}
+			if err := params.Add("* root=" + params.ServerName + ":" + root); err != nil {
+				log.Fatalf("bootparams failure: %v", err)
+			}
+		}
+		if _, err = nfs.StartBootparamd("", params, reg, loggerPM); err != nil {
+			log.Fatalf("start bootparamd failure: %v", err)
+		}
+		// Start ypserv for clients looking up ethers, hosts and bootparams
+		if *nisEnable {
+			if *domain == "" {
+				log.Fatalf("-nis needs -domain")
+			}
+			dom := &nis.Domain{Name: *domain, Allocator: allocator, ServerName: params.ServerName, ServerIP: serverIP, Bootparams: params.Entries}
+			if _, err = nis.StartYPServ("", dom, reg, loggerPM); err != nil {
+				log.Fatalf("start ypserv failure: %v", err)
+			}
+			if *nfsTCP {
+				if _, err = nis.StartYPServTCP("", dom, reg, loggerPM); err != nil {
+					log.Fatalf("start ypserv tcp failure: %v", err)
+				}
+			}
+		}
+		// Start rpcbind answering for the registered services
+		_, err = oncrpc.StartPortmapServer(":111", reg, loggerPM)
 		if err != nil {
 			log.Fatalf("start portmap failure: %v", err)
 		}
-		loggerPM.Printf("MOUNT/NFS/portmap enabled")
+		loggerPM.Printf("MOUNT/NFS/NLM/portmap enabled")
 	}
 
 	// Start BOOTP server if enabled
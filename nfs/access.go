@@ -0,0 +1,244 @@
+package nfs
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"ofw-install-server/oncrpc"
+	"ofw-install-server/xdr"
+)
+
+// ClientRule is one entry of an export's client table: which clients it
+// admits and what they may do. A rule with neither Network nor MAC admits
+// every client.
+type ClientRule struct {
+	// Network admits the clients whose address is inside it.
+	Network *net.IPNet
+	// MAC admits the client that holds the address it calls from as a
+	// lease of the export's Allocator.
+	MAC net.HardwareAddr
+	// ReadOnly refuses changes even on a writable export.
+	ReadOnly bool
+	// RootSquash maps uid and gid 0 of the caller to the export's
+	// AnonUID/AnonGID.
+	RootSquash bool
+}
+
+func (r ClientRule) String() string {
+	switch {
+	case r.Network != nil:
+		return "net=" + r.Network.String()
+	case r.MAC != nil:
+		return "mac=" + r.MAC.String()
+	}
+	return "all"
+}
+
+// ParseClientRule parses "selector[,option...]" where the selector is
+// net=CIDR (or a single address), mac=MAC or all, and the options are ro,
+// rw, root_squash and no_root_squash. As in exports(5), root is squashed
+// unless no_root_squash is given; rw only lets through what the export's
+// own Writable setting allows.
+func ParseClientRule(spec string) (ClientRule, error) {
+	r := ClientRule{RootSquash: true}
+	parts := strings.Split(spec, ",")
+	sel, val, _ := strings.Cut(strings.TrimSpace(parts[0]), "=")
+	switch strings.ToLower(sel) {
+	case "net":
+		if !strings.Contains(val, "/") {
+			val += "/32"
+		}
+		_, n, err := net.ParseCIDR(val)
+		if err != nil || n.IP.To4() == nil {
+			return r, fmt.Errorf("client %q: invalid IPv4 network %q", spec, val)
+		}
+		r.Network = n
+	case "mac":
+		hw, err := net.ParseMAC(val)
+		if err != nil || len(hw) != 6 {
+			return r, fmt.Errorf("client %q: invalid mac %q", spec, val)
+		}
+		r.MAC = hw
+	case "all", "*":
+		if val != "" {
+			return r, fmt.Errorf("client %q: all takes no value", spec)
+		}
+	default:
+		return r, fmt.Errorf("client %q: expected net=, mac= or all", spec)
+	}
+	for _, opt := range parts[1:] {
+		switch strings.ToLower(strings.TrimSpace(opt)) {
+		case "ro":
+			r.ReadOnly = true
+		case "rw":
+			r.ReadOnly = false
+		case "root_squash":
+			r.RootSquash = true
+		case "no_root_squash":
+			r.RootSquash = false
+		default:
+			return r, fmt.Errorf("client %q: unknown option %q", spec, opt)
+		}
+	}
+	return r, nil
+}
+
+// clientAccess is what the client of one call may do.
+type clientAccess struct {
+	readOnly   bool
+	rootSquash bool
+}
+
+// access returns the access of the client at ip from the first rule of the
+// client table that admits it; ok is false when none does. An empty table
+// admits everyone read-only, with root squashed: clients are trusted to
+// change the export only once they are listed.
+func (e *Export) access(ip net.IP) (acc clientAccess, ok bool) {
+	if len(e.Clients) == 0 {
+		return clientAccess{readOnly: true, rootSquash: true}, true
+	}
+	var mac net.HardwareAddr
+	if e.Allocator != nil && ip != nil {
+		mac, _ = e.Allocator.MACForIP(ip)
+	}
+	for _, r := range e.Clients {
+		switch {
+		case r.Network != nil && !r.Network.Contains(ip):
+			continue
+		case r.MAC != nil && (mac == nil || mac.String() != r.MAC.String()):
+			continue
+		}
+		return clientAccess{readOnly: r.ReadOnly, rootSquash: r.RootSquash}, true
+	}
+	return clientAccess{}, false
+}
+
+// caller returns the identity a call runs with: the AUTH_UNIX credential,
+// squashed to AnonUID/AnonGID for AUTH_NONE callers, with AllSquash, and for
+// root when acc asks for it.
+func (e *Export) caller(unixCred *oncrpc.AuthUnixCred, acc clientAccess) oncrpc.AuthUnixCred {
+	anon := oncrpc.AuthUnixCred{UID: e.AnonUID, GID: e.AnonGID}
+	if unixCred == nil || e.AllSquash {
+		return anon
+	}
+	cred := *unixCred
+	anon.Machine = cred.Machine
+	switch {
+	case acc.rootSquash && cred.UID == 0:
+		return anon
+	case acc.rootSquash && cred.GID == 0:
+		cred.GID = e.AnonGID
+	}
+	return cred
+}
+
+// mayWrite reports whether c may change an object with attributes a: root
+// and the owner always may, anyone else needs the write bit of their class.
+// Owners are let through like knfsd does, since they could chmod first.
+func mayWrite(c oncrpc.AuthUnixCred, a fileAttrs) bool {
+	switch {
+	case c.UID == 0, c.UID == a.uid:
+		return true
+	case c.InGroup(a.gid):
+		return a.mode&0o020 != 0
+	}
+	return a.mode&0o002 != 0
+}
+
+// admit checks a call against the export's client table and returns the
+// nfsd to run it with, carrying the caller's identity and access. When the
+// call is refused, admit answers it with NFSERR_ACCES and returns nil.
+func (d *nfsd) admit(c *oncrpc.Call, w *xdr.Writer) *nfsd {
+	acc, ok := d.export.access(oncrpc.AddrIP(c.From))
+	if !ok {
+		d.logf("nfsd v%d proc %d refused for %v: not in the client table", c.Vers, c.Proc, c.From)
+		if c.Vers == nfsV3 {
+			nfs3ReplyErr(w, c.Proc, nfsErrAcces)
+		} else {
+			nfsReplyErr(w, nfsErrAcces)
+		}
+		return nil
+	}
+	call := *d
+	call.access = acc
+	call.caller = d.export.caller(c.Unix, acc)
+	root, err := d.export.disklessClient(oncrpc.AddrIP(c.From))
+	if err != nil {
+		d.logf("nfsd diskless area of %v: %v", c.From, err)
+	}
+	call.root = root
+	return &call
+}
+
+// writable returns errReadOnly unless the calling client may change p: its
+// access must allow changes, and p must be in its own diskless area, or in
+// the template it changes copies of, or else the export must be writable.
+func (d *nfsd) writable(p string) error {
+	if d.access.readOnly {
+		return errReadOnly
+	}
+	if d.root != nil && d.root.owns(p) {
+		return nil
+	}
+	return d.export.writable()
+}
+
+// permitWrite returns nfsOK when the caller may change the contents or the
+// entries of p, nfsErrAcces when it may not.
+func (d *nfsd) permitWrite(p string) uint32 {
+	a, err := statAttrs(p)
+	if err != nil {
+		return nfsStatus(err)
+	}
+	if !mayWrite(d.caller, a) {
+		return nfsErrAcces
+	}
+	return nfsOK
+}
+
+// permitSetattr checks a SETATTR of p with a as a Unix kernel would: only
+// root gives files away, owners change their group among their own groups,
+// mode and times, and a size change needs write permission.
+func (d *nfsd) permitSetattr(p string, a sattr) uint32 {
+	cur, err := statAttrs(p)
+	if err != nil {
+		return nfsStatus(err)
+	}
+	c := d.caller
+	root, owner := c.UID == 0, c.UID == cur.uid
+	if a.uid != sattrUnset && a.uid != cur.uid && !root {
+		return nfsErrPerm
+	}
+	if a.gid != sattrUnset && a.gid != cur.gid && !root && !(owner && c.InGroup(a.gid)) {
+		return nfsErrPerm
+	}
+	if a.mode != sattrUnset && !root && !owner {
+		return nfsErrPerm
+	}
+	if (a.atime.Nsec != unix.UTIME_OMIT || a.mtime.Nsec != unix.UTIME_OMIT) && !mayWrite(c, cur) {
+		return nfsErrAcces
+	}
+	if a.size != sizeUnset && !mayWrite(c, cur) {
+		return nfsErrAcces
+	}
+	return nfsOK
+}
+
+// owned gives a new object the caller as owner unless the client sets one.
+// Only a server running as root can hand out ownership.
+func (d *nfsd) owned(a sattr) sattr {
+	if os.Geteuid() != 0 {
+		return a
+	}
+	if a.uid == sattrUnset {
+		a.uid = d.caller.UID
+	}
+	if a.gid == sattrUnset {
+		a.gid = d.caller.GID
+	}
+	return a
+}
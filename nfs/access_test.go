@@ -0,0 +1,182 @@
+package nfs
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"ofw-install-server/oncrpc"
+	"ofw-install-server/utils"
+	"ofw-install-server/xdr"
+)
+
+func TestParseClientRule(t *testing.T) {
+	good := map[string]string{
+		"net=10.0.0.0/24":                      "net=10.0.0.0/24",
+		"net=10.0.0.7,ro":                      "net=10.0.0.7/32",
+		"mac=08:00:20:AA:BB:CC,no_root_squash": "mac=08:00:20:aa:bb:cc",
+		"all,rw,root_squash":                   "all",
+	}
+	for spec, want := range good {
+		r, err := ParseClientRule(spec)
+		if err != nil || r.String() != want {
+			t.Errorf("%q: %v %v, want %s", spec, r, err, want)
+		}
+	}
+	if r, _ := ParseClientRule("net=10.0.0.0/8,ro"); !r.ReadOnly || !r.RootSquash {
+		t.Errorf("ro rule: %+v", r)
+	}
+	if r, _ := ParseClientRule("all,no_root_squash"); r.ReadOnly || r.RootSquash {
+		t.Errorf("no_root_squash rule: %+v", r)
+	}
+	for _, spec := range []string{"", "host=a", "net=fe80::/64", "net=10.0.0.0/33", "mac=08:00:20", "all=1", "all,sync"} {
+		if _, err := ParseClientRule(spec); err == nil {
+			t.Errorf("%q: parsed", spec)
+		}
+	}
+}
+
+// nfsCallFrom runs one NFS v2 call from client ip as uid/gid and returns
+// the NFS status.
+func nfsCallFrom(t *testing.T, d *nfsd, ip string, uid, gid, proc uint32, args *xdr.Writer) uint32 {
+	t.Helper()
+	req := append(buildUnixRPCCall(1, nfsProgram, nfsV2, proc, uid, gid), args.Bytes()...)
+	resp := d.handle(req, &net.UDPAddr{IP: net.ParseIP(ip), Port: 1023})
+	stat, r := acceptStat(t, resp)
+	if stat != oncrpc.AcceptSuccess {
+		t.Fatalf("proc %d from %s: accept_stat %d", proc, ip, stat)
+	}
+	status, _ := r.ReadUint32()
+	return status
+}
+
+func TestClientTable(t *testing.T) {
+	root := t.TempDir()
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	alloc, err := utils.NewIPv4AllocatorFromCIDR("10.1.0.0/24")
+	if err != nil {
+		t.Fatalf("allocator: %v", err)
+	}
+	leased, _ := alloc.AllocateForMAC([6]byte{8, 0, 0x20, 0xaa, 0xbb, 0xcc})
+	export.Writable = true
+	export.Allocator = alloc
+	for _, spec := range []string{"net=10.0.0.0/24,ro", "mac=08:00:20:aa:bb:cc,no_root_squash", "net=10.2.0.0/24"} {
+		r, err := ParseClientRule(spec)
+		if err != nil {
+			t.Fatalf("ParseClientRule: %v", err)
+		}
+		export.Clients = append(export.Clients, r)
+	}
+	d := &nfsd{export: export}
+	rootFH := export.handle(root)
+	diskless := net.IP(leased[:]).String()
+
+	// MOUNT and NFS refuse clients outside the table.
+	mnt := xdr.NewWriter(buildMinimalRPCCall(7, mountProgram, mountV1, mountProcMnt))
+	mnt.WriteOpaque([]byte("/"))
+	for ip, want := range map[string]uint32{"192.168.1.9": nfsErrAcces, "10.0.0.5": nfsOK, diskless: nfsOK, "10.1.0.200": nfsErrAcces} {
+		_, r := acceptStat(t, handleMountd(mnt.Bytes(), &net.UDPAddr{IP: net.ParseIP(ip)}, export, nil))
+		if status, _ := r.ReadUint32(); status != want {
+			t.Errorf("MNT from %s status=%d, want %d", ip, status, want)
+		}
+	}
+	getattr := xdr.NewWriter(nil)
+	getattr.WriteFixedOpaque(rootFH)
+	if status := nfsCallFrom(t, d, "192.168.1.9", 0, 0, nfsProcGetAttr, getattr); status != nfsErrAcces {
+		t.Fatalf("GETATTR from outside status=%d", status)
+	}
+	v3 := xdr.NewWriter(buildUnixRPCCall(1, nfsProgram, nfsV3, nfs3ProcGetAttr, 0, 0))
+	v3.WriteOpaque(rootFH)
+	_, r := acceptStat(t, d.handle(v3.Bytes(), &net.TCPAddr{IP: net.ParseIP("192.168.1.9")}))
+	if status, _ := r.ReadUint32(); status != nfsErrAcces {
+		t.Fatalf("v3 GETATTR from outside status=%d", status)
+	}
+
+	create := func(name string) *xdr.Writer {
+		args := lookupArgs(rootFH, name)
+		unsetSattr(args)
+		return args
+	}
+	// ro rule on a writable export
+	if status := nfsCallFrom(t, d, "10.0.0.5", 0, 0, nfsProcCreate, create("ro")); status != nfsErrROFS {
+		t.Fatalf("CREATE from ro client status=%d", status)
+	}
+	// no_root_squash: root creates as root
+	if status := nfsCallFrom(t, d, diskless, 0, 0, nfsProcCreate, create("swap")); status != nfsOK {
+		t.Fatalf("CREATE as root status=%d", status)
+	}
+	// root_squash: root is nobody and may not write the root-owned export
+	if status := nfsCallFrom(t, d, "10.2.0.9", 0, 0, nfsProcCreate, create("squashed")); status != nfsErrAcces {
+		t.Fatalf("CREATE as squashed root status=%d", status)
+	}
+	// ...but a user may write their own directory, and owns what they create
+	home := filepath.Join(root, "home")
+	if err := os.Mkdir(home, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.Chown(home, 1000, 100); err != nil {
+		t.Skipf("chown needs root: %v", err)
+	}
+	homeFH := export.handle(home)
+	args := lookupArgs(homeFH, "notes")
+	unsetSattr(args)
+	if status := nfsCallFrom(t, d, "10.2.0.9", 1000, 100, nfsProcCreate, args); status != nfsOK {
+		t.Fatalf("CREATE as owner status=%d", status)
+	}
+	fi, err := os.Stat(filepath.Join(home, "notes"))
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); st.Uid != 1000 || st.Gid != 100 {
+		t.Fatalf("created file owned by %d:%d", st.Uid, st.Gid)
+	}
+	// Only root gives files away.
+	chown := xdr.NewWriter(nil)
+	chown.WriteFixedOpaque(export.handle(filepath.Join(home, "notes")))
+	chown.WriteUint32(sattrUnset)
+	chown.WriteUint32(0)
+	for i := 0; i < 6; i++ {
+		chown.WriteUint32(sattrUnset)
+	}
+	if status := nfsCallFrom(t, d, "10.2.0.9", 1000, 100, nfsProcSetAttr, chown); status != nfsErrPerm {
+		t.Fatalf("SETATTR chown by owner status=%d", status)
+	}
+	if status := nfsCallFrom(t, d, diskless, 0, 0, nfsProcSetAttr, chown); status != nfsOK {
+		t.Fatalf("SETATTR chown by root status=%d", status)
+	}
+}
+
+func TestNoClientTable(t *testing.T) {
+	root := t.TempDir()
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	export.Writable = true
+	d := &nfsd{export: export}
+	rootFH := export.handle(root)
+
+	// Everyone may read, nobody may write without being listed.
+	getattr := xdr.NewWriter(nil)
+	getattr.WriteFixedOpaque(rootFH)
+	if status := nfsCallFrom(t, d, "192.168.1.9", 0, 0, nfsProcGetAttr, getattr); status != nfsOK {
+		t.Fatalf("GETATTR status=%d", status)
+	}
+	args := lookupArgs(rootFH, "new")
+	unsetSattr(args)
+	if status := nfsCallFrom(t, d, "192.168.1.9", 0, 0, nfsProcCreate, args); status != nfsErrROFS {
+		t.Fatalf("CREATE without a client table status=%d, want ROFS", status)
+	}
+	acc, ok := export.access(net.ParseIP("192.168.1.9"))
+	if !ok || !acc.readOnly || !acc.rootSquash {
+		t.Fatalf("access without a client table: %+v %v", acc, ok)
+	}
+	if cred := export.caller(&oncrpc.AuthUnixCred{}, acc); cred.UID != anonID {
+		t.Fatalf("root not squashed: %+v", cred)
+	}
+}
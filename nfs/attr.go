@@ -0,0 +1,250 @@
+package nfs
+
+import (
+	"math"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"ofw-install-server/xdr"
+)
+
+// NFS v3 file types (RFC 1813 ftype3). NFS v2 shares the first five.
+const (
+	nfsTypeReg  = 1
+	nfsTypeDir  = 2
+	nfsTypeBlk  = 3
+	nfsTypeChr  = 4
+	nfsTypeLnk  = 5
+	nfsTypeSock = 6
+	nfsTypeFifo = 7
+)
+
+// fileAttrs is what the server reports about a file, taken from lstat.
+type fileAttrs struct {
+	ftype  uint32
+	mode   uint32 // st_mode: file type and permission bits
+	nlink  uint32
+	uid    uint32
+	gid    uint32
+	size   uint64
+	used   uint64 // bytes allocated on disk
+	blksz  uint32 // preferred I/O block size
+	rdev   uint64
+	fsid   uint64
+	fileid uint64
+	atime  time.Time
+	mtime  time.Time
+	ctime  time.Time
+}
+
+func statAttrs(path string) (fileAttrs, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return fileAttrs{}, err
+	}
+	return fileInfoAttrs(fi)
+}
+
+func fileInfoAttrs(fi os.FileInfo) (fileAttrs, error) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileAttrs{}, syscall.ENOTSUP
+	}
+	a := fileAttrs{
+		mode:   st.Mode,
+		nlink:  uint32(st.Nlink),
+		uid:    st.Uid,
+		gid:    st.Gid,
+		size:   uint64(st.Size),
+		used:   uint64(st.Blocks) * 512,
+		blksz:  uint32(st.Blksize),
+		rdev:   uint64(st.Rdev),
+		fsid:   uint64(st.Dev),
+		fileid: st.Ino,
+		atime:  time.Unix(st.Atim.Unix()),
+		mtime:  time.Unix(st.Mtim.Unix()),
+		ctime:  time.Unix(st.Ctim.Unix()),
+	}
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		a.ftype = nfsTypeDir
+	case syscall.S_IFLNK:
+		a.ftype = nfsTypeLnk
+	case syscall.S_IFBLK:
+		a.ftype = nfsTypeBlk
+	case syscall.S_IFCHR:
+		a.ftype = nfsTypeChr
+	case syscall.S_IFSOCK:
+		a.ftype = nfsTypeSock
+	case syscall.S_IFIFO:
+		a.ftype = nfsTypeFifo
+	default:
+		a.ftype = nfsTypeReg
+	}
+	return a, nil
+}
+
+// nfstime3 is an NFS v3 time (RFC 1813).
+type nfstime3 struct {
+	Seconds  uint32
+	Nseconds uint32
+}
+
+func nfs3Time(t time.Time) nfstime3 {
+	return nfstime3{uint32(t.Unix()), uint32(t.Nanosecond())}
+}
+
+// specdata3 is the major and minor number of a device.
+type specdata3 struct {
+	Specdata1 uint32
+	Specdata2 uint32
+}
+
+// fattr3 is the NFS v3 file attributes structure (RFC 1813).
+type fattr3 struct {
+	Type   uint32
+	Mode   uint32
+	Nlink  uint32
+	UID    uint32
+	GID    uint32
+	Size   uint64
+	Used   uint64
+	Rdev   specdata3
+	FSID   uint64
+	FileID uint64
+	Atime  nfstime3
+	Mtime  nfstime3
+	Ctime  nfstime3
+}
+
+func newFattr3(a fileAttrs) fattr3 {
+	return fattr3{
+		Type:   a.ftype,
+		Mode:   a.mode & 07777,
+		Nlink:  a.nlink,
+		UID:    a.uid,
+		GID:    a.gid,
+		Size:   a.size,
+		Used:   a.used,
+		Rdev:   specdata3{unix.Major(a.rdev), unix.Minor(a.rdev)},
+		FSID:   a.fsid,
+		FileID: a.fileid,
+		Atime:  nfs3Time(a.atime),
+		Mtime:  nfs3Time(a.mtime),
+		Ctime:  nfs3Time(a.ctime),
+	}
+}
+
+func writeNFSv3Fattr(w *xdr.Writer, a fileAttrs) {
+	encode(w, newFattr3(a))
+}
+
+// encode writes v, which is one of the package's wire structures. Those
+// always encode, so an error is a bug; the RPC server turns the panic into
+// SYSTEM_ERR.
+func encode(w *xdr.Writer, v any) {
+	if err := w.Encode(v); err != nil {
+		panic(err)
+	}
+}
+
+// attrs returns the attributes of p as reported to clients of the export,
+// with ownership squashed if the export asks for it.
+func (e *Export) attrs(p string) (fileAttrs, error) {
+	a, err := statAttrs(p)
+	if err != nil {
+		return a, err
+	}
+	return e.squash(a), nil
+}
+
+// squash hides the ownership of a if the export asks for it.
+func (e *Export) squash(a fileAttrs) fileAttrs {
+	if e.AllSquash {
+		a.uid, a.gid = e.AnonUID, e.AnonGID
+	}
+	return a
+}
+
+// timeval is an NFS v2 time (RFC 1094).
+type timeval struct {
+	Seconds  uint32
+	Useconds uint32
+}
+
+func nfs2Time(t time.Time) timeval {
+	return timeval{uint32(t.Unix()), uint32(t.Nanosecond() / 1000)}
+}
+
+// fattr is the NFS v2 file attributes structure (RFC 1094). Unlike fattr3
+// its mode carries the file type bits, and sizes are 32 bits.
+type fattr struct {
+	Type      uint32
+	Mode      uint32
+	Nlink     uint32
+	UID       uint32
+	GID       uint32
+	Size      uint32
+	Blocksize uint32
+	Rdev      uint32
+	Blocks    uint32
+	FSID      uint32
+	FileID    uint32
+	Atime     timeval
+	Mtime     timeval
+	Ctime     timeval
+}
+
+func newFattr(a fileAttrs) fattr {
+	ftype := a.ftype
+	if ftype > nfsTypeLnk {
+		// NFS v2 has no socket or FIFO type; the mode still tells.
+		ftype = 0 // NFNON
+	}
+	blksz := max(a.blksz, 512)
+	return fattr{
+		Type:      ftype,
+		Mode:      a.mode,
+		Nlink:     a.nlink,
+		UID:       a.uid,
+		GID:       a.gid,
+		Size:      uint32(min(a.size, math.MaxUint32)),
+		Blocksize: blksz,
+		Rdev:      unix.Major(a.rdev)<<8 | unix.Minor(a.rdev)&0xff,
+		Blocks:    uint32((a.used + uint64(blksz) - 1) / uint64(blksz)),
+		FSID:      uint32(a.fsid),
+		FileID:    uint32(a.fileid),
+		Atime:     nfs2Time(a.atime),
+		Mtime:     nfs2Time(a.mtime),
+		Ctime:     nfs2Time(a.ctime),
+	}
+}
+
+func writeNFSV2Fattr(w *xdr.Writer, a fileAttrs) {
+	encode(w, newFattr(a))
+}
+
+// postOpAttr is an NFS v3 post_op_attr: attributes if the server has them.
+type postOpAttr struct {
+	Attributes *fattr3
+}
+
+// writePostOpAttr writes a post_op_attr, empty when path cannot be stat'ed.
+func (d *nfsd) writePostOpAttr(w *xdr.Writer, path string) {
+	var post postOpAttr
+	if a, err := d.export.attrs(path); err == nil {
+		attrs := newFattr3(a)
+		post.Attributes = &attrs
+	}
+	encode(w, post)
+}
+
+// writeWccData writes a wcc_data for dir after an operation. No pre-operation
+// attributes are kept, so clients simply refresh their cache.
+func (d *nfsd) writeWccData(w *xdr.Writer, dir string) {
+	w.WriteBool(false)
+	d.writePostOpAttr(w, dir)
+}
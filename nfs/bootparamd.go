@@ -0,0 +1,436 @@
+package nfs
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"ofw-install-server/oncrpc"
+	"ofw-install-server/utils"
+	"ofw-install-server/xdr"
+)
+
+// bootparamd (bootparam_prot.x) tells a client that found its address with
+// RARP who it is (WHOAMI, usually a broadcast PMAPPROC_CALLIT) and where its
+// root, swap and dump live (GETFILE). As with Sun's rpc.bootparamd, clients
+// it knows nothing about get no answer, so other servers can.
+const (
+	bootparamProgram = 100026
+	bootparamV1      = 1
+
+	bootparamProcNull    = 0
+	bootparamProcWhoami  = 1
+	bootparamProcGetfile = 2
+
+	// bp_address type of an IPv4 address
+	bootparamIPAddrType = 1
+
+	bootparamMaxName = 255  // MAX_MACHINE_NAME
+	bootparamMaxPath = 1024 // MAX_PATH_LEN
+)
+
+// BootParams is a bootparams(5) table: for each client name, or * for any
+// client, a list of key=server:path entries such as root=server:/export/root.
+// Client names come from the Allocator, which maps the address a client asks
+// about to its MAC and hostname.
+type BootParams struct {
+	Allocator *utils.IPv4Allocator
+	// ServerName and ServerIP are this server; entries naming ServerName,
+	// or no server at all, resolve to ServerIP.
+	ServerName string
+	ServerIP   net.IP
+	// Domain is the domain name answered to WHOAMI.
+	Domain string
+	// Router is the router address answered to WHOAMI, 0.0.0.0 if nil.
+	Router net.IP
+	// Install, when set, returns the entries of a network install for a
+	// client without entries of their own, as key → server:path, or nil;
+	// clients it gives entries to do not get the others below.
+	Install func(client string) map[string]string
+	// Installing, when set, is called for a client with install entries
+	// when it asks WHOAMI or GETFILE, before it is answered, to make the
+	// files they name; not when the entries are only listed.
+	Installing func(client string) error
+	// Export, when it has diskless roots, answers root and swap for the
+	// clients of the Allocator without entries of their own with their
+	// areas, on ServerName. An area is made when its client asks WHOAMI or
+	// calls the NFS server.
+	Export *Export
+
+	mu      sync.Mutex
+	entries map[string]map[string]string // client → key → server:path
+}
+
+// Add parses one bootparams(5) line, "client key=server:path ...", and adds
+// its entries to the table. Entries for a client given twice are merged.
+func (b *BootParams) Add(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return fmt.Errorf("bootparams %q: expected client key=server:path ...", line)
+	}
+	client := fields[0]
+	files := make(map[string]string)
+	for _, f := range fields[1:] {
+		key, val, ok := strings.Cut(f, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("bootparams %q: expected key=server:path, got %q", line, f)
+		}
+		if !strings.Contains(val, ":") {
+			return fmt.Errorf("bootparams %q: %s: expected server:path, got %q", line, key, val)
+		}
+		files[key] = val
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.entries == nil {
+		b.entries = make(map[string]map[string]string)
+	}
+	if b.entries[client] == nil {
+		b.entries[client] = files
+		return nil
+	}
+	for key, val := range files {
+		b.entries[client][key] = val
+	}
+	return nil
+}
+
+// Load adds the lines of a bootparams(5) file. Lines ending in a backslash
+// continue on the next one, # starts a comment.
+func (b *BootParams) Load(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var line string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		text, _, _ := strings.Cut(sc.Text(), "#")
+		text = strings.TrimRight(text, " \t")
+		if cont, ok := strings.CutSuffix(text, "\\"); ok {
+			line += cont + " "
+			continue
+		}
+		line += text
+		if strings.TrimSpace(line) != "" {
+			if err := b.Add(line); err != nil {
+				return err
+			}
+		}
+		line = ""
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if strings.TrimSpace(line) != "" {
+		return b.Add(line)
+	}
+	return nil
+}
+
+// Len returns the number of clients in the table, counting *.
+func (b *BootParams) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.entries)
+}
+
+// Entries returns the table by client as a bootparams(5) file has it, the
+// client name left out, e.g. "root=server:/export/root swap=...": the NIS
+// bootparams map. The clients of the Allocator without entries of their
+// own have their install entries or diskless areas, if there are any.
+func (b *BootParams) Entries() map[string]string {
+	lines := make(map[string]string)
+	b.mu.Lock()
+	for client, files := range b.entries {
+		lines[client] = entriesLine(files)
+	}
+	b.mu.Unlock()
+	if b.Allocator == nil {
+		return lines
+	}
+	for _, c := range b.Allocator.Clients() {
+		if _, own := lines[c.Hostname]; own {
+			continue
+		}
+		files := b.install(c.Hostname)
+		if files == nil && b.Export != nil {
+			files = make(map[string]string)
+			for _, key := range []string{"root", "swap"} {
+				if path, ok := b.Export.disklessDirpath(c.Hostname, key); ok {
+					files[key] = b.ServerName + ":" + path
+				}
+			}
+		}
+		if len(files) > 0 {
+			lines[c.Hostname] = entriesLine(files)
+		}
+	}
+	return lines
+}
+
+// entriesLine returns files as key=server:path entries sorted by key.
+func entriesLine(files map[string]string) string {
+	keys := make([]string, 0, len(files))
+	for key := range files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		keys[i] = key + "=" + files[key]
+	}
+	return strings.Join(keys, " ")
+}
+
+// install returns the install entries of client, nil if it has none.
+func (b *BootParams) install(client string) map[string]string {
+	if b.Install == nil {
+		return nil
+	}
+	return b.Install(client)
+}
+
+// installing calls Installing for client if it is to boot with its install
+// entries.
+func (b *BootParams) installing(client string) error {
+	if b.Installing == nil {
+		return nil
+	}
+	b.mu.Lock()
+	_, own := b.entries[client]
+	b.mu.Unlock()
+	if own || b.install(client) == nil {
+		return nil
+	}
+	return b.Installing(client)
+}
+
+// lookup returns the value of key for client, from its own entries, else
+// its install entries, else its diskless area, else the wildcard entries.
+func (b *BootParams) lookup(client, key string) (string, bool) {
+	b.mu.Lock()
+	files, own := b.entries[client]
+	b.mu.Unlock()
+	if !own {
+		files = b.install(client)
+	}
+	if files != nil {
+		val, ok := files[key]
+		return val, ok
+	}
+	if b.diskless(client) {
+		if path, ok := b.Export.disklessDirpath(client, key); ok {
+			return ":" + path, true
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	val, ok := b.entries["*"][key]
+	return val, ok
+}
+
+// known reports whether the table has entries for client, or the export
+// a diskless root for it, or client install entries.
+func (b *BootParams) known(client string) bool {
+	b.mu.Lock()
+	_, own := b.entries[client]
+	_, wildcard := b.entries["*"]
+	b.mu.Unlock()
+	return own || wildcard || b.diskless(client) || b.install(client) != nil
+}
+
+// diskless reports whether the export has a diskless area for client: it
+// must be a client of the Allocator, so that names made up by anyone asking
+// get none.
+func (b *BootParams) diskless(client string) bool {
+	if b.Export == nil || b.Export.Diskless == nil || b.Allocator == nil {
+		return false
+	}
+	for _, c := range b.Allocator.Clients() {
+		if c.Hostname == client {
+			return true
+		}
+	}
+	return false
+}
+
+// makeArea makes the diskless area of client if it is to boot from one.
+func (b *BootParams) makeArea(client string) error {
+	b.mu.Lock()
+	_, own := b.entries[client]
+	b.mu.Unlock()
+	if own || b.install(client) != nil || !b.diskless(client) {
+		return nil
+	}
+	_, err := b.Export.disklessArea(client)
+	return err
+}
+
+// whoami returns the name of the client at ip.
+func (b *BootParams) whoami(ip net.IP) (string, bool) {
+	if b.Allocator == nil {
+		return "", false
+	}
+	hw, ok := b.Allocator.MACForIP(ip)
+	if !ok {
+		return "", false
+	}
+	var mac [6]byte
+	copy(mac[:], hw)
+	name := b.Allocator.Host(mac).Hostname
+	return name, b.known(name)
+}
+
+// serverIP resolves the server part of an entry.
+func (b *BootParams) serverIP(server string) (net.IP, error) {
+	if server == "" || server == b.ServerName {
+		return b.ServerIP.To4(), nil
+	}
+	if ip := net.ParseIP(server); ip != nil && ip.To4() != nil {
+		return ip.To4(), nil
+	}
+	addrs, err := net.LookupIP(server)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range addrs {
+		if v4 := ip.To4(); v4 != nil {
+			return v4, nil
+		}
+	}
+	return nil, fmt.Errorf("%s has no IPv4 address", server)
+}
+
+// StartBootparamd runs bootparamd v1 over UDP answering from params and
+// registers it in reg. Without a port in addr it takes any free one, which
+// clients find through rpcbind.
+func StartBootparamd(addr string, params *BootParams, reg *oncrpc.Registry, logger *log.Logger) (net.PacketConn, error) {
+	if addr == "" {
+		addr = ":0"
+	}
+	if logger != nil {
+		logger.Printf("bootparamd serving %d clients", params.Len())
+	}
+	return newBootparamServer(params, logger).ListenUDP(addr, reg)
+}
+
+type bootparamd struct {
+	params *BootParams
+	logger *log.Logger
+}
+
+func (b *bootparamd) logf(format string, args ...any) {
+	if b.logger != nil {
+		b.logger.Printf(format, args...)
+	}
+}
+
+// newBootparamServer returns the bootparamd v1 server of params. Clients it
+// does not know get no answer, leaving them to other servers.
+func newBootparamServer(params *BootParams, logger *log.Logger) *oncrpc.Server {
+	b := &bootparamd{params: params, logger: logger}
+	s := oncrpc.NewServer("bootparamd", logger)
+	s.Register(bootparamProgram, bootparamV1, oncrpc.Procs{
+		bootparamProcWhoami:  b.whoami,
+		bootparamProcGetfile: b.getfile,
+	})
+	return s
+}
+
+func (b *bootparamd) whoami(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: bp_whoami_arg { bp_address client_address }
+	ip, err := readBpAddress(c.Args)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	name, ok := b.params.whoami(ip)
+	b.logf("bootparamd WHOAMI %s from %v: %q known=%v", ip, c.From, name, ok)
+	if !ok {
+		return oncrpc.ErrNoReply
+	}
+	if err := b.params.installing(name); err != nil {
+		b.logf("bootparamd install of %q: %v", name, err)
+	}
+	if err := b.params.makeArea(name); err != nil {
+		b.logf("bootparamd diskless area of %q: %v", name, err)
+	}
+	// bp_whoami_res: client_name, domain_name, router_address
+	w.WriteOpaque([]byte(name))
+	w.WriteOpaque([]byte(b.params.Domain))
+	writeBpAddress(w, b.params.Router)
+	return nil
+}
+
+func (b *bootparamd) getfile(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: bp_getfile_arg { client_name, file_id }
+	client, err := c.Args.ReadOpaque()
+	if err != nil || len(client) > bootparamMaxName {
+		return oncrpc.ErrGarbageArgs
+	}
+	key, err := c.Args.ReadOpaque()
+	if err != nil || len(key) > bootparamMaxPath {
+		return oncrpc.ErrGarbageArgs
+	}
+	if err := b.params.installing(string(client)); err != nil {
+		b.logf("bootparamd install of %q: %v", client, err)
+	}
+	val, ok := b.params.lookup(string(client), string(key))
+	server, path, _ := strings.Cut(val, ":")
+	var ip net.IP
+	if ok {
+		if ip, err = b.params.serverIP(server); err != nil {
+			ok = false
+			b.logf("bootparamd GETFILE %s for %q: %v", key, client, err)
+		}
+	}
+	b.logf("bootparamd GETFILE %s for %q from %v: %q", key, client, c.From, val)
+	if !ok {
+		return oncrpc.ErrNoReply
+	}
+	if server == "" {
+		server = b.params.ServerName
+	}
+	// bp_getfile_res: server_name, server_address, server_path
+	w.WriteOpaque([]byte(server))
+	writeBpAddress(w, ip)
+	w.WriteOpaque([]byte(path))
+	return nil
+}
+
+// readBpAddress decodes a bp_address, whose IPv4 address is four XDR chars,
+// each taking a whole word.
+func readBpAddress(r *xdr.Reader) (net.IP, error) {
+	typ, err := r.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	if typ != bootparamIPAddrType {
+		return nil, fmt.Errorf("bp_address type %d", typ)
+	}
+	ip := make(net.IP, 4)
+	for i := range ip {
+		v, err := r.ReadUint32()
+		if err != nil {
+			return nil, err
+		}
+		ip[i] = byte(v)
+	}
+	return ip, nil
+}
+
+func writeBpAddress(w *xdr.Writer, ip net.IP) {
+	v4 := ip.To4()
+	if v4 == nil {
+		v4 = net.IPv4zero.To4()
+	}
+	w.WriteUint32(bootparamIPAddrType)
+	for _, b := range v4 {
+		w.WriteUint32(uint32(b))
+	}
+}
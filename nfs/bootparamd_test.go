@@ -0,0 +1,264 @@
+package nfs
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ofw-install-server/oncrpc"
+	"ofw-install-server/utils"
+	"ofw-install-server/xdr"
+)
+
+func testBootParams(t *testing.T) (*BootParams, net.IP, net.IP) {
+	t.Helper()
+	alloc, err := utils.NewIPv4AllocatorFromCIDR("10.1.0.0/24")
+	if err != nil {
+		t.Fatalf("allocator: %v", err)
+	}
+	known := [6]byte{8, 0, 0x20, 0xaa, 0xbb, 0xcc}
+	alloc.SetHost(known, utils.HostInfo{Hostname: "sparky"})
+	a, _ := alloc.AllocateForMAC(known)
+	b, _ := alloc.AllocateForMAC([6]byte{8, 0, 0x20, 1, 2, 3})
+	params := &BootParams{
+		Allocator:  alloc,
+		ServerName: "installer",
+		ServerIP:   net.IPv4(10, 1, 0, 254),
+		Domain:     "lab",
+		Router:     net.IPv4(10, 1, 0, 1),
+	}
+	return params, net.IP(a[:]), net.IP(b[:])
+}
+
+func bootparamWhoami(params *BootParams, ip net.IP) []byte {
+	w := xdr.NewWriter(buildUnixRPCCall(3, bootparamProgram, bootparamV1, bootparamProcWhoami, 0, 0))
+	writeBpAddress(w, ip)
+	return handleBootparamd(w.Bytes(), nil, params, nil)
+}
+
+func bootparamGetfile(params *BootParams, client, key string) []byte {
+	w := xdr.NewWriter(buildUnixRPCCall(4, bootparamProgram, bootparamV1, bootparamProcGetfile, 0, 0))
+	w.WriteOpaque([]byte(client))
+	w.WriteOpaque([]byte(key))
+	return handleBootparamd(w.Bytes(), nil, params, nil)
+}
+
+func TestBootparamWhoami(t *testing.T) {
+	params, sparky, other := testBootParams(t)
+	if err := params.Add("sparky root=installer:/export/sparky swap=installer:/export/swap/sparky"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	stat, r := acceptStat(t, bootparamWhoami(params, sparky))
+	name, _ := r.ReadOpaque()
+	domain, _ := r.ReadOpaque()
+	router, err := readBpAddress(r)
+	if stat != oncrpc.AcceptSuccess || err != nil || string(name) != "sparky" || string(domain) != "lab" || !router.Equal(params.Router) {
+		t.Fatalf("WHOAMI: accept_stat %d name %q domain %q router %v, %v", stat, name, domain, router, err)
+	}
+	// Neither unknown addresses nor clients without entries get an answer.
+	for _, ip := range []net.IP{other, net.IPv4(10, 9, 9, 9)} {
+		if resp := bootparamWhoami(params, ip); resp != nil {
+			t.Fatalf("WHOAMI %v answered", ip)
+		}
+	}
+	// A wildcard entry covers every client of the allocator.
+	if err := params.Add("* root=10.1.0.253:/export/generic"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	stat, r = acceptStat(t, bootparamWhoami(params, other))
+	name, _ = r.ReadOpaque()
+	if stat != oncrpc.AcceptSuccess || string(name) != "ofw-010203" {
+		t.Fatalf("WHOAMI with wildcard: accept_stat %d name %q", stat, name)
+	}
+}
+
+func TestBootparamGetfile(t *testing.T) {
+	params, _, _ := testBootParams(t)
+	for _, line := range []string{
+		"sparky root=installer:/export/sparky swap=installer:/export/swap/sparky",
+		"* root=10.1.0.253:/export/generic dump=:/export/dump",
+	} {
+		if err := params.Add(line); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	for _, tc := range []struct {
+		client, key  string
+		server, path string
+		ip           net.IP
+	}{
+		{"sparky", "root", "installer", "/export/sparky", params.ServerIP},
+		{"sparky", "swap", "installer", "/export/swap/sparky", params.ServerIP},
+		{"ofw-010203", "root", "10.1.0.253", "/export/generic", net.IPv4(10, 1, 0, 253)},
+		{"ofw-010203", "dump", "installer", "/export/dump", params.ServerIP},
+	} {
+		stat, r := acceptStat(t, bootparamGetfile(params, tc.client, tc.key))
+		server, _ := r.ReadOpaque()
+		ip, _ := readBpAddress(r)
+		path, err := r.ReadOpaque()
+		if stat != oncrpc.AcceptSuccess || err != nil || string(server) != tc.server || !ip.Equal(tc.ip) || string(path) != tc.path {
+			t.Errorf("GETFILE %s %s: accept_stat %d %s (%v):%s, %v", tc.client, tc.key, stat, server, ip, path, err)
+		}
+	}
+	// The entries of a named client replace the wildcard ones.
+	for _, key := range []string{"dump", "nosuchkey"} {
+		if resp := bootparamGetfile(params, "sparky", key); resp != nil {
+			t.Errorf("GETFILE sparky %s answered", key)
+		}
+	}
+}
+
+func TestBootparamDiskless(t *testing.T) {
+	export, sparkyIP, _ := testDiskless(t)
+	params, _, _ := testBootParams(t)
+	params.Allocator = export.Allocator
+	params.Export = export
+	if err := params.Add("ofw-010203 root=installer:/export/own"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	// Names the Allocator does not know get no area, and GETFILE alone
+	// makes none: the area is made on the client's own WHOAMI.
+	if resp := bootparamGetfile(params, "made-up", "root"); resp != nil {
+		t.Fatalf("GETFILE for an unknown name answered")
+	}
+	if resp := bootparamGetfile(params, "sparky", "root"); resp == nil {
+		t.Fatalf("GETFILE sparky root not answered")
+	}
+	if names, _ := os.ReadDir(filepath.Join(export.Root, "diskless")); len(names) != 0 {
+		t.Fatalf("areas made by GETFILE: %v", names)
+	}
+	stat, r := acceptStat(t, bootparamWhoami(params, net.ParseIP(sparkyIP)))
+	if name, _ := r.ReadOpaque(); stat != oncrpc.AcceptSuccess || string(name) != "sparky" {
+		t.Fatalf("WHOAMI: accept_stat %d %q", stat, name)
+	}
+	for _, tc := range []struct{ client, key, path string }{
+		{"sparky", "root", "/diskless/sparky/root"},
+		{"sparky", "swap", "/diskless/sparky/swap"},
+		{"ofw-010203", "root", "/export/own"},
+	} {
+		stat, r := acceptStat(t, bootparamGetfile(params, tc.client, tc.key))
+		server, _ := r.ReadOpaque()
+		ip, _ := readBpAddress(r)
+		path, _ := r.ReadOpaque()
+		if stat != oncrpc.AcceptSuccess || string(server) != "installer" || !ip.Equal(params.ServerIP) || string(path) != tc.path {
+			t.Errorf("GETFILE %s %s: accept_stat %d %s (%v):%s", tc.client, tc.key, stat, server, ip, path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(export.Root, "diskless", "sparky", "swap")); err != nil {
+		t.Fatalf("area not created: %v", err)
+	}
+	for _, key := range []string{"swap", "dump"} {
+		if resp := bootparamGetfile(params, "ofw-010203", key); resp != nil {
+			t.Errorf("GETFILE ofw-010203 %s answered", key)
+		}
+	}
+	entries := params.Entries()
+	if len(entries) != 2 || entries["sparky"] != "root=installer:/diskless/sparky/root swap=installer:/diskless/sparky/swap" ||
+		entries["ofw-010203"] != "root=installer:/export/own" {
+		t.Fatalf("Entries %q", entries)
+	}
+}
+
+func TestBootparamInstall(t *testing.T) {
+	params, sparkyIP, _ := testBootParams(t)
+	params.Install = func(client string) map[string]string {
+		if client != "sparky" {
+			return nil
+		}
+		return map[string]string{"root": "installer:/install/Solaris_10/Tools/Boot", "boottype": ":in"}
+	}
+	installing := 0
+	params.Installing = func(client string) error {
+		if client != "sparky" {
+			t.Errorf("Installing %q", client)
+		}
+		installing++
+		return nil
+	}
+	entries := params.Entries()
+	if len(entries) != 1 || entries["sparky"] != "boottype=:in root=installer:/install/Solaris_10/Tools/Boot" {
+		t.Fatalf("Entries %q", entries)
+	}
+	if installing != 0 {
+		t.Fatalf("listing the entries called Installing")
+	}
+	stat, r := acceptStat(t, bootparamWhoami(params, sparkyIP))
+	if name, _ := r.ReadOpaque(); stat != oncrpc.AcceptSuccess || string(name) != "sparky" {
+		t.Fatalf("WHOAMI: accept_stat %d %q", stat, name)
+	}
+	stat, r = acceptStat(t, bootparamGetfile(params, "sparky", "boottype"))
+	server, _ := r.ReadOpaque()
+	if stat != oncrpc.AcceptSuccess || string(server) != "installer" {
+		t.Fatalf("GETFILE boottype: accept_stat %d %q", stat, server)
+	}
+	if resp := bootparamGetfile(params, "sparky", "swap"); resp != nil {
+		t.Fatalf("GETFILE of a key the install lacks answered")
+	}
+	if installing != 3 {
+		t.Fatalf("Installing called %d times for WHOAMI and 2 GETFILE", installing)
+	}
+}
+
+func TestBootparamsLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bootparams")
+	data := "# diskless clients\n" +
+		"sparky root=installer:/export/sparky \\\n" +
+		"\tswap=installer:/export/swap/sparky # swap file\n" +
+		"\n" +
+		"* root=installer:/export/generic\n"
+	if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var params BootParams
+	if err := params.Load(file); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if params.Len() != 2 {
+		t.Fatalf("Len %d, want 2", params.Len())
+	}
+	if swap, ok := params.lookup("sparky", "swap"); !ok || swap != "installer:/export/swap/sparky" {
+		t.Fatalf("swap of sparky: %q %v", swap, ok)
+	}
+	for _, bad := range []string{"sparky", "sparky root", "sparky root=/export/sparky", "sparky =x:/y"} {
+		if err := params.Add(bad); err == nil {
+			t.Errorf("Add(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestBootparamCallit(t *testing.T) {
+	params, sparky, _ := testBootParams(t)
+	if err := params.Add("sparky root=installer:/export/sparky"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	reg := oncrpc.NewRegistry(params.ServerIP)
+	pc, err := StartBootparamd("127.0.0.1:0", params, reg, nil)
+	if err != nil {
+		t.Fatalf("StartBootparamd: %v", err)
+	}
+	defer pc.Close()
+	if port := reg.Port(bootparamProgram, bootparamV1, oncrpc.IPProtoUDP); port != uint32(pc.LocalAddr().(*net.UDPAddr).Port) {
+		t.Fatalf("bootparamd registered on port %d, listening on %v", port, pc.LocalAddr())
+	}
+
+	// The broadcast WHOAMI a client sends after RARP: portmap v2 CALLIT.
+	args := xdr.NewWriter(nil)
+	writeBpAddress(args, sparky)
+	w := xdr.NewWriter(buildUnixRPCCall(5, oncrpc.ProgramPortmap, 2, 5, 0, 0))
+	w.WriteUint32(bootparamProgram)
+	w.WriteUint32(bootparamV1)
+	w.WriteUint32(bootparamProcWhoami)
+	w.WriteOpaque(args.Bytes())
+	stat, r := acceptStat(t, oncrpc.NewPortmapServer(reg, nil).Handle(w.Bytes(), &net.UDPAddr{IP: net.IPv4bcast}))
+	r.Skip(4) // port
+	res, err := r.ReadOpaque()
+	if stat != oncrpc.AcceptSuccess || err != nil {
+		t.Fatalf("CALLIT WHOAMI: accept_stat %d, %v", stat, err)
+	}
+	name, err := xdr.NewReader(res).ReadOpaque()
+	if err != nil || string(name) != "sparky" {
+		t.Fatalf("CALLIT WHOAMI: name %q, %v", name, err)
+	}
+}
@@ -0,0 +1,549 @@
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Diskless clients boot with their root and swap over NFS. They share one
+// read-only template root, and each gets an area of its own below Areas,
+// created the first time it shows up:
+//
+//	<Areas>/<hostname>/root   the client's changes to the template
+//	<Areas>/<hostname>/swap   a sparse swap file of SwapSize bytes
+//
+// nfsd serves a client its root as the union of the two: names are looked
+// up in the client's root first, then in the template. Changing a template
+// file copies it up into the client's root first. Removing one leaves a
+// whiteout, an empty file named .wh.<name>, which hides it from then on; a
+// directory both whited out and in the client's root was made anew and
+// hides the template's directory of that name.
+type Diskless struct {
+	// Template and Areas are dirpaths of the export, "/" being its Root.
+	Template string
+	Areas    string
+	// SwapSize is the size of the swap files; with 0 there are none.
+	SwapSize int64
+
+	mu    sync.Mutex
+	roots map[string]*clientRoot // by client name, once created
+}
+
+// whiteoutPrefix starts the names of whiteouts, and of the files being
+// copied up; clients never see them.
+const whiteoutPrefix = ".wh."
+
+// EnableDiskless gives every diskless client a root of its own, made of
+// the template directory and its area below areas, with a swap file of
+// swapSize bytes. The export must be a directory holding both.
+func (e *Export) EnableDiskless(template, areas string, swapSize int64) error {
+	if e.SingleFile {
+		return errors.New("diskless roots need a directory export")
+	}
+	dl := &Diskless{Template: cleanDirpath(template), Areas: cleanDirpath(areas), SwapSize: swapSize}
+	lower, dir := filepath.Join(e.Root, dl.Template), filepath.Join(e.Root, dl.Areas)
+	if _, ok := within(lower, dir); ok {
+		return fmt.Errorf("diskless areas %s inside the template %s", dl.Areas, dl.Template)
+	}
+	if _, ok := within(dir, lower); ok {
+		return fmt.Errorf("diskless template %s inside the areas %s", dl.Template, dl.Areas)
+	}
+	if fi, err := os.Stat(lower); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("diskless template %s: %w", dl.Template, errNotDir)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	e.Diskless = dl
+	return nil
+}
+
+// clientRoot is the area of one diskless client.
+type clientRoot struct {
+	area  string // <Areas>/<name>
+	upper string // area/root, the client's changes
+	lower string // the template
+}
+
+// disklessArea returns the area of the client called name, creating it the
+// first time.
+func (e *Export) disklessArea(name string) (*clientRoot, error) {
+	dl := e.Diskless
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return nil, fmt.Errorf("diskless client name %q", name)
+	}
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if r, ok := dl.roots[name]; ok {
+		return r, nil
+	}
+	area := filepath.Join(e.Root, dl.Areas, name)
+	r := &clientRoot{area: area, upper: filepath.Join(area, "root"), lower: filepath.Join(e.Root, dl.Template)}
+	if err := os.MkdirAll(r.upper, 0o755); err != nil {
+		return nil, err
+	}
+	if dl.SwapSize > 0 {
+		if err := makeSwap(filepath.Join(area, "swap"), dl.SwapSize); err != nil {
+			return nil, err
+		}
+	}
+	if dl.roots == nil {
+		dl.roots = make(map[string]*clientRoot)
+	}
+	dl.roots[name] = r
+	return r, nil
+}
+
+// makeSwap creates a sparse swap file of size bytes, or grows a smaller
+// one; its contents do not matter.
+func makeSwap(p string, size int64) error {
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err == nil && fi.Size() < size {
+		err = f.Truncate(size)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// disklessClient returns the area of the client at ip, nil when the export
+// has no diskless roots or the client is unknown to the Allocator.
+func (e *Export) disklessClient(ip net.IP) (*clientRoot, error) {
+	if e.Diskless == nil || e.Allocator == nil || ip == nil {
+		return nil, nil
+	}
+	hw, ok := e.Allocator.MACForIP(ip)
+	if !ok {
+		return nil, nil
+	}
+	var mac [6]byte
+	copy(mac[:], hw)
+	return e.disklessArea(e.Allocator.Host(mac).Hostname)
+}
+
+// disklessDirpath returns the dirpath of file ("root" or "swap") in the
+// area of the client called name, which disklessArea makes.
+func (e *Export) disklessDirpath(name, file string) (string, bool) {
+	if e.Diskless == nil || (file != "root" && file != "swap") || (file == "swap" && e.Diskless.SwapSize <= 0) {
+		return "", false
+	}
+	return filepath.Join(e.Diskless.Areas, name, file), true
+}
+
+// private reports whether p lies in the area of a diskless client other
+// than r, which are not served to anyone else.
+func (e *Export) private(p string, r *clientRoot) bool {
+	if e.Diskless == nil {
+		return false
+	}
+	rel, ok := within(filepath.Join(e.Root, e.Diskless.Areas), p)
+	if !ok || rel == "." {
+		return false
+	}
+	if r != nil {
+		_, own := within(r.area, p)
+		return !own
+	}
+	return true
+}
+
+// inTemplate reports whether p is the diskless template or below it.
+func (e *Export) inTemplate(p string) bool {
+	if e.Diskless == nil {
+		return false
+	}
+	_, ok := within(filepath.Join(e.Root, e.Diskless.Template), p)
+	return ok
+}
+
+// within returns the path of p relative to base, if p is base or below it.
+func within(base, p string) (string, bool) {
+	rel, err := filepath.Rel(base, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+func exists(p string) bool {
+	_, err := os.Lstat(p)
+	return err == nil
+}
+
+// hidden reports whether the template's rel is whited out in the client's
+// root, itself or one of its parents.
+func (r *clientRoot) hidden(rel string) bool {
+	if rel == "." {
+		return false
+	}
+	dir := r.upper
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		if exists(filepath.Join(dir, whiteoutPrefix+name)) {
+			return true
+		}
+		dir = filepath.Join(dir, name)
+		if !exists(dir) {
+			return false
+		}
+	}
+	return false
+}
+
+// resolve returns the file the client sees at p, a path of its root or of
+// the template: its own copy if it has one, else the template's unless it
+// is whited out. Missing files resolve to the client's root.
+func (r *clientRoot) resolve(p string) string {
+	if rel, ok := within(r.lower, p); ok {
+		up := filepath.Join(r.upper, rel)
+		if exists(up) || r.hidden(rel) {
+			return up
+		}
+		return p
+	}
+	if rel, ok := within(r.upper, p); ok && !exists(p) && !r.hidden(rel) {
+		if low := filepath.Join(r.lower, rel); exists(low) {
+			return low
+		}
+	}
+	return p
+}
+
+// owns reports whether changes to p are the client's own: p is in its area,
+// or in the template, whose files it changes copies of.
+func (r *clientRoot) owns(p string) bool {
+	_, own := within(r.area, p)
+	_, tmpl := within(r.lower, p)
+	return own || tmpl
+}
+
+// lowerOf returns the template file that p, a path of the client's root,
+// stands over, if the client can see it.
+func (r *clientRoot) lowerOf(p string) (string, bool) {
+	rel, ok := within(r.upper, p)
+	if !ok || rel == "." || r.hidden(rel) {
+		return "", false
+	}
+	low := filepath.Join(r.lower, rel)
+	return low, exists(low)
+}
+
+// copyUp returns where a change to p goes: for a template file, a copy of
+// it in the client's root, made along with its parent directories.
+func (r *clientRoot) copyUp(p string) (string, error) {
+	rel, ok := within(r.lower, p)
+	if !ok {
+		return p, nil
+	}
+	up := filepath.Join(r.upper, rel)
+	if exists(up) {
+		return up, nil
+	}
+	if r.hidden(rel) {
+		return "", fs.ErrNotExist
+	}
+	if _, err := r.copyUp(filepath.Dir(p)); err != nil {
+		return "", err
+	}
+	if err := copyFile(p, up); err != nil && !exists(up) {
+		return "", err
+	}
+	return up, nil
+}
+
+// copyFile copies the file, directory, symlink or device at src to dst
+// with its mode, owner and times. Files are copied under a hidden name and
+// linked into place, so a copy is either whole or missing.
+func copyFile(src, dst string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+	mode := fi.Mode()
+	switch {
+	case mode.IsDir():
+		err = os.Mkdir(dst, mode.Perm())
+	case mode&fs.ModeSymlink != 0:
+		var target string
+		if target, err = os.Readlink(src); err == nil {
+			err = os.Symlink(target, dst)
+		}
+	case mode.IsRegular():
+		err = copyContents(src, dst, mode.Perm())
+	default:
+		err = unix.Mknod(dst, st.Mode, int(st.Rdev))
+	}
+	if err != nil {
+		return err
+	}
+	// Without the privilege to give files away, the copy is the server's.
+	_ = os.Lchown(dst, int(st.Uid), int(st.Gid))
+	if mode&fs.ModeSymlink == 0 {
+		_ = syscall.Chmod(dst, st.Mode&07777)
+		_ = os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+	}
+	return nil
+}
+
+func copyContents(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dst), whiteoutPrefix+"copy")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, in)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err == nil {
+		err = os.Link(tmp.Name(), dst)
+	}
+	return err
+}
+
+// whiteout hides the template file under p, a path of the client's root.
+func whiteout(p string) error {
+	f, err := os.OpenFile(filepath.Join(filepath.Dir(p), whiteoutPrefix+filepath.Base(p)), os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// unlink removes p, a path of the client's root, from the client's view
+// with fn, which is unlink or, when dir is set, rmdir. A template file is
+// whited out.
+func (r *clientRoot) unlink(p string, fn func(string) error, dir bool) error {
+	low, ok := r.lowerOf(p)
+	if !ok {
+		return fn(p)
+	}
+	fi, err := os.Lstat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		fi, err = os.Lstat(low)
+	}
+	switch {
+	case err != nil:
+		return err
+	case dir && !fi.IsDir():
+		return syscall.ENOTDIR
+	case !dir && fi.IsDir():
+		return syscall.EISDIR
+	}
+	if dir {
+		entries, err := r.readDir(p)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return syscall.ENOTEMPTY
+		}
+		// Only whiteouts may be left in the client's copy.
+		des, _ := os.ReadDir(p)
+		for _, de := range des {
+			if err := os.Remove(filepath.Join(p, de.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if exists(p) {
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return whiteout(p)
+}
+
+// rename renames from to to, both paths of the client's root. Template
+// directories are not moved, as with overlayfs: clients copy them instead.
+func (r *clientRoot) rename(from, to string) error {
+	low, fromLower := r.lowerOf(from)
+	if fromLower {
+		fi, err := os.Lstat(low)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return syscall.EXDEV
+		}
+		if _, err := r.copyUp(low); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	if fi, err := os.Lstat(to); err == nil && fi.IsDir() {
+		// The directory moved over a template one replaces it.
+		if _, toLower := r.lowerOf(to); toLower {
+			if err := whiteout(to); err != nil {
+				return err
+			}
+		}
+	}
+	if fromLower {
+		return whiteout(from)
+	}
+	return nil
+}
+
+// readDir returns the entries the client sees in dir, a directory of its
+// root or of the template, sorted by name: its own, then the template's
+// that it neither has nor whited out.
+func (r *clientRoot) readDir(dir string) ([]fs.FileInfo, error) {
+	rel, ok := within(r.upper, dir)
+	if !ok {
+		if rel, ok = within(r.lower, dir); !ok {
+			return readDirInfo(dir)
+		}
+	}
+	up, low := filepath.Join(r.upper, rel), filepath.Join(r.lower, rel)
+	seen := make(map[string]bool)
+	var infos []fs.FileInfo
+	upper, err := readDirInfo(up)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, fi := range upper {
+		name := fi.Name()
+		if whited, ok := strings.CutPrefix(name, whiteoutPrefix); ok {
+			seen[whited] = true
+			continue
+		}
+		seen[name] = true
+		infos = append(infos, fi)
+	}
+	if !r.hidden(rel) {
+		lower, err := readDirInfo(low)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		for _, fi := range lower {
+			if !seen[fi.Name()] && !strings.HasPrefix(fi.Name(), whiteoutPrefix) {
+				infos = append(infos, fi)
+			}
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// readDirInfo returns the entries of dir, skipping those removed while
+// reading it.
+func readDirInfo(dir string) ([]fs.FileInfo, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fs.FileInfo, 0, len(des))
+	for _, de := range des {
+		if fi, err := de.Info(); err == nil {
+			infos = append(infos, fi)
+		}
+	}
+	return infos, nil
+}
+
+// view returns the file the caller sees at p, which pathFor resolved: for
+// a diskless client, its own copy of a template file. ok is false for the
+// areas of other clients.
+func (d *nfsd) view(p string) (string, bool) {
+	if d.export.private(p, d.root) {
+		return "", false
+	}
+	if d.root != nil {
+		p = d.root.resolve(p)
+	}
+	return p, true
+}
+
+// lookupPath resolves name in directory dir as the caller sees it.
+func (d *nfsd) lookupPath(dir, name string) (string, error) {
+	p, err := d.export.lookup(dir, name)
+	if err != nil || d.export.Diskless == nil {
+		return p, err
+	}
+	if d.root != nil && strings.HasPrefix(name, whiteoutPrefix) {
+		return "", fs.ErrNotExist
+	}
+	p, ok := d.view(p)
+	if !ok {
+		return "", errNotExported
+	}
+	return p, nil
+}
+
+// modifiable returns the path a change to p goes to: a diskless client
+// changes its copy of a template file. Nobody else may change the template.
+func (d *nfsd) modifiable(p string) (string, error) {
+	if d.root != nil {
+		return d.root.copyUp(p)
+	}
+	if d.export.inTemplate(p) {
+		return "", errReadOnly
+	}
+	return p, nil
+}
+
+// copyUpAt copies up the template file a diskless client sees at p, a
+// path of its root about to be created, so that creating it finds the file
+// there as anyone else would.
+func (d *nfsd) copyUpAt(p string) error {
+	if d.root == nil {
+		return nil
+	}
+	if low, ok := d.root.lowerOf(p); ok {
+		_, err := d.root.copyUp(low)
+		return err
+	}
+	return nil
+}
+
+// unlinkPath removes p with fn, unlink or, when dir is set, rmdir; a
+// diskless client's template files are whited out.
+func (d *nfsd) unlinkPath(p string, fn func(string) error, dir bool) error {
+	defer d.export.forgetHandles(p)
+	if d.root != nil {
+		return d.root.unlink(p, fn, dir)
+	}
+	return fn(p)
+}
+
+// renamePath renames from to to, both returned by readDirOp.
+func (d *nfsd) renamePath(from, to string) error {
+	defer d.export.forgetHandles(from)
+	defer d.export.forgetHandles(to)
+	if d.root != nil {
+		return d.root.rename(from, to)
+	}
+	return os.Rename(from, to)
+}
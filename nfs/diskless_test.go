@@ -0,0 +1,364 @@
+package nfs
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"ofw-install-server/oncrpc"
+	"ofw-install-server/utils"
+	"ofw-install-server/xdr"
+)
+
+// testDiskless returns an export, read-only but for the diskless areas,
+// whose template, /sparc64/root,
+// holds etc/hosts, etc/motd and usr/share/doc, with diskless areas below
+// /diskless, and the addresses of two clients: sparky and ofw-010203.
+func testDiskless(t *testing.T) (*Export, string, string) {
+	t.Helper()
+	root := t.TempDir()
+	template := filepath.Join(root, "sparc64", "root")
+	for name, data := range map[string]string{
+		"etc/hosts":     "template",
+		"etc/motd":      "welcome",
+		"usr/share/doc": "doc",
+	} {
+		p := filepath.Join(template, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	export.Clients = []ClientRule{{}} // all,rw,no_root_squash
+	if err := export.EnableDiskless("/sparc64/root", "/diskless", 1<<20); err != nil {
+		t.Fatalf("EnableDiskless: %v", err)
+	}
+	alloc, err := utils.NewIPv4AllocatorFromCIDR("10.1.0.0/24")
+	if err != nil {
+		t.Fatalf("allocator: %v", err)
+	}
+	known := [6]byte{8, 0, 0x20, 0xaa, 0xbb, 0xcc}
+	alloc.SetHost(known, utils.HostInfo{Hostname: "sparky"})
+	a, _ := alloc.AllocateForMAC(known)
+	b, _ := alloc.AllocateForMAC([6]byte{8, 0, 0x20, 1, 2, 3})
+	export.Allocator = alloc
+	return export, net.IP(a[:]).String(), net.IP(b[:]).String()
+}
+
+// nfs3CallFrom runs one NFS v3 call through d as root from client ip and
+// returns the NFS status and the reader positioned after it.
+func nfs3CallFrom(t *testing.T, d *nfsd, ip string, proc uint32, args *xdr.Writer) (uint32, *xdr.Reader) {
+	t.Helper()
+	req := append(buildUnixRPCCall(1, nfsProgram, nfsV3, proc, 0, 0), args.Bytes()...)
+	stat, r := acceptStat(t, d.handle(req, &net.UDPAddr{IP: net.ParseIP(ip), Port: 1023}))
+	if stat != oncrpc.AcceptSuccess {
+		t.Fatalf("v3 proc %d from %s: accept_stat %d", proc, ip, stat)
+	}
+	status, _ := r.ReadUint32()
+	return status, r
+}
+
+// mountRoot mounts dirpath from ip and returns its handle.
+func mountRoot(t *testing.T, export *Export, ip, dirpath string) []byte {
+	t.Helper()
+	r := mountCallFrom(t, export, ip, mountProcMnt, dirpath)
+	if status, _ := r.ReadUint32(); status != nfsOK {
+		t.Fatalf("MNT %s from %s status=%d", dirpath, ip, status)
+	}
+	fh, _ := r.ReadOpaque()
+	return fh
+}
+
+// walk looks up the names of path one by one from dir, as ip sees them.
+func walk(t *testing.T, d *nfsd, ip string, dir []byte, path string) ([]byte, uint32) {
+	t.Helper()
+	fh := dir
+	for _, name := range strings.Split(path, "/") {
+		status, r := nfs3CallFrom(t, d, ip, nfs3ProcLookup, dirop3Args(fh, name))
+		if status != nfsOK {
+			return nil, status
+		}
+		fh, _ = r.ReadOpaque()
+	}
+	return fh, nfsOK
+}
+
+// readFrom reads the whole of the small file fh as ip.
+func readFrom(t *testing.T, d *nfsd, ip string, fh []byte) string {
+	t.Helper()
+	args := fh3Args(fh)
+	args.WriteUint64(0)
+	args.WriteUint32(8192)
+	status, r := nfs3CallFrom(t, d, ip, nfs3ProcRead, args)
+	if status != nfsOK {
+		t.Fatalf("READ from %s status=%d", ip, status)
+	}
+	r.Skip(4 + fattr3Size + 4 + 4) // post_op_attr, count, eof
+	data, _ := r.ReadOpaque()
+	return string(data)
+}
+
+// readdirFrom lists the directory fh as ip, without . and ...
+func readdirFrom(t *testing.T, d *nfsd, ip string, fh []byte) []string {
+	t.Helper()
+	args := fh3Args(fh)
+	args.WriteUint64(0)
+	args.WriteFixedOpaque(make([]byte, 8))
+	args.WriteUint32(8192)
+	status, r := nfs3CallFrom(t, d, ip, nfs3ProcReaddir, args)
+	if status != nfsOK {
+		t.Fatalf("READDIR from %s status=%d", ip, status)
+	}
+	r.Skip(4 + fattr3Size + 8)
+	var names []string
+	for {
+		if follows, _ := r.ReadBool(); !follows {
+			break
+		}
+		r.ReadUint64()
+		name, _ := r.ReadOpaque()
+		r.ReadUint64()
+		if n := string(name); n != "." && n != ".." {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestDisklessArea(t *testing.T) {
+	export, sparky, other := testDiskless(t)
+	fh := mountRoot(t, export, sparky, "/diskless/sparky/root")
+	area := filepath.Join(export.Root, "diskless", "sparky")
+	if p, _ := export.file(fh); p != filepath.Join(area, "root") {
+		t.Fatalf("mounted %q", p)
+	}
+	fi, err := os.Stat(filepath.Join(area, "swap"))
+	if err != nil {
+		t.Fatalf("swap: %v", err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); fi.Size() != 1<<20 || st.Blocks*512 >= fi.Size() {
+		t.Fatalf("swap size=%d blocks=%d, want a sparse file of 1 MiB", fi.Size(), st.Blocks)
+	}
+
+	// Areas are private to their clients.
+	mountRoot(t, export, other, "/diskless/ofw-010203/root")
+	r := mountCallFrom(t, export, sparky, mountProcMnt, "/diskless/ofw-010203/root")
+	if status, _ := r.ReadUint32(); status != nfsErrAcces {
+		t.Fatalf("MNT of another client's root status=%d", status)
+	}
+	r = mountCallFrom(t, export, "10.1.0.99", mountProcMnt, "/diskless/sparky")
+	if status, _ := r.ReadUint32(); status != nfsErrAcces {
+		t.Fatalf("MNT of an area by a stranger status=%d", status)
+	}
+	d := &nfsd{export: export}
+	if status, _ := nfs3CallFrom(t, d, other, nfs3ProcGetAttr, fh3Args(fh)); status != nfsErrStale {
+		t.Fatalf("GETATTR of another client's root status=%d", status)
+	}
+	if err := export.EnableDiskless("/diskless", "/diskless/areas", 0); err == nil {
+		t.Fatalf("areas inside the template accepted")
+	}
+}
+
+func TestDisklessCopyOnWrite(t *testing.T) {
+	export, sparky, other := testDiskless(t)
+	d := &nfsd{export: export}
+	template := filepath.Join(export.Root, "sparc64", "root")
+	upper := filepath.Join(export.Root, "diskless", "sparky", "root")
+	sparkyRoot := mountRoot(t, export, sparky, "/diskless/sparky/root")
+	otherRoot := mountRoot(t, export, other, "/diskless/ofw-010203/root")
+
+	hosts, status := walk(t, d, sparky, sparkyRoot, "etc/hosts")
+	if status != nfsOK {
+		t.Fatalf("LOOKUP etc/hosts status=%d", status)
+	}
+	if data := readFrom(t, d, sparky, hosts); data != "template" {
+		t.Fatalf("READ etc/hosts %q", data)
+	}
+
+	// WRITE copies the file into sparky's root.
+	args := fh3Args(hosts)
+	args.WriteUint64(0)
+	args.WriteUint32(6)
+	args.WriteUint32(writeFileSync)
+	args.WriteOpaque([]byte("sparky"))
+	if status, _ := nfs3CallFrom(t, d, sparky, nfs3ProcWrite, args); status != nfsOK {
+		t.Fatalf("WRITE status=%d", status)
+	}
+	if data := readFrom(t, d, sparky, hosts); data != "sparkyte" {
+		t.Fatalf("READ after WRITE %q", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(upper, "etc", "hosts")); string(data) != "sparkyte" {
+		t.Fatalf("copy %q", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(template, "etc", "hosts")); string(data) != "template" {
+		t.Fatalf("template changed to %q", data)
+	}
+	otherHosts, _ := walk(t, d, other, otherRoot, "etc/hosts")
+	if data := readFrom(t, d, other, otherHosts); data != "template" {
+		t.Fatalf("other client READ %q", data)
+	}
+	// Creating a template file finds it there.
+	etc, _ := walk(t, d, sparky, sparkyRoot, "etc")
+	create := dirop3Args(etc, "motd")
+	create.WriteUint32(createGuarded)
+	for range 6 {
+		create.WriteUint32(0)
+	}
+	if status, _ := nfs3CallFrom(t, d, sparky, nfs3ProcCreate, create); status != nfsErrExist {
+		t.Fatalf("GUARDED CREATE of a template file status=%d", status)
+	}
+
+	// REMOVE whites the template file out.
+	if status, _ := nfs3CallFrom(t, d, sparky, nfs3ProcRemove, dirop3Args(etc, "motd")); status != nfsOK {
+		t.Fatalf("REMOVE status=%d", status)
+	}
+	if _, status := walk(t, d, sparky, sparkyRoot, "etc/motd"); status != nfsErrNoEnt {
+		t.Fatalf("LOOKUP of a removed file status=%d", status)
+	}
+	if _, status := walk(t, d, sparky, sparkyRoot, "etc/.wh.motd"); status != nfsErrNoEnt {
+		t.Fatalf("LOOKUP of a whiteout status=%d", status)
+	}
+	if names := readdirFrom(t, d, sparky, etc); len(names) != 1 || names[0] != "hosts" {
+		t.Fatalf("READDIR etc %v", names)
+	}
+	otherEtc, _ := walk(t, d, other, otherRoot, "etc")
+	if names := readdirFrom(t, d, other, otherEtc); len(names) != 2 {
+		t.Fatalf("other client READDIR etc %v", names)
+	}
+	if _, err := os.Stat(filepath.Join(template, "etc", "motd")); err != nil {
+		t.Fatalf("template file removed: %v", err)
+	}
+
+	// A directory removed and made anew hides the template's.
+	usr, _ := walk(t, d, sparky, sparkyRoot, "usr")
+	if status, _ := nfs3CallFrom(t, d, sparky, nfs3ProcRmdir, dirop3Args(usr, "share")); status != nfsErrNotEmpty {
+		t.Fatalf("RMDIR of a full directory status=%d", status)
+	}
+	share, _ := walk(t, d, sparky, usr, "share")
+	if status, _ := nfs3CallFrom(t, d, sparky, nfs3ProcRemove, dirop3Args(share, "doc")); status != nfsOK {
+		t.Fatalf("REMOVE doc status=%d", status)
+	}
+	if status, _ := nfs3CallFrom(t, d, sparky, nfs3ProcRmdir, dirop3Args(usr, "share")); status != nfsOK {
+		t.Fatalf("RMDIR status=%d", status)
+	}
+	mkdir := dirop3Args(usr, "share")
+	for range 6 {
+		mkdir.WriteUint32(0)
+	}
+	if status, _ := nfs3CallFrom(t, d, sparky, nfs3ProcMkdir, mkdir); status != nfsOK {
+		t.Fatalf("MKDIR status=%d", status)
+	}
+	share, _ = walk(t, d, sparky, usr, "share")
+	if names := readdirFrom(t, d, sparky, share); len(names) != 0 {
+		t.Fatalf("READDIR of the new directory %v", names)
+	}
+	if _, status := walk(t, d, other, otherRoot, "usr/share/doc"); status != nfsOK {
+		t.Fatalf("other client LOOKUP usr/share/doc status=%d", status)
+	}
+
+	// Clients that are not diskless may not change the template.
+	tmpl := export.handle(filepath.Join(template, "etc", "hosts"))
+	args = fh3Args(tmpl)
+	args.WriteUint64(0)
+	args.WriteUint32(1)
+	args.WriteUint32(writeFileSync)
+	args.WriteOpaque([]byte("x"))
+	if status, _ := nfs3CallFrom(t, d, "10.1.0.99", nfs3ProcWrite, args); status != nfsErrROFS {
+		t.Fatalf("WRITE to the template status=%d", status)
+	}
+	args = fh3Args(tmpl)
+	args.WriteUint64(0)
+	args.WriteUint32(0)
+	if status, _ := nfs3CallFrom(t, d, "10.1.0.99", nfs3ProcCommit, args); status != nfsErrROFS {
+		t.Fatalf("COMMIT of the template status=%d", status)
+	}
+}
+
+func TestDisklessWritesStayInArea(t *testing.T) {
+	export, sparky, _ := testDiskless(t)
+	d := &nfsd{export: export}
+	top := mountRoot(t, export, sparky, "/")
+	create := func(dir []byte, name string) uint32 {
+		args := dirop3Args(dir, name)
+		args.WriteUint32(createGuarded)
+		for range 6 {
+			args.WriteUint32(0)
+		}
+		status, _ := nfs3CallFrom(t, d, sparky, nfs3ProcCreate, args)
+		return status
+	}
+
+	// A diskless client changes its own area, and nothing else of an
+	// export that is not writable.
+	area, _ := walk(t, d, sparky, top, "diskless/sparky")
+	if status := create(area, "notes"); status != nfsOK {
+		t.Fatalf("CREATE in its own area status=%d", status)
+	}
+	if status := create(top, "motd"); status != nfsErrROFS {
+		t.Fatalf("CREATE at the top of the export status=%d", status)
+	}
+	sparc64, _ := walk(t, d, sparky, top, "sparc64")
+	if status := create(sparc64, "kernel"); status != nfsErrROFS {
+		t.Fatalf("CREATE next to the template status=%d", status)
+	}
+
+	// -nfs-rw makes the rest writable.
+	export.Writable = true
+	if status := create(top, "motd"); status != nfsOK {
+		t.Fatalf("CREATE in a writable export status=%d", status)
+	}
+}
+
+func TestDisklessLinkStaysInArea(t *testing.T) {
+	export, sparky, _ := testDiskless(t)
+	d := &nfsd{export: export}
+	bsd := filepath.Join(export.Root, "sparc64", "bsd")
+	if err := os.WriteFile(bsd, []byte("kernel"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	top := mountRoot(t, export, sparky, "/")
+	kernel, _ := walk(t, d, sparky, top, "sparc64/bsd")
+	root, _ := walk(t, d, sparky, top, "diskless/sparky/root")
+
+	// Linking a file of the export into its own area would let a diskless
+	// client write it through the link.
+	args := fh3Args(kernel)
+	args.WriteFixedOpaque(dirop3Args(root, "bsd").Bytes())
+	if status, _ := nfs3CallFrom(t, d, sparky, nfs3ProcLink, args); status != nfsErrXDev {
+		t.Fatalf("v3 LINK from outside the area status=%d", status)
+	}
+	args = xdr.NewWriter(nil)
+	args.WriteFixedOpaque(kernel)
+	args.WriteFixedOpaque(lookupArgs(root, "bsd").Bytes())
+	if status := nfsCallFrom(t, d, sparky, 0, 0, nfsProcLink, args); status != nfsErrAcces {
+		t.Fatalf("v2 LINK from outside the area status=%d", status)
+	}
+	if _, status := walk(t, d, sparky, root, "bsd"); status != nfsErrNoEnt {
+		t.Fatalf("LOOKUP of the refused link status=%d", status)
+	}
+	if fi, err := os.Stat(bsd); err != nil || fi.Sys().(*syscall.Stat_t).Nlink != 1 {
+		t.Fatalf("source linked: %v", err)
+	}
+	if data, _ := os.ReadFile(bsd); string(data) != "kernel" {
+		t.Fatalf("source changed to %q", data)
+	}
+
+	// Its own files it may link.
+	hosts, _ := walk(t, d, sparky, root, "etc/hosts")
+	args = fh3Args(hosts)
+	args.WriteFixedOpaque(dirop3Args(root, "hosts").Bytes())
+	if status, _ := nfs3CallFrom(t, d, sparky, nfs3ProcLink, args); status != nfsOK {
+		t.Fatalf("v3 LINK in the area status=%d", status)
+	}
+}
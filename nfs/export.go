@@ -0,0 +1,218 @@
+package nfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"ofw-install-server/utils"
+)
+
+// anonID is the uid and gid of nobody.
+const anonID = 65534
+
+var (
+	errOutsideExport = errors.New("path outside export")
+	errReadOnly      = errors.New("export is read-only")
+	errNotExported   = errors.New("path is not exported")
+)
+
+// Export is the tree served by mountd and nfsd. It is normally a directory;
+// when created from a regular file it runs in single-file compatibility mode
+// where every LOOKUP resolves to that file, whatever the name.
+type Export struct {
+	Root       string
+	SingleFile bool
+	// Writable allows the modifying procedures (WRITE, CREATE, REMOVE...)
+	// everywhere; without it, diskless clients change their own areas only.
+	// Single-file exports are always read-only.
+	Writable bool
+	// AllSquash reports every file as owned by AnonUID/AnonGID instead of
+	// its real owner, and runs every caller as AnonUID/AnonGID.
+	AllSquash bool
+	// AnonUID and AnonGID are the identity of squashed and AUTH_NONE
+	// callers, nobody by default.
+	AnonUID uint32
+	AnonGID uint32
+	// HandleKey signs file handles; when empty a random key is made, and
+	// handles last until the server restarts. See LoadHandleKey.
+	HandleKey []byte
+	// Clients is the client table: the first rule admitting a client sets
+	// its access. When empty, every client is admitted.
+	Clients []ClientRule
+	// Allocator resolves client addresses to MACs for the mac= rules, and
+	// names diskless clients.
+	Allocator *utils.IPv4Allocator
+	// Paths are the directories MOUNT hands out, named as clients see
+	// them: "/" is Root. Directories below them may be mounted too. When
+	// empty, the whole tree is exported as "/".
+	Paths []string
+	// Diskless, set by EnableDiskless, gives each diskless client a root
+	// of its own.
+	Diskless *Diskless
+
+	mu      sync.Mutex
+	handles map[string]string    // handle -> path cache, see resolve
+	misses  map[string]time.Time // handles that resolved to nothing
+	mounts  map[mountEntry]bool
+	locks   lockTable // NLM locks, see lockd
+	files   fileCache // files open for READ
+}
+
+// NewExport returns an export rooted at path, in single-file mode if path is
+// a regular file.
+func NewExport(path string) (*Export, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+	return &Export{Root: filepath.Clean(abs), SingleFile: !fi.IsDir(), AnonUID: anonID, AnonGID: anonID}, nil
+}
+
+// contains reports whether p is the export root or below it.
+func (e *Export) contains(p string) bool {
+	rel, err := filepath.Rel(e.Root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// lookup resolves name in directory dir. "." and ".." are handled lexically
+// and ".." at the top of the exported directory holding dir stays there, so
+// lookups never leave what MOUNT hands out.
+func (e *Export) lookup(dir, name string) (string, error) {
+	if e.SingleFile {
+		return e.Root, nil
+	}
+	if name == "" || strings.ContainsRune(name, '/') || strings.ContainsRune(name, 0) {
+		return "", os.ErrInvalid
+	}
+	dirpath, ok := e.exportOf(dir)
+	if !ok {
+		return "", errOutsideExport
+	}
+	top := filepath.Join(e.Root, dirpath)
+	p := filepath.Join(dir, name)
+	if _, ok := within(top, p); !ok {
+		p = top
+	}
+	return p, nil
+}
+
+// writable returns errReadOnly unless clients may modify the export.
+func (e *Export) writable() error {
+	if e.SingleFile || !e.Writable {
+		return errReadOnly
+	}
+	return nil
+}
+
+// child returns the path of a new or existing entry name of directory dir,
+// for the procedures that modify the tree, once the caller may change dir.
+// Unlike lookup, "." and ".." are refused since they cannot be created,
+// removed or renamed.
+func (e *Export) child(dir, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') || strings.ContainsRune(name, 0) {
+		return "", os.ErrInvalid
+	}
+	if !e.contains(dir) {
+		return "", errOutsideExport
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// cleanDirpath returns a MOUNT dirpath in the form Paths use: absolute and
+// clean, with ".." at the top staying at the top.
+func cleanDirpath(dirpath string) string {
+	return filepath.Clean("/" + dirpath)
+}
+
+// exportPaths returns the dirpaths clients may mount.
+func (e *Export) exportPaths() []string {
+	if len(e.Paths) == 0 {
+		return []string{"/"}
+	}
+	paths := make([]string, len(e.Paths))
+	for i, p := range e.Paths {
+		paths[i] = cleanDirpath(p)
+	}
+	return paths
+}
+
+// served returns the dirpaths of the trees clients are given handles in:
+// the exported directories, and the diskless template and areas.
+func (e *Export) served() []string {
+	paths := e.exportPaths()
+	if e.Diskless != nil {
+		paths = append(paths, e.Diskless.Template, e.Diskless.Areas)
+	}
+	return paths
+}
+
+// exportOf returns the innermost of the served dirpaths holding p, a path
+// of the export.
+func (e *Export) exportOf(p string) (string, bool) {
+	dirpath, found := "", false
+	for _, d := range e.served() {
+		if _, ok := within(filepath.Join(e.Root, d), p); ok && (!found || len(d) > len(dirpath)) {
+			dirpath, found = d, true
+		}
+	}
+	return dirpath, found
+}
+
+// mountPath maps a MOUNT dirpath to a directory of the export. Paths that
+// are not one of the export's Paths or below one, or a diskless area, fail
+// with errNotExported. A single-file export hands out its file for any
+// dirpath.
+func (e *Export) mountPath(dirpath string) (string, error) {
+	if e.SingleFile {
+		return e.Root, nil
+	}
+	dir := cleanDirpath(dirpath)
+	paths := e.exportPaths()
+	if e.Diskless != nil {
+		paths = append(paths, e.Diskless.Areas)
+	}
+	exported := false
+	for _, p := range paths {
+		if dir == p || p == "/" || strings.HasPrefix(dir, p+"/") {
+			exported = true
+			break
+		}
+	}
+	if !exported {
+		return "", errNotExported
+	}
+	p := filepath.Join(e.Root, dir)
+	if !e.contains(p) {
+		return "", errOutsideExport
+	}
+	return p, nil
+}
+
+// groups returns the client table as EXPORT groups: networks, and the
+// hostnames of MAC rules. An empty list means everyone may mount.
+func (e *Export) groups() []string {
+	var groups []string
+	for _, r := range e.Clients {
+		switch {
+		case r.Network != nil:
+			groups = append(groups, r.Network.String())
+		case r.MAC != nil && e.Allocator != nil:
+			var mac [6]byte
+			copy(mac[:], r.MAC)
+			groups = append(groups, e.Allocator.Host(mac).Hostname)
+		case r.MAC != nil:
+			groups = append(groups, r.MAC.String())
+		default:
+			return nil
+		}
+	}
+	return groups
+}
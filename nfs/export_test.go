@@ -0,0 +1,58 @@
+package nfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportLookupConfined(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "sparc64"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	e, err := NewExport(root)
+	if err != nil || e.SingleFile {
+		t.Fatalf("NewExport: %+v %v", e, err)
+	}
+	sub := filepath.Join(e.Root, "sparc64")
+	cases := []struct {
+		dir, name, want string
+	}{
+		{e.Root, "sparc64", sub},
+		{sub, "..", e.Root},
+		{e.Root, "..", e.Root},
+		{sub, ".", sub},
+	}
+	for _, c := range cases {
+		got, err := e.lookup(c.dir, c.name)
+		if err != nil || got != c.want {
+			t.Fatalf("lookup(%q, %q) = %q, %v; want %q", c.dir, c.name, got, err, c.want)
+		}
+	}
+	for _, bad := range []string{"", "a/b", "../etc"} {
+		if _, err := e.lookup(e.Root, bad); err == nil {
+			t.Fatalf("lookup(%q) should fail", bad)
+		}
+	}
+	if _, err := e.lookup("/etc", "passwd"); err == nil {
+		t.Fatalf("lookup outside the export should fail")
+	}
+	if p, err := e.mountPath("/../sparc64"); err != nil || p != sub {
+		t.Fatalf("mountPath = %q, %v", p, err)
+	}
+}
+
+func TestExportSingleFile(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "bsd.rd")
+	if err := os.WriteFile(f, []byte("x"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	e, err := NewExport(f)
+	if err != nil || !e.SingleFile {
+		t.Fatalf("NewExport: %+v %v", e, err)
+	}
+	if p, err := e.lookup("/anything", "netbsd"); err != nil || p != e.Root {
+		t.Fatalf("single-file lookup = %q, %v", p, err)
+	}
+}
@@ -0,0 +1,219 @@
+package nfs
+
+import (
+	"io"
+	"os"
+	"runtime/debug"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// READ serves files from a cache of open files, so that a client loading a
+// 30 MB ramdisk 8 KB at a time costs a copy per call rather than an open,
+// two stats, a read into a fresh buffer and a close. Files large enough to
+// be read in many calls are mapped into memory and replies are copied
+// straight from the page cache.
+//
+// The modifying procedures forget the files they change. Changes made on
+// the server are noticed by checking the path again every
+// fileCheckInterval, as NFS clients check their attribute cache.
+const (
+	// maxOpenFiles bounds the number of files kept open.
+	maxOpenFiles = 64
+	// fileCheckInterval is how long a cached file is served before its
+	// path is looked up again.
+	fileCheckInterval = time.Second
+	// mmapMin is the size from which files are mapped; smaller ones are
+	// read with pread.
+	mmapMin = 64 << 10
+)
+
+// openFile is a regular file held open for READ.
+type openFile struct {
+	f       *os.File
+	attrs   fileAttrs // as of the open; never changes
+	data    []byte    // the file mapped into memory, nil if it is not
+	refs    int       // the cache's reference and the reads in progress
+	checked time.Time // last time the path still led to this file
+	used    time.Time
+}
+
+// close releases the file once no read uses it any more.
+func (f *openFile) close() {
+	if f.data != nil {
+		_ = unix.Munmap(f.data)
+	}
+	f.f.Close()
+}
+
+// fileCache is an export's cache of open files, keyed by path.
+type fileCache struct {
+	mu    sync.Mutex
+	files map[string]*openFile
+}
+
+// readBuffers are the buffers files that are not mapped are read into.
+var readBuffers = sync.Pool{New: func() any {
+	b := make([]byte, nfs3MaxData)
+	return &b
+}}
+
+// get returns the open file at p, opening it if it is not cached or has
+// changed since. The caller must put it back.
+func (fc *fileCache) get(p string) (*openFile, error) {
+	now := time.Now()
+	fc.mu.Lock()
+	f := fc.files[p]
+	if f != nil && now.Sub(f.checked) < fileCheckInterval {
+		f.refs++
+		f.used = now
+		fc.mu.Unlock()
+		return f, nil
+	}
+	fc.mu.Unlock()
+
+	if f != nil {
+		if fi, err := os.Lstat(p); err == nil && sameFile(f.attrs, fi) {
+			fc.mu.Lock()
+			current := fc.files[p] == f
+			if current {
+				f.checked, f.used = now, now
+				f.refs++
+			}
+			fc.mu.Unlock()
+			if current {
+				return f, nil
+			}
+		}
+	}
+	f, err := openCached(p)
+	if err != nil {
+		fc.forget(p)
+		return nil, err
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.files == nil {
+		fc.files = make(map[string]*openFile)
+	}
+	if old := fc.files[p]; old != nil {
+		fc.drop(old)
+	} else if len(fc.files) >= maxOpenFiles {
+		fc.evict()
+	}
+	f.checked, f.used = now, now
+	f.refs = 2
+	fc.files[p] = f
+	return f, nil
+}
+
+// put ends a read of f.
+func (fc *fileCache) put(f *openFile) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.drop(f)
+}
+
+// forget drops the file at p, which is being changed, replaced or removed.
+func (fc *fileCache) forget(p string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if f := fc.files[p]; f != nil {
+		delete(fc.files, p)
+		fc.drop(f)
+	}
+}
+
+// drop releases a reference to f.
+func (fc *fileCache) drop(f *openFile) {
+	if f.refs--; f.refs == 0 {
+		f.close()
+	}
+}
+
+// evict drops the least recently used file.
+func (fc *fileCache) evict() {
+	var lru string
+	for p, f := range fc.files {
+		if lru == "" || f.used.Before(fc.files[lru].used) {
+			lru = p
+		}
+	}
+	fc.drop(fc.files[lru])
+	delete(fc.files, lru)
+}
+
+// openCached opens the regular file p, mapping it if it is large.
+func openCached(p string) (*openFile, error) {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, syscall.EISDIR
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, syscall.EACCES
+	}
+	fd, err := os.OpenFile(p, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	f := &openFile{f: fd}
+	if fi, err = fd.Stat(); err == nil {
+		f.attrs, err = fileInfoAttrs(fi)
+	}
+	if err == nil && f.attrs.ftype != nfsTypeReg {
+		err = syscall.EACCES
+	}
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if size := f.attrs.size; size >= mmapMin && size == uint64(int(size)) {
+		// Unmappable files are read with pread like small ones.
+		f.data, _ = unix.Mmap(int(fd.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+	}
+	return f, nil
+}
+
+// sameFile reports whether fi describes the file a was taken from, unchanged.
+func sameFile(a fileAttrs, fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Ino == a.fileid && uint64(st.Dev) == a.fsid && uint64(st.Size) == a.size &&
+		time.Unix(st.Mtim.Unix()).Equal(a.mtime) && time.Unix(st.Ctim.Unix()).Equal(a.ctime)
+}
+
+// readFile calls fn with up to count bytes of the regular file p from
+// offset, and the attributes of the file as reported to clients. data is
+// only valid until fn returns.
+func (e *Export) readFile(p string, offset uint64, count int, fn func(data []byte, a fileAttrs)) error {
+	f, err := e.files.get(p)
+	if err != nil {
+		return err
+	}
+	defer e.files.put(f)
+	a := e.squash(f.attrs)
+	if offset >= f.attrs.size {
+		fn(nil, a)
+		return nil
+	}
+	if f.data != nil {
+		// A file truncated on the server under the mapping faults; the
+		// panic fails the call rather than the server.
+		defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+		fn(f.data[offset:min(offset+uint64(count), f.attrs.size)], a)
+		return nil
+	}
+	buf := readBuffers.Get().(*[]byte)
+	defer readBuffers.Put(buf)
+	n, err := f.f.ReadAt((*buf)[:min(count, len(*buf))], int64(offset))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	fn((*buf)[:n], a)
+	return nil
+}
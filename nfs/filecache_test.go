@@ -0,0 +1,205 @@
+package nfs
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ofw-install-server/oncrpc"
+	"ofw-install-server/xdr"
+)
+
+// read3 reads count bytes of fh at offset with NFS v3 READ through d.
+func read3(t *testing.T, d *nfsd, fh []byte, offset uint64, count uint32) (data []byte, size uint64, eof bool) {
+	t.Helper()
+	args := fh3Args(fh)
+	args.WriteUint64(offset)
+	args.WriteUint32(count)
+	status, r := nfs3Call(t, d, nfs3ProcRead, args)
+	if status != nfsOK {
+		t.Fatalf("READ status=%d", status)
+	}
+	r.Skip(4 + 5*4) // attributes_follow, type to gid
+	size, _ = r.ReadUint64()
+	r.Skip(fattr3Size - 28 + 4) // the rest, count
+	eof, _ = r.ReadBool()
+	data, err := r.ReadOpaque()
+	if err != nil {
+		t.Fatalf("short READ reply: %v", err)
+	}
+	return data, size, eof
+}
+
+func TestReadFileCache(t *testing.T) {
+	root := t.TempDir()
+	p := filepath.Join(root, "bsd.rd")
+	ramdisk := bytes.Repeat([]byte("ramdisk!"), mmapMin/8*2)
+	if err := os.WriteFile(p, ramdisk, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	export.Writable = true
+	export.Clients = []ClientRule{{}} // all,rw,no_root_squash
+	d := &nfsd{export: export}
+	fh := export.handle(p)
+
+	data, size, eof := read3(t, d, fh, 8, 8)
+	if string(data) != "ramdisk!" || size != uint64(len(ramdisk)) || eof {
+		t.Fatalf("READ %q size=%d eof=%v", data, size, eof)
+	}
+	f := export.files.files[p]
+	if f == nil || f.data == nil {
+		t.Fatalf("ramdisk not mapped: %+v", f)
+	}
+	if data, _, eof := read3(t, d, fh, uint64(len(ramdisk))-4, 8192); string(data) != "isk!" || !eof {
+		t.Fatalf("READ at the end %q eof=%v", data, eof)
+	}
+	if export.files.files[p] != f {
+		t.Fatalf("file opened again")
+	}
+
+	// A WRITE through the server is read back at once.
+	args := fh3Args(fh)
+	args.WriteUint64(uint64(len(ramdisk)))
+	args.WriteUint32(4)
+	args.WriteUint32(writeFileSync)
+	args.WriteOpaque([]byte("tail"))
+	if status, _ := nfs3Call(t, d, nfs3ProcWrite, args); status != nfsOK {
+		t.Fatalf("WRITE status=%d", status)
+	}
+	if data, size, eof := read3(t, d, fh, uint64(len(ramdisk)), 8192); string(data) != "tail" || size != uint64(len(ramdisk))+4 || !eof {
+		t.Fatalf("READ after WRITE %q size=%d eof=%v", data, size, eof)
+	}
+
+	// A file replaced on the server is noticed once it is checked again.
+	tmp := filepath.Join(root, "new")
+	if err := os.WriteFile(tmp, []byte("small"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	export.files.files[p].checked = time.Now().Add(-fileCheckInterval)
+	fh = export.handle(p)
+	if data, size, eof := read3(t, d, fh, 0, 8192); string(data) != "small" || size != 5 || !eof {
+		t.Fatalf("READ after replacing %q size=%d eof=%v", data, size, eof)
+	}
+	if export.files.files[p].data != nil {
+		t.Fatalf("small file mapped")
+	}
+
+	// REMOVE closes it.
+	f = export.files.files[p]
+	if status, _ := nfs3Call(t, d, nfs3ProcRemove, dirop3Args(export.handle(root), "bsd.rd")); status != nfsOK {
+		t.Fatalf("REMOVE status=%d", status)
+	}
+	if _, ok := export.files.files[p]; ok || f.refs != 0 {
+		t.Fatalf("removed file still open, %d references", f.refs)
+	}
+}
+
+func TestReadFileCacheBounds(t *testing.T) {
+	root := t.TempDir()
+	var fc fileCache
+	for i := range maxOpenFiles + 8 {
+		p := filepath.Join(root, fmt.Sprint(i))
+		if err := os.WriteFile(p, []byte{byte(i)}, 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		f, err := fc.get(p)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		fc.put(f)
+	}
+	if len(fc.files) != maxOpenFiles {
+		t.Fatalf("%d files open", len(fc.files))
+	}
+	if _, ok := fc.files[filepath.Join(root, "0")]; ok {
+		t.Fatalf("least recently used file kept")
+	}
+	if _, err := fc.get(root); err == nil {
+		t.Fatalf("directory opened for READ")
+	}
+}
+
+// readUncached is READ as it was before the file cache: every call opens
+// and stats the file and reads into a fresh buffer.
+func readUncached(d *nfsd, c *oncrpc.Call, w *xdr.Writer) error {
+	p, status, ok := d.readPath3(c.Args)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	offset, _ := c.Args.ReadUint64()
+	count, _ := c.Args.ReadUint32()
+	if status != nfsOK {
+		return nfs3ReplyErr(w, nfs3ProcRead, status)
+	}
+	fi, err := os.Lstat(p)
+	if err != nil || !fi.Mode().IsRegular() {
+		return nfs3ReplyErr(w, nfs3ProcRead, nfsStatus(err))
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nfs3ReplyErr(w, nfs3ProcRead, nfsStatus(err))
+	}
+	defer f.Close()
+	buf := make([]byte, min(count, nfs3MaxData))
+	n := 0
+	if offset < math.MaxInt64 {
+		n, _ = f.ReadAt(buf, int64(offset))
+	}
+	w.WriteUint32(nfsOK)
+	d.writePostOpAttr(w, p)
+	w.WriteUint32(uint32(n))
+	w.WriteBool(offset+uint64(n) >= uint64(fi.Size()))
+	w.WriteOpaque(buf[:n])
+	return nil
+}
+
+// BenchmarkRead serves a ramdisk in 8 KB READs, as before the file cache
+// and now.
+func BenchmarkRead(b *testing.B) {
+	const size, chunk = 4 << 20, 8192
+	root := b.TempDir()
+	p := filepath.Join(root, "bsd.rd")
+	if err := os.WriteFile(p, make([]byte, size), 0o644); err != nil {
+		b.Fatalf("write: %v", err)
+	}
+	export, _ := NewExport(root)
+	d := &nfsd{export: export}
+	fh := export.handle(p)
+	for _, bc := range []struct {
+		name   string
+		read   func(*nfsd, *oncrpc.Call, *xdr.Writer) error
+		pooled bool // reply built in a reused buffer, as the server does now
+	}{
+		{"uncached", readUncached, false},
+		{"cached", (*nfsd).read3, true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			reply := make([]byte, 0, 65535)
+			b.SetBytes(chunk)
+			b.ReportAllocs()
+			for i := range b.N {
+				args := fh3Args(fh)
+				args.WriteUint64(uint64(i*chunk) % size)
+				args.WriteUint32(chunk)
+				w := xdr.NewWriter(oncrpc.Accepted(uint32(i), oncrpc.AcceptSuccess))
+				if bc.pooled {
+					w = xdr.NewWriter(append(reply[:0], w.Bytes()...))
+				}
+				if err := bc.read(d, &oncrpc.Call{Args: xdr.NewReader(args.Bytes())}, w); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,478 @@
+package nfs
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	"ofw-install-server/oncrpc"
+	"ofw-install-server/xdr"
+)
+
+// lockd is the network lock manager (NLM, nlm_prot.x) of an export, with
+// the status monitor (NSM) its clients notify when they reboot. Locks are
+// advisory and only live in memory: they stop other NLM clients, not local
+// processes, and vanish when the server restarts, as after a crash.
+const (
+	nlmProgram = 100021
+	nlmV1      = 1
+	nlmV3      = 3 // v1 with share reservations and FREE_ALL
+	nlmV4      = 4 // v3 with 64-bit offsets, for NFS v3
+)
+
+// NLM procedures. The _MSG ones are asynchronous: results are sent back
+// in a call of the client's matching _RES procedure.
+const (
+	nlmProcTest       = 1
+	nlmProcLock       = 2
+	nlmProcCancel     = 3
+	nlmProcUnlock     = 4
+	nlmProcGranted    = 5
+	nlmProcTestMsg    = 6
+	nlmProcLockMsg    = 7
+	nlmProcCancelMsg  = 8
+	nlmProcUnlockMsg  = 9
+	nlmProcGrantedMsg = 10
+	nlmProcTestRes    = 11
+	nlmProcLockRes    = 12
+	nlmProcCancelRes  = 13
+	nlmProcUnlockRes  = 14
+	nlmProcGrantedRes = 15
+	nlmProcShare      = 20
+	nlmProcUnshare    = 21
+	nlmProcNMLock     = 22
+	nlmProcFreeAll    = 23
+
+	// nlmResOffset turns a _MSG procedure into its _RES one.
+	nlmResOffset = nlmProcTestRes - nlmProcTestMsg
+)
+
+// nlm_stats, and the nlm4_stats only v4 has
+const (
+	nlmGranted  = 0
+	nlmDenied   = 1
+	nlmBlocked  = 3
+	nlm4StaleFH = 7
+)
+
+const (
+	nlmMaxNetobj = 1024 // MAXNETOBJ_SZ
+	nlmMaxName   = 1024 // LM_MAXSTRLEN
+)
+
+// StartLockd runs NLM v1, v3 and v4 and NSM v1 over UDP for the locks of
+// export's files, and registers them in reg. Without a port in addr it
+// takes any free one, which clients find through rpcbind.
+func StartLockd(addr string, export *Export, reg *oncrpc.Registry, logger *log.Logger) (net.PacketConn, error) {
+	if addr == "" {
+		addr = ":0"
+	}
+	if logger != nil {
+		logger.Printf("lockd NLM v1/v3/v4 and statd root=%q", export.Root)
+	}
+	return newLockServer(export, logger).ListenUDP(addr, reg)
+}
+
+// StartLockdTCP serves NLM and NSM over TCP, the same as StartLockd does
+// over UDP.
+func StartLockdTCP(addr string, export *Export, reg *oncrpc.Registry, logger *log.Logger) (net.Listener, error) {
+	if addr == "" {
+		addr = ":0"
+	}
+	return newLockServer(export, logger).ListenTCP(addr, reg)
+}
+
+type lockd struct {
+	export *Export
+	logger *log.Logger
+	// call sends an NLM call to the lock manager of the client at ip.
+	call func(ip net.IP, vers, proc uint32, args []byte)
+}
+
+func (l *lockd) logf(format string, args ...any) {
+	if l.logger != nil {
+		l.logger.Printf(format, args...)
+	}
+}
+
+// newLockServer returns the NLM and NSM server of export.
+func newLockServer(export *Export, logger *log.Logger) *oncrpc.Server {
+	l := &lockd{export: export, logger: logger}
+	l.call = l.callClient
+	return l.server()
+}
+
+func (l *lockd) server() *oncrpc.Server {
+	s := oncrpc.NewServer("lockd", l.logger)
+	procs := oncrpc.Procs{
+		nlmProcTest:       l.test,
+		nlmProcLock:       l.lock,
+		nlmProcCancel:     l.cancel,
+		nlmProcUnlock:     l.unlock,
+		nlmProcGranted:    l.granted,
+		nlmProcTestMsg:    l.msg(l.test),
+		nlmProcLockMsg:    l.msg(l.lock),
+		nlmProcCancelMsg:  l.msg(l.cancel),
+		nlmProcUnlockMsg:  l.msg(l.unlock),
+		nlmProcGrantedMsg: l.msg(l.granted),
+		nlmProcTestRes:    l.res,
+		nlmProcLockRes:    l.res,
+		nlmProcCancelRes:  l.res,
+		nlmProcUnlockRes:  l.res,
+		nlmProcGrantedRes: l.res,
+	}
+	s.Register(nlmProgram, nlmV1, procs)
+	v3 := oncrpc.Procs{
+		nlmProcShare:   l.share,
+		nlmProcUnshare: l.share,
+		nlmProcNMLock:  l.lock,
+		nlmProcFreeAll: l.freeAll,
+	}
+	for proc, h := range procs {
+		v3[proc] = h
+	}
+	s.Register(nlmProgram, nlmV3, v3)
+	s.Register(nlmProgram, nlmV4, v3)
+	for _, vers := range []uint32{nlmV1, nlmV3, nlmV4} {
+		s.CacheReplies(nlmProgram, vers, nlmProcLock, nlmProcCancel, nlmProcUnlock,
+			nlmProcLockMsg, nlmProcCancelMsg, nlmProcUnlockMsg, nlmProcNMLock)
+	}
+	registerStatd(s, &statd{export: l.export, logger: l.logger})
+	return s
+}
+
+// nlmLock is an nlm_lock, or an nlm4_lock with 64-bit offset and length.
+type nlmLock struct {
+	caller string
+	fh, oh []byte
+	svid   int32
+	offset uint64
+	length uint64
+}
+
+func readNLMLock(r *xdr.Reader, vers uint32) (nlmLock, error) {
+	var a nlmLock
+	var err error
+	if a.caller, err = r.ReadString(nlmMaxName); err != nil {
+		return a, err
+	}
+	if a.fh, err = r.ReadOpaqueMax(nlmMaxNetobj); err != nil {
+		return a, err
+	}
+	if a.oh, err = r.ReadOpaqueMax(nlmMaxNetobj); err != nil {
+		return a, err
+	}
+	if a.svid, err = r.ReadInt32(); err != nil {
+		return a, err
+	}
+	if vers == nlmV4 {
+		if a.offset, err = r.ReadUint64(); err != nil {
+			return a, err
+		}
+		a.length, err = r.ReadUint64()
+		return a, err
+	}
+	offset, err := r.ReadUint32()
+	if err != nil {
+		return a, err
+	}
+	length, err := r.ReadUint32()
+	a.offset, a.length = uint64(offset), uint64(length)
+	return a, err
+}
+
+func writeNLMLock(w *xdr.Writer, vers uint32, a nlmLock) {
+	w.WriteString(a.caller)
+	w.WriteOpaque(a.fh)
+	w.WriteOpaque(a.oh)
+	w.WriteInt32(a.svid)
+	writeNLMRange(w, vers, a.offset, a.length)
+}
+
+func writeNLMRange(w *xdr.Writer, vers uint32, offset, length uint64) {
+	if vers == nlmV4 {
+		w.WriteUint64(offset)
+		w.WriteUint64(length)
+		return
+	}
+	w.WriteUint32(uint32(min(offset, math.MaxUint32)))
+	w.WriteUint32(uint32(min(length, math.MaxUint32)))
+}
+
+// writeNLMHolder writes the nlm_holder or nlm4_holder of a lock.
+func writeNLMHolder(w *xdr.Writer, vers uint32, held byteLock) {
+	var length uint64
+	if held.end != math.MaxUint64 {
+		length = held.end - held.start
+	}
+	w.WriteBool(held.exclusive)
+	w.WriteInt32(held.owner.svid)
+	w.WriteOpaque([]byte(held.owner.oh))
+	writeNLMRange(w, vers, held.start, length)
+}
+
+// writeNLMRes writes an nlm_res.
+func writeNLMRes(w *xdr.Writer, cookie []byte, stat uint32) error {
+	w.WriteOpaque(cookie)
+	w.WriteUint32(stat)
+	return nil
+}
+
+// file resolves the file a lock is on, for a client the export's client
+// table admits. On failure it returns the status to answer with.
+func (l *lockd) file(c *oncrpc.Call, a nlmLock) (string, uint32, bool) {
+	if _, ok := l.export.access(oncrpc.AddrIP(c.From)); !ok {
+		l.logf("lockd v%d proc %d refused for %v: not in the client table", c.Vers, c.Proc, c.From)
+		return "", nlmDenied, false
+	}
+	p, ok := l.export.file(a.fh)
+	if !ok {
+		if c.Vers == nlmV4 {
+			return "", nlm4StaleFH, false
+		}
+		return "", nlmDenied, false
+	}
+	return p, nlmGranted, true
+}
+
+// byteLock returns the lock a asks for, taken from the client at from.
+func (a nlmLock) byteLock(exclusive bool, from net.Addr) byteLock {
+	start, end := lockRange(a.offset, a.length)
+	var ip string
+	if addr := oncrpc.AddrIP(from); addr != nil {
+		ip = addr.String()
+	}
+	return byteLock{
+		owner:     lockOwner{caller: a.caller, oh: string(a.oh), svid: a.svid},
+		exclusive: exclusive,
+		start:     start,
+		end:       end,
+		ip:        ip,
+	}
+}
+
+func (l *lockd) test(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: nlm_testargs { cookie, exclusive, alock }
+	cookie, err := c.Args.ReadOpaqueMax(nlmMaxNetobj)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	exclusive, err := c.Args.ReadBool()
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	a, err := readNLMLock(c.Args, c.Vers)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	p, stat, ok := l.file(c, a)
+	if !ok {
+		return writeNLMRes(w, cookie, stat)
+	}
+	held, busy := l.export.locks.test(p, a.byteLock(exclusive, c.From))
+	l.logf("lockd TEST %q for %s svid %d: held=%v", p, a.caller, a.svid, busy)
+	if !busy {
+		return writeNLMRes(w, cookie, nlmGranted)
+	}
+	// nlm_testres: cookie, nlm_testrply switch (stat) { case denied: holder }
+	writeNLMRes(w, cookie, nlmDenied)
+	writeNLMHolder(w, c.Vers, held)
+	return nil
+}
+
+func (l *lockd) lock(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: nlm_lockargs { cookie, block, exclusive, alock, reclaim, state }
+	cookie, err := c.Args.ReadOpaqueMax(nlmMaxNetobj)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	block, err := c.Args.ReadBool()
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	exclusive, err := c.Args.ReadBool()
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	a, err := readNLMLock(c.Args, c.Vers)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	p, stat, ok := l.file(c, a)
+	if !ok {
+		return writeNLMRes(w, cookie, stat)
+	}
+	var granted func()
+	if block && c.Proc != nlmProcNMLock {
+		granted = l.grantCallback(c, cookie, exclusive, a)
+	}
+	ok, blocked := l.export.locks.lock(p, a.byteLock(exclusive, c.From), granted)
+	l.logf("lockd LOCK %q for %s svid %d exclusive=%v: granted=%v blocked=%v", p, a.caller, a.svid, exclusive, ok, blocked)
+	switch {
+	case ok:
+		return writeNLMRes(w, cookie, nlmGranted)
+	case blocked:
+		return writeNLMRes(w, cookie, nlmBlocked)
+	}
+	return writeNLMRes(w, cookie, nlmDenied)
+}
+
+// grantCallback returns what tells the client of a blocked LOCK that it
+// got the lock after all: a GRANTED_MSG call, answered by GRANTED_RES.
+func (l *lockd) grantCallback(c *oncrpc.Call, cookie []byte, exclusive bool, a nlmLock) func() {
+	ip, vers := oncrpc.AddrIP(c.From), c.Vers
+	// The arguments share the buffer of the call, which is reused.
+	cookie, a.fh, a.oh = bytes.Clone(cookie), bytes.Clone(a.fh), bytes.Clone(a.oh)
+	return func() {
+		if ip == nil {
+			return
+		}
+		// args: nlm_testargs { cookie, exclusive, alock }
+		args := xdr.NewWriter(nil)
+		args.WriteOpaque(cookie)
+		args.WriteBool(exclusive)
+		writeNLMLock(args, vers, a)
+		l.logf("lockd GRANTED to %s svid %d at %s", a.caller, a.svid, ip)
+		l.call(ip, vers, nlmProcGrantedMsg, args.Bytes())
+	}
+}
+
+func (l *lockd) cancel(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: nlm_cancargs { cookie, block, exclusive, alock }
+	cookie, err := c.Args.ReadOpaqueMax(nlmMaxNetobj)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	if _, err := c.Args.ReadBool(); err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	exclusive, err := c.Args.ReadBool()
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	a, err := readNLMLock(c.Args, c.Vers)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	p, stat, ok := l.file(c, a)
+	if !ok {
+		return writeNLMRes(w, cookie, stat)
+	}
+	ok = l.export.locks.cancel(p, a.byteLock(exclusive, c.From))
+	l.logf("lockd CANCEL %q for %s svid %d: waiting=%v", p, a.caller, a.svid, ok)
+	if !ok {
+		return writeNLMRes(w, cookie, nlmDenied)
+	}
+	return writeNLMRes(w, cookie, nlmGranted)
+}
+
+func (l *lockd) unlock(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: nlm_unlockargs { cookie, alock }
+	cookie, err := c.Args.ReadOpaqueMax(nlmMaxNetobj)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	a, err := readNLMLock(c.Args, c.Vers)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	p, stat, ok := l.file(c, a)
+	if !ok {
+		return writeNLMRes(w, cookie, stat)
+	}
+	l.export.locks.unlock(p, a.byteLock(false, c.From))
+	l.logf("lockd UNLOCK %q for %s svid %d", p, a.caller, a.svid)
+	return writeNLMRes(w, cookie, nlmGranted)
+}
+
+// granted answers GRANTED, which a server sends to the clients it made
+// wait. This server never waits for other lock managers, so it has
+// nothing to take.
+func (l *lockd) granted(c *oncrpc.Call, w *xdr.Writer) error {
+	cookie, err := c.Args.ReadOpaqueMax(nlmMaxNetobj)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	return writeNLMRes(w, cookie, nlmDenied)
+}
+
+// msg serves the _MSG variant of a procedure: the call gets an empty
+// reply, and its results go to the caller's lock manager in a call of the
+// matching _RES procedure.
+func (l *lockd) msg(h oncrpc.Handler) oncrpc.Handler {
+	return func(c *oncrpc.Call, w *xdr.Writer) error {
+		res := xdr.NewWriter(nil)
+		if err := h(c, res); err != nil {
+			return err
+		}
+		if ip := oncrpc.AddrIP(c.From); ip != nil {
+			go l.call(ip, c.Vers, c.Proc+nlmResOffset, res.Bytes())
+		}
+		return nil
+	}
+}
+
+// res takes the results of a _MSG call. Only GRANTED_MSG is sent by this
+// server, and a client refusing a lock it was granted keeps it until it
+// unlocks or reboots.
+func (l *lockd) res(c *oncrpc.Call, w *xdr.Writer) error {
+	cookie, err := c.Args.ReadOpaqueMax(nlmMaxNetobj)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	stat, err := c.Args.ReadUint32()
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	l.logf("lockd proc %d from %v: cookie %x stat %d", c.Proc, c.From, cookie, stat)
+	return nil
+}
+
+// share answers SHARE and UNSHARE. Share reservations only matter to DOS
+// clients; they are granted without being enforced.
+func (l *lockd) share(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: nlm_shareargs { cookie, share { caller_name, fh, oh, mode,
+	// access }, reclaim }
+	cookie, err := c.Args.ReadOpaqueMax(nlmMaxNetobj)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	// nlm_shareres: cookie, stat, sequence
+	writeNLMRes(w, cookie, nlmGranted)
+	w.WriteInt32(0)
+	return nil
+}
+
+// freeAll answers FREE_ALL, by which a client that rebooted without a
+// status monitor releases its locks.
+func (l *lockd) freeAll(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: nlm_notify { name, state }
+	name, err := c.Args.ReadString(nlmMaxName + 1)
+	if err != nil || name == "" {
+		return oncrpc.ErrGarbageArgs
+	}
+	n := l.export.locks.release(name, "")
+	l.logf("lockd FREE_ALL for %s: %d locks released", name, n)
+	return nil
+}
+
+// callClient sends an NLM call to the lock manager of the client at ip,
+// which its portmapper tells the port of. The calls are _MSG and _RES
+// callbacks, which return void and get no reply: none is waited for.
+func (l *lockd) callClient(ip net.IP, vers, proc uint32, args []byte) {
+	port, err := oncrpc.GetPort(ip, nlmProgram, vers)
+	if err == nil && port == 0 {
+		err = errors.New("lock manager not registered")
+	}
+	if err == nil {
+		c := &oncrpc.Call{XID: uint32(time.Now().UnixNano()), Prog: nlmProgram, Vers: vers, Proc: proc}
+		err = oncrpc.SendUDP(net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), c, args)
+	}
+	if err != nil {
+		l.logf("lockd v%d proc %d to %s: %v", vers, proc, ip, err)
+	}
+}
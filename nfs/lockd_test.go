@@ -0,0 +1,245 @@
+package nfs
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ofw-install-server/oncrpc"
+	"ofw-install-server/xdr"
+)
+
+// nlmCallback is a call lockd made to a client's lock manager.
+type nlmCallback struct {
+	ip         string
+	vers, proc uint32
+	args       []byte
+}
+
+// testLockd returns a lock server of a writable export holding one file,
+// the handle of that file, and the calls the server makes to clients.
+func testLockd(t *testing.T) (*oncrpc.Server, *Export, []byte, chan nlmCallback) {
+	t.Helper()
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "passwd"), []byte("root:x:0:0\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	calls := make(chan nlmCallback, 8)
+	l := &lockd{export: export, call: func(ip net.IP, vers, proc uint32, args []byte) {
+		calls <- nlmCallback{ip.String(), vers, proc, args}
+	}}
+	return l.server(), export, export.handle(filepath.Join(root, "passwd")), calls
+}
+
+var (
+	clientA = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 700}
+	clientB = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 11), Port: 700}
+)
+
+// nlmCall returns an NLM call of proc whose arguments are a cookie, the
+// booleans flags and an nlm_lock of caller on fh.
+func nlmCall(vers, proc uint32, fh []byte, caller string, offset, length uint64, flags ...bool) []byte {
+	w := xdr.NewWriter(nil)
+	w.WriteOpaque([]byte("cookie"))
+	for _, f := range flags {
+		w.WriteBool(f)
+	}
+	writeNLMLock(w, vers, nlmLock{caller: caller, fh: fh, oh: []byte(caller), svid: 42, offset: offset, length: length})
+	if proc == nlmProcLock || proc == nlmProcLockMsg {
+		w.WriteBool(false) // reclaim
+		w.WriteInt32(3)    // state
+	}
+	return append(buildMinimalRPCCall(1, nlmProgram, vers, proc), w.Bytes()...)
+}
+
+// nlmStat decodes an nlm_res.
+func nlmStat(t *testing.T, r *xdr.Reader) uint32 {
+	t.Helper()
+	cookie, err := r.ReadOpaque()
+	if err != nil || string(cookie) != "cookie" {
+		t.Fatalf("cookie %q, %v", cookie, err)
+	}
+	stat, err := r.ReadUint32()
+	if err != nil {
+		t.Fatalf("short nlm_res: %v", err)
+	}
+	return stat
+}
+
+func TestLockdLockTestUnlock(t *testing.T) {
+	s, _, fh, _ := testLockd(t)
+	for _, vers := range []uint32{nlmV1, nlmV3, nlmV4} {
+		// LOCK args flags: block, exclusive
+		stat, r := acceptStat(t, s.Handle(nlmCall(vers, nlmProcLock, fh, "a", 10, 20, false, true), clientA))
+		if stat != oncrpc.AcceptSuccess || nlmStat(t, r) != nlmGranted {
+			t.Fatalf("v%d LOCK by a refused", vers)
+		}
+		_, r = acceptStat(t, s.Handle(nlmCall(vers, nlmProcLock, fh, "b", 0, 0, false, false), clientB))
+		if got := nlmStat(t, r); got != nlmDenied {
+			t.Fatalf("v%d LOCK by b: stat %d", vers, got)
+		}
+
+		// TEST args flags: exclusive
+		_, r = acceptStat(t, s.Handle(nlmCall(vers, nlmProcTest, fh, "b", 25, 1, false), clientB))
+		if got := nlmStat(t, r); got != nlmDenied {
+			t.Fatalf("v%d TEST by b: stat %d", vers, got)
+		}
+		exclusive, _ := r.ReadBool()
+		svid, _ := r.ReadInt32()
+		oh, _ := r.ReadOpaque()
+		var offset, length uint64
+		if vers == nlmV4 {
+			offset, _ = r.ReadUint64()
+			length, _ = r.ReadUint64()
+		} else {
+			o, _ := r.ReadUint32()
+			l, err := r.ReadUint32()
+			if err != nil {
+				t.Fatalf("v%d short holder", vers)
+			}
+			offset, length = uint64(o), uint64(l)
+		}
+		if !exclusive || svid != 42 || string(oh) != "a" || offset != 10 || length != 20 || len(r.Remaining()) != 0 {
+			t.Fatalf("v%d holder exclusive=%v svid=%d oh=%q %d+%d", vers, exclusive, svid, oh, offset, length)
+		}
+		_, r = acceptStat(t, s.Handle(nlmCall(vers, nlmProcTest, fh, "b", 30, 0, false), clientB))
+		if got := nlmStat(t, r); got != nlmGranted {
+			t.Fatalf("v%d TEST past the lock: stat %d", vers, got)
+		}
+
+		_, r = acceptStat(t, s.Handle(nlmCall(vers, nlmProcUnlock, fh, "a", 0, 0), clientA))
+		if got := nlmStat(t, r); got != nlmGranted {
+			t.Fatalf("v%d UNLOCK: stat %d", vers, got)
+		}
+		_, r = acceptStat(t, s.Handle(nlmCall(vers, nlmProcTest, fh, "b", 0, 0, true), clientB))
+		if got := nlmStat(t, r); got != nlmGranted {
+			t.Fatalf("v%d TEST after UNLOCK: stat %d", vers, got)
+		}
+	}
+}
+
+func TestLockdBlockedGranted(t *testing.T) {
+	s, _, fh, calls := testLockd(t)
+	acceptStat(t, s.Handle(nlmCall(nlmV4, nlmProcLock, fh, "a", 0, 0, false, true), clientA))
+	_, r := acceptStat(t, s.Handle(nlmCall(nlmV4, nlmProcLock, fh, "b", 0, 0, true, true), clientB))
+	if got := nlmStat(t, r); got != nlmBlocked {
+		t.Fatalf("blocking LOCK: stat %d", got)
+	}
+	acceptStat(t, s.Handle(nlmCall(nlmV4, nlmProcUnlock, fh, "a", 0, 0), clientA))
+
+	select {
+	case cb := <-calls:
+		if cb.ip != "192.0.2.11" || cb.vers != nlmV4 || cb.proc != nlmProcGrantedMsg {
+			t.Fatalf("callback %+v", cb)
+		}
+		// nlm_testargs { cookie, exclusive, alock }
+		r := xdr.NewReader(cb.args)
+		cookie, _ := r.ReadOpaque()
+		exclusive, _ := r.ReadBool()
+		a, err := readNLMLock(r, nlmV4)
+		if err != nil || string(cookie) != "cookie" || !exclusive || a.caller != "b" || a.svid != 42 {
+			t.Fatalf("GRANTED_MSG args %q %v %+v, %v", cookie, exclusive, a, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no GRANTED_MSG")
+	}
+	_, r = acceptStat(t, s.Handle(nlmCall(nlmV4, nlmProcTest, fh, "a", 0, 0, false), clientA))
+	if got := nlmStat(t, r); got != nlmDenied {
+		t.Fatalf("b does not hold the lock: stat %d", got)
+	}
+
+	// A cancelled request is not granted.
+	acceptStat(t, s.Handle(nlmCall(nlmV4, nlmProcLock, fh, "a", 0, 0, true, true), clientA))
+	_, r = acceptStat(t, s.Handle(nlmCall(nlmV4, nlmProcCancel, fh, "a", 0, 0, true, true), clientA))
+	if got := nlmStat(t, r); got != nlmGranted {
+		t.Fatalf("CANCEL: stat %d", got)
+	}
+	acceptStat(t, s.Handle(nlmCall(nlmV4, nlmProcUnlock, fh, "b", 0, 0), clientB))
+	select {
+	case cb := <-calls:
+		t.Fatalf("callback after CANCEL: %+v", cb)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestLockdMsg(t *testing.T) {
+	s, _, fh, calls := testLockd(t)
+	stat, r := acceptStat(t, s.Handle(nlmCall(nlmV3, nlmProcLockMsg, fh, "a", 0, 1, false, true), clientA))
+	if stat != oncrpc.AcceptSuccess || len(r.Remaining()) != 0 {
+		t.Fatalf("LOCK_MSG reply: stat %d, %x", stat, r.Remaining())
+	}
+	select {
+	case cb := <-calls:
+		if cb.ip != "192.0.2.10" || cb.vers != nlmV3 || cb.proc != nlmProcLockRes {
+			t.Fatalf("callback %+v", cb)
+		}
+		if got := nlmStat(t, xdr.NewReader(cb.args)); got != nlmGranted {
+			t.Fatalf("LOCK_RES stat %d", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no LOCK_RES")
+	}
+	// The client's _RES calls are taken silently.
+	res := xdr.NewWriter(buildMinimalRPCCall(1, nlmProgram, nlmV3, nlmProcGrantedRes))
+	writeNLMRes(res, []byte("c"), nlmGranted)
+	if stat, r := acceptStat(t, s.Handle(res.Bytes(), clientA)); stat != oncrpc.AcceptSuccess || len(r.Remaining()) != 0 {
+		t.Fatalf("GRANTED_RES reply: stat %d", stat)
+	}
+}
+
+func TestLockdRefused(t *testing.T) {
+	s, export, fh, _ := testLockd(t)
+	bad := append([]byte(nil), fh...)
+	bad[len(bad)-1] ^= 1
+	_, r := acceptStat(t, s.Handle(nlmCall(nlmV4, nlmProcLock, bad, "a", 0, 0, false, true), clientA))
+	if got := nlmStat(t, r); got != nlm4StaleFH {
+		t.Fatalf("v4 LOCK of a bad handle: stat %d", got)
+	}
+	_, r = acceptStat(t, s.Handle(nlmCall(nlmV1, nlmProcLock, bad, "a", 0, 0, false, true), clientA))
+	if got := nlmStat(t, r); got != nlmDenied {
+		t.Fatalf("v1 LOCK of a bad handle: stat %d", got)
+	}
+
+	rule, _ := ParseClientRule("net=192.0.2.11")
+	export.Clients = []ClientRule{rule}
+	_, r = acceptStat(t, s.Handle(nlmCall(nlmV4, nlmProcLock, fh, "a", 0, 0, false, true), clientA))
+	if got := nlmStat(t, r); got != nlmDenied {
+		t.Fatalf("LOCK from outside the client table: stat %d", got)
+	}
+	_, r = acceptStat(t, s.Handle(nlmCall(nlmV4, nlmProcLock, fh, "b", 0, 0, false, true), clientB))
+	if got := nlmStat(t, r); got != nlmGranted {
+		t.Fatalf("LOCK from the client table: stat %d", got)
+	}
+
+	if stat, _ := acceptStat(t, s.Handle(buildMinimalRPCCall(1, nlmProgram, nlmV1, nlmProcFreeAll), clientA)); stat != oncrpc.AcceptProcUnavail {
+		t.Fatalf("v1 FREE_ALL: accept_stat %d", stat)
+	}
+	free := xdr.NewWriter(buildMinimalRPCCall(1, nlmProgram, nlmV4, nlmProcFreeAll))
+	free.WriteString("b")
+	free.WriteInt32(5)
+	acceptStat(t, s.Handle(free.Bytes(), clientB))
+	if len(export.locks.files) != 0 {
+		t.Fatalf("locks left after FREE_ALL: %+v", export.locks.files)
+	}
+}
+
+func TestLockdRegistered(t *testing.T) {
+	reg := oncrpc.NewRegistry(nil)
+	pc, err := StartLockd("127.0.0.1:0", &Export{Root: t.TempDir()}, reg, nil)
+	if err != nil {
+		t.Fatalf("StartLockd: %v", err)
+	}
+	defer pc.Close()
+	port := uint32(pc.LocalAddr().(*net.UDPAddr).Port)
+	for _, pv := range [][2]uint32{{nlmProgram, nlmV1}, {nlmProgram, nlmV3}, {nlmProgram, nlmV4}, {nsmProgram, nsmV1}} {
+		if got := reg.Port(pv[0], pv[1], oncrpc.IPProtoUDP); got != port {
+			t.Errorf("program %d v%d on port %d, want %d", pv[0], pv[1], got, port)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package nfs
+
+import (
+	"math"
+	"slices"
+	"sync"
+)
+
+// lockOwner identifies the holder of an NLM lock: a process (svid) of a
+// client, with the owner handle the client chose.
+type lockOwner struct {
+	caller string
+	oh     string
+	svid   int32
+}
+
+// byteLock is a byte range lock of one owner on a file. end is exclusive,
+// math.MaxUint64 for a lock reaching the end of the file, whatever it is.
+type byteLock struct {
+	owner      lockOwner
+	exclusive  bool
+	start, end uint64
+	// ip is the address the owner locked from; a reboot notification for
+	// it releases the lock even when the client names itself differently.
+	ip string
+}
+
+// lockRange returns the bounds of length bytes from offset; a length of 0
+// extends to the end of the file.
+func lockRange(offset, length uint64) (start, end uint64) {
+	if length == 0 || offset > math.MaxUint64-length {
+		return offset, math.MaxUint64
+	}
+	return offset, offset + length
+}
+
+func (l byteLock) overlaps(o byteLock) bool {
+	return l.start < o.end && o.start < l.end
+}
+
+// conflicts reports whether l cannot be held along with o: they are of
+// different owners, overlap and one of them is exclusive.
+func (l byteLock) conflicts(o byteLock) bool {
+	return l.owner != o.owner && l.overlaps(o) && (l.exclusive || o.exclusive)
+}
+
+// lockWaiter is a blocked lock request; granted is called, in its own
+// goroutine, once the lock is taken for it.
+type lockWaiter struct {
+	file    string
+	lock    byteLock
+	granted func()
+}
+
+// lockTable holds the locks granted through NLM, per file path, and the
+// blocked requests that wait for them, in the order they came. The zero
+// value is an empty table.
+type lockTable struct {
+	mu      sync.Mutex
+	files   map[string][]byteLock
+	waiting []*lockWaiter
+}
+
+// test returns a lock conflicting with l on file, if there is one.
+func (t *lockTable) test(file string, l byteLock) (byteLock, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.conflict(file, l)
+}
+
+func (t *lockTable) conflict(file string, l byteLock) (byteLock, bool) {
+	for _, held := range t.files[file] {
+		if l.conflicts(held) {
+			return held, true
+		}
+	}
+	return byteLock{}, false
+}
+
+// lock takes l on file and reports whether it did. A conflicting request
+// with a granted callback waits for the lock, once; without one it fails.
+func (t *lockTable) lock(file string, l byteLock, granted func()) (ok, blocked bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, busy := t.conflict(file, l); !busy {
+		t.set(file, l)
+		return true, false
+	}
+	if granted == nil {
+		return false, false
+	}
+	for _, w := range t.waiting {
+		if w.file == file && w.lock.owner == l.owner && w.lock.start == l.start && w.lock.end == l.end {
+			// a retransmission, or the client asking again
+			w.lock.exclusive, w.granted = l.exclusive, granted
+			return false, true
+		}
+	}
+	t.waiting = append(t.waiting, &lockWaiter{file: file, lock: l, granted: granted})
+	return false, true
+}
+
+// set gives l to its owner. Like POSIX locks, it replaces whatever the
+// owner held in its range.
+func (t *lockTable) set(file string, l byteLock) {
+	if t.files == nil {
+		t.files = make(map[string][]byteLock)
+	}
+	t.files[file] = append(carve(t.files[file], l), l)
+}
+
+// carve returns locks without the parts of the range of l its owner held,
+// splitting locks that straddle it.
+func carve(locks []byteLock, l byteLock) []byteLock {
+	var kept []byteLock
+	for _, held := range locks {
+		if held.owner != l.owner || !held.overlaps(l) {
+			kept = append(kept, held)
+			continue
+		}
+		if held.start < l.start {
+			left := held
+			left.end = l.start
+			kept = append(kept, left)
+		}
+		if held.end > l.end {
+			right := held
+			right.start = l.end
+			kept = append(kept, right)
+		}
+	}
+	return kept
+}
+
+// unlock releases the range of l held by its owner on file, if any, and
+// grants what waited for it.
+func (t *lockTable) unlock(file string, l byteLock) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.files[file] = carve(t.files[file], l)
+	if len(t.files[file]) == 0 {
+		delete(t.files, file)
+	}
+	t.wake(file)
+}
+
+// cancel withdraws a blocked request for l and reports whether there was
+// one.
+func (t *lockTable) cancel(file string, l byteLock) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, w := range t.waiting {
+		if w.file == file && w.lock.owner == l.owner && w.lock.start == l.start && w.lock.end == l.end {
+			t.waiting = slices.Delete(t.waiting, i, i+1)
+			return true
+		}
+	}
+	return false
+}
+
+// release drops the locks and the blocked requests of the client named
+// caller or calling from ip, after it rebooted, and grants what waited for
+// them. It returns how many locks were held.
+func (t *lockTable) release(caller, ip string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	gone := func(l byteLock) bool {
+		return (caller != "" && l.owner.caller == caller) || (ip != "" && l.ip == ip)
+	}
+	t.waiting = slices.DeleteFunc(t.waiting, func(w *lockWaiter) bool { return gone(w.lock) })
+	n := 0
+	for file, locks := range t.files {
+		kept := slices.DeleteFunc(locks, gone)
+		if len(kept) == len(locks) {
+			continue
+		}
+		n += len(locks) - len(kept)
+		if len(kept) == 0 {
+			delete(t.files, file)
+		} else {
+			t.files[file] = kept
+		}
+		t.wake(file)
+	}
+	return n
+}
+
+// wake grants the blocked requests on file that no longer conflict, in
+// the order they came.
+func (t *lockTable) wake(file string) {
+	t.waiting = slices.DeleteFunc(t.waiting, func(w *lockWaiter) bool {
+		if w.file != file {
+			return false
+		}
+		if _, busy := t.conflict(file, w.lock); busy {
+			return false
+		}
+		t.set(file, w.lock)
+		go w.granted()
+		return true
+	})
+}
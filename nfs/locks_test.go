@@ -0,0 +1,119 @@
+package nfs
+
+import (
+	"math"
+	"testing"
+)
+
+func testLock(caller string, svid int32, exclusive bool, offset, length uint64) byteLock {
+	start, end := lockRange(offset, length)
+	return byteLock{owner: lockOwner{caller: caller, oh: caller, svid: svid}, exclusive: exclusive, start: start, end: end}
+}
+
+func TestLockTableConflicts(t *testing.T) {
+	var tab lockTable
+	if ok, _ := tab.lock("f", testLock("a", 1, false, 0, 100), nil); !ok {
+		t.Fatalf("first shared lock refused")
+	}
+	if ok, _ := tab.lock("f", testLock("b", 1, false, 50, 100), nil); !ok {
+		t.Fatalf("second shared lock refused")
+	}
+	if ok, _ := tab.lock("f", testLock("c", 1, true, 99, 1), nil); ok {
+		t.Fatalf("exclusive lock over shared ones granted")
+	}
+	if ok, _ := tab.lock("f", testLock("c", 1, true, 150, 0), nil); !ok {
+		t.Fatalf("exclusive lock past the shared ones refused")
+	}
+	if ok, _ := tab.lock("g", testLock("c", 1, true, 0, 0), nil); !ok {
+		t.Fatalf("lock of another file refused")
+	}
+	// Another process of the same client is another owner.
+	if held, busy := tab.test("f", testLock("c", 2, false, 1<<40, 1)); !busy || held.owner.svid != 1 || held.end != math.MaxUint64 {
+		t.Fatalf("test past EOF: %+v %v", held, busy)
+	}
+}
+
+func TestLockTableOwnRanges(t *testing.T) {
+	var tab lockTable
+	tab.lock("f", testLock("a", 1, true, 0, 100), nil)
+	// The owner's own locks are replaced, not conflicting.
+	if ok, _ := tab.lock("f", testLock("a", 1, false, 40, 20), nil); !ok {
+		t.Fatalf("downgrade of the middle refused")
+	}
+	if n := len(tab.files["f"]); n != 3 {
+		t.Fatalf("%d locks after the downgrade, want 3: %+v", n, tab.files["f"])
+	}
+	if ok, _ := tab.lock("f", testLock("b", 1, false, 45, 5), nil); !ok {
+		t.Fatalf("shared lock in the downgraded range refused")
+	}
+	if ok, _ := tab.lock("f", testLock("b", 1, false, 30, 5), nil); ok {
+		t.Fatalf("shared lock in the exclusive range granted")
+	}
+	tab.unlock("f", testLock("a", 1, false, 0, 0))
+	if ok, _ := tab.lock("f", testLock("b", 1, true, 0, 45), nil); !ok {
+		t.Fatalf("lock after unlock refused")
+	}
+	tab.unlock("f", testLock("b", 1, false, 0, 0))
+	if len(tab.files) != 0 {
+		t.Fatalf("locks left: %+v", tab.files)
+	}
+}
+
+func TestLockTableWaiters(t *testing.T) {
+	var tab lockTable
+	granted := make(chan string, 4)
+	wait := func(name string) func() { return func() { granted <- name } }
+
+	tab.lock("f", testLock("a", 1, true, 0, 0), nil)
+	if ok, blocked := tab.lock("f", testLock("b", 1, true, 0, 10), wait("b")); ok || !blocked {
+		t.Fatalf("blocking lock: ok=%v blocked=%v", ok, blocked)
+	}
+	tab.lock("f", testLock("c", 1, true, 5, 10), wait("c"))
+	tab.lock("f", testLock("d", 1, true, 100, 10), wait("d"))
+	// asking again does not queue twice
+	tab.lock("f", testLock("d", 1, true, 100, 10), wait("d"))
+	if !tab.cancel("f", testLock("d", 1, true, 100, 10)) || tab.cancel("f", testLock("d", 1, true, 100, 10)) {
+		t.Fatalf("cancel of d")
+	}
+
+	tab.unlock("f", testLock("a", 1, false, 0, 0))
+	// b came first, and c still conflicts with it.
+	if got := <-granted; got != "b" {
+		t.Fatalf("granted %s first", got)
+	}
+	if len(tab.waiting) != 1 || tab.waiting[0].lock.owner.caller != "c" {
+		t.Fatalf("waiting: %+v", tab.waiting)
+	}
+	// b rebooting hands the range to c.
+	if n := tab.release("b", ""); n != 1 {
+		t.Fatalf("released %d locks of b", n)
+	}
+	if got := <-granted; got != "c" {
+		t.Fatalf("granted %s after b", got)
+	}
+	if held, busy := tab.test("f", testLock("e", 1, false, 0, 0)); !busy || held.owner.caller != "c" {
+		t.Fatalf("held %+v %v", held, busy)
+	}
+	select {
+	case got := <-granted:
+		t.Fatalf("%s granted after cancel", got)
+	default:
+	}
+}
+
+func TestLockTableReleaseByAddress(t *testing.T) {
+	var tab lockTable
+	l := testLock("client.local", 1, true, 0, 0)
+	l.ip = "192.0.2.7"
+	tab.lock("f", l, nil)
+	tab.lock("g", testLock("other", 1, true, 0, 0), nil)
+	if n := tab.release("", "192.0.2.8"); n != 0 {
+		t.Fatalf("released %d locks of another address", n)
+	}
+	if n := tab.release("client", "192.0.2.7"); n != 1 {
+		t.Fatalf("released %d locks by address", n)
+	}
+	if _, ok := tab.files["g"]; !ok || len(tab.files) != 1 {
+		t.Fatalf("files left: %+v", tab.files)
+	}
+}
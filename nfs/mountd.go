@@ -3,94 +3,252 @@ package nfs
 import (
 	"log"
 	"net"
-	"path/filepath"
+	"os"
+	"sort"
+
+	"ofw-install-server/oncrpc"
+	"ofw-install-server/xdr"
 )
 
-// Program and version numbers
+// Program and version numbers. MOUNT v2 only adds PATHCONF to v1; v3 returns
+// NFS v3 handles.
 const (
 	mountProgram = 100005
 	mountV1      = 1
+	mountV3      = 3
 )
 
-// MOUNT v1 procedures
+// MOUNT procedures, the same in every version. EXPORTALL (v1 and v2 only)
+// answers like EXPORT.
 const (
-	mountProcNull = 0
-	mountProcMnt  = 1
-	mountProcUmnt = 3
+	mountProcNull      = 0
+	mountProcMnt       = 1
+	mountProcDump      = 2
+	mountProcUmnt      = 3
+	mountProcUmntAll   = 4
+	mountProcExport    = 5
+	mountProcExportAll = 6
 )
 
-// StartMountd runs a tiny MOUNT v1 UDP server that accepts any export under baseDir.
-func StartMountd(addr string, baseDir string, logger *log.Logger) (net.PacketConn, error) {
+// mountPathLen is MNTPATHLEN, the longest dirpath.
+const mountPathLen = 1024
+
+// StartMountd runs a tiny MOUNT v1-v3 UDP server that hands out the exported
+// directories of export to the clients its client table admits. It is
+// registered in reg unless that is nil.
+func StartMountd(addr string, export *Export, reg *oncrpc.Registry, logger *log.Logger) (net.PacketConn, error) {
 	if addr == "" {
 		addr = ":20048"
 	}
-	pc, err := net.ListenPacket("udp4", addr)
-	if err != nil {
-		return nil, err
+	if logger != nil {
+		logger.Printf("mountd v1-v3 root=%q", export.Root)
+	}
+	return newMountServer(export, logger).ListenUDP(addr, reg)
+}
+
+// StartMountdTCP serves MOUNT over TCP, the same as StartMountd does over UDP.
+func StartMountdTCP(addr string, export *Export, reg *oncrpc.Registry, logger *log.Logger) (net.Listener, error) {
+	if addr == "" {
+		addr = ":20048"
+	}
+	return newMountServer(export, logger).ListenTCP(addr, reg)
+}
+
+type mountd struct {
+	export *Export
+	logger *log.Logger
+}
+
+func (m *mountd) logf(format string, args ...any) {
+	if m.logger != nil {
+		m.logger.Printf(format, args...)
 	}
-	go func() {
-		if logger != nil {
-			logger.Printf("mountd v1 listening on %s base=%q", addr, baseDir)
-		}
-		buf := make([]byte, 8192)
-		for {
-			n, raddr, err := pc.ReadFrom(buf)
-			if err != nil {
-				if logger != nil {
-					logger.Printf("mountd read error: %v", err)
-				}
-				return
-			}
-			resp := handleMountd(buf[:n], baseDir, logger)
-			if resp != nil {
-				_, _ = pc.WriteTo(resp, raddr)
-			}
-		}
-	}()
-	return pc, nil
 }
 
-func handleMountd(pkt []byte, baseDir string, logger *log.Logger) []byte {
-	xid, prog, vers, proc, rr, err := parseRPCCall(pkt)
+// newMountServer returns the MOUNT v1-v3 server of export.
+func newMountServer(export *Export, logger *log.Logger) *oncrpc.Server {
+	m := &mountd{export: export, logger: logger}
+	s := oncrpc.NewServer("mountd", logger)
+	v3 := oncrpc.Procs{
+		mountProcMnt:     m.mnt,
+		mountProcDump:    m.dump,
+		mountProcUmnt:    m.umnt,
+		mountProcUmntAll: m.umntAll,
+		mountProcExport:  m.exports,
+	}
+	v1 := oncrpc.Procs{mountProcExportAll: m.exports}
+	for proc, h := range v3 {
+		v1[proc] = h
+	}
+	s.Register(mountProgram, mountV1, v1)
+	s.Register(mountProgram, 2, v1)
+	s.Register(mountProgram, mountV3, v3)
+	return s
+}
+
+// mnt answers MNT with a handle for the directory, after checking the
+// caller against the client table and the path against the export's Paths.
+func (m *mountd) mnt(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: dirpath (string)
+	path, err := c.Args.ReadOpaque()
 	if err != nil {
-		return nil
-	}
-	if prog != mountProgram || vers != mountV1 {
-		return rpcReplyDeniedAuth(xid)
-	}
-	switch proc {
-	case mountProcNull:
-		return rpcReplyHeaderAccepted(xid)
-	case mountProcMnt:
-		// args: dirpath (string)
-		path, err := rr.readOpaque()
-		if err != nil {
-			return rpcReplyDeniedAuth(xid)
-		}
-		// Clean path and ensure inside baseDir
-		clean := filepath.Clean(string(path))
-		full := filepath.Join(baseDir, clean)
-		if logger != nil {
-			logger.Printf("mountd MNT request path=%q full=%q", clean, full)
+		return oncrpc.ErrGarbageArgs
+	}
+	if len(path) > mountPathLen {
+		return mountReplyErr(w, nfsErrNameLong)
+	}
+	export := m.export
+	if _, ok := export.access(oncrpc.AddrIP(c.From)); !ok {
+		m.logf("mountd MNT refused path=%q for %v: not in the client table", string(path), c.From)
+		return mountReplyErr(w, nfsErrAcces)
+	}
+	// A diskless client gets its area when it first mounts.
+	root, err := export.disklessClient(oncrpc.AddrIP(c.From))
+	if err != nil {
+		m.logf("mountd diskless area of %v: %v", c.From, err)
+	}
+	full, err := export.mountPath(string(path))
+	if err == nil && export.private(full, root) {
+		err = errNotExported
+	}
+	m.logf("mountd MNT request path=%q full=%q", string(path), full)
+	if err == nil && !export.SingleFile {
+		var fi os.FileInfo
+		if fi, err = os.Stat(full); err == nil && !fi.IsDir() {
+			return mountReplyErr(w, nfsErrNotDir)
 		}
-		// success: status=0 and a 32-byte file handle derived from path
-		w := &xdrWriter{}
-		w.b = append(w.b, rpcReplyHeaderAccepted(xid)...)
-		w.writeUint32(0) // status OK
-		w.writeOpaque(handleForPath(full))
-		if logger != nil {
-			logger.Printf("mountd MNT ok path=%q", full)
+	}
+	if err != nil {
+		m.logf("mountd MNT refused path=%q: %v", string(path), err)
+		return mountReplyErr(w, nfsStatus(err))
+	}
+	host := mountClient(c)
+	export.addMount(host, cleanDirpath(string(path)))
+	// success: status=0 and a file handle derived from path, a fixed
+	// 32-byte fhandle before v3
+	w.WriteUint32(0) // status OK
+	if c.Vers == mountV3 {
+		w.WriteOpaque(export.handle(full))
+		w.WriteUint32(1) // auth_flavors: AUTH_UNIX
+		w.WriteUint32(oncrpc.AuthUnix)
+	} else {
+		w.WriteFixedOpaque(export.handle(full))
+	}
+	m.logf("mountd MNT ok path=%q for %s", full, host)
+	return nil
+}
+
+func (m *mountd) umnt(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: dirpath (string); UMNT returns void
+	path, err := c.Args.ReadOpaque()
+	if err != nil || len(path) > mountPathLen {
+		return oncrpc.ErrGarbageArgs
+	}
+	host := mountClient(c)
+	m.export.removeMount(host, cleanDirpath(string(path)))
+	m.logf("mountd UMNT path=%q from %s", string(path), host)
+	return nil
+}
+
+func (m *mountd) umntAll(c *oncrpc.Call, w *xdr.Writer) error {
+	host := mountClient(c)
+	m.export.removeMount(host, "")
+	m.logf("mountd UMNTALL from %s", host)
+	return nil
+}
+
+// exports answers EXPORT with the export's Paths and, as groups, the
+// clients of its table; no groups means every client may mount.
+//
+//	exports: exportnode *; exportnode { dirpath; groups; exports next }
+//	groups: groupnode *; groupnode { name; groups next }
+func (m *mountd) exports(c *oncrpc.Call, w *xdr.Writer) error {
+	groups := m.export.groups()
+	for _, p := range m.export.exportPaths() {
+		w.WriteBool(true)
+		w.WriteOpaque([]byte(p))
+		for _, g := range groups {
+			w.WriteBool(true)
+			w.WriteOpaque([]byte(g))
 		}
-		return w.b
-	case mountProcUmnt:
-		if logger != nil {
-			logger.Printf("mountd UMNT request")
+		w.WriteBool(false)
+	}
+	w.WriteBool(false)
+	return nil
+}
+
+// dump answers DUMP with the active mounts.
+//
+//	mountlist: mountbody *; mountbody { hostname; dirpath; mountlist next }
+func (m *mountd) dump(c *oncrpc.Call, w *xdr.Writer) error {
+	for _, e := range m.export.mountList() {
+		w.WriteBool(true)
+		w.WriteOpaque([]byte(e.host))
+		w.WriteOpaque([]byte(e.dir))
+	}
+	w.WriteBool(false)
+	return nil
+}
+
+// mountClient names the client of a MOUNT call for the mount list: its
+// address, or the machine name of its AUTH_UNIX credential when the
+// address is unknown.
+func mountClient(c *oncrpc.Call) string {
+	if ip := oncrpc.AddrIP(c.From); ip != nil {
+		return ip.String()
+	}
+	if c.Unix != nil && c.Unix.Machine != "" {
+		return c.Unix.Machine
+	}
+	return "unknown"
+}
+
+// mountReplyErr answers MNT with a non-zero fhstatus (errno values as NFS v2,
+// which mountstat3 shares).
+func mountReplyErr(w *xdr.Writer, status uint32) error {
+	w.WriteUint32(status)
+	return nil
+}
+
+// mountEntry is one active mount, as DUMP reports it.
+type mountEntry struct {
+	host, dir string
+}
+
+func (e *Export) addMount(host, dir string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.mounts == nil {
+		e.mounts = make(map[mountEntry]bool)
+	}
+	e.mounts[mountEntry{host, dir}] = true
+}
+
+// removeMount forgets the mount of dir by host, or all of its mounts when
+// dir is empty.
+func (e *Export) removeMount(host, dir string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for m := range e.mounts {
+		if m.host == host && (dir == "" || m.dir == dir) {
+			delete(e.mounts, m)
 		}
-		w := &xdrWriter{}
-		w.b = append(w.b, rpcReplyHeaderAccepted(xid)...)
-		w.writeUint32(0)
-		return w.b
-	default:
-		return rpcReplyDeniedAuth(xid)
 	}
 }
+
+// mountList returns the active mounts ordered by host and directory.
+func (e *Export) mountList() []mountEntry {
+	e.mu.Lock()
+	list := make([]mountEntry, 0, len(e.mounts))
+	for m := range e.mounts {
+		list = append(list, m)
+	}
+	e.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].host != list[j].host {
+			return list[i].host < list[j].host
+		}
+		return list[i].dir < list[j].dir
+	})
+	return list
+}
@@ -0,0 +1,227 @@
+package nfs
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ofw-install-server/oncrpc"
+	"ofw-install-server/xdr"
+)
+
+func mntCall(t *testing.T, export *Export, dirpath string) (uint32, []byte) {
+	t.Helper()
+	req := buildMinimalRPCCall(7, mountProgram, mountV1, mountProcMnt)
+	w := xdr.NewWriter(nil)
+	w.WriteOpaque([]byte(dirpath))
+	resp := handleMountd(append(req, w.Bytes()...), nil, export, nil)
+	if len(resp) < 28 {
+		t.Fatalf("short reply: %x", resp)
+	}
+	status := binary.BigEndian.Uint32(resp[24:28])
+	return status, resp[28:]
+}
+
+func TestMountdMnt(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "install"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "bsd.rd"), nil, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	status, fh := mntCall(t, export, "/install")
+	if status != 0 || len(fh) != 32 {
+		t.Fatalf("MNT /install status=%d fh=%d bytes", status, len(fh))
+	}
+	if p, err := export.resolve(fh); err != nil || p != filepath.Join(export.Root, "install") {
+		t.Fatalf("handle maps to %q err=%v", p, err)
+	}
+	if status, _ := mntCall(t, export, "/missing"); status != nfsErrNoEnt {
+		t.Fatalf("MNT /missing status=%d", status)
+	}
+	if status, _ := mntCall(t, export, "/bsd.rd"); status != nfsErrNotDir {
+		t.Fatalf("MNT of a file status=%d", status)
+	}
+}
+
+func TestMountdV3(t *testing.T) {
+	export, err := NewExport(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	req := buildMinimalRPCCall(7, mountProgram, mountV3, mountProcMnt)
+	w := xdr.NewWriter(nil)
+	w.WriteOpaque([]byte("/"))
+	resp := handleMountd(append(req, w.Bytes()...), nil, export, nil)
+	r := xdr.NewReader(resp[24:])
+	status, _ := r.ReadUint32()
+	fh, _ := r.ReadOpaque()
+	nflavors, _ := r.ReadUint32()
+	flavor, _ := r.ReadUint32()
+	if status != 0 || len(fh) != 32 || nflavors != 1 || flavor != oncrpc.AuthUnix {
+		t.Fatalf("MNT v3 status=%d fh=%d bytes flavors=%d/%d", status, len(fh), nflavors, flavor)
+	}
+
+	resp = handleMountd(buildMinimalRPCCall(8, mountProgram, 4, mountProcNull), nil, export, nil)
+	if len(resp) != 32 || binary.BigEndian.Uint32(resp[20:24]) != 2 {
+		t.Fatalf("MOUNT v4 not answered with PROG_MISMATCH: %x", resp)
+	}
+}
+
+// mountCallFrom runs a MOUNT v3 call from client ip with a dirpath argument
+// unless dirpath is empty, and returns the reader after the accept_stat.
+func mountCallFrom(t *testing.T, export *Export, ip string, proc uint32, dirpath string) *xdr.Reader {
+	t.Helper()
+	w := xdr.NewWriter(buildMinimalRPCCall(9, mountProgram, mountV3, proc))
+	if dirpath != "" {
+		w.WriteOpaque([]byte(dirpath))
+	}
+	stat, r := acceptStat(t, handleMountd(w.Bytes(), &net.UDPAddr{IP: net.ParseIP(ip)}, export, nil))
+	if stat != oncrpc.AcceptSuccess {
+		t.Fatalf("MOUNT proc %d: accept_stat %d", proc, stat)
+	}
+	return r
+}
+
+func TestMountdExportPaths(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"sparc64/etc", "private"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	export.Paths = []string{"/sparc64"}
+	for dirpath, want := range map[string]uint32{
+		"/sparc64":                              nfsOK,
+		"sparc64/":                              nfsOK,
+		"/sparc64/etc":                          nfsOK,
+		"/private":                              nfsErrAcces,
+		"/":                                     nfsErrAcces,
+		"/sparc64/../private":                   nfsErrAcces,
+		"/sparc64/missing":                      nfsErrNoEnt,
+		"/" + strings.Repeat("a", mountPathLen): nfsErrNameLong,
+	} {
+		if status, _ := mntCall(t, export, dirpath); status != want {
+			t.Errorf("MNT %q status=%d, want %d", dirpath, status, want)
+		}
+	}
+
+	// EXPORT lists the paths with the client table as groups.
+	rule, _ := ParseClientRule("net=10.0.0.0/24")
+	export.Clients = []ClientRule{rule}
+	r := mountCallFrom(t, export, "10.0.0.1", mountProcExport, "")
+	var exports []string
+	for more, _ := r.ReadBool(); more; more, _ = r.ReadBool() {
+		dir, _ := r.ReadOpaque()
+		entry := string(dir)
+		for g, _ := r.ReadBool(); g; g, _ = r.ReadBool() {
+			name, _ := r.ReadOpaque()
+			entry += " " + string(name)
+		}
+		exports = append(exports, entry)
+	}
+	if len(exports) != 1 || exports[0] != "/sparc64 10.0.0.0/24" {
+		t.Fatalf("EXPORT = %q", exports)
+	}
+}
+
+func TestMountedExportConfinesLookups(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"sparc64/etc", "private"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	export.Paths = []string{"/sparc64"}
+	d := &nfsd{export: export}
+	sparc64 := filepath.Join(export.Root, "sparc64")
+
+	// ".." stays at the exported directory, from it and from below it,
+	// over NFS v2 and v3.
+	for _, dirpath := range []string{"/sparc64", "/sparc64/etc"} {
+		status, fh := mntCall(t, export, dirpath)
+		if status != nfsOK {
+			t.Fatalf("MNT %s status=%d", dirpath, status)
+		}
+		dir := fh[:fhSize]
+		for i := 0; i < 2; i++ {
+			status, r := nfsCall(t, d, nfsProcLookup, lookupArgs(dir, ".."))
+			if status != nfsOK {
+				t.Fatalf("LOOKUP .. from %s status=%d", dirpath, status)
+			}
+			dir, _ = r.ReadFixed(fhSize)
+		}
+		if p, err := export.resolve(dir); err != nil || p != sparc64 {
+			t.Fatalf("LOOKUP ../.. from %s = %q, %v; want %q", dirpath, p, err, sparc64)
+		}
+		status, r := nfs3Call(t, d, nfs3ProcLookup, dirop3Args(dir, ".."))
+		if status != nfsOK {
+			t.Fatalf("v3 LOOKUP .. from %s status=%d", dirpath, status)
+		}
+		up, _ := r.ReadOpaque()
+		if p, err := export.resolve(up); err != nil || p != sparc64 {
+			t.Fatalf("v3 LOOKUP .. from %s = %q, %v", dirpath, p, err)
+		}
+	}
+
+	// Handles of what is no longer exported go stale.
+	export.Paths = nil
+	rootFH := export.handle(export.Root)
+	export.Paths = []string{"/sparc64"}
+	if _, err := export.resolve(rootFH); err != errStaleHandle {
+		t.Fatalf("handle of an unexported directory err=%v", err)
+	}
+}
+
+func TestMountdDumpAndUmnt(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "swap"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	for _, m := range []struct{ ip, dir string }{{"10.0.0.2", "/"}, {"10.0.0.2", "/swap"}, {"10.0.0.1", "/swap/"}} {
+		if status, _ := mountCallFrom(t, export, m.ip, mountProcMnt, m.dir).ReadUint32(); status != nfsOK {
+			t.Fatalf("MNT %s from %s status=%d", m.dir, m.ip, status)
+		}
+	}
+	dump := func() []string {
+		r := mountCallFrom(t, export, "10.0.0.9", mountProcDump, "")
+		var list []string
+		for more, _ := r.ReadBool(); more; more, _ = r.ReadBool() {
+			host, _ := r.ReadOpaque()
+			dir, _ := r.ReadOpaque()
+			list = append(list, string(host)+":"+string(dir))
+		}
+		return list
+	}
+	if got := strings.Join(dump(), " "); got != "10.0.0.1:/swap 10.0.0.2:/ 10.0.0.2:/swap" {
+		t.Fatalf("DUMP = %s", got)
+	}
+	mountCallFrom(t, export, "10.0.0.1", mountProcUmnt, "/swap")
+	if got := strings.Join(dump(), " "); got != "10.0.0.2:/ 10.0.0.2:/swap" {
+		t.Fatalf("DUMP after UMNT = %s", got)
+	}
+	mountCallFrom(t, export, "10.0.0.2", mountProcUmntAll, "")
+	if got := dump(); len(got) != 0 {
+		t.Fatalf("DUMP after UMNTALL = %s", got)
+	}
+}
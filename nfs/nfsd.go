@@ -1,220 +1,517 @@
 package nfs
 
 import (
+	"encoding/binary"
+	"errors"
+	"io/fs"
 	"log"
+	"math"
 	"net"
 	"os"
+	"path/filepath"
+	"syscall"
 	"time"
+
+	"golang.org/x/sys/unix"
+
+	"ofw-install-server/oncrpc"
+	"ofw-install-server/xdr"
 )
 
-// NFS program and version (v2 minimal)
+// NFS program and versions
 const (
 	nfsProgram = 100003
 	nfsV2      = 2
+	nfsV3      = 3
 )
 
 // NFS v2 procedures (subset)
 const (
-	nfsProcNull    = 0
-	nfsProcGetAttr = 1
-	nfsProcLookup  = 4
-	nfsProcRead    = 6
+	nfsProcNull     = 0
+	nfsProcGetAttr  = 1
+	nfsProcSetAttr  = 2
+	nfsProcLookup   = 4
+	nfsProcReadlink = 5
+	nfsProcRead     = 6
+	nfsProcWrite    = 8
+	nfsProcCreate   = 9
+	nfsProcRemove   = 10
+	nfsProcRename   = 11
+	nfsProcLink     = 12
+	nfsProcSymlink  = 13
+	nfsProcMkdir    = 14
+	nfsProcRmdir    = 15
+	nfsProcReaddir  = 16
+	nfsProcStatfs   = 17
+)
+
+// NFS v2 status codes (RFC 1094 stat)
+const (
+	nfsOK          = 0
+	nfsErrPerm     = 1
+	nfsErrNoEnt    = 2
+	nfsErrIO       = 5
+	nfsErrNXIO     = 6
+	nfsErrAcces    = 13
+	nfsErrExist    = 17
+	nfsErrXDev     = 18
+	nfsErrNoDev    = 19
+	nfsErrNotDir   = 20
+	nfsErrIsDir    = 21
+	nfsErrInval    = 22
+	nfsErrFBig     = 27
+	nfsErrNoSpc    = 28
+	nfsErrROFS     = 30
+	nfsErrNameLong = 63
+	nfsErrNotEmpty = 66
+	nfsErrDQuot    = 69
+	nfsErrStale    = 70
 )
 
-// StartNFSD runs a tiny NFS v2 UDP server rooted at baseDir.
-func StartNFSD(addr string, baseDir string, logger *log.Logger) (net.PacketConn, error) {
+var errNotDir = errors.New("not a directory")
+
+// nfsMaxData is the largest READ payload of NFS v2.
+const nfsMaxData = 8192
+
+// StartNFSD runs a tiny NFS v2/v3 UDP server serving export, registered in
+// reg unless it is nil.
+func StartNFSD(addr string, export *Export, reg *oncrpc.Registry, logger *log.Logger) (net.PacketConn, error) {
 	if addr == "" {
 		addr = ":2049"
 	}
-	pc, err := net.ListenPacket("udp4", addr)
-	if err != nil {
-		return nil, err
+	if logger != nil {
+		logger.Printf("nfsd v2/v3 root=%q single-file=%v", export.Root, export.SingleFile)
 	}
-	go func() {
-		if logger != nil {
-			logger.Printf("nfsd v2 listening on %s base=%q", addr, baseDir)
-		}
-		buf := make([]byte, 8192)
-		for {
-			n, raddr, err := pc.ReadFrom(buf)
-			if err != nil {
-				if logger != nil {
-					logger.Printf("nfsd read error: %v", err)
-				}
-				return
-			}
-			resp := handleNFSD(buf[:n], baseDir, logger)
-			if resp != nil {
-				_, _ = pc.WriteTo(resp, raddr)
+	return newNFSServer(export, logger).ListenUDP(addr, reg)
+}
+
+// StartNFSDTCP serves export over TCP, the same as StartNFSD does over UDP.
+func StartNFSDTCP(addr string, export *Export, reg *oncrpc.Registry, logger *log.Logger) (net.Listener, error) {
+	if addr == "" {
+		addr = ":2049"
+	}
+	return newNFSServer(export, logger).ListenTCP(addr, reg)
+}
+
+// writeVerf is the NFS v3 write verifier. It changes on restart so clients
+// resend UNSTABLE writes the server may have lost.
+var writeVerf = func() (v [8]byte) {
+	binary.BigEndian.PutUint64(v[:], uint64(time.Now().UnixNano()))
+	return v
+}()
+
+type nfsd struct {
+	export *Export
+	logger *log.Logger
+
+	// Set per call by admit
+	access clientAccess
+	caller oncrpc.AuthUnixCred
+	root   *clientRoot // the caller's diskless area, if it has one
+}
+
+func (d *nfsd) logf(format string, args ...any) {
+	if d.logger != nil {
+		d.logger.Printf(format, args...)
+	}
+}
+
+// nfsProc serves one NFS procedure with the nfsd admit returns for the call.
+type nfsProc func(d *nfsd, c *oncrpc.Call, w *xdr.Writer) error
+
+// newNFSServer returns the NFS v2 and v3 server of export. NULL answers
+// anyone; the other procedures are checked against the client table first.
+func newNFSServer(export *Export, logger *log.Logger) *oncrpc.Server {
+	d := &nfsd{export: export, logger: logger}
+	s := oncrpc.NewServer("nfsd", logger)
+	s.Register(nfsProgram, nfsV2, d.procs(map[uint32]nfsProc{
+		nfsProcGetAttr:  (*nfsd).getattr,
+		nfsProcSetAttr:  (*nfsd).setattr,
+		nfsProcLookup:   (*nfsd).lookup,
+		nfsProcReadlink: (*nfsd).readlink,
+		nfsProcRead:     (*nfsd).read,
+		nfsProcWrite:    (*nfsd).write,
+		nfsProcCreate:   (*nfsd).create,
+		nfsProcRemove:   (*nfsd).remove,
+		nfsProcRename:   (*nfsd).rename,
+		nfsProcLink:     (*nfsd).link,
+		nfsProcSymlink:  (*nfsd).symlink,
+		nfsProcMkdir:    (*nfsd).mkdir,
+		nfsProcRmdir:    (*nfsd).rmdir,
+		nfsProcReaddir:  (*nfsd).readdir,
+		nfsProcStatfs:   (*nfsd).statfs,
+	}))
+	s.Register(nfsProgram, nfsV3, d.procs(nfs3Procs))
+	// Running these again for a retransmission would fail, or undo what
+	// another client did since.
+	s.CacheReplies(nfsProgram, nfsV2, nfsProcSetAttr, nfsProcWrite, nfsProcCreate, nfsProcRemove,
+		nfsProcRename, nfsProcLink, nfsProcSymlink, nfsProcMkdir, nfsProcRmdir)
+	s.CacheReplies(nfsProgram, nfsV3, nfs3ProcSetAttr, nfs3ProcWrite, nfs3ProcCreate, nfs3ProcMkdir,
+		nfs3ProcSymlink, nfs3ProcMknod, nfs3ProcRemove, nfs3ProcRmdir, nfs3ProcRename, nfs3ProcLink)
+	return s
+}
+
+// procs wraps procs into handlers that admit each call before serving it.
+func (d *nfsd) procs(procs map[uint32]nfsProc) oncrpc.Procs {
+	handlers := make(oncrpc.Procs, len(procs))
+	for proc, fn := range procs {
+		handlers[proc] = func(c *oncrpc.Call, w *xdr.Writer) error {
+			call := d.admit(c, w)
+			if call == nil {
+				return nil
 			}
+			return fn(call, c, w)
 		}
-	}()
-	return pc, nil
+	}
+	return handlers
+}
+
+// readFH reads a file handle argument: fixed 32 bytes in NFS v2, a counted
+// opaque of up to 64 bytes in NFS v3.
+func readFH(rr *xdr.Reader, vers uint32) ([]byte, error) {
+	if vers == nfsV2 {
+		return rr.ReadFixed(32)
+	}
+	return rr.ReadOpaque()
+}
+
+// pathFor resolves a file handle to a path of the export, as the caller
+// sees it.
+func (d *nfsd) pathFor(fh []byte) (string, bool) {
+	p, ok := d.export.file(fh)
+	if !ok {
+		return "", false
+	}
+	return d.view(p)
 }
 
-func handleNFSD(pkt []byte, defaultFile string, logger *log.Logger) []byte {
-	xid, prog, vers, proc, rr, err := parseRPCCall(pkt)
+func (d *nfsd) getattr(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: fhandle (fixed 32 bytes)
+	fh, err := c.Args.ReadFixed(32)
 	if err != nil {
-		return nil
+		return oncrpc.ErrGarbageArgs
 	}
-	if prog != nfsProgram || vers != nfsV2 {
-		return rpcReplyDeniedAuth(xid)
+	p, ok := d.pathFor(fh)
+	if !ok {
+		return nfsReplyErr(w, nfsErrStale)
 	}
-	switch proc {
-	case nfsProcNull:
-		logger.Printf("nfsProcNull")
-		return rpcReplyHeaderAccepted(xid)
-	case nfsProcGetAttr:
-		logger.Printf("nfsProcGetAttr")
-		// args: fhandle (fixed 32 bytes)
-		_, err := rr.readFixed(32)
-		if err != nil {
-			return rpcReplyDeniedAuth(xid)
-		}
-		logger.Printf("nfsd GETATTR for root -> /")
-		return nfsReplyAttrOK(xid, defaultFile)
-	case nfsProcLookup:
-		logger.Printf("nfsProcLookup")
-		// args: diropargs: dir(fh fixed32), name(string)
-		_, err := rr.readFixed(32) // dir fh
-		if err != nil {
-			return rpcReplyDeniedAuth(xid)
-		}
-		name, err := rr.readOpaque()
-		if err != nil {
-			logger.Printf("nfsd LOOKUP failed to read name")
-			return rpcReplyDeniedAuth(xid)
-		}
-		logger.Printf("nfsd LOOKUP attempt: %q", string(name))
+	if _, err := os.Lstat(p); err != nil {
+		return nfsReplyErr(w, nfsStatus(err))
+	}
+	d.logf("nfsd GETATTR %q", p)
+	return d.replyAttrOK(w, p)
+}
 
-		target := defaultFile
-		logger.Printf("nfsd LOOKUP name=%q -> %q", string(name), target)
-		if _, err := os.Stat(target); err != nil {
-			if logger != nil {
-				logger.Printf("nfsd LOOKUP noent: %q", target)
-			}
-			return nfsReplyErrNoEnt(xid)
-		}
-		// Return a filehandle and attributes
-		w := &xdrWriter{}
-		w.b = append(w.b, rpcReplyHeaderAccepted(xid)...)
-		w.writeUint32(0)                          // status OK
-		w.writeFixedOpaque(handleForPath(target)) // object fh (fixed 32)
-		// For v2 diropres: next is attributes; we omit any boolean and serialize fattr
-		writeNFSV2Fattr(w, target)
-		if logger != nil {
-			logger.Printf("nfsd LOOKUP ok: %q (fh stored)", target)
-		}
-		return w.b
-	case nfsProcRead:
-		logger.Printf("nfsProcRead")
-		// args: fh(fixed32), offset(uint32), count(uint32), totalcount(uint32)
-		//_, err := rr.readFixed(32)
-		fh, err := rr.readFixed(32)
-		if err != nil {
-			logger.Printf("file handle (fh) recovery failed")
-			//return rpcReplyDeniedAuth(xid)
-		}
-		offset, err := rr.readUint32()
-		if err != nil {
-			logger.Printf("offset recovery failed")
-			return rpcReplyDeniedAuth(xid)
-		}
-		count, err := rr.readUint32()
+func (d *nfsd) lookup(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: diropargs: dir(fh fixed32), name(string)
+	dirfh, err := c.Args.ReadFixed(32)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	name, err := c.Args.ReadOpaque()
+	if err != nil {
+		d.logf("nfsd LOOKUP failed to read name")
+		return oncrpc.ErrGarbageArgs
+	}
+	if len(name) > 255 {
+		return nfsReplyErr(w, nfsErrNameLong)
+	}
+	dir, ok := d.pathFor(dirfh)
+	if !ok {
+		return nfsReplyErr(w, nfsErrStale)
+	}
+	if !d.export.SingleFile {
+		fi, err := os.Lstat(dir)
 		if err != nil {
-			logger.Printf("count recovery failed")
-			return rpcReplyDeniedAuth(xid)
+			return nfsReplyErr(w, nfsStatus(err))
 		}
-		// totalcount ignored
-		_, _ = rr.readUint32()
-		p, ok := pathForHandle(fh)
-		if !ok {
-			logger.Printf("path/p recovery failed")
-			//return nfsReplyErrNoEnt(xid)
+		if !fi.IsDir() {
+			return nfsReplyErr(w, nfsErrNotDir)
 		}
-		f, err := os.Open(defaultFile)
-		if err != nil {
-			return nfsReplyErrNoEnt(xid)
+	}
+	target, err := d.lookupPath(dir, string(name))
+	if err != nil {
+		d.logf("nfsd LOOKUP %q in %q: %v", string(name), dir, err)
+		return nfsReplyErr(w, nfsErrNoEnt)
+	}
+	if _, err := os.Lstat(target); err != nil {
+		d.logf("nfsd LOOKUP noent: %q", target)
+		return nfsReplyErr(w, nfsStatus(err))
+	}
+	d.logf("nfsd LOOKUP name=%q -> %q", string(name), target)
+	return d.replyDirOK(w, target)
+}
+
+// readargs are the arguments of READ (RFC 1094). totalcount is unused.
+type readargs struct {
+	File       [fhSize]byte
+	Offset     uint32
+	Count      uint32
+	Totalcount uint32
+}
+
+func (d *nfsd) read(c *oncrpc.Call, w *xdr.Writer) error {
+	var args readargs
+	if err := c.Args.Decode(&args); err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	fh, offset, count := args.File[:], args.Offset, args.Count
+	p, ok := d.pathFor(fh)
+	if !ok {
+		return nfsReplyErr(w, nfsErrStale)
+	}
+	err := d.export.readFile(p, uint64(offset), int(min(count, nfsMaxData)), func(data []byte, a fileAttrs) {
+		d.logf("nfsd READ %q off=%d count=%d -> %d bytes", p, offset, count, len(data))
+		w.WriteUint32(nfsOK)
+		writeNFSV2Fattr(w, a)
+		w.WriteOpaque(data) // data as counted opaque
+	})
+	if err != nil {
+		return nfsReplyErr(w, nfsStatus(err))
+	}
+	return nil
+}
+
+func (d *nfsd) readlink(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: fh(fixed32)
+	fh, err := c.Args.ReadFixed(32)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	p, ok := d.pathFor(fh)
+	if !ok {
+		return nfsReplyErr(w, nfsErrStale)
+	}
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return nfsReplyErr(w, nfsStatus(err))
+	}
+	if fi.Mode()&fs.ModeSymlink == 0 {
+		return nfsReplyErr(w, nfsErrInval)
+	}
+	target, err := os.Readlink(p)
+	if err != nil {
+		return nfsReplyErr(w, nfsStatus(err))
+	}
+	d.logf("nfsd READLINK %q -> %q", p, target)
+	w.WriteUint32(nfsOK)
+	w.WriteOpaque([]byte(target))
+	return nil
+}
+
+// dirEntry is one READDIR entry; cookies are positions in the listing.
+type dirEntry struct {
+	name   string
+	fileid uint64
+}
+
+func (d *nfsd) readdir(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: dir fh(fixed32), cookie(4 opaque), count(uint32)
+	fh, err := c.Args.ReadFixed(32)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	cookie, err := c.Args.ReadUint32()
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	count, err := c.Args.ReadUint32()
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	dir, ok := d.pathFor(fh)
+	if !ok {
+		return nfsReplyErr(w, nfsErrStale)
+	}
+	entries, err := d.listDir(dir)
+	if err != nil {
+		return nfsReplyErr(w, nfsStatus(err))
+	}
+	// count bounds the directory information in the reply; never exceed
+	// what fits a READ-sized UDP reply either.
+	budget := int(min(count, nfsMaxData)) - 8 // list terminator + eof
+	list := xdr.NewWriter(nil)
+	i := int(cookie)
+	for ; i < len(entries); i++ {
+		e := entries[i]
+		size := 16 + (len(e.name)+3)&^3
+		if size > budget {
+			break
 		}
-		defer f.Close()
-		buf := make([]byte, count)
-		n, _ := f.ReadAt(buf, int64(offset))
-		buf = buf[:n]
-		if logger != nil {
-			logger.Printf("nfsd READ %q off=%d count=%d -> %d bytes", p, offset, count, n)
+		budget -= size
+		list.WriteUint32(1) // value follows
+		list.WriteUint32(uint32(e.fileid))
+		list.WriteOpaque([]byte(e.name))
+		list.WriteUint32(uint32(i + 1)) // cookie of the next entry
+	}
+	if i == int(cookie) && i < len(entries) {
+		// Not even one entry fits in count.
+		return nfsReplyErr(w, nfsErrInval)
+	}
+	w.WriteUint32(nfsOK)
+	w.WriteFixedOpaque(list.Bytes())
+	w.WriteUint32(0)
+	eof := uint32(0)
+	if i >= len(entries) {
+		eof = 1
+	}
+	w.WriteUint32(eof)
+	d.logf("nfsd READDIR %q cookie=%d count=%d -> %d entries eof=%d", dir, cookie, count, i-int(cookie), eof)
+	return nil
+}
+
+// listDir returns the entries of dir in a stable order, "." and ".." first,
+// so cookies stay valid across calls while the directory is unchanged.
+func (d *nfsd) listDir(dir string) ([]dirEntry, error) {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, errNotDir
+	}
+	parent := filepath.Dir(dir)
+	if !d.export.contains(parent) {
+		parent = dir
+	}
+	pfi, err := os.Lstat(parent)
+	if err != nil {
+		return nil, err
+	}
+	var infos []fs.FileInfo
+	if d.root != nil {
+		infos, err = d.root.readDir(dir)
+	} else {
+		infos, err = readDirInfo(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []dirEntry{{".", fileID(fi)}, {"..", fileID(pfi)}}
+	for _, info := range infos {
+		entries = append(entries, dirEntry{info.Name(), fileID(info)})
+	}
+	return entries, nil
+}
+
+func (d *nfsd) statfs(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: fh(fixed32)
+	fh, err := c.Args.ReadFixed(32)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	p, ok := d.pathFor(fh)
+	if !ok {
+		return nfsReplyErr(w, nfsErrStale)
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(p, &st); err != nil {
+		return nfsReplyErr(w, nfsStatus(err))
+	}
+	// Scale the block size up until the counts fit the 32-bit fields.
+	bsize, blocks, bfree, bavail := uint64(st.Bsize), st.Blocks, st.Bfree, st.Bavail
+	for blocks > math.MaxUint32 {
+		bsize, blocks, bfree, bavail = bsize*2, blocks/2, bfree/2, bavail/2
+	}
+	d.logf("nfsd STATFS %q", p)
+	w.WriteUint32(nfsOK)
+	w.WriteUint32(nfsMaxData) // tsize: optimum transfer size
+	w.WriteUint32(uint32(bsize))
+	w.WriteUint32(uint32(blocks))
+	w.WriteUint32(uint32(bfree))
+	w.WriteUint32(uint32(bavail))
+	return nil
+}
+
+// fileID returns the inode number of fi, used as the NFS fileid.
+func fileID(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Ino
+	}
+	return 1
+}
+
+// errnoStatus maps the errnos RFC 1094 knows to their NFS v2 status. The
+// protocol borrowed BSD numbering, which differs from Linux for some.
+var errnoStatus = map[syscall.Errno]uint32{
+	syscall.EPERM:        nfsErrPerm,
+	syscall.ENOENT:       nfsErrNoEnt,
+	syscall.EIO:          nfsErrIO,
+	syscall.ENXIO:        nfsErrNXIO,
+	syscall.EACCES:       nfsErrAcces,
+	syscall.EEXIST:       nfsErrExist,
+	syscall.EXDEV:        nfsErrXDev,
+	syscall.ENODEV:       nfsErrNoDev,
+	syscall.ENOTDIR:      nfsErrNotDir,
+	syscall.EISDIR:       nfsErrIsDir,
+	syscall.EINVAL:       nfsErrInval,
+	syscall.ELOOP:        nfsErrInval,
+	syscall.EMLINK:       nfsErrInval,
+	syscall.EFBIG:        nfsErrFBig,
+	syscall.ENOSPC:       nfsErrNoSpc,
+	syscall.EROFS:        nfsErrROFS,
+	syscall.ENAMETOOLONG: nfsErrNameLong,
+	syscall.ENOTEMPTY:    nfsErrNotEmpty,
+	syscall.EDQUOT:       nfsErrDQuot,
+	syscall.ESTALE:       nfsErrStale,
+}
+
+// nfsStatus maps a filesystem error to an NFS v2 status.
+func nfsStatus(err error) uint32 {
+	var errno syscall.Errno
+	switch {
+	case err == nil:
+		return nfsOK
+	case errors.Is(err, errOutsideExport), errors.Is(err, errNotExported):
+		return nfsErrAcces
+	case errors.Is(err, errNotDir):
+		return nfsErrNotDir
+	case errors.Is(err, errReadOnly):
+		return nfsErrROFS
+	case errors.Is(err, os.ErrInvalid):
+		return nfsErrInval
+	case errors.As(err, &errno):
+		if st, ok := errnoStatus[errno]; ok {
+			return st
 		}
-		w := &xdrWriter{}
-		w.b = append(w.b, rpcReplyHeaderAccepted(xid)...)
-		w.writeUint32(0) // status OK
-		writeNFSV2Fattr(w, defaultFile)
-		w.writeOpaque(buf) // data as counted opaque
-		return w.b
+		return nfsErrIO
+	case errors.Is(err, fs.ErrNotExist):
+		return nfsErrNoEnt
+	case errors.Is(err, fs.ErrExist):
+		return nfsErrExist
+	case errors.Is(err, fs.ErrPermission):
+		return nfsErrAcces
 	default:
-		logger.Printf("proc not supported: %d", proc)
-		return rpcReplyDeniedAuth(xid)
-	}
-}
-
-func nfsReplyAttrOK(xid uint32, path string) []byte {
-	w := &xdrWriter{}
-	w.b = append(w.b, rpcReplyHeaderAccepted(xid)...)
-	w.writeUint32(0) // status OK
-	writeNFSV2Fattr(w, path)
-	return w.b
-}
-
-func nfsReplyErrNoEnt(xid uint32) []byte {
-	w := &xdrWriter{}
-	w.b = append(w.b, rpcReplyHeaderAccepted(xid)...)
-	w.writeUint32(2) // NFSERR_NOENT
-	return w.b
-}
-
-// NFSv2 fattr (RFC 1094):
-// ftype(4) mode(4) nlink(4) uid(4) gid(4) size(4) blocksize(4) rdev(4)
-// blocks(4) fsid(4) fileid(4) atime(3*4) mtime(3*4) ctime(3*4)
-func writeNFSV2Fattr(w *xdrWriter, path string) {
-	fi, err := os.Stat(path)
-	var mode uint32 = 040755
-	var ftype uint32 = 2 // directory
-	var nlink uint32 = 1
-	var size uint32 = 0
-	if err == nil {
-		if fi.IsDir() {
-			ftype = 2
-			mode = 040755
-		} else {
-			ftype = 1
-			mode = 0100644
-			if fi.Size() > 0 {
-				if fi.Size() > 0xFFFFFFFF {
-					size = 0xFFFFFFFF
-				} else {
-					size = uint32(fi.Size())
-				}
-			}
-		}
-		nlink = uint32(1)
-	}
-	// naive values for the rest
-	w.writeUint32(ftype)
-	w.writeUint32(mode)
-	w.writeUint32(nlink)
-	w.writeUint32(0) // uid
-	w.writeUint32(0) // gid
-	w.writeUint32(size)
-	w.writeUint32(4096) // blocksize
-	w.writeUint32(0)    // rdev
-	w.writeUint32(0)    // blocks
-	w.writeUint32(1)    // fsid
-	w.writeUint32(1)    // fileid
-	now := time.Now()
-	writeNFSv2Time(w, now)
-	writeNFSv2Time(w, now)
-	writeNFSv2Time(w, now)
-}
-
-func writeNFSv2Time(w *xdrWriter, t time.Time) {
-	w.writeUint32(uint32(t.Unix()))
-	w.writeUint32(0) // usec
+		return nfsErrIO
+	}
+}
+
+// replyAttrOK answers with an attrstat carrying the attributes of path.
+func (d *nfsd) replyAttrOK(w *xdr.Writer, path string) error {
+	a, err := d.export.attrs(path)
+	if err != nil {
+		return nfsReplyErr(w, nfsStatus(err))
+	}
+	w.WriteUint32(nfsOK)
+	writeNFSV2Fattr(w, a)
+	return nil
+}
+
+// replyDirOK answers with a diropres: the file handle and attributes of path.
+func (d *nfsd) replyDirOK(w *xdr.Writer, path string) error {
+	a, err := d.export.attrs(path)
+	if err != nil {
+		return nfsReplyErr(w, nfsStatus(err))
+	}
+	w.WriteUint32(nfsOK)
+	w.WriteFixedOpaque(d.export.handle(path)) // object fh (fixed 32)
+	writeNFSV2Fattr(w, a)
+	return nil
+}
+
+// nfsReplyErr answers with status alone, which is all NFS v2 sends on
+// failure and for procedures without results.
+func nfsReplyErr(w *xdr.Writer, status uint32) error {
+	w.WriteUint32(status)
+	return nil
 }
@@ -0,0 +1,902 @@
+package nfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"ofw-install-server/oncrpc"
+	"ofw-install-server/xdr"
+)
+
+// NFS v3 procedures (RFC 1813)
+const (
+	nfs3ProcNull        = 0
+	nfs3ProcGetAttr     = 1
+	nfs3ProcSetAttr     = 2
+	nfs3ProcLookup      = 3
+	nfs3ProcAccess      = 4
+	nfs3ProcReadlink    = 5
+	nfs3ProcRead        = 6
+	nfs3ProcWrite       = 7
+	nfs3ProcCreate      = 8
+	nfs3ProcMkdir       = 9
+	nfs3ProcSymlink     = 10
+	nfs3ProcMknod       = 11
+	nfs3ProcRemove      = 12
+	nfs3ProcRmdir       = 13
+	nfs3ProcRename      = 14
+	nfs3ProcLink        = 15
+	nfs3ProcReaddir     = 16
+	nfs3ProcReaddirPlus = 17
+	nfs3ProcFsstat      = 18
+	nfs3ProcFsinfo      = 19
+	nfs3ProcPathconf    = 20
+	nfs3ProcCommit      = 21
+)
+
+// NFS v3 status codes beyond those shared with NFS v2
+const (
+	nfs3ErrBadHandle = 10001
+	nfs3ErrNotSync   = 10002
+	nfs3ErrNotSupp   = 10004
+	nfs3ErrTooSmall  = 10005
+)
+
+// ACCESS bits (RFC 1813 ACCESS3_*)
+const (
+	access3Read    = 0x01
+	access3Lookup  = 0x02
+	access3Modify  = 0x04
+	access3Extend  = 0x08
+	access3Delete  = 0x10
+	access3Execute = 0x20
+)
+
+// stable_how values for WRITE
+const (
+	writeUnstable = 0
+	writeFileSync = 2
+)
+
+// CREATE modes (createmode3)
+const (
+	createUnchecked = 0
+	createGuarded   = 1
+	createExclusive = 2
+)
+
+const (
+	// nfs3FHSize is the largest NFS v3 file handle.
+	nfs3FHSize = 64
+	// nfs3MaxData is the READ and WRITE size offered in FSINFO. It keeps a
+	// reply within one UDP datagram.
+	nfs3MaxData = 32768
+	// fattr3Size is the encoded size of a fattr3.
+	fattr3Size = 84
+)
+
+// nfs3FailWords is the number of XDR words of the failure body of each
+// procedure. Every failure body is made of post_op_attr and wcc_data,
+// which are sent empty: one word per post_op_attr, two per wcc_data.
+var nfs3FailWords = [...]int{
+	nfs3ProcNull:        0,
+	nfs3ProcGetAttr:     0,
+	nfs3ProcSetAttr:     2,
+	nfs3ProcLookup:      1,
+	nfs3ProcAccess:      1,
+	nfs3ProcReadlink:    1,
+	nfs3ProcRead:        1,
+	nfs3ProcWrite:       2,
+	nfs3ProcCreate:      2,
+	nfs3ProcMkdir:       2,
+	nfs3ProcSymlink:     2,
+	nfs3ProcMknod:       2,
+	nfs3ProcRemove:      2,
+	nfs3ProcRmdir:       2,
+	nfs3ProcRename:      4,
+	nfs3ProcLink:        3,
+	nfs3ProcReaddir:     1,
+	nfs3ProcReaddirPlus: 1,
+	nfs3ProcFsstat:      1,
+	nfs3ProcFsinfo:      1,
+	nfs3ProcPathconf:    1,
+	nfs3ProcCommit:      2,
+}
+
+// nfs3Procs are the NFS v3 procedures.
+var nfs3Procs = map[uint32]nfsProc{
+	nfs3ProcGetAttr:  (*nfsd).getattr3,
+	nfs3ProcSetAttr:  (*nfsd).setattr3,
+	nfs3ProcLookup:   (*nfsd).lookup3,
+	nfs3ProcAccess:   (*nfsd).access3,
+	nfs3ProcReadlink: (*nfsd).readlink3,
+	nfs3ProcRead:     (*nfsd).read3,
+	nfs3ProcWrite:    (*nfsd).write3,
+	nfs3ProcCreate:   (*nfsd).create3,
+	nfs3ProcMkdir:    (*nfsd).mkdir3,
+	nfs3ProcSymlink:  (*nfsd).symlink3,
+	nfs3ProcMknod: func(d *nfsd, c *oncrpc.Call, w *xdr.Writer) error {
+		return nfs3ReplyErr(w, nfs3ProcMknod, nfs3ErrNotSupp)
+	},
+	nfs3ProcRemove: func(d *nfsd, c *oncrpc.Call, w *xdr.Writer) error {
+		return d.unlink3(c, w, syscall.Unlink)
+	},
+	nfs3ProcRmdir: func(d *nfsd, c *oncrpc.Call, w *xdr.Writer) error {
+		return d.unlink3(c, w, syscall.Rmdir)
+	},
+	nfs3ProcRename: (*nfsd).rename3,
+	nfs3ProcLink:   (*nfsd).link3,
+	nfs3ProcReaddir: func(d *nfsd, c *oncrpc.Call, w *xdr.Writer) error {
+		return d.readdir3(c, w, false)
+	},
+	nfs3ProcReaddirPlus: func(d *nfsd, c *oncrpc.Call, w *xdr.Writer) error {
+		return d.readdir3(c, w, true)
+	},
+	nfs3ProcFsstat:   (*nfsd).fsstat3,
+	nfs3ProcFsinfo:   (*nfsd).fsinfo3,
+	nfs3ProcPathconf: (*nfsd).pathconf3,
+	nfs3ProcCommit:   (*nfsd).commit3,
+}
+
+// nfs3ReplyErr answers proc with status and an empty failure body.
+func nfs3ReplyErr(w *xdr.Writer, proc, status uint32) error {
+	w.WriteUint32(status)
+	for i := 0; i < nfs3FailWords[proc]; i++ {
+		w.WriteUint32(0)
+	}
+	return nil
+}
+
+// readPath3 reads an nfs_fh3 and resolves it. ok is false when the argument
+// cannot be decoded; otherwise a non-zero status is the error to answer with.
+func (d *nfsd) readPath3(rr *xdr.Reader) (path string, status uint32, ok bool) {
+	fh, err := readFH(rr, nfsV3)
+	if err != nil {
+		return "", 0, false
+	}
+	if len(fh) > nfs3FHSize {
+		return "", nfs3ErrBadHandle, true
+	}
+	p, found := d.pathFor(fh)
+	if !found {
+		return "", nfsErrStale, true
+	}
+	return p, nfsOK, true
+}
+
+// readSattr3 decodes an NFS v3 sattr3, where each field is preceded by a
+// discriminant telling whether to set it.
+func readSattr3(rr *xdr.Reader) (sattr, error) {
+	a := sattr{mode: sattrUnset, uid: sattrUnset, gid: sattrUnset, size: sizeUnset}
+	for _, v := range []*uint32{&a.mode, &a.uid, &a.gid} {
+		set, err := rr.ReadBool()
+		if err != nil {
+			return a, err
+		}
+		if set {
+			if *v, err = rr.ReadUint32(); err != nil {
+				return a, err
+			}
+		}
+	}
+	set, err := rr.ReadBool()
+	if err != nil {
+		return a, err
+	}
+	if set {
+		if a.size, err = rr.ReadUint64(); err != nil {
+			return a, err
+		}
+	}
+	for _, t := range []*unix.Timespec{&a.atime, &a.mtime} {
+		how, err := rr.ReadUint32()
+		if err != nil {
+			return a, err
+		}
+		switch how {
+		case 1: // SET_TO_SERVER_TIME
+			*t = unix.Timespec{Nsec: unix.UTIME_NOW}
+		case 2: // SET_TO_CLIENT_TIME
+			sec, err := rr.ReadUint32()
+			if err != nil {
+				return a, err
+			}
+			nsec, err := rr.ReadUint32()
+			if err != nil {
+				return a, err
+			}
+			*t = unix.Timespec{Sec: int64(sec), Nsec: int64(nsec % 1e9)}
+		default: // DONT_CHANGE
+			*t = unix.Timespec{Nsec: unix.UTIME_OMIT}
+		}
+	}
+	return a, nil
+}
+
+func (d *nfsd) getattr3(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: object fh3
+	p, status, ok := d.readPath3(c.Args)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	if status != nfsOK {
+		return nfs3ReplyErr(w, nfs3ProcGetAttr, status)
+	}
+	a, err := d.export.attrs(p)
+	if err != nil {
+		return nfs3ReplyErr(w, nfs3ProcGetAttr, nfsStatus(err))
+	}
+	d.logf("nfsd v3 GETATTR %q", p)
+	w.WriteUint32(nfsOK)
+	writeNFSv3Fattr(w, a)
+	return nil
+}
+
+func (d *nfsd) setattr3(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: object fh3, new_attributes sattr3, guard sattrguard3
+	p, status, ok := d.readPath3(c.Args)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	a, err := readSattr3(c.Args)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	guarded, err := c.Args.ReadBool()
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	var ctime [2]uint32
+	if guarded {
+		if ctime[0], err = c.Args.ReadUint32(); err != nil {
+			return oncrpc.ErrGarbageArgs
+		}
+		if ctime[1], err = c.Args.ReadUint32(); err != nil {
+			return oncrpc.ErrGarbageArgs
+		}
+	}
+	if status == nfsOK {
+		status = nfsStatus(d.writable(p))
+	}
+	if status == nfsOK {
+		status = d.permitSetattr(p, a)
+	}
+	if status != nfsOK {
+		return nfs3ReplyErr(w, nfs3ProcSetAttr, status)
+	}
+	if guarded {
+		cur, err := statAttrs(p)
+		if err != nil {
+			return nfs3ReplyErr(w, nfs3ProcSetAttr, nfsStatus(err))
+		}
+		if uint32(cur.ctime.Unix()) != ctime[0] || uint32(cur.ctime.Nanosecond()) != ctime[1] {
+			return nfs3ReplyErr(w, nfs3ProcSetAttr, nfs3ErrNotSync)
+		}
+	}
+	if p, err = d.modifiable(p); err != nil {
+		return nfs3ReplyErr(w, nfs3ProcSetAttr, nfsStatus(err))
+	}
+	defer d.export.files.forget(p)
+	if err := a.apply(p); err != nil {
+		d.logf("nfsd v3 SETATTR %q: %v", p, err)
+		return nfs3ReplyErr(w, nfs3ProcSetAttr, nfsStatus(err))
+	}
+	d.logf("nfsd v3 SETATTR %q", p)
+	w.WriteUint32(nfsOK)
+	d.writeWccData(w, p)
+	return nil
+}
+
+func (d *nfsd) lookup3(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: what diropargs3
+	dir, status, ok := d.readPath3(c.Args)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	name, err := c.Args.ReadOpaque()
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	if status == nfsOK && len(name) > 255 {
+		status = nfsErrNameLong
+	}
+	if status != nfsOK {
+		return nfs3ReplyErr(w, nfs3ProcLookup, status)
+	}
+	if !d.export.SingleFile {
+		fi, err := os.Lstat(dir)
+		if err != nil {
+			return nfs3ReplyErr(w, nfs3ProcLookup, nfsStatus(err))
+		}
+		if !fi.IsDir() {
+			return nfs3ReplyErr(w, nfs3ProcLookup, nfsErrNotDir)
+		}
+	}
+	target, err := d.lookupPath(dir, string(name))
+	if err != nil {
+		d.logf("nfsd v3 LOOKUP %q in %q: %v", string(name), dir, err)
+		return nfs3ReplyErr(w, nfs3ProcLookup, nfsErrNoEnt)
+	}
+	if _, err := os.Lstat(target); err != nil {
+		return nfs3ReplyErr(w, nfs3ProcLookup, nfsStatus(err))
+	}
+	d.logf("nfsd v3 LOOKUP name=%q -> %q", string(name), target)
+	w.WriteUint32(nfsOK)
+	w.WriteOpaque(d.export.handle(target))
+	d.writePostOpAttr(w, target)
+	d.writePostOpAttr(w, dir)
+	return nil
+}
+
+func (d *nfsd) access3(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: object fh3, access uint32
+	p, status, ok := d.readPath3(c.Args)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	access, err := c.Args.ReadUint32()
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	if status != nfsOK {
+		return nfs3ReplyErr(w, nfs3ProcAccess, status)
+	}
+	a, err := d.export.attrs(p)
+	if err != nil {
+		return nfs3ReplyErr(w, nfs3ProcAccess, nfsStatus(err))
+	}
+	// Reads are not checked against the caller; changes need a writable
+	// export and write permission on the object.
+	granted := access & (access3Read | access3Lookup | access3Modify | access3Extend | access3Delete | access3Execute)
+	if d.writable(p) != nil || d.permitWrite(p) != nfsOK {
+		granted &^= access3Modify | access3Extend | access3Delete
+	}
+	if a.ftype != nfsTypeDir {
+		granted &^= access3Lookup | access3Delete
+	}
+	w.WriteUint32(nfsOK)
+	w.WriteBool(true)
+	writeNFSv3Fattr(w, a)
+	w.WriteUint32(granted)
+	return nil
+}
+
+func (d *nfsd) readlink3(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: symlink fh3
+	p, status, ok := d.readPath3(c.Args)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	if status != nfsOK {
+		return nfs3ReplyErr(w, nfs3ProcReadlink, status)
+	}
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return nfs3ReplyErr(w, nfs3ProcReadlink, nfsStatus(err))
+	}
+	if fi.Mode()&fs.ModeSymlink == 0 {
+		return nfs3ReplyErr(w, nfs3ProcReadlink, nfsErrInval)
+	}
+	target, err := os.Readlink(p)
+	if err != nil {
+		return nfs3ReplyErr(w, nfs3ProcReadlink, nfsStatus(err))
+	}
+	d.logf("nfsd v3 READLINK %q -> %q", p, target)
+	w.WriteUint32(nfsOK)
+	d.writePostOpAttr(w, p)
+	w.WriteOpaque([]byte(target))
+	return nil
+}
+
+func (d *nfsd) read3(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: file fh3, offset uint64, count uint32
+	p, status, ok := d.readPath3(c.Args)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	offset, err := c.Args.ReadUint64()
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	count, err := c.Args.ReadUint32()
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	if status != nfsOK {
+		return nfs3ReplyErr(w, nfs3ProcRead, status)
+	}
+	err = d.export.readFile(p, offset, int(min(count, nfs3MaxData)), func(data []byte, a fileAttrs) {
+		eof := offset+uint64(len(data)) >= a.size
+		d.logf("nfsd v3 READ %q off=%d count=%d -> %d bytes", p, offset, count, len(data))
+		w.WriteUint32(nfsOK)
+		attrs := newFattr3(a)
+		encode(w, postOpAttr{&attrs})
+		w.WriteUint32(uint32(len(data)))
+		w.WriteBool(eof)
+		w.WriteOpaque(data)
+	})
+	if err != nil {
+		return nfs3ReplyErr(w, nfs3ProcRead, nfsStatus(err))
+	}
+	return nil
+}
+
+func (d *nfsd) write3(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: file fh3, offset uint64, count uint32, stable stable_how, data opaque
+	p, status, ok := d.readPath3(c.Args)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	offset, err := c.Args.ReadUint64()
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	if _, err := c.Args.ReadUint32(); err != nil { // count, repeated by data
+		return oncrpc.ErrGarbageArgs
+	}
+	stable, err := c.Args.ReadUint32()
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	data, err := c.Args.ReadOpaque()
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	if status == nfsOK {
+		status = nfsStatus(d.writable(p))
+	}
+	if status == nfsOK {
+		status = d.permitWrite(p)
+	}
+	if status == nfsOK && (len(data) > nfs3MaxData || offset > math.MaxInt64) {
+		status = nfsErrFBig
+	}
+	if status != nfsOK {
+		return nfs3ReplyErr(w, nfs3ProcWrite, status)
+	}
+	if p, err = d.modifiable(p); err != nil {
+		return nfs3ReplyErr(w, nfs3ProcWrite, nfsStatus(err))
+	}
+	committed := uint32(writeFileSync)
+	if stable == writeUnstable {
+		committed = writeUnstable
+	}
+	defer d.export.files.forget(p)
+	if err := writeFile(p, int64(offset), data, committed != writeUnstable); err != nil {
+		d.logf("nfsd v3 WRITE %q: %v", p, err)
+		return nfs3ReplyErr(w, nfs3ProcWrite, nfsStatus(err))
+	}
+	d.logf("nfsd v3 WRITE %q off=%d count=%d stable=%d", p, offset, len(data), stable)
+	w.WriteUint32(nfsOK)
+	d.writeWccData(w, p)
+	w.WriteUint32(uint32(len(data)))
+	w.WriteUint32(committed)
+	w.WriteFixedOpaque(writeVerf[:])
+	return nil
+}
+
+// writeCreated finishes a CREATE, MKDIR or SYMLINK reply: the new object's
+// handle and attributes, then the directory's wcc_data.
+func (d *nfsd) writeCreated(w *xdr.Writer, p string) {
+	w.WriteBool(true)
+	w.WriteOpaque(d.export.handle(p))
+	d.writePostOpAttr(w, p)
+	d.writeWccData(w, filepath.Dir(p))
+}
+
+func (d *nfsd) create3(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: where diropargs3, how createhow3
+	p, status, ok := d.readDirOp(c.Args, nfsV3)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	mode, err := c.Args.ReadUint32()
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	var a sattr
+	var verf []byte
+	if mode == createExclusive {
+		if verf, err = c.Args.ReadFixed(8); err != nil {
+			return oncrpc.ErrGarbageArgs
+		}
+	} else if a, err = readSattr3(c.Args); err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	if status != nfsOK {
+		return nfs3ReplyErr(w, nfs3ProcCreate, status)
+	}
+	defer d.export.files.forget(p)
+	if err := d.copyUpAt(p); err != nil {
+		return nfs3ReplyErr(w, nfs3ProcCreate, nfsStatus(err))
+	}
+	switch mode {
+	case createUnchecked:
+		err = createFile(p, d.owned(a), 0)
+	case createGuarded:
+		err = createFile(p, d.owned(a), os.O_EXCL)
+	case createExclusive:
+		err = createExclusiveFile(p, verf, d.owned(keepSattr()))
+	default:
+		return oncrpc.ErrGarbageArgs
+	}
+	if err != nil {
+		d.logf("nfsd v3 CREATE %q: %v", p, err)
+		return nfs3ReplyErr(w, nfs3ProcCreate, nfsStatus(err))
+	}
+	d.logf("nfsd v3 CREATE %q mode=%d", p, mode)
+	w.WriteUint32(nfsOK)
+	d.writeCreated(w, p)
+	return nil
+}
+
+// createExclusiveFile implements EXCLUSIVE CREATE. The verifier is kept in
+// the file's atime and mtime, so a retransmitted CREATE finds its own file
+// and succeeds; the client sets the real attributes with SETATTR afterwards.
+// Only the owner is taken from a.
+func createExclusiveFile(p string, verf []byte, a sattr) error {
+	atime := int64(binary.BigEndian.Uint32(verf[0:4]))
+	mtime := int64(binary.BigEndian.Uint32(verf[4:8]))
+	a = sattr{mode: sattrUnset, uid: a.uid, gid: a.gid, size: sizeUnset,
+		atime: unix.Timespec{Sec: atime}, mtime: unix.Timespec{Sec: mtime}}
+	err := createFile(p, a, os.O_EXCL)
+	if errors.Is(err, fs.ErrExist) {
+		if cur, serr := statAttrs(p); serr == nil && cur.ftype == nfsTypeReg &&
+			cur.atime.Unix() == atime && cur.mtime.Unix() == mtime {
+			return nil
+		}
+	}
+	return err
+}
+
+func (d *nfsd) mkdir3(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: where diropargs3, attributes sattr3
+	p, status, ok := d.readDirOp(c.Args, nfsV3)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	a, err := readSattr3(c.Args)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	if status != nfsOK {
+		return nfs3ReplyErr(w, nfs3ProcMkdir, status)
+	}
+	if err := d.copyUpAt(p); err != nil {
+		return nfs3ReplyErr(w, nfs3ProcMkdir, nfsStatus(err))
+	}
+	if err := makeDir(p, d.owned(a)); err != nil {
+		d.logf("nfsd v3 MKDIR %q: %v", p, err)
+		return nfs3ReplyErr(w, nfs3ProcMkdir, nfsStatus(err))
+	}
+	d.logf("nfsd v3 MKDIR %q", p)
+	w.WriteUint32(nfsOK)
+	d.writeCreated(w, p)
+	return nil
+}
+
+func (d *nfsd) symlink3(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: where diropargs3, symlink symlinkdata3 (sattr3, path)
+	p, status, ok := d.readDirOp(c.Args, nfsV3)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	a, err := readSattr3(c.Args)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	target, err := c.Args.ReadOpaque()
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	if status == nfsOK && len(target) > 1024 {
+		status = nfsErrNameLong
+	}
+	if status != nfsOK {
+		return nfs3ReplyErr(w, nfs3ProcSymlink, status)
+	}
+	if err := d.copyUpAt(p); err != nil {
+		return nfs3ReplyErr(w, nfs3ProcSymlink, nfsStatus(err))
+	}
+	if err := makeSymlink(p, string(target), d.owned(a)); err != nil {
+		d.logf("nfsd v3 SYMLINK %q -> %q: %v", p, target, err)
+		return nfs3ReplyErr(w, nfs3ProcSymlink, nfsStatus(err))
+	}
+	d.logf("nfsd v3 SYMLINK %q -> %q", p, target)
+	w.WriteUint32(nfsOK)
+	d.writeCreated(w, p)
+	return nil
+}
+
+// unlink3 runs REMOVE or RMDIR, see unlink.
+func (d *nfsd) unlink3(c *oncrpc.Call, w *xdr.Writer, fn func(string) error) error {
+	// args: object diropargs3
+	p, status, ok := d.readDirOp(c.Args, nfsV3)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	if status != nfsOK {
+		return nfs3ReplyErr(w, c.Proc, status)
+	}
+	defer d.export.files.forget(p)
+	if err := d.unlinkPath(p, fn, c.Proc == nfs3ProcRmdir); err != nil {
+		d.logf("nfsd v3 unlink proc=%d %q: %v", c.Proc, p, err)
+		return nfs3ReplyErr(w, c.Proc, nfsStatus(err))
+	}
+	d.logf("nfsd v3 unlink proc=%d %q", c.Proc, p)
+	w.WriteUint32(nfsOK)
+	d.writeWccData(w, filepath.Dir(p))
+	return nil
+}
+
+func (d *nfsd) rename3(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: from diropargs3, to diropargs3
+	from, fromStatus, ok := d.readDirOp(c.Args, nfsV3)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	to, toStatus, ok := d.readDirOp(c.Args, nfsV3)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	if fromStatus != nfsOK {
+		return nfs3ReplyErr(w, nfs3ProcRename, fromStatus)
+	}
+	if toStatus != nfsOK {
+		return nfs3ReplyErr(w, nfs3ProcRename, toStatus)
+	}
+	defer d.export.files.forget(from)
+	defer d.export.files.forget(to)
+	if err := d.renamePath(from, to); err != nil {
+		d.logf("nfsd v3 RENAME %q -> %q: %v", from, to, err)
+		return nfs3ReplyErr(w, nfs3ProcRename, nfsStatus(err))
+	}
+	d.logf("nfsd v3 RENAME %q -> %q", from, to)
+	w.WriteUint32(nfsOK)
+	d.writeWccData(w, filepath.Dir(from))
+	d.writeWccData(w, filepath.Dir(to))
+	return nil
+}
+
+func (d *nfsd) link3(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: file fh3, link diropargs3
+	from, fromStatus, ok := d.readPath3(c.Args)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	to, status, ok := d.readDirOp(c.Args, nfsV3)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	if fromStatus != nfsOK {
+		status = fromStatus
+	}
+	if status == nfsOK && d.writable(from) != nil {
+		// See link: the source must be something the caller may change.
+		status = nfsErrXDev
+	}
+	if status != nfsOK {
+		return nfs3ReplyErr(w, nfs3ProcLink, status)
+	}
+	from, err := d.modifiable(from)
+	if err == nil {
+		err = d.copyUpAt(to)
+	}
+	if err != nil {
+		return nfs3ReplyErr(w, nfs3ProcLink, nfsStatus(err))
+	}
+	if err := os.Link(from, to); err != nil {
+		d.logf("nfsd v3 LINK %q -> %q: %v", from, to, err)
+		return nfs3ReplyErr(w, nfs3ProcLink, nfsStatus(err))
+	}
+	d.logf("nfsd v3 LINK %q -> %q", from, to)
+	w.WriteUint32(nfsOK)
+	d.writePostOpAttr(w, from)
+	d.writeWccData(w, filepath.Dir(to))
+	return nil
+}
+
+// readdir3 serves READDIR and, with plus set, READDIRPLUS. Cookies are
+// positions in listDir, as in NFS v2; the cookie verifier is unused.
+func (d *nfsd) readdir3(c *oncrpc.Call, w *xdr.Writer, plus bool) error {
+	// args: dir fh3, cookie uint64, cookieverf [8], count uint32
+	// (READDIRPLUS: dircount uint32, maxcount uint32)
+	proc, name := uint32(nfs3ProcReaddir), "READDIR"
+	if plus {
+		proc, name = nfs3ProcReaddirPlus, "READDIRPLUS"
+	}
+	dir, status, ok := d.readPath3(c.Args)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	cookie, err := c.Args.ReadUint64()
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	if _, err := c.Args.ReadFixed(8); err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	count, err := c.Args.ReadUint32()
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	dircount := count
+	if plus {
+		// count was dircount; maxcount bounds the reply
+		if count, err = c.Args.ReadUint32(); err != nil {
+			return oncrpc.ErrGarbageArgs
+		}
+	}
+	if status != nfsOK {
+		return nfs3ReplyErr(w, proc, status)
+	}
+	entries, err := d.listDir(dir)
+	if err != nil {
+		return nfs3ReplyErr(w, proc, nfsStatus(err))
+	}
+	// status, dir post_op_attr, cookieverf, list terminator and eof
+	budget := int(min(count, nfs3MaxData)) - (4 + 4 + fattr3Size + 8 + 8)
+	dirBudget := int(dircount)
+	list := xdr.NewWriter(nil)
+	i := int(min(cookie, uint64(len(entries))))
+	first := i
+	for ; i < len(entries); i++ {
+		e := entries[i]
+		nameSize := 4 + (len(e.name)+3)&^3
+		size := 4 + 8 + nameSize + 8
+		if plus {
+			dirSize := 8 + nameSize + 8
+			size += 4 + fattr3Size + 4 + 4 + nfs3FHSize
+			if dirSize > dirBudget {
+				break
+			}
+			dirBudget -= dirSize
+		}
+		if size > budget {
+			break
+		}
+		budget -= size
+		list.WriteBool(true)
+		list.WriteUint64(e.fileid)
+		list.WriteOpaque([]byte(e.name))
+		list.WriteUint64(uint64(i + 1))
+		if plus {
+			p, err := d.lookupPath(dir, e.name)
+			if err != nil {
+				p = dir
+			}
+			d.writePostOpAttr(list, p)
+			list.WriteBool(true)
+			list.WriteOpaque(d.export.handle(p))
+		}
+	}
+	if i == first && i < len(entries) {
+		return nfs3ReplyErr(w, proc, nfs3ErrTooSmall)
+	}
+	w.WriteUint32(nfsOK)
+	d.writePostOpAttr(w, dir)
+	w.WriteUint64(0) // cookieverf
+	w.WriteFixedOpaque(list.Bytes())
+	w.WriteBool(false)
+	w.WriteBool(i >= len(entries))
+	d.logf("nfsd v3 %s %q cookie=%d count=%d -> %d entries", name, dir, cookie, count, i-first)
+	return nil
+}
+
+func (d *nfsd) fsstat3(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: fsroot fh3
+	p, status, ok := d.readPath3(c.Args)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	if status != nfsOK {
+		return nfs3ReplyErr(w, nfs3ProcFsstat, status)
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(p, &st); err != nil {
+		return nfs3ReplyErr(w, nfs3ProcFsstat, nfsStatus(err))
+	}
+	bsize := uint64(st.Bsize)
+	w.WriteUint32(nfsOK)
+	d.writePostOpAttr(w, p)
+	w.WriteUint64(st.Blocks * bsize)
+	w.WriteUint64(st.Bfree * bsize)
+	w.WriteUint64(st.Bavail * bsize)
+	w.WriteUint64(st.Files)
+	w.WriteUint64(st.Ffree)
+	w.WriteUint64(st.Ffree)
+	w.WriteUint32(0) // invarsec: may change at any time
+	return nil
+}
+
+func (d *nfsd) fsinfo3(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: fsroot fh3
+	p, status, ok := d.readPath3(c.Args)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	if status != nfsOK {
+		return nfs3ReplyErr(w, nfs3ProcFsinfo, status)
+	}
+	w.WriteUint32(nfsOK)
+	d.writePostOpAttr(w, p)
+	w.WriteUint32(nfs3MaxData) // rtmax
+	w.WriteUint32(nfs3MaxData) // rtpref
+	w.WriteUint32(4096)        // rtmult
+	w.WriteUint32(nfs3MaxData) // wtmax
+	w.WriteUint32(nfs3MaxData) // wtpref
+	w.WriteUint32(4096)        // wtmult
+	w.WriteUint32(nfsMaxData)  // dtpref
+	w.WriteUint64(math.MaxInt64)
+	w.WriteUint32(0) // time_delta: nanosecond timestamps
+	w.WriteUint32(1)
+	// FSF3_LINK | FSF3_SYMLINK | FSF3_HOMOGENEOUS | FSF3_CANSETTIME
+	w.WriteUint32(0x1 | 0x2 | 0x8 | 0x10)
+	return nil
+}
+
+func (d *nfsd) pathconf3(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: object fh3
+	p, status, ok := d.readPath3(c.Args)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	if status != nfsOK {
+		return nfs3ReplyErr(w, nfs3ProcPathconf, status)
+	}
+	w.WriteUint32(nfsOK)
+	d.writePostOpAttr(w, p)
+	w.WriteUint32(65000) // linkmax
+	w.WriteUint32(255)   // name_max
+	w.WriteBool(true)    // no_trunc
+	w.WriteBool(true)    // chown_restricted
+	w.WriteBool(false)   // case_insensitive
+	w.WriteBool(true)    // case_preserving
+	return nil
+}
+
+func (d *nfsd) commit3(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: file fh3, offset uint64, count uint32
+	p, status, ok := d.readPath3(c.Args)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	if _, err := c.Args.ReadUint64(); err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	if _, err := c.Args.ReadUint32(); err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	if status == nfsOK {
+		status = nfsStatus(d.writable(p))
+	}
+	if status != nfsOK {
+		return nfs3ReplyErr(w, nfs3ProcCommit, status)
+	}
+	// Only a regular file is copied up and synced; anything else has
+	// nothing to commit.
+	fi, err := os.Lstat(p)
+	if err == nil && !fi.Mode().IsRegular() {
+		err = syscall.EINVAL
+	}
+	if err == nil {
+		p, err = d.modifiable(p)
+	}
+	if err == nil {
+		err = syncFile(p)
+	}
+	if err != nil {
+		return nfs3ReplyErr(w, nfs3ProcCommit, nfsStatus(err))
+	}
+	w.WriteUint32(nfsOK)
+	d.writeWccData(w, p)
+	w.WriteFixedOpaque(writeVerf[:])
+	return nil
+}
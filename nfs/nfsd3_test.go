@@ -0,0 +1,353 @@
+package nfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"ofw-install-server/oncrpc"
+	"ofw-install-server/xdr"
+)
+
+// nfs3Call runs one NFS v3 call through d as root and returns the NFS status and the
+// reader positioned after it.
+func nfs3Call(t *testing.T, d *nfsd, proc uint32, args *xdr.Writer) (uint32, *xdr.Reader) {
+	t.Helper()
+	req := buildUnixRPCCall(1, nfsProgram, nfsV3, proc, 0, 0)
+	req = append(req, args.Bytes()...)
+	resp := d.handle(req, nil)
+	if len(resp) < 28 || binary.BigEndian.Uint32(resp[20:24]) != 0 {
+		t.Fatalf("v3 proc %d: not an accepted reply: %x", proc, resp)
+	}
+	r := xdr.NewReader(resp[24:])
+	status, _ := r.ReadUint32()
+	return status, r
+}
+
+func fh3Args(fh []byte) *xdr.Writer {
+	w := xdr.NewWriter(nil)
+	w.WriteOpaque(fh)
+	return w
+}
+
+func dirop3Args(dir []byte, name string) *xdr.Writer {
+	w := fh3Args(dir)
+	w.WriteOpaque([]byte(name))
+	return w
+}
+
+func TestNFSDVersionMismatch(t *testing.T) {
+	d := &nfsd{export: &Export{Root: t.TempDir()}}
+	resp := d.handle(buildMinimalRPCCall(1, nfsProgram, 4, nfsProcNull), nil)
+	r := xdr.NewReader(resp[8:])
+	stat, _ := r.ReadUint32()
+	r.Skip(8) // verf
+	accept, _ := r.ReadUint32()
+	low, _ := r.ReadUint32()
+	high, _ := r.ReadUint32()
+	if stat != 0 || accept != 2 || low != nfsV2 || high != nfsV3 {
+		t.Fatalf("v4 call: reply_stat=%d accept_stat=%d versions %d-%d", stat, accept, low, high)
+	}
+}
+
+func TestNFSDv3LargeFile(t *testing.T) {
+	root := t.TempDir()
+	big := filepath.Join(root, "swap")
+	if err := os.WriteFile(big, nil, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	// sparse 5 GiB file, beyond NFS v2 sizes
+	if err := os.Truncate(big, 5<<30); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	export.Writable = true
+	export.Clients = []ClientRule{{}} // all,rw,no_root_squash
+	d := &nfsd{export: export}
+	rootFH := export.handle(export.Root)
+
+	status, r := nfs3Call(t, d, nfs3ProcLookup, dirop3Args(rootFH, "swap"))
+	if status != nfsOK {
+		t.Fatalf("LOOKUP status=%d", status)
+	}
+	fh, _ := r.ReadOpaque()
+	if follows, _ := r.ReadBool(); !follows {
+		t.Fatalf("LOOKUP without attributes")
+	}
+	r.Skip(5 * 4)
+	if size, _ := r.ReadUint64(); size != 5<<30 {
+		t.Fatalf("fattr3 size=%d, want %d", size, int64(5<<30))
+	}
+
+	// WRITE past 4 GiB, then READ it back
+	args := fh3Args(fh)
+	args.WriteUint64(5<<30 - 4)
+	args.WriteUint32(4)
+	args.WriteUint32(writeFileSync)
+	args.WriteOpaque([]byte("tail"))
+	status, r = nfs3Call(t, d, nfs3ProcWrite, args)
+	if status != nfsOK {
+		t.Fatalf("WRITE status=%d", status)
+	}
+	r.Skip(4 + 4 + fattr3Size) // wcc_data
+	if n, _ := r.ReadUint32(); n != 4 {
+		t.Fatalf("WRITE count=%d", n)
+	}
+	args = fh3Args(fh)
+	args.WriteUint64(5<<30 - 4)
+	args.WriteUint32(100)
+	status, r = nfs3Call(t, d, nfs3ProcRead, args)
+	if status != nfsOK {
+		t.Fatalf("READ status=%d", status)
+	}
+	r.Skip(4 + fattr3Size)
+	r.ReadUint32() // count
+	eof, _ := r.ReadBool()
+	if data, _ := r.ReadOpaque(); string(data) != "tail" || !eof {
+		t.Fatalf("READ data=%q eof=%v", data, eof)
+	}
+}
+
+func TestNFSDv3CreateAndReaddirPlus(t *testing.T) {
+	root := t.TempDir()
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	export.Writable = true
+	export.Clients = []ClientRule{{}} // all,rw,no_root_squash
+	d := &nfsd{export: export}
+	rootFH := export.handle(export.Root)
+
+	args := dirop3Args(rootFH, "vmunix")
+	args.WriteUint32(createGuarded)
+	for i := 0; i < 6; i++ { // sattr3: nothing set
+		args.WriteUint32(0)
+	}
+	if status, _ := nfs3Call(t, d, nfs3ProcCreate, args); status != nfsOK {
+		t.Fatalf("CREATE status=%d", status)
+	}
+	if status, _ := nfs3Call(t, d, nfs3ProcCreate, args); status != nfsErrExist {
+		t.Fatalf("GUARDED CREATE of an existing file status=%d", status)
+	}
+	args = dirop3Args(rootFH, "verf")
+	args.WriteUint32(createExclusive)
+	args.WriteFixedOpaque([]byte{0, 0, 1, 0, 0, 0, 2, 0})
+	for i := 0; i < 2; i++ { // a retransmitted EXCLUSIVE CREATE succeeds
+		if status, _ := nfs3Call(t, d, nfs3ProcCreate, args); status != nfsOK {
+			t.Fatalf("EXCLUSIVE CREATE #%d status=%d", i, status)
+		}
+	}
+
+	args = fh3Args(rootFH)
+	args.WriteUint64(0)
+	args.WriteFixedOpaque(make([]byte, 8))
+	args.WriteUint32(1024)
+	args.WriteUint32(4096)
+	status, r := nfs3Call(t, d, nfs3ProcReaddirPlus, args)
+	if status != nfsOK {
+		t.Fatalf("READDIRPLUS status=%d", status)
+	}
+	r.Skip(4 + fattr3Size + 8)
+	names := map[string]bool{}
+	for {
+		follows, _ := r.ReadBool()
+		if !follows {
+			break
+		}
+		r.ReadUint64()
+		name, _ := r.ReadOpaque()
+		names[string(name)] = true
+		r.ReadUint64() // cookie
+		if attrs, _ := r.ReadBool(); !attrs {
+			t.Fatalf("entry %q without attributes", name)
+		}
+		r.Skip(fattr3Size)
+		if hasFH, _ := r.ReadBool(); !hasFH {
+			t.Fatalf("entry %q without handle", name)
+		}
+		r.ReadOpaque()
+	}
+	if eof, _ := r.ReadBool(); !eof || !names["vmunix"] || !names["verf"] || !names[".."] {
+		t.Fatalf("READDIRPLUS names=%v eof=%v", names, eof)
+	}
+
+	status, r = nfs3Call(t, d, nfs3ProcFsinfo, fh3Args(rootFH))
+	if status != nfsOK {
+		t.Fatalf("FSINFO status=%d", status)
+	}
+	r.Skip(4 + fattr3Size)
+	if rtmax, _ := r.ReadUint32(); rtmax != nfs3MaxData {
+		t.Fatalf("FSINFO rtmax=%d", rtmax)
+	}
+	if status, _ := nfs3Call(t, d, nfs3ProcGetAttr, fh3Args(make([]byte, 65))); status != nfs3ErrBadHandle {
+		t.Fatalf("GETATTR of a 65-byte handle status=%d", status)
+	}
+}
+
+// readRamdisk reads file over NFS v3 from the server at addr in chunks of
+// size, as a client loading its ramdisk does.
+func readRamdisk(addr string, fh []byte, size int, xid uint32) ([]byte, error) {
+	var data []byte
+	for {
+		args := fh3Args(fh)
+		args.WriteUint64(uint64(len(data)))
+		args.WriteUint32(uint32(size))
+		xid++
+		c := &oncrpc.Call{XID: xid, Prog: nfsProgram, Vers: nfsV3, Proc: nfs3ProcRead}
+		res, err := oncrpc.CallUDP(addr, c, args.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		r := xdr.NewReader(res)
+		if status, _ := r.ReadUint32(); status != nfsOK {
+			return nil, fmt.Errorf("READ status %d", status)
+		}
+		r.Skip(4 + fattr3Size + 4) // post_op_attr, count
+		eof, _ := r.ReadBool()
+		chunk, err := r.ReadOpaque()
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+		if eof {
+			return data, nil
+		}
+	}
+}
+
+func TestNFSDv3ConcurrentReaders(t *testing.T) {
+	root := t.TempDir()
+	ramdisk := make([]byte, 1<<20)
+	for i := range ramdisk {
+		ramdisk[i] = byte(i * 7)
+	}
+	if err := os.WriteFile(filepath.Join(root, "bsd.rd"), ramdisk, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	pc, err := StartNFSD("127.0.0.1:0", export, nil, nil)
+	if err != nil {
+		t.Fatalf("StartNFSD: %v", err)
+	}
+	defer pc.Close()
+	fh := export.handle(filepath.Join(root, "bsd.rd"))
+
+	const readers = 8
+	var wg sync.WaitGroup
+	for i := range readers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := readRamdisk(pc.LocalAddr().String(), fh, 8192, uint32(i)<<24)
+			if err != nil || !bytes.Equal(data, ramdisk) {
+				t.Errorf("reader %d: %d bytes, %v", i, len(data), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func BenchmarkNFSDv3Read(b *testing.B) {
+	root := b.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "bsd.rd"), make([]byte, 256<<10), 0o644); err != nil {
+		b.Fatalf("write: %v", err)
+	}
+	export, _ := NewExport(root)
+	fh := export.handle(filepath.Join(root, "bsd.rd"))
+	for _, readers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("readers=%d", readers), func(b *testing.B) {
+			pc, err := StartNFSD("127.0.0.1:0", export, nil, nil)
+			if err != nil {
+				b.Fatalf("StartNFSD: %v", err)
+			}
+			defer pc.Close()
+			var xid atomic.Uint32
+			b.SetBytes(256 << 10)
+			b.SetParallelism(readers)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := readRamdisk(pc.LocalAddr().String(), fh, 8192, xid.Add(1<<16)); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestNFSDv3RetransmittedRemove(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "core"), nil, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	export.Writable = true
+	export.Clients = []ClientRule{{}} // all,rw,no_root_squash
+	s := newNFSServer(export, nil)
+	req := append(buildUnixRPCCall(9, nfsProgram, nfsV3, nfs3ProcRemove, 0, 0), dirop3Args(export.handle(root), "core").Bytes()...)
+	from := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 5), Port: 800}
+	first := s.Handle(req, from)
+	if stat, r := acceptStat(t, first); stat != oncrpc.AcceptSuccess {
+		t.Fatalf("REMOVE accept_stat %d", stat)
+	} else if status, _ := r.ReadUint32(); status != nfsOK {
+		t.Fatalf("REMOVE status %d", status)
+	}
+	// The reply got lost: the retransmission must not answer NOENT.
+	if again := s.Handle(req, from); !bytes.Equal(again, first) {
+		t.Fatalf("retransmitted REMOVE answered %x, first %x", again, first)
+	}
+}
+
+func TestNFSDv3CommitRegularOnly(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "core"), []byte("core"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Symlink("core", filepath.Join(root, "link")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(root, "fifo"), 0o644); err != nil {
+		t.Fatalf("mkfifo: %v", err)
+	}
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	export.Writable = true
+	export.Clients = []ClientRule{{}} // all,rw,no_root_squash
+	d := &nfsd{export: export}
+	commit := func(name string) uint32 {
+		args := fh3Args(export.handle(filepath.Join(root, name)))
+		args.WriteUint64(0)
+		args.WriteUint32(0)
+		status, _ := nfs3Call(t, d, nfs3ProcCommit, args)
+		return status
+	}
+	if status := commit("core"); status != nfsOK {
+		t.Fatalf("COMMIT of a file status=%d", status)
+	}
+	// A symlink is not followed, and a FIFO is not opened to block on.
+	for _, name := range []string{"link", "fifo"} {
+		if status := commit(name); status != nfsErrInval {
+			t.Fatalf("COMMIT of %s status=%d", name, status)
+		}
+	}
+}
@@ -1,8 +1,15 @@
 package nfs
 
 import (
+	"encoding/binary"
+	"fmt"
 	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
+
+	"ofw-install-server/xdr"
 )
 
 func TestWriteNFSv2Fattr(t *testing.T) {
@@ -12,10 +19,299 @@ func TestWriteNFSv2Fattr(t *testing.T) {
 	}
 	defer os.Remove(f.Name())
 	defer f.Close()
+	if _, err := f.Write(make([]byte, 10000)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Chtimes(f.Name(), time.Unix(1000, 5000), time.Unix(2000, 7000)); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+
+	a, err := statAttrs(f.Name())
+	if err != nil {
+		t.Fatalf("statAttrs: %v", err)
+	}
+	w := xdr.NewWriter(nil)
+	writeNFSV2Fattr(w, a)
+	if len(w.Bytes()) != 17*4 {
+		t.Fatalf("fattr is %d bytes", len(w.Bytes()))
+	}
+	var got [17]uint32
+	for i := range got {
+		got[i] = binary.BigEndian.Uint32(w.Bytes()[i*4:])
+	}
+	fi, _ := os.Stat(f.Name())
+	st := fi.Sys().(*syscall.Stat_t)
+	want := map[int]uint32{
+		0:  1, // NFREG
+		1:  st.Mode,
+		2:  uint32(st.Nlink),
+		3:  st.Uid,
+		4:  st.Gid,
+		5:  10000,
+		6:  uint32(st.Blksize),
+		8:  uint32((st.Blocks*512 + st.Blksize - 1) / st.Blksize),
+		9:  uint32(st.Dev),
+		10: uint32(st.Ino),
+		11: 1000, // atime
+		12: 5,
+		13: 2000, // mtime
+		14: 7,
+		15: uint32(st.Ctim.Sec),
+	}
+	for i, v := range want {
+		if got[i] != v {
+			t.Errorf("fattr word %d = %d, want %d", i, got[i], v)
+		}
+	}
+}
+
+func TestExportAttrsSquash(t *testing.T) {
+	root := t.TempDir()
+	export := &Export{Root: root, AllSquash: true, AnonUID: 65534, AnonGID: 65533}
+	a, err := export.attrs(root)
+	if err != nil {
+		t.Fatalf("attrs: %v", err)
+	}
+	fi, _ := os.Stat(root)
+	st := fi.Sys().(*syscall.Stat_t)
+	if a.uid != 65534 || a.gid != 65533 || a.fileid != st.Ino || a.ftype != nfsTypeDir || a.mode != st.Mode {
+		t.Fatalf("attrs %+v", a)
+	}
+	w := xdr.NewWriter(nil)
+	writeNFSv3Fattr(w, a)
+	r := xdr.NewReader(w.Bytes()[4:])
+	if mode, _ := r.ReadUint32(); mode != st.Mode&07777 {
+		t.Fatalf("fattr3 mode %o", mode)
+	}
+	r = xdr.NewReader(w.Bytes()[52:])
+	if fileid, _ := r.ReadUint64(); fileid != st.Ino {
+		t.Fatalf("fattr3 fileid %d, want %d", fileid, st.Ino)
+	}
+	r = xdr.NewReader(w.Bytes()[68:])
+	sec, _ := r.ReadUint32()
+	nsec, _ := r.ReadUint32()
+	if int64(sec) != st.Mtim.Sec || int64(nsec) != st.Mtim.Nsec {
+		t.Fatalf("fattr3 mtime %d.%09d, want %d.%09d", sec, nsec, st.Mtim.Sec, st.Mtim.Nsec)
+	}
+}
+
+// nfsCall runs one NFS v2 call through d as root and returns the NFS status and the
+// reader positioned after it.
+func nfsCall(t *testing.T, d *nfsd, proc uint32, args *xdr.Writer) (uint32, *xdr.Reader) {
+	t.Helper()
+	req := buildUnixRPCCall(1, nfsProgram, nfsV2, proc, 0, 0)
+	req = append(req, args.Bytes()...)
+	resp := d.handle(req, nil)
+	if len(resp) < 28 || binary.BigEndian.Uint32(resp[20:24]) != 0 {
+		t.Fatalf("proc %d: not an accepted reply: %x", proc, resp)
+	}
+	r := xdr.NewReader(resp[24:])
+	status, _ := r.ReadUint32()
+	return status, r
+}
+
+func lookupArgs(dir []byte, name string) *xdr.Writer {
+	w := xdr.NewWriter(nil)
+	w.WriteFixedOpaque(dir)
+	w.WriteOpaque([]byte(name))
+	return w
+}
+
+func TestNFSDExportTree(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "sparc64"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "sparc64", "netbsd"), []byte("kernel-bytes"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	d := &nfsd{export: export}
+	rootFH := export.handle(export.Root)
+
+	status, r := nfsCall(t, d, nfsProcLookup, lookupArgs(rootFH, "sparc64"))
+	if status != nfsOK {
+		t.Fatalf("LOOKUP sparc64 status=%d", status)
+	}
+	dirFH, _ := r.ReadFixed(32)
+	if ftype, _ := r.ReadUint32(); ftype != 2 {
+		t.Fatalf("sparc64 ftype=%d, want directory", ftype)
+	}
+	if status, _ := nfsCall(t, d, nfsProcLookup, lookupArgs(dirFH, "missing")); status != nfsErrNoEnt {
+		t.Fatalf("LOOKUP missing status=%d", status)
+	}
+	status, r = nfsCall(t, d, nfsProcLookup, lookupArgs(dirFH, "netbsd"))
+	if status != nfsOK {
+		t.Fatalf("LOOKUP netbsd status=%d", status)
+	}
+	fileFH, _ := r.ReadFixed(32)
+	if status, _ := nfsCall(t, d, nfsProcLookup, lookupArgs(fileFH, "x")); status != nfsErrNotDir {
+		t.Fatalf("LOOKUP in a file status=%d", status)
+	}
 
-	w := &xdrWriter{}
-	writeNFSV2Fattr(w, f.Name())
-	if len(w.b) == 0 {
-		t.Fatalf("expected some bytes written")
+	args := xdr.NewWriter(nil)
+	args.WriteFixedOpaque(fileFH)
+	args.WriteUint32(7)  // offset
+	args.WriteUint32(64) // count
+	args.WriteUint32(0)
+	status, r = nfsCall(t, d, nfsProcRead, args)
+	if status != nfsOK {
+		t.Fatalf("READ status=%d", status)
+	}
+	r.Skip(17 * 4) // fattr
+	if data, _ := r.ReadOpaque(); string(data) != "bytes" {
+		t.Fatalf("READ data=%q", data)
+	}
+
+	args = xdr.NewWriter(nil)
+	args.WriteFixedOpaque(dirFH)
+	args.WriteUint32(0)
+	args.WriteUint32(64)
+	args.WriteUint32(0)
+	if status, _ := nfsCall(t, d, nfsProcRead, args); status != nfsErrIsDir {
+		t.Fatalf("READ of a directory status=%d", status)
+	}
+
+	stale := make([]byte, 32)
+	stale[0] = 0xff
+	args = xdr.NewWriter(nil)
+	args.WriteFixedOpaque(stale)
+	if status, _ := nfsCall(t, d, nfsProcGetAttr, args); status != nfsErrStale {
+		t.Fatalf("GETATTR unknown handle status=%d", status)
+	}
+}
+
+func TestNFSDSingleFileCompat(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "bsd.rd")
+	if err := os.WriteFile(f, []byte("ramdisk"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	export, err := NewExport(f)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	d := &nfsd{export: export}
+	status, r := nfsCall(t, d, nfsProcLookup, lookupArgs(make([]byte, 32), "whatever"))
+	if status != nfsOK {
+		t.Fatalf("LOOKUP status=%d", status)
+	}
+	fh, _ := r.ReadFixed(32)
+	args := xdr.NewWriter(nil)
+	args.WriteFixedOpaque(fh)
+	args.WriteUint32(0)
+	args.WriteUint32(100)
+	args.WriteUint32(0)
+	status, r = nfsCall(t, d, nfsProcRead, args)
+	r.Skip(17 * 4)
+	if data, _ := r.ReadOpaque(); status != nfsOK || string(data) != "ramdisk" {
+		t.Fatalf("READ status=%d data=%q", status, data)
+	}
+}
+
+func TestNFSDReaddirPaging(t *testing.T) {
+	root := t.TempDir()
+	want := map[string]bool{".": true, "..": true}
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("file-with-a-longish-name-%02d", i)
+		if err := os.WriteFile(filepath.Join(root, name), nil, 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		want[name] = true
+	}
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	d := &nfsd{export: export}
+	rootFH := export.handle(export.Root)
+
+	seen := map[string]bool{}
+	var cookie uint32
+	for calls := 0; ; calls++ {
+		if calls > 20 {
+			t.Fatalf("READDIR did not reach eof")
+		}
+		args := xdr.NewWriter(nil)
+		args.WriteFixedOpaque(rootFH)
+		args.WriteUint32(cookie)
+		args.WriteUint32(512)
+		status, r := nfsCall(t, d, nfsProcReaddir, args)
+		if status != nfsOK {
+			t.Fatalf("READDIR status=%d", status)
+		}
+		if size := len(r.Remaining()); size > 512 {
+			t.Fatalf("READDIR reply carries %d bytes, count was 512", size)
+		}
+		for {
+			follows, _ := r.ReadUint32()
+			if follows == 0 {
+				break
+			}
+			r.ReadUint32() // fileid
+			name, _ := r.ReadOpaque()
+			if seen[string(name)] {
+				t.Fatalf("entry %q returned twice", name)
+			}
+			seen[string(name)] = true
+			cookie, _ = r.ReadUint32()
+		}
+		if eof, _ := r.ReadUint32(); eof == 1 {
+			break
+		}
+	}
+	if len(seen) != len(want) {
+		t.Fatalf("READDIR returned %d entries, want %d", len(seen), len(want))
+	}
+	for name := range want {
+		if !seen[name] {
+			t.Fatalf("READDIR missing %q", name)
+		}
+	}
+}
+
+func TestNFSDSymlinkAndStatfs(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Symlink("sparc64/netbsd", filepath.Join(root, "netbsd")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	d := &nfsd{export: export}
+	rootFH := export.handle(export.Root)
+
+	status, r := nfsCall(t, d, nfsProcLookup, lookupArgs(rootFH, "netbsd"))
+	if status != nfsOK {
+		t.Fatalf("LOOKUP status=%d", status)
+	}
+	linkFH, _ := r.ReadFixed(32)
+	if ftype, _ := r.ReadUint32(); ftype != 5 {
+		t.Fatalf("symlink ftype=%d, want NFLNK", ftype)
+	}
+	args := xdr.NewWriter(nil)
+	args.WriteFixedOpaque(linkFH)
+	status, r = nfsCall(t, d, nfsProcReadlink, args)
+	if target, _ := r.ReadOpaque(); status != nfsOK || string(target) != "sparc64/netbsd" {
+		t.Fatalf("READLINK status=%d target=%q", status, target)
+	}
+	args = xdr.NewWriter(nil)
+	args.WriteFixedOpaque(rootFH)
+	if status, _ := nfsCall(t, d, nfsProcReadlink, args); status != nfsErrInval {
+		t.Fatalf("READLINK of a directory status=%d", status)
+	}
+
+	status, r = nfsCall(t, d, nfsProcStatfs, args)
+	if status != nfsOK {
+		t.Fatalf("STATFS status=%d", status)
+	}
+	tsize, _ := r.ReadUint32()
+	bsize, _ := r.ReadUint32()
+	blocks, _ := r.ReadUint32()
+	if tsize != nfsMaxData || bsize == 0 || blocks == 0 {
+		t.Fatalf("STATFS tsize=%d bsize=%d blocks=%d", tsize, bsize, blocks)
 	}
 }
@@ -1,35 +1,346 @@
 package nfs
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
 	"path/filepath"
-	"sync"
+	"strings"
+	"syscall"
+	"time"
 )
 
-var (
-	fhMu     sync.Mutex
-	fhToPath = make(map[string]string)
+// File handles are self-describing so they survive a server restart:
+//
+//	[0]      handle format version
+//	[1]      depth of the object below the export root
+//	[2:4]    export id, from the export root path and the exported
+//	         directory the object is below, which lookups do not leave
+//	[4:12]   inode number
+//	[12:16]  low 32 bits of the device number
+//	[16:24]  low byte of the inode of each of the first 8 path components
+//	[24:32]  HMAC-SHA256 of bytes 0-23, truncated
+//
+// Resolving a handle walks down from the export root following the inode
+// trail, so no server state is needed; a cache only saves the walk. The same
+// 32 bytes serve as NFS v2 fhandle and NFS v3 nfs_fh3.
+const (
+	fhSize    = 32
+	fhVersion = 1
+	fhTrail   = 8
+	// fhMaxCandidates bounds the directories examined per level when the
+	// trail is ambiguous.
+	fhMaxCandidates = 4096
+	// fhMaxSearch bounds the entries examined looking for a renamed object.
+	fhMaxSearch = 1 << 16
+	// fhMissTTL is how long a handle that resolved to nothing is answered
+	// stale without looking again, and fhMaxMisses bounds how many are kept.
+	fhMissTTL   = 30 * time.Second
+	fhMaxMisses = 1024
+	// fhMaxHandles bounds the handle -> path cache; a handle dropped from
+	// it is found again through its trail.
+	fhMaxHandles = 1 << 14
 )
 
-func normalizePath(p string) string {
-	return filepath.Clean(p)
+var errStaleHandle = errors.New("stale file handle")
+
+// LoadHandleKey reads the key that signs file handles from path, creating
+// it and its directory with a random key, readable by root only, if it does
+// not exist. Keeping the key in a file lets handles stay valid across
+// restarts even if the export moves.
+func LoadHandleKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err == nil {
+		if len(key) < 16 {
+			return nil, errors.New("handle key " + path + " is shorter than 16 bytes")
+		}
+		return key, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	key, err = newHandleKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(key); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return key, f.Close()
+}
+
+func newHandleKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// handleKey returns HandleKey, making a random one if it is empty: handles
+// must not be made by anyone who knows the export path.
+func (e *Export) handleKey() []byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.HandleKey) == 0 {
+		key, err := newHandleKey()
+		if err != nil {
+			panic("nfs: no random handle key: " + err.Error())
+		}
+		e.HandleKey = key
+	}
+	return e.HandleKey
+}
+
+func (e *Export) handleMAC(fh []byte) []byte {
+	m := hmac.New(sha256.New, e.handleKey())
+	m.Write(fh[:24])
+	return m.Sum(nil)[:8]
+}
+
+// id returns the export id of the handles of objects below dirpath, one of
+// the served directories.
+func (e *Export) id(dirpath string) uint16 {
+	sum := sha256.Sum256([]byte(e.Root + "\x00" + dirpath))
+	return binary.BigEndian.Uint16(sum[:2])
+}
+
+// exportByID returns the served directory of export id id.
+func (e *Export) exportByID(id uint16) (string, bool) {
+	for _, dirpath := range e.served() {
+		if e.id(dirpath) == id {
+			return dirpath, true
+		}
+	}
+	return "", false
+}
+
+// handle returns the file handle of p. Paths that cannot be stat'ed, or
+// are not served, get an all-zero handle, which never resolves.
+func (e *Export) handle(p string) []byte {
+	fh := make([]byte, fhSize)
+	rel, err := filepath.Rel(e.Root, p)
+	if err != nil || !e.contains(p) {
+		return fh
+	}
+	dirpath, ok := e.exportOf(p)
+	if !ok {
+		return fh
+	}
+	var parts []string
+	if rel != "." {
+		parts = strings.Split(rel, string(filepath.Separator))
+	}
+	if len(parts) > 255 {
+		return fh
+	}
+	ino, dev, err := inodeOf(p)
+	if err != nil {
+		return fh
+	}
+	cur := e.Root
+	for i, name := range parts[:min(len(parts), fhTrail)] {
+		cur = filepath.Join(cur, name)
+		cino, _, err := inodeOf(cur)
+		if err != nil {
+			return make([]byte, fhSize)
+		}
+		fh[16+i] = byte(cino)
+	}
+	fh[0] = fhVersion
+	fh[1] = byte(len(parts))
+	binary.BigEndian.PutUint16(fh[2:4], e.id(dirpath))
+	binary.BigEndian.PutUint64(fh[4:12], ino)
+	binary.BigEndian.PutUint32(fh[12:16], dev)
+	copy(fh[24:], e.handleMAC(fh))
+	e.remember(fh, p)
+	return fh
+}
+
+// resolve returns the path fh stands for, or errStaleHandle when it does not
+// belong to this export, its object no longer exists or has left the
+// exported directory it was below.
+func (e *Export) resolve(fh []byte) (string, error) {
+	if len(fh) != fhSize || fh[0] != fhVersion {
+		return "", errStaleHandle
+	}
+	dirpath, ok := e.exportByID(binary.BigEndian.Uint16(fh[2:4]))
+	if !ok || !hmac.Equal(fh[24:], e.handleMAC(fh)) {
+		return "", errStaleHandle
+	}
+	top := filepath.Join(e.Root, dirpath)
+	ino := binary.BigEndian.Uint64(fh[4:12])
+	dev := binary.BigEndian.Uint32(fh[12:16])
+	e.mu.Lock()
+	p, ok := e.handles[string(fh)]
+	missed, miss := e.misses[string(fh)]
+	e.mu.Unlock()
+	if _, in := within(top, p); ok && in && isInode(p, ino, dev) {
+		return p, nil
+	}
+	if miss && time.Since(missed) < fhMissTTL {
+		return "", errStaleHandle
+	}
+	p, ok = e.walkTrail(fh, ino, dev)
+	if !ok {
+		// Renamed since the handle was issued: look everywhere.
+		if p, ok = e.search(ino, dev); !ok {
+			e.missed(fh)
+			return "", errStaleHandle
+		}
+	}
+	if _, in := within(top, p); !in {
+		return "", errStaleHandle
+	}
+	e.remember(fh, p)
+	return p, nil
+}
+
+// missed records that fh resolved to nothing, so that clients retrying it
+// do not make the export be searched again and again.
+func (e *Export) missed(fh []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	if len(e.misses) >= fhMaxMisses {
+		for k, t := range e.misses {
+			if now.Sub(t) >= fhMissTTL {
+				delete(e.misses, k)
+			}
+		}
+	}
+	if len(e.misses) >= fhMaxMisses {
+		clear(e.misses)
+	}
+	if e.misses == nil {
+		e.misses = make(map[string]time.Time)
+	}
+	e.misses[string(fh)] = now
+}
+
+func (e *Export) remember(fh []byte, p string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.handles[string(fh)]; !ok && len(e.handles) >= fhMaxHandles {
+		clear(e.handles)
+	}
+	if e.handles == nil {
+		e.handles = make(map[string]string)
+	}
+	e.handles[string(fh)] = p
+	delete(e.misses, string(fh))
+}
+
+// forgetHandles drops the cached handles of p and everything below it, once
+// it has been removed or renamed, so that a handle is not answered with a
+// path that now names another object.
+func (e *Export) forgetHandles(p string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for fh, q := range e.handles {
+		if q == p || strings.HasPrefix(q, p+string(filepath.Separator)) {
+			delete(e.handles, fh)
+		}
+	}
+}
+
+// walkTrail finds the object of fh by descending from the root through
+// entries whose inode matches the trail.
+func (e *Export) walkTrail(fh []byte, ino uint64, dev uint32) (string, bool) {
+	depth := int(fh[1])
+	cands := []string{e.Root}
+	if depth == 0 {
+		return e.Root, isInode(e.Root, ino, dev)
+	}
+	for level := 0; level < depth; level++ {
+		var next []string
+		for _, dir := range cands {
+			des, err := os.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+			for _, de := range des {
+				p := filepath.Join(dir, de.Name())
+				cino, cdev, err := inodeOf(p)
+				if err != nil || (level < fhTrail && byte(cino) != fh[16+level]) {
+					continue
+				}
+				if level == depth-1 {
+					if cino == ino && cdev == dev {
+						return p, true
+					}
+				} else if de.IsDir() && len(next) < fhMaxCandidates {
+					next = append(next, p)
+				}
+			}
+		}
+		cands = next
+	}
+	return "", false
+}
+
+// search scans the export for the inode, giving up after fhMaxSearch
+// entries.
+func (e *Export) search(ino uint64, dev uint32) (string, bool) {
+	var found string
+	n := 0
+	_ = filepath.WalkDir(e.Root, func(p string, de fs.DirEntry, err error) error {
+		if n++; n > fhMaxSearch {
+			return fs.SkipAll
+		}
+		if err != nil {
+			return nil
+		}
+		if isInode(p, ino, dev) {
+			found = p
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return found, found != ""
+}
+
+func inodeOf(p string) (uint64, uint32, error) {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return 0, 0, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, syscall.ENOTSUP
+	}
+	return st.Ino, uint32(st.Dev), nil
 }
 
-func handleForPath(path string) []byte {
-	fhMu.Lock()
-	defer fhMu.Unlock()
-	norm := normalizePath(path)
-	sum := sha256.Sum256([]byte(norm))
-	fh := sum[:]
-	fh32 := make([]byte, 32)
-	copy(fh32, fh)
-	fhToPath[string(fh32)] = norm
-	return fh32
+func isInode(p string, ino uint64, dev uint32) bool {
+	cino, cdev, err := inodeOf(p)
+	return err == nil && cino == ino && cdev == dev
 }
 
-func pathForHandle(fh []byte) (string, bool) {
-	fhMu.Lock()
-	defer fhMu.Unlock()
-	p, ok := fhToPath[string(fh)]
-	return p, ok
+// file resolves a file handle to a path of the export. In single-file mode
+// every handle stands for the exported file.
+func (e *Export) file(fh []byte) (string, bool) {
+	if len(fh) > nfs3FHSize {
+		return "", false
+	}
+	if e.SingleFile {
+		return e.Root, true
+	}
+	p, err := e.resolve(fh)
+	if err != nil {
+		return "", false
+	}
+	return p, true
 }
@@ -1,12 +1,168 @@
 package nfs
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
 
 func TestHandlePathRoundTrip(t *testing.T) {
-	p := "/tmp/some/path"
-	fh := handleForPath(p)
-	got, ok := pathForHandle(fh)
-	if !ok || got != p {
-		t.Fatalf("round-trip failed: ok=%v got=%q", ok, got)
+	root := t.TempDir()
+	p := filepath.Join(root, "some", "path")
+	if err := os.MkdirAll(p, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	fh := export.handle(p)
+	if len(fh) != fhSize {
+		t.Fatalf("handle is %d bytes", len(fh))
+	}
+	got, err := export.resolve(fh)
+	if err != nil || got != p {
+		t.Fatalf("round-trip failed: err=%v got=%q", err, got)
+	}
+}
+
+func TestHandleCacheForgets(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "a")
+	if err := os.MkdirAll(filepath.Join(dir, "b"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for _, name := range []string{"core", "b/netbsd"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	d := &nfsd{export: export}
+	cached := func(p string) bool {
+		for _, q := range export.handles {
+			if q == p {
+				return true
+			}
+		}
+		return false
+	}
+	core := filepath.Join(dir, "core")
+	kernel := filepath.Join(dir, "b", "netbsd")
+	export.handle(core)
+	export.handle(kernel)
+	export.handle(root)
+
+	// Removed and renamed paths, and what was below them, leave the cache.
+	if err := d.unlinkPath(core, os.Remove, false); err != nil {
+		t.Fatalf("unlink: %v", err)
+	}
+	if cached(core) {
+		t.Fatalf("removed file still cached")
+	}
+	if err := d.renamePath(dir, filepath.Join(root, "c")); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if cached(kernel) || !cached(root) {
+		t.Fatalf("cache after rename: %v", export.handles)
+	}
+
+	// The cache does not grow without bound.
+	for i := range fhMaxHandles + 1 {
+		export.remember([]byte{byte(i >> 16), byte(i >> 8), byte(i)}, root)
+	}
+	if n := len(export.handles); n > fhMaxHandles {
+		t.Fatalf("%d handles cached", n)
+	}
+}
+
+func TestHandleSurvivesRestart(t *testing.T) {
+	root := t.TempDir()
+	deep := filepath.Join(root, "a", "b", "c", "d", "e", "f", "g", "h", "i", "j")
+	if err := os.MkdirAll(deep, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	kernel := filepath.Join(deep, "netbsd")
+	if err := os.WriteFile(kernel, []byte("k"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	before, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	fh := before.handle(kernel)
+	rootFH := before.handle(root)
+
+	// A fresh export has no cache, as after a server restart; its key is
+	// read back from the handle key file.
+	after, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	after.HandleKey = before.handleKey()
+	if got, err := after.resolve(fh); err != nil || got != kernel {
+		t.Fatalf("after restart: %q, %v", got, err)
+	}
+	if got, err := after.resolve(rootFH); err != nil || got != before.Root {
+		t.Fatalf("root after restart: %q, %v", got, err)
+	}
+
+	// Renamed objects keep their handle.
+	moved := filepath.Join(root, "a", "netbsd.old")
+	if err := os.Rename(kernel, moved); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if got, err := after.resolve(fh); err != nil || got != moved {
+		t.Fatalf("after rename: %q, %v", got, err)
+	}
+
+	// Removed objects and forged or foreign handles are stale.
+	if err := os.Remove(moved); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := after.resolve(fh); err != errStaleHandle {
+		t.Fatalf("removed file err=%v", err)
+	}
+	if _, missed := after.misses[string(fh)]; !missed {
+		t.Fatalf("stale handle not remembered")
+	}
+	forged := append([]byte(nil), rootFH...)
+	forged[5] ^= 1
+	if _, err := after.resolve(forged); err != errStaleHandle {
+		t.Fatalf("forged handle err=%v", err)
+	}
+	other, err := NewExport(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	if _, err := other.resolve(rootFH); err != errStaleHandle {
+		t.Fatalf("foreign handle err=%v", err)
+	}
+	// Without a key file the key is random, not one anybody knowing the
+	// export path could compute.
+	guess, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	if _, err := guess.resolve(rootFH); err != errStaleHandle {
+		t.Fatalf("handle of another key err=%v", err)
+	}
+}
+
+func TestLoadHandleKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "handle.key")
+	key, err := LoadHandleKey(path)
+	if err != nil || len(key) != 32 {
+		t.Fatalf("create: %d bytes, %v", len(key), err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("key file mode: %v, %v", fi, err)
+	}
+	again, err := LoadHandleKey(path)
+	if err != nil || string(again) != string(key) {
+		t.Fatalf("reload changed the key: %v", err)
 	}
 }
@@ -0,0 +1,490 @@
+package nfs
+
+import (
+	"errors"
+	"io/fs"
+	"math"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"ofw-install-server/oncrpc"
+	"ofw-install-server/xdr"
+)
+
+// The procedures below modify the export. They answer NFSERR_ROFS unless the
+// export is writable for the calling client, and NFSERR_ACCES or NFSERR_PERM
+// when the caller's uid/gid lacks the permission a local user would need.
+
+// sattrUnset marks a sattr field the client leaves unchanged.
+const sattrUnset = 0xFFFFFFFF
+
+// sizeUnset marks an unchanged size.
+const sizeUnset = math.MaxUint64
+
+// sattr holds the attributes a client sets, decoded from an NFS v2 sattr or
+// an NFS v3 sattr3. Times left unchanged carry UTIME_OMIT.
+type sattr struct {
+	mode, uid, gid uint32 // sattrUnset when unchanged
+	size           uint64 // sizeUnset when unchanged
+	atime, mtime   unix.Timespec
+}
+
+// keepSattr returns a sattr that changes nothing.
+func keepSattr() sattr {
+	return sattr{mode: sattrUnset, uid: sattrUnset, gid: sattrUnset, size: sizeUnset,
+		atime: unix.Timespec{Nsec: unix.UTIME_OMIT}, mtime: unix.Timespec{Nsec: unix.UTIME_OMIT}}
+}
+
+// readSattr decodes an NFS v2 sattr (RFC 1094), where all-ones fields are
+// left unchanged.
+func readSattr(rr *xdr.Reader) (sattr, error) {
+	var v [8]uint32
+	for i := range v {
+		var err error
+		if v[i], err = rr.ReadUint32(); err != nil {
+			return sattr{}, err
+		}
+	}
+	a := sattr{mode: v[0], uid: v[1], gid: v[2], size: sizeUnset,
+		atime: sattrTime(v[4], v[5]), mtime: sattrTime(v[6], v[7])}
+	if v[3] != sattrUnset {
+		a.size = uint64(v[3])
+	}
+	return a, nil
+}
+
+// sattrTime converts a sattr timeval. Following SunOS, a microsecond value
+// of one million asks for the server's current time.
+func sattrTime(sec, usec uint32) unix.Timespec {
+	switch {
+	case sec == sattrUnset:
+		return unix.Timespec{Nsec: unix.UTIME_OMIT}
+	case usec == 1000000:
+		return unix.Timespec{Nsec: unix.UTIME_NOW}
+	}
+	return unix.Timespec{Sec: int64(sec), Nsec: int64(usec%1000000) * 1000}
+}
+
+// apply sets the attributes of p that a carries. Symbolic links only take an
+// owner, since chmod, truncate and utimes would act on their target.
+func (a sattr) apply(p string) error {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if a.uid != sattrUnset || a.gid != sattrUnset {
+		uid, gid := -1, -1
+		if a.uid != sattrUnset {
+			uid = int(a.uid)
+		}
+		if a.gid != sattrUnset {
+			gid = int(a.gid)
+		}
+		if err := os.Lchown(p, uid, gid); err != nil {
+			return err
+		}
+	}
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		return nil
+	}
+	if a.mode != sattrUnset {
+		if err := syscall.Chmod(p, a.mode&07777); err != nil {
+			return err
+		}
+	}
+	if a.size != sizeUnset {
+		if err := os.Truncate(p, int64(a.size)); err != nil {
+			return err
+		}
+	}
+	if a.atime.Nsec != unix.UTIME_OMIT || a.mtime.Nsec != unix.UTIME_OMIT {
+		ts := []unix.Timespec{a.atime, a.mtime}
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, p, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// perm returns the permission bits to create an object with.
+func (a sattr) perm(def uint32) fs.FileMode {
+	if a.mode == sattrUnset {
+		return fs.FileMode(def)
+	}
+	return fs.FileMode(a.mode & 0o777)
+}
+
+// createFile creates p, or reuses an existing file as NFS v2 CREATE and
+// NFS v3 UNCHECKED CREATE do, then applies a. A symlink at p is not
+// followed, which would create or truncate its target, maybe outside the
+// export: it is in the way, as any other object.
+func createFile(p string, a sattr, flags int) error {
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE|syscall.O_NOFOLLOW|flags, a.perm(0o644))
+	if errors.Is(err, syscall.ELOOP) {
+		return syscall.EEXIST
+	}
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return a.apply(p)
+}
+
+func makeDir(p string, a sattr) error {
+	if err := os.Mkdir(p, a.perm(0o755)); err != nil {
+		return err
+	}
+	return a.apply(p)
+}
+
+func makeSymlink(p, target string, a sattr) error {
+	if err := os.Symlink(target, p); err != nil {
+		return err
+	}
+	return a.apply(p)
+}
+
+// writeFile writes data at off into the regular file p, syncing it to
+// stable storage when sync is set.
+func writeFile(p string, off int64, data []byte, sync bool) error {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return syscall.EISDIR
+	}
+	if !fi.Mode().IsRegular() {
+		return syscall.EACCES
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, off)
+	if err == nil && sync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncFile flushes the regular file p to stable storage. Anything else is
+// refused without being opened, so a symlink is not followed and a FIFO or
+// device cannot block the caller.
+func syncFile(p string) error {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return syscall.EINVAL
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readDirOp reads diropargs (diropargs3 for NFS v3) and resolves the entry
+// to create, remove or rename. ok is false when the arguments cannot be
+// decoded; otherwise a non-zero status is the NFS error to answer with.
+func (d *nfsd) readDirOp(rr *xdr.Reader, vers uint32) (path string, status uint32, ok bool) {
+	fh, err := readFH(rr, vers)
+	if err != nil {
+		return "", 0, false
+	}
+	name, err := rr.ReadOpaque()
+	if err != nil {
+		return "", 0, false
+	}
+	if len(name) > 255 {
+		return "", nfsErrNameLong, true
+	}
+	dir, found := d.pathFor(fh)
+	if !found {
+		return "", nfsErrStale, true
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return "", nfsStatus(err), true
+	}
+	if !fi.IsDir() {
+		return "", nfsErrNotDir, true
+	}
+	if err := d.writable(dir); err != nil {
+		return "", nfsStatus(err), true
+	}
+	if status := d.permitWrite(dir); status != nfsOK {
+		return "", status, true
+	}
+	if dir, err = d.modifiable(dir); err != nil {
+		return "", nfsStatus(err), true
+	}
+	p, err := d.export.child(dir, string(name))
+	if err != nil {
+		return "", nfsStatus(err), true
+	}
+	return p, nfsOK, true
+}
+
+// writableHandle resolves fh to a path the calling client may change.
+func (d *nfsd) writableHandle(fh []byte) (string, uint32) {
+	p, ok := d.pathFor(fh)
+	if !ok {
+		return "", nfsErrStale
+	}
+	if err := d.writable(p); err != nil {
+		return "", nfsStatus(err)
+	}
+	p, err := d.modifiable(p)
+	if err != nil {
+		return "", nfsStatus(err)
+	}
+	return p, nfsOK
+}
+
+func (d *nfsd) setattr(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: fh(fixed32), sattr
+	fh, err := c.Args.ReadFixed(32)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	a, err := readSattr(c.Args)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	p, status := d.writableHandle(fh)
+	if status == nfsOK {
+		status = d.permitSetattr(p, a)
+	}
+	if status != nfsOK {
+		return nfsReplyErr(w, status)
+	}
+	defer d.export.files.forget(p)
+	if err := a.apply(p); err != nil {
+		d.logf("nfsd SETATTR %q: %v", p, err)
+		return nfsReplyErr(w, nfsStatus(err))
+	}
+	d.logf("nfsd SETATTR %q", p)
+	return d.replyAttrOK(w, p)
+}
+
+func (d *nfsd) write(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: fh(fixed32), beginoffset(uint32), offset(uint32), totalcount(uint32), data(opaque)
+	fh, err := c.Args.ReadFixed(32)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	_, _ = c.Args.ReadUint32() // beginoffset, unused
+	offset, err := c.Args.ReadUint32()
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	_, _ = c.Args.ReadUint32() // totalcount, unused
+	data, err := c.Args.ReadOpaque()
+	if err != nil || len(data) > nfsMaxData {
+		return oncrpc.ErrGarbageArgs
+	}
+	p, status := d.writableHandle(fh)
+	if status == nfsOK {
+		status = d.permitWrite(p)
+	}
+	if status != nfsOK {
+		return nfsReplyErr(w, status)
+	}
+	// NFS v2 writes are synchronous.
+	defer d.export.files.forget(p)
+	if err := writeFile(p, int64(offset), data, true); err != nil {
+		d.logf("nfsd WRITE %q: %v", p, err)
+		return nfsReplyErr(w, nfsStatus(err))
+	}
+	d.logf("nfsd WRITE %q off=%d count=%d", p, offset, len(data))
+	return d.replyAttrOK(w, p)
+}
+
+func (d *nfsd) create(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: diropargs, sattr
+	p, status, ok := d.readDirOp(c.Args, nfsV2)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	a, err := readSattr(c.Args)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	if status != nfsOK {
+		return nfsReplyErr(w, status)
+	}
+	// NFS v2 CREATE is not exclusive: an existing file is reused, and
+	// truncated when the client sets its size.
+	defer d.export.files.forget(p)
+	err = d.copyUpAt(p)
+	if err == nil {
+		err = createFile(p, d.owned(a), 0)
+	}
+	if err != nil {
+		d.logf("nfsd CREATE %q: %v", p, err)
+		return nfsReplyErr(w, nfsStatus(err))
+	}
+	d.logf("nfsd CREATE %q", p)
+	return d.replyDirOK(w, p)
+}
+
+func (d *nfsd) mkdir(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: diropargs, sattr
+	p, status, ok := d.readDirOp(c.Args, nfsV2)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	a, err := readSattr(c.Args)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	if status != nfsOK {
+		return nfsReplyErr(w, status)
+	}
+	err = d.copyUpAt(p)
+	if err == nil {
+		err = makeDir(p, d.owned(a))
+	}
+	if err != nil {
+		d.logf("nfsd MKDIR %q: %v", p, err)
+		return nfsReplyErr(w, nfsStatus(err))
+	}
+	d.logf("nfsd MKDIR %q", p)
+	return d.replyDirOK(w, p)
+}
+
+func (d *nfsd) remove(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: diropargs
+	return d.unlink(c, w, "REMOVE", syscall.Unlink)
+}
+
+func (d *nfsd) rmdir(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: diropargs
+	return d.unlink(c, w, "RMDIR", syscall.Rmdir)
+}
+
+// unlink runs REMOVE or RMDIR; the syscalls refuse the wrong kind of entry
+// with EISDIR or ENOTDIR, which map directly to NFS errors.
+func (d *nfsd) unlink(c *oncrpc.Call, w *xdr.Writer, op string, fn func(string) error) error {
+	p, status, ok := d.readDirOp(c.Args, nfsV2)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	if status != nfsOK {
+		return nfsReplyErr(w, status)
+	}
+	defer d.export.files.forget(p)
+	if err := d.unlinkPath(p, fn, op == "RMDIR"); err != nil {
+		d.logf("nfsd %s %q: %v", op, p, err)
+		return nfsReplyErr(w, nfsStatus(err))
+	}
+	d.logf("nfsd %s %q", op, p)
+	return nfsReplyErr(w, nfsOK)
+}
+
+func (d *nfsd) rename(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: from diropargs, to diropargs
+	from, fromStatus, ok := d.readDirOp(c.Args, nfsV2)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	to, toStatus, ok := d.readDirOp(c.Args, nfsV2)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	if fromStatus != nfsOK {
+		return nfsReplyErr(w, fromStatus)
+	}
+	if toStatus != nfsOK {
+		return nfsReplyErr(w, toStatus)
+	}
+	defer d.export.files.forget(from)
+	defer d.export.files.forget(to)
+	if err := d.renamePath(from, to); err != nil {
+		d.logf("nfsd RENAME %q -> %q: %v", from, to, err)
+		return nfsReplyErr(w, nfsStatus(err))
+	}
+	d.logf("nfsd RENAME %q -> %q", from, to)
+	return nfsReplyErr(w, nfsOK)
+}
+
+func (d *nfsd) link(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: from fh(fixed32), to diropargs
+	fh, err := c.Args.ReadFixed(32)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	to, status, ok := d.readDirOp(c.Args, nfsV2)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	if status != nfsOK {
+		return nfsReplyErr(w, status)
+	}
+	from, found := d.pathFor(fh)
+	if !found {
+		return nfsReplyErr(w, nfsErrStale)
+	}
+	// A link is another way to change its source: a diskless client may
+	// only link what it could write, lest it link in a file of the export
+	// and write through the link.
+	if d.writable(from) != nil {
+		return nfsReplyErr(w, nfsErrAcces)
+	}
+	if from, err = d.modifiable(from); err == nil {
+		err = d.copyUpAt(to)
+	}
+	if err != nil {
+		return nfsReplyErr(w, nfsStatus(err))
+	}
+	if err := os.Link(from, to); err != nil {
+		d.logf("nfsd LINK %q -> %q: %v", from, to, err)
+		return nfsReplyErr(w, nfsStatus(err))
+	}
+	d.logf("nfsd LINK %q -> %q", from, to)
+	return nfsReplyErr(w, nfsOK)
+}
+
+func (d *nfsd) symlink(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: from diropargs, to path(string), sattr
+	p, status, ok := d.readDirOp(c.Args, nfsV2)
+	if !ok {
+		return oncrpc.ErrGarbageArgs
+	}
+	target, err := c.Args.ReadOpaque()
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	a, err := readSattr(c.Args)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	if status != nfsOK {
+		return nfsReplyErr(w, status)
+	}
+	if len(target) > 1024 {
+		return nfsReplyErr(w, nfsErrNameLong)
+	}
+	err = d.copyUpAt(p)
+	if err == nil {
+		err = makeSymlink(p, string(target), d.owned(a))
+	}
+	if err != nil {
+		d.logf("nfsd SYMLINK %q -> %q: %v", p, target, err)
+		return nfsReplyErr(w, nfsStatus(err))
+	}
+	d.logf("nfsd SYMLINK %q -> %q", p, target)
+	return nfsReplyErr(w, nfsOK)
+}
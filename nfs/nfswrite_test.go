@@ -0,0 +1,203 @@
+package nfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ofw-install-server/xdr"
+)
+
+func unsetSattr(w *xdr.Writer) {
+	for i := 0; i < 8; i++ {
+		w.WriteUint32(sattrUnset)
+	}
+}
+
+func TestNFSDWritableExport(t *testing.T) {
+	root := t.TempDir()
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	export.Writable = true
+	export.Clients = []ClientRule{{}} // all,rw,no_root_squash
+	d := &nfsd{export: export}
+	rootFH := export.handle(export.Root)
+
+	// CREATE then WRITE
+	args := lookupArgs(rootFH, "swap")
+	unsetSattr(args)
+	status, r := nfsCall(t, d, nfsProcCreate, args)
+	if status != nfsOK {
+		t.Fatalf("CREATE status=%d", status)
+	}
+	fileFH, _ := r.ReadFixed(32)
+	args = xdr.NewWriter(nil)
+	args.WriteFixedOpaque(fileFH)
+	args.WriteUint32(0)
+	args.WriteUint32(4) // offset
+	args.WriteUint32(0)
+	args.WriteOpaque([]byte("data"))
+	status, r = nfsCall(t, d, nfsProcWrite, args)
+	if status != nfsOK {
+		t.Fatalf("WRITE status=%d", status)
+	}
+	r.Skip(5 * 4)
+	if size, _ := r.ReadUint32(); size != 8 {
+		t.Fatalf("WRITE fattr size=%d, want 8", size)
+	}
+	if b, _ := os.ReadFile(filepath.Join(root, "swap")); string(b) != "\x00\x00\x00\x00data" {
+		t.Fatalf("file content %q", b)
+	}
+
+	// SETATTR truncates and changes the mode
+	args = xdr.NewWriter(nil)
+	args.WriteFixedOpaque(fileFH)
+	args.WriteUint32(0o600)
+	args.WriteUint32(sattrUnset)
+	args.WriteUint32(sattrUnset)
+	args.WriteUint32(2)
+	for i := 0; i < 4; i++ {
+		args.WriteUint32(sattrUnset)
+	}
+	if status, _ := nfsCall(t, d, nfsProcSetAttr, args); status != nfsOK {
+		t.Fatalf("SETATTR status=%d", status)
+	}
+	fi, err := os.Stat(filepath.Join(root, "swap"))
+	if err != nil || fi.Size() != 2 || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("after SETATTR: %v %v", fi, err)
+	}
+
+	// MKDIR, RENAME into it, LINK and SYMLINK
+	args = lookupArgs(rootFH, "etc")
+	unsetSattr(args)
+	status, r = nfsCall(t, d, nfsProcMkdir, args)
+	if status != nfsOK {
+		t.Fatalf("MKDIR status=%d", status)
+	}
+	etcFH, _ := r.ReadFixed(32)
+	args = lookupArgs(rootFH, "etc")
+	unsetSattr(args)
+	if status, _ := nfsCall(t, d, nfsProcMkdir, args); status != nfsErrExist {
+		t.Fatalf("MKDIR existing status=%d", status)
+	}
+	args = lookupArgs(rootFH, "swap")
+	args.WriteFixedOpaque(lookupArgs(etcFH, "swap0").Bytes())
+	if status, _ := nfsCall(t, d, nfsProcRename, args); status != nfsOK {
+		t.Fatalf("RENAME status=%d", status)
+	}
+	status, r = nfsCall(t, d, nfsProcLookup, lookupArgs(etcFH, "swap0"))
+	if status != nfsOK {
+		t.Fatalf("LOOKUP renamed status=%d", status)
+	}
+	swapFH, _ := r.ReadFixed(32)
+	args = xdr.NewWriter(nil)
+	args.WriteFixedOpaque(swapFH)
+	args.WriteFixedOpaque(lookupArgs(rootFH, "hard").Bytes())
+	if status, _ := nfsCall(t, d, nfsProcLink, args); status != nfsOK {
+		t.Fatalf("LINK status=%d", status)
+	}
+	args = lookupArgs(rootFH, "soft")
+	args.WriteOpaque([]byte("etc/swap0"))
+	unsetSattr(args)
+	if status, _ := nfsCall(t, d, nfsProcSymlink, args); status != nfsOK {
+		t.Fatalf("SYMLINK status=%d", status)
+	}
+	if target, err := os.Readlink(filepath.Join(root, "soft")); err != nil || target != "etc/swap0" {
+		t.Fatalf("symlink target %q %v", target, err)
+	}
+
+	// REMOVE and RMDIR error mapping
+	if status, _ := nfsCall(t, d, nfsProcRmdir, lookupArgs(rootFH, "etc")); status != nfsErrNotEmpty {
+		t.Fatalf("RMDIR non-empty status=%d", status)
+	}
+	if status, _ := nfsCall(t, d, nfsProcRemove, lookupArgs(rootFH, "etc")); status != nfsErrIsDir {
+		t.Fatalf("REMOVE directory status=%d", status)
+	}
+	if status, _ := nfsCall(t, d, nfsProcRemove, lookupArgs(rootFH, "missing")); status != nfsErrNoEnt {
+		t.Fatalf("REMOVE missing status=%d", status)
+	}
+	if status, _ := nfsCall(t, d, nfsProcRemove, lookupArgs(rootFH, "..")); status != nfsErrInval {
+		t.Fatalf("REMOVE .. status=%d", status)
+	}
+	if status, _ := nfsCall(t, d, nfsProcRemove, lookupArgs(etcFH, "swap0")); status != nfsOK {
+		t.Fatalf("REMOVE status=%d", status)
+	}
+	if status, _ := nfsCall(t, d, nfsProcRmdir, lookupArgs(rootFH, "etc")); status != nfsOK {
+		t.Fatalf("RMDIR status=%d", status)
+	}
+}
+
+func TestNFSDReadOnlyExport(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "netbsd"), []byte("kernel"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	d := &nfsd{export: export}
+	rootFH := export.handle(export.Root)
+
+	args := lookupArgs(rootFH, "new")
+	unsetSattr(args)
+	if status, _ := nfsCall(t, d, nfsProcCreate, args); status != nfsErrROFS {
+		t.Fatalf("CREATE status=%d, want ROFS", status)
+	}
+	if status, _ := nfsCall(t, d, nfsProcRemove, lookupArgs(rootFH, "netbsd")); status != nfsErrROFS {
+		t.Fatalf("REMOVE status=%d, want ROFS", status)
+	}
+	args = xdr.NewWriter(nil)
+	args.WriteFixedOpaque(export.handle(filepath.Join(root, "netbsd")))
+	args.WriteUint32(0)
+	args.WriteUint32(0)
+	args.WriteUint32(0)
+	args.WriteOpaque([]byte("x"))
+	if status, _ := nfsCall(t, d, nfsProcWrite, args); status != nfsErrROFS {
+		t.Fatalf("WRITE status=%d, want ROFS", status)
+	}
+	if b, _ := os.ReadFile(filepath.Join(root, "netbsd")); string(b) != "kernel" {
+		t.Fatalf("read-only file modified: %q", b)
+	}
+}
+
+func TestNFSDCreateOverSymlink(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	export, err := NewExport(root)
+	if err != nil {
+		t.Fatalf("NewExport: %v", err)
+	}
+	export.Writable = true
+	export.Clients = []ClientRule{{}} // all,rw,no_root_squash
+	d := &nfsd{export: export}
+	rootFH := export.handle(export.Root)
+
+	target := filepath.Join(outside, "nologin")
+	args := lookupArgs(rootFH, "trap")
+	args.WriteOpaque([]byte(target))
+	unsetSattr(args)
+	if status, _ := nfsCall(t, d, nfsProcSymlink, args); status != nfsOK {
+		t.Fatalf("SYMLINK status=%d", status)
+	}
+
+	// v2 CREATE and v3 UNCHECKED CREATE reuse existing files, but not
+	// through a symlink.
+	args = lookupArgs(rootFH, "trap")
+	unsetSattr(args)
+	if status, _ := nfsCall(t, d, nfsProcCreate, args); status != nfsErrExist {
+		t.Fatalf("CREATE over a symlink status=%d, want EXIST", status)
+	}
+	args = dirop3Args(rootFH, "trap")
+	args.WriteUint32(createUnchecked)
+	for i := 0; i < 6; i++ {
+		args.WriteUint32(0)
+	}
+	if status, _ := nfs3Call(t, d, nfs3ProcCreate, args); status != nfsErrExist {
+		t.Fatalf("UNCHECKED CREATE over a symlink status=%d, want EXIST", status)
+	}
+	if _, err := os.Lstat(target); !os.IsNotExist(err) {
+		t.Fatalf("symlink target created outside the export: %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package nfs
+
+import (
+	"log"
+	"net"
+	"testing"
+
+	"ofw-install-server/oncrpc"
+	"ofw-install-server/xdr"
+)
+
+func buildMinimalRPCCall(xid, prog, vers, proc uint32) []byte {
+	c := &oncrpc.Call{XID: xid, Prog: prog, Vers: vers, Proc: proc}
+	return c.Encode(nil)
+}
+
+// buildUnixRPCCall is buildMinimalRPCCall with AUTH_UNIX credentials for
+// uid/gid.
+func buildUnixRPCCall(xid, prog, vers, proc, uid, gid uint32, gids ...uint32) []byte {
+	w := xdr.NewWriter(nil)
+	w.WriteUint32(0) // stamp
+	w.WriteOpaque([]byte("client"))
+	w.WriteUint32(uid)
+	w.WriteUint32(gid)
+	w.WriteUint32(uint32(len(gids)))
+	for _, g := range gids {
+		w.WriteUint32(g)
+	}
+	c := &oncrpc.Call{XID: xid, Prog: prog, Vers: vers, Proc: proc,
+		Cred: oncrpc.OpaqueAuth{Flavor: oncrpc.AuthUnix, Body: w.Bytes()}}
+	return c.Encode(nil)
+}
+
+// handle, handleMountd and handleBootparamd answer one call message the way
+// the UDP and TCP servers do.
+func (d *nfsd) handle(msg []byte, from net.Addr) []byte {
+	return newNFSServer(d.export, d.logger).Handle(msg, from)
+}
+
+func handleMountd(msg []byte, from net.Addr, export *Export, logger *log.Logger) []byte {
+	return newMountServer(export, logger).Handle(msg, from)
+}
+
+func handleBootparamd(msg []byte, from net.Addr, params *BootParams, logger *log.Logger) []byte {
+	return newBootparamServer(params, logger).Handle(msg, from)
+}
+
+// acceptStat decodes an accepted reply, failing the test on MSG_DENIED.
+func acceptStat(t *testing.T, resp []byte) (stat uint32, body *xdr.Reader) {
+	t.Helper()
+	r := xdr.NewReader(resp)
+	r.Skip(8)
+	replyStat, err := r.ReadUint32()
+	if err != nil || replyStat != 0 {
+		t.Fatalf("not an accepted reply: %x", resp)
+	}
+	r.Skip(8) // verf
+	stat, err = r.ReadUint32()
+	if err != nil {
+		t.Fatalf("short reply: %x", resp)
+	}
+	return stat, r
+}
+
+func TestRPCAcceptStat(t *testing.T) {
+	d := &nfsd{export: &Export{Root: t.TempDir()}}
+	export := d.export
+	mountd := func(req []byte) []byte { return handleMountd(req, nil, export, nil) }
+	nfsd := func(req []byte) []byte { return d.handle(req, nil) }
+	// A handle shorter than 32 bytes cannot be decoded.
+	shortFH := append(buildMinimalRPCCall(1, nfsProgram, nfsV2, nfsProcGetAttr), make([]byte, 8)...)
+	// A v3 handle whose length promises more bytes than were sent.
+	cutFH := xdr.NewWriter(buildMinimalRPCCall(1, nfsProgram, nfsV3, nfs3ProcGetAttr))
+	cutFH.WriteUint32(fhSize)
+
+	tests := []struct {
+		name  string
+		serve func([]byte) []byte
+		req   []byte
+		want  uint32
+	}{
+		{"nfsd wrong program", nfsd, buildMinimalRPCCall(1, mountProgram, nfsV2, 0), oncrpc.AcceptProgUnavail},
+		{"nfsd v2 unknown proc", nfsd, buildMinimalRPCCall(1, nfsProgram, nfsV2, 99), oncrpc.AcceptProcUnavail},
+		{"nfsd v3 unknown proc", nfsd, buildMinimalRPCCall(1, nfsProgram, nfsV3, 99), oncrpc.AcceptProcUnavail},
+		{"nfsd v2 short handle", nfsd, shortFH, oncrpc.AcceptGarbageArgs},
+		{"nfsd v3 truncated handle", nfsd, cutFH.Bytes(), oncrpc.AcceptGarbageArgs},
+		{"mountd wrong program", mountd, buildMinimalRPCCall(1, nfsProgram, mountV1, 0), oncrpc.AcceptProgUnavail},
+		{"mountd unknown proc", mountd, buildMinimalRPCCall(1, mountProgram, mountV3, 99), oncrpc.AcceptProcUnavail},
+		{"mountd v3 EXPORTALL", mountd, buildMinimalRPCCall(1, mountProgram, mountV3, mountProcExportAll), oncrpc.AcceptProcUnavail},
+		{"mountd MNT without dirpath", mountd, buildMinimalRPCCall(1, mountProgram, mountV1, mountProcMnt), oncrpc.AcceptGarbageArgs},
+	}
+	for _, tt := range tests {
+		if stat, _ := acceptStat(t, tt.serve(tt.req)); stat != tt.want {
+			t.Errorf("%s: accept_stat %d, want %d", tt.name, stat, tt.want)
+		}
+	}
+}
+
+func TestRPCProgMismatch(t *testing.T) {
+	d := &nfsd{export: &Export{Root: t.TempDir()}}
+	tests := []struct {
+		name      string
+		resp      []byte
+		low, high uint32
+	}{
+		{"nfsd", d.handle(buildMinimalRPCCall(1, nfsProgram, 4, 0), nil), nfsV2, nfsV3},
+		{"mountd", handleMountd(buildMinimalRPCCall(1, mountProgram, 4, 0), nil, d.export, nil), mountV1, mountV3},
+		{"bootparamd", handleBootparamd(buildMinimalRPCCall(1, bootparamProgram, 2, 0), nil, &BootParams{}, nil), bootparamV1, bootparamV1},
+	}
+	for _, tt := range tests {
+		stat, r := acceptStat(t, tt.resp)
+		low, _ := r.ReadUint32()
+		high, err := r.ReadUint32()
+		if stat != oncrpc.AcceptProgMismatch || err != nil || low != tt.low || high != tt.high {
+			t.Errorf("%s: accept_stat %d versions %d-%d, want %d with %d-%d", tt.name, stat, low, high, oncrpc.AcceptProgMismatch, tt.low, tt.high)
+		}
+	}
+}
+
+func TestRPCSystemErr(t *testing.T) {
+	// Without an export every procedure touching files panics; the caller
+	// must still get an answer.
+	d := &nfsd{}
+	req := append(buildMinimalRPCCall(1, nfsProgram, nfsV2, nfsProcGetAttr), make([]byte, fhSize)...)
+	if stat, _ := acceptStat(t, d.handle(req, nil)); stat != oncrpc.AcceptSystemErr {
+		t.Errorf("nfsd: accept_stat %d, want %d", stat, oncrpc.AcceptSystemErr)
+	}
+	w := xdr.NewWriter(buildMinimalRPCCall(1, mountProgram, mountV1, mountProcMnt))
+	w.WriteOpaque([]byte("/"))
+	if stat, _ := acceptStat(t, handleMountd(w.Bytes(), nil, nil, nil)); stat != oncrpc.AcceptSystemErr {
+		t.Errorf("mountd: accept_stat %d, want %d", stat, oncrpc.AcceptSystemErr)
+	}
+}
@@ -0,0 +1,149 @@
+package nfs
+
+import (
+	"log"
+	"time"
+
+	"ofw-install-server/oncrpc"
+	"ofw-install-server/xdr"
+)
+
+// The status monitor (NSM, sm_inter.x) lets clients tell the lock manager
+// they rebooted, so the locks they held are released. It only serves the
+// lock manager of this server: other programs cannot have hosts monitored.
+const (
+	nsmProgram = 100024
+	nsmV1      = 1
+
+	nsmProcStat      = 1
+	nsmProcMon       = 2
+	nsmProcUnmon     = 3
+	nsmProcUnmonAll  = 4
+	nsmProcSimuCrash = 5
+	nsmProcNotify    = 6
+
+	// res
+	nsmStatSucc = 0
+	nsmStatFail = 1
+
+	nsmMaxName = 1024 // SM_MAXSTRLEN
+)
+
+// nsmState is the state number of this host: odd while it is up. It
+// changes on restart since locks do not survive one.
+var nsmState = int32(time.Now().Unix()) | 1
+
+// smMyID is a my_id: the RPC procedure a monitor wants called back.
+type smMyID struct {
+	MyName string `xdr:"max=1024"`
+	MyProg int32
+	MyVers int32
+	MyProc int32
+}
+
+// smMonID is a mon_id: the host to monitor and who asks.
+type smMonID struct {
+	MonName string `xdr:"max=1024"`
+	MyID    smMyID
+}
+
+// smMon is the argument of SM_MON.
+type smMon struct {
+	MonID smMonID
+	Priv  [16]byte
+}
+
+// smStatChge is the argument of SM_NOTIFY: a host and its new state.
+type smStatChge struct {
+	MonName string `xdr:"max=1024"`
+	State   int32
+}
+
+// smStatRes is the result of SM_STAT and SM_MON; SM_UNMON and
+// SM_UNMON_ALL only return State.
+type smStatRes struct {
+	Res   uint32
+	State int32
+}
+
+type statd struct {
+	export *Export
+	logger *log.Logger
+}
+
+func (s *statd) logf(format string, args ...any) {
+	if s.logger != nil {
+		s.logger.Printf(format, args...)
+	}
+}
+
+// registerStatd serves NSM v1 from srv.
+func registerStatd(srv *oncrpc.Server, s *statd) {
+	srv.Register(nsmProgram, nsmV1, oncrpc.Procs{
+		nsmProcStat:      s.stat,
+		nsmProcMon:       s.mon,
+		nsmProcUnmon:     s.unmon,
+		nsmProcUnmonAll:  s.unmonAll,
+		nsmProcSimuCrash: s.simuCrash,
+		nsmProcNotify:    s.notify,
+	})
+}
+
+func (s *statd) stat(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: sm_name { mon_name }
+	if _, err := c.Args.ReadString(nsmMaxName); err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	return w.Encode(smStatRes{Res: nsmStatSucc, State: nsmState})
+}
+
+// mon refuses SM_MON: the lock manager of this server needs no monitor
+// to hear of client reboots, and no other one is served.
+func (s *statd) mon(c *oncrpc.Call, w *xdr.Writer) error {
+	var args smMon
+	if err := c.Args.Decode(&args); err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	s.logf("statd MON %s for %s prog %d refused", args.MonID.MonName, args.MonID.MyID.MyName, args.MonID.MyID.MyProg)
+	return w.Encode(smStatRes{Res: nsmStatFail, State: nsmState})
+}
+
+func (s *statd) unmon(c *oncrpc.Call, w *xdr.Writer) error {
+	var args smMonID
+	if err := c.Args.Decode(&args); err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	w.WriteInt32(nsmState)
+	return nil
+}
+
+func (s *statd) unmonAll(c *oncrpc.Call, w *xdr.Writer) error {
+	var args smMyID
+	if err := c.Args.Decode(&args); err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	w.WriteInt32(nsmState)
+	return nil
+}
+
+// simuCrash answers SM_SIMU_CRASH, which only matters to monitors.
+func (s *statd) simuCrash(c *oncrpc.Call, w *xdr.Writer) error {
+	return nil
+}
+
+// notify releases the locks of a client that tells it rebooted. Clients
+// name themselves as they see fit, so locks taken from the address the
+// notification comes from go too.
+func (s *statd) notify(c *oncrpc.Call, w *xdr.Writer) error {
+	var args smStatChge
+	if err := c.Args.Decode(&args); err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	var ip string
+	if addr := oncrpc.AddrIP(c.From); addr != nil {
+		ip = addr.String()
+	}
+	n := s.export.locks.release(args.MonName, ip)
+	s.logf("statd NOTIFY %s state %d from %v: %d locks released", args.MonName, args.State, c.From, n)
+	return nil
+}
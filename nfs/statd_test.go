@@ -0,0 +1,55 @@
+package nfs
+
+import (
+	"testing"
+
+	"ofw-install-server/oncrpc"
+	"ofw-install-server/xdr"
+)
+
+func TestStatdNotify(t *testing.T) {
+	s, export, fh, _ := testLockd(t)
+	acceptStat(t, s.Handle(nlmCall(nlmV4, nlmProcLock, fh, "a", 0, 0, false, true), clientA))
+
+	// Client A names itself differently to its status monitor; the
+	// address still tells.
+	args, _ := xdr.Marshal(smStatChge{MonName: "a.example", State: 3})
+	req := append(buildMinimalRPCCall(1, nsmProgram, nsmV1, nsmProcNotify), args...)
+	if stat, r := acceptStat(t, s.Handle(req, clientA)); stat != oncrpc.AcceptSuccess || len(r.Remaining()) != 0 {
+		t.Fatalf("SM_NOTIFY: accept_stat %d", stat)
+	}
+	if len(export.locks.files) != 0 {
+		t.Fatalf("locks left: %+v", export.locks.files)
+	}
+	_, r := acceptStat(t, s.Handle(nlmCall(nlmV4, nlmProcLock, fh, "b", 0, 0, false, false), clientB))
+	if got := nlmStat(t, r); got != nlmGranted {
+		t.Fatalf("LOCK after the notification: stat %d", got)
+	}
+}
+
+func TestStatdMon(t *testing.T) {
+	s, _, _, _ := testLockd(t)
+	var res smStatRes
+
+	args, _ := xdr.Marshal(smMon{MonID: smMonID{MonName: "client", MyID: smMyID{MyName: "localhost", MyProg: 100021, MyVers: 4, MyProc: 16}}})
+	_, r := acceptStat(t, s.Handle(append(buildMinimalRPCCall(1, nsmProgram, nsmV1, nsmProcMon), args...), clientA))
+	if err := r.Decode(&res); err != nil || res.Res != nsmStatFail || res.State%2 != 1 {
+		t.Fatalf("SM_MON: %+v, %v", res, err)
+	}
+
+	w := xdr.NewWriter(buildMinimalRPCCall(1, nsmProgram, nsmV1, nsmProcStat))
+	w.WriteString("client")
+	_, r = acceptStat(t, s.Handle(w.Bytes(), clientA))
+	if err := r.Decode(&res); err != nil || res.Res != nsmStatSucc || res.State != nsmState {
+		t.Fatalf("SM_STAT: %+v, %v", res, err)
+	}
+
+	args, _ = xdr.Marshal(smMyID{MyName: "localhost"})
+	_, r = acceptStat(t, s.Handle(append(buildMinimalRPCCall(1, nsmProgram, nsmV1, nsmProcUnmonAll), args...), clientA))
+	if state, err := r.ReadInt32(); err != nil || state != nsmState {
+		t.Fatalf("SM_UNMON_ALL: %d, %v", state, err)
+	}
+	if stat, _ := acceptStat(t, s.Handle(buildMinimalRPCCall(1, nsmProgram, nsmV1, nsmProcUnmon), clientA)); stat != oncrpc.AcceptGarbageArgs {
+		t.Fatalf("SM_UNMON without arguments: accept_stat %d", stat)
+	}
+}
@@ -0,0 +1,122 @@
+package nis
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// The maps served, as ypmake builds them from ethers(5), hosts(5) and
+// bootparams(5): keyed by the first field, or by name, with the whole line
+// as value, except bootparams, whose value leaves the client name out.
+const (
+	mapBootparams   = "bootparams"
+	mapEthersByAddr = "ethers.byaddr"
+	mapEthersByName = "ethers.byname"
+	mapHostsByAddr  = "hosts.byaddr"
+	mapHostsByName  = "hosts.byname"
+)
+
+type mapEntry struct{ key, val string }
+
+// ypMap is a map sorted by key, the order of FIRST, NEXT and ALL.
+type ypMap []mapEntry
+
+// find returns the index of key in m.
+func (m ypMap) find(key string) (int, bool) {
+	i := sort.Search(len(m), func(i int) bool { return m[i].key >= key })
+	return i, i < len(m) && m[i].key == key
+}
+
+// entry returns entry i of m as FIRST and NEXT answer it, YP_NOMORE past
+// the end; stat other than YP_TRUE is returned alone.
+func (m ypMap) entry(stat int32, i int) yprespKeyVal {
+	switch {
+	case stat != ypTrue:
+		return yprespKeyVal{Stat: stat}
+	case i >= len(m):
+		return yprespKeyVal{Stat: ypNoMore}
+	}
+	return yprespKeyVal{Stat: ypTrue, Val: []byte(m[i].val), Key: []byte(m[i].key)}
+}
+
+// newMap sorts the entries of byKey into a map.
+func newMap(byKey map[string]string) ypMap {
+	m := make(ypMap, 0, len(byKey))
+	for key, val := range byKey {
+		m = append(m, mapEntry{key, val})
+	}
+	sort.Slice(m, func(i, j int) bool { return m[i].key < m[j].key })
+	return m
+}
+
+// mapNames returns the names of the maps of d, sorted.
+func (d *Domain) mapNames() []string {
+	names := []string{mapEthersByAddr, mapEthersByName, mapHostsByAddr, mapHostsByName}
+	if d.Bootparams != nil {
+		names = append([]string{mapBootparams}, names...)
+	}
+	return names
+}
+
+// makeMap returns the map called name as the client table has it now.
+func (d *Domain) makeMap(name string) (ypMap, bool) {
+	byKey := make(map[string]string)
+	// add keeps the first entry of a key, as ypmake does.
+	add := func(key, val string) {
+		if _, dup := byKey[key]; !dup {
+			byKey[key] = val
+		}
+	}
+	switch name {
+	case mapEthersByAddr, mapEthersByName:
+		if d.Allocator == nil {
+			break
+		}
+		for _, c := range d.Allocator.Clients() {
+			addr := etherNtoa(c.MAC)
+			line := addr + "\t" + c.Hostname
+			if name == mapEthersByAddr {
+				add(addr, line)
+			} else {
+				add(c.Hostname, line)
+			}
+		}
+	case mapHostsByAddr, mapHostsByName:
+		host := func(ip net.IP, hostname string) {
+			line := ip.String() + "\t" + hostname
+			if name == mapHostsByAddr {
+				add(ip.String(), line)
+			} else {
+				add(hostname, line)
+			}
+		}
+		if d.ServerName != "" && d.ServerIP.To4() != nil {
+			host(d.ServerIP.To4(), d.ServerName)
+		}
+		if d.Allocator == nil {
+			break
+		}
+		for _, c := range d.Allocator.Clients() {
+			if c.IP != nil {
+				host(c.IP, c.Hostname)
+			}
+		}
+	case mapBootparams:
+		if d.Bootparams == nil {
+			return nil, false
+		}
+		for client, line := range d.Bootparams() {
+			add(client, line)
+		}
+	default:
+		return nil, false
+	}
+	return newMap(byKey), true
+}
+
+// etherNtoa formats mac as ether_ntoa(3) does, e.g. 8:0:20:aa:bb:cc: the
+// keys of ethers.byaddr.
+func etherNtoa(mac [6]byte) string {
+	return fmt.Sprintf("%x:%x:%x:%x:%x:%x", mac[0], mac[1], mac[2], mac[3], mac[4], mac[5])
+}
@@ -0,0 +1,99 @@
+package nis
+
+import (
+	"net"
+	"testing"
+
+	"ofw-install-server/utils"
+)
+
+// testDomain returns the domain "lab" with sparky, leased and named by
+// -host, ofw-010203, leased, and t1000, named only.
+func testDomain(t *testing.T) *Domain {
+	t.Helper()
+	alloc, err := utils.NewIPv4AllocatorFromCIDR("10.1.0.0/24")
+	if err != nil {
+		t.Fatalf("allocator: %v", err)
+	}
+	sparky := [6]byte{8, 0, 0x20, 0xaa, 0xbb, 0xcc}
+	alloc.SetHost(sparky, utils.HostInfo{Hostname: "sparky"})
+	alloc.SetHost([6]byte{8, 0, 0x20, 0x0d, 0x0e, 0x0f}, utils.HostInfo{Hostname: "t1000"})
+	alloc.AllocateForMAC(sparky)
+	alloc.AllocateForMAC([6]byte{8, 0, 0x20, 1, 2, 3})
+	return &Domain{
+		Name:       "lab",
+		Allocator:  alloc,
+		ServerName: "installer",
+		ServerIP:   net.IPv4(10, 1, 0, 254),
+		Bootparams: func() map[string]string {
+			return map[string]string{"sparky": "root=installer:/export/sparky"}
+		},
+	}
+}
+
+func TestMaps(t *testing.T) {
+	dom := testDomain(t)
+	for _, tc := range []struct {
+		name string
+		want ypMap
+	}{
+		{mapEthersByAddr, ypMap{
+			{"8:0:20:1:2:3", "8:0:20:1:2:3\tofw-010203"},
+			{"8:0:20:aa:bb:cc", "8:0:20:aa:bb:cc\tsparky"},
+			{"8:0:20:d:e:f", "8:0:20:d:e:f\tt1000"},
+		}},
+		{mapEthersByName, ypMap{
+			{"ofw-010203", "8:0:20:1:2:3\tofw-010203"},
+			{"sparky", "8:0:20:aa:bb:cc\tsparky"},
+			{"t1000", "8:0:20:d:e:f\tt1000"},
+		}},
+		{mapHostsByAddr, ypMap{
+			{"10.1.0.1", "10.1.0.1\tsparky"},
+			{"10.1.0.2", "10.1.0.2\tofw-010203"},
+			{"10.1.0.254", "10.1.0.254\tinstaller"},
+		}},
+		{mapHostsByName, ypMap{
+			{"installer", "10.1.0.254\tinstaller"},
+			{"ofw-010203", "10.1.0.2\tofw-010203"},
+			{"sparky", "10.1.0.1\tsparky"},
+		}},
+		{mapBootparams, ypMap{{"sparky", "root=installer:/export/sparky"}}},
+	} {
+		m, ok := dom.makeMap(tc.name)
+		if !ok || len(m) != len(tc.want) {
+			t.Errorf("%s: %v %q", tc.name, ok, m)
+			continue
+		}
+		for i := range m {
+			if m[i] != tc.want[i] {
+				t.Errorf("%s entry %d: %q, want %q", tc.name, i, m[i], tc.want[i])
+			}
+		}
+	}
+	if _, ok := dom.makeMap("passwd.byname"); ok {
+		t.Errorf("passwd.byname served")
+	}
+	dom.Bootparams = nil
+	if _, ok := dom.makeMap(mapBootparams); ok {
+		t.Errorf("bootparams served without a table")
+	}
+}
+
+func TestMapFindAndEntry(t *testing.T) {
+	m := newMap(map[string]string{"b": "2", "a": "1"})
+	if i, ok := m.find("b"); !ok || i != 1 {
+		t.Fatalf("find b: %d %v", i, ok)
+	}
+	if _, ok := m.find("c"); ok {
+		t.Fatalf("found c")
+	}
+	if e := m.entry(ypTrue, 0); e.Stat != ypTrue || string(e.Key) != "a" || string(e.Val) != "1" {
+		t.Fatalf("entry 0: %+v", e)
+	}
+	if e := m.entry(ypTrue, 2); e.Stat != ypNoMore {
+		t.Fatalf("entry past the end: %+v", e)
+	}
+	if e := m.entry(ypNoMap, 0); e.Stat != ypNoMap || e.Key != nil {
+		t.Fatalf("entry of a missing map: %+v", e)
+	}
+}
@@ -0,0 +1,351 @@
+package nis
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"ofw-install-server/oncrpc"
+	"ofw-install-server/utils"
+	"ofw-install-server/xdr"
+)
+
+// ypserv (yp.x) answers NIS lookups of one domain. Clients find it by
+// broadcasting DOMAIN_NONACK, usually through PMAPPROC_CALLIT; servers of
+// other domains stay silent. ypbind, which a client runs to remember the
+// server it found, is answered too, naming this server.
+const (
+	ypProgram = 100004
+	ypV2      = 2
+
+	ypProcDomain       = 1
+	ypProcDomainNonack = 2
+	ypProcMatch        = 3
+	ypProcFirst        = 4
+	ypProcNext         = 5
+	ypProcAll          = 8
+	ypProcMaster       = 9
+	ypProcOrder        = 10
+	ypProcMaplist      = 11
+
+	ypbindProgram = 100007
+	ypbindV2      = 2
+
+	ypbindProcDomain = 1
+
+	// ypbind_resptype
+	ypbindSuccVal = 1
+	ypbindFailVal = 2
+	// ypbind_resp error
+	ypbindErrNoServ = 2
+
+	ypMaxDomain = 64   // YPMAXDOMAIN
+	ypMaxMap    = 64   // YPMAXMAP
+	ypMaxRecord = 1024 // YPMAXRECORD
+)
+
+// ypstat
+const (
+	ypTrue   int32 = 1
+	ypNoMore int32 = 2
+	ypNoMap  int32 = -1
+	ypNoDom  int32 = -2
+	ypNoKey  int32 = -3
+)
+
+// ypreqNokey names a map.
+type ypreqNokey struct {
+	Domain string `xdr:"max=64"`
+	Map    string `xdr:"max=64"`
+}
+
+// ypreqKey names a key of a map.
+type ypreqKey struct {
+	Domain string `xdr:"max=64"`
+	Map    string `xdr:"max=64"`
+	Key    []byte `xdr:"max=1024"`
+}
+
+type yprespVal struct {
+	Stat int32
+	Val  []byte
+}
+
+// yprespKeyVal is the result of FIRST and NEXT, and an entry of ALL; the
+// value comes first.
+type yprespKeyVal struct {
+	Stat int32
+	Val  []byte
+	Key  []byte
+}
+
+type yprespMaster struct {
+	Stat int32
+	Peer string
+}
+
+type yprespOrder struct {
+	Stat     int32
+	Ordernum uint32
+}
+
+// ypMaplist is a list of map names.
+type ypMaplist struct {
+	Map  string
+	Next *ypMaplist
+}
+
+type yprespMaplist struct {
+	Stat int32
+	Maps *ypMaplist
+}
+
+// ypbindResp tells where the server of a domain is.
+type ypbindResp struct {
+	Status  uint32        `xdr:"union"`
+	Binding ypbindBinding `xdr:"case=1"`
+	Error   uint32        `xdr:"case=2"`
+}
+
+type ypbindBinding struct {
+	Addr [4]byte
+	Port [2]byte
+}
+
+// Domain is the NIS domain served. Its maps are made from the client table
+// for every call, so they always agree with RARP, BOOTP and bootparamd.
+type Domain struct {
+	Name      string
+	Allocator *utils.IPv4Allocator
+	// ServerName and ServerIP are this server: the master of the maps,
+	// and in the hosts maps.
+	ServerName string
+	ServerIP   net.IP
+	// Bootparams returns the bootparams map, entries by client; without
+	// it there is no such map.
+	Bootparams func() map[string]string
+}
+
+// StartYPServ runs ypserv and ypbind v2 for dom over UDP and registers them
+// in reg. Without a port in addr it takes any free one, which clients find
+// through rpcbind.
+func StartYPServ(addr string, dom *Domain, reg *oncrpc.Registry, logger *log.Logger) (net.PacketConn, error) {
+	if addr == "" {
+		addr = ":0"
+	}
+	if logger != nil {
+		logger.Printf("ypserv domain=%q maps %v", dom.Name, dom.mapNames())
+	}
+	return newServer(dom, reg, logger).ListenUDP(addr, reg)
+}
+
+// StartYPServTCP serves ypserv and ypbind over TCP, the same as StartYPServ
+// does over UDP. Clients list whole maps (ypcat) over TCP.
+func StartYPServTCP(addr string, dom *Domain, reg *oncrpc.Registry, logger *log.Logger) (net.Listener, error) {
+	if addr == "" {
+		addr = ":0"
+	}
+	return newServer(dom, reg, logger).ListenTCP(addr, reg)
+}
+
+type ypserv struct {
+	dom    *Domain
+	reg    *oncrpc.Registry // finds the port ypbind answers
+	logger *log.Logger
+}
+
+func (y *ypserv) logf(format string, args ...any) {
+	if y.logger != nil {
+		y.logger.Printf(format, args...)
+	}
+}
+
+// newServer returns the ypserv and ypbind server of dom.
+func newServer(dom *Domain, reg *oncrpc.Registry, logger *log.Logger) *oncrpc.Server {
+	y := &ypserv{dom: dom, reg: reg, logger: logger}
+	s := oncrpc.NewServer("ypserv", logger)
+	s.Register(ypProgram, ypV2, oncrpc.Procs{
+		ypProcDomain:       y.domain,
+		ypProcDomainNonack: y.domainNonack,
+		ypProcMatch:        y.match,
+		ypProcFirst:        y.first,
+		ypProcNext:         y.next,
+		ypProcAll:          y.all,
+		ypProcMaster:       y.master,
+		ypProcOrder:        y.order,
+		ypProcMaplist:      y.maplist,
+	})
+	s.Register(ypbindProgram, ypbindV2, oncrpc.Procs{
+		ypbindProcDomain: y.bind,
+	})
+	return s
+}
+
+func (y *ypserv) domain(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: domainname
+	name, err := c.Args.ReadString(ypMaxDomain)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	w.WriteBool(name == y.dom.Name)
+	return nil
+}
+
+// domainNonack answers only for the domain served, as clients broadcast it
+// to find a server.
+func (y *ypserv) domainNonack(c *oncrpc.Call, w *xdr.Writer) error {
+	name, err := c.Args.ReadString(ypMaxDomain)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	y.logf("ypserv DOMAIN_NONACK %q from %v", name, c.From)
+	if name != y.dom.Name {
+		return oncrpc.ErrNoReply
+	}
+	w.WriteBool(true)
+	return nil
+}
+
+// lookupMap returns the map domain/name, or the ypstat saying why not.
+func (y *ypserv) lookupMap(domain, name string) (ypMap, int32) {
+	if domain != y.dom.Name {
+		return nil, ypNoDom
+	}
+	m, ok := y.dom.makeMap(name)
+	if !ok {
+		return nil, ypNoMap
+	}
+	return m, ypTrue
+}
+
+func (y *ypserv) match(c *oncrpc.Call, w *xdr.Writer) error {
+	var args ypreqKey
+	if err := c.Args.Decode(&args); err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	m, stat := y.lookupMap(args.Domain, args.Map)
+	var val []byte
+	if stat == ypTrue {
+		if i, ok := m.find(string(args.Key)); ok {
+			val = []byte(m[i].val)
+		} else {
+			stat = ypNoKey
+		}
+	}
+	y.logf("ypserv MATCH %s %q from %v: %d", args.Map, args.Key, c.From, stat)
+	return w.Encode(yprespVal{Stat: stat, Val: val})
+}
+
+func (y *ypserv) first(c *oncrpc.Call, w *xdr.Writer) error {
+	var args ypreqNokey
+	if err := c.Args.Decode(&args); err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	m, stat := y.lookupMap(args.Domain, args.Map)
+	return w.Encode(m.entry(stat, 0))
+}
+
+func (y *ypserv) next(c *oncrpc.Call, w *xdr.Writer) error {
+	var args ypreqKey
+	if err := c.Args.Decode(&args); err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	m, stat := y.lookupMap(args.Domain, args.Map)
+	i, ok := m.find(string(args.Key))
+	if stat == ypTrue && !ok {
+		stat = ypNoKey
+	}
+	return w.Encode(m.entry(stat, i+1))
+}
+
+// all sends the whole map as a stream of ypresp_all: each entry follows a
+// TRUE, and YP_NOMORE then FALSE end it.
+func (y *ypserv) all(c *oncrpc.Call, w *xdr.Writer) error {
+	var args ypreqNokey
+	if err := c.Args.Decode(&args); err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	m, stat := y.lookupMap(args.Domain, args.Map)
+	y.logf("ypserv ALL %s from %v: %d entries", args.Map, c.From, len(m))
+	if stat == ypTrue {
+		for _, e := range m {
+			w.WriteBool(true)
+			if err := w.Encode(yprespKeyVal{Stat: ypTrue, Val: []byte(e.val), Key: []byte(e.key)}); err != nil {
+				return err
+			}
+		}
+		stat = ypNoMore
+	}
+	w.WriteBool(true)
+	if err := w.Encode(yprespKeyVal{Stat: stat}); err != nil {
+		return err
+	}
+	w.WriteBool(false)
+	return nil
+}
+
+func (y *ypserv) master(c *oncrpc.Call, w *xdr.Writer) error {
+	var args ypreqNokey
+	if err := c.Args.Decode(&args); err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	_, stat := y.lookupMap(args.Domain, args.Map)
+	res := yprespMaster{Stat: stat}
+	if stat == ypTrue {
+		res.Peer = y.dom.ServerName
+	}
+	return w.Encode(res)
+}
+
+// order answers the time as the order number of every map: they are made
+// anew for each call.
+func (y *ypserv) order(c *oncrpc.Call, w *xdr.Writer) error {
+	var args ypreqNokey
+	if err := c.Args.Decode(&args); err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	_, stat := y.lookupMap(args.Domain, args.Map)
+	res := yprespOrder{Stat: stat}
+	if stat == ypTrue {
+		res.Ordernum = uint32(time.Now().Unix())
+	}
+	return w.Encode(res)
+}
+
+func (y *ypserv) maplist(c *oncrpc.Call, w *xdr.Writer) error {
+	name, err := c.Args.ReadString(ypMaxDomain)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	if name != y.dom.Name {
+		return w.Encode(yprespMaplist{Stat: ypNoDom})
+	}
+	var list *ypMaplist
+	names := y.dom.mapNames()
+	for i := len(names) - 1; i >= 0; i-- {
+		list = &ypMaplist{Map: names[i], Next: list}
+	}
+	return w.Encode(yprespMaplist{Stat: ypTrue, Maps: list})
+}
+
+// bind answers YPBINDPROC_DOMAIN with this server for the domain served.
+func (y *ypserv) bind(c *oncrpc.Call, w *xdr.Writer) error {
+	// args: domainname
+	name, err := c.Args.ReadString(ypMaxDomain)
+	if err != nil {
+		return oncrpc.ErrGarbageArgs
+	}
+	var port uint32
+	if y.reg != nil {
+		port = y.reg.Port(ypProgram, ypV2, oncrpc.IPProtoUDP)
+	}
+	ip := y.dom.ServerIP.To4()
+	y.logf("ypbind DOMAIN %q from %v: %v port %d", name, c.From, ip, port)
+	if name != y.dom.Name || ip == nil || port == 0 {
+		return w.Encode(ypbindResp{Status: ypbindFailVal, Error: ypbindErrNoServ})
+	}
+	res := ypbindResp{Status: ypbindSuccVal}
+	copy(res.Binding.Addr[:], ip)
+	res.Binding.Port = [2]byte{byte(port >> 8), byte(port)}
+	return w.Encode(res)
+}
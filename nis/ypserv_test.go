@@ -0,0 +1,154 @@
+package nis
+
+import (
+	"net"
+	"testing"
+
+	"ofw-install-server/oncrpc"
+	"ofw-install-server/xdr"
+)
+
+// ypCall makes one call to s, ypserv and ypbind both being version 2,
+// with the arguments args encodes and returns the results, nil without a
+// reply.
+func ypCall(t *testing.T, s *oncrpc.Server, prog, proc uint32, args any) *xdr.Reader {
+	t.Helper()
+	w := xdr.NewWriter(nil)
+	if err := w.Encode(args); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	c := &oncrpc.Call{XID: 7, Prog: prog, Vers: ypV2, Proc: proc}
+	resp := s.Handle(c.Encode(w.Bytes()), &net.UDPAddr{IP: net.IPv4(10, 1, 0, 1), Port: 1023})
+	if resp == nil {
+		return nil
+	}
+	res, err := oncrpc.ParseReply(resp, 7)
+	if err != nil {
+		t.Fatalf("proc %d: %v", proc, err)
+	}
+	return xdr.NewReader(res)
+}
+
+func TestYPServDomain(t *testing.T) {
+	s := newServer(testDomain(t), nil, nil)
+	for domain, want := range map[string]bool{"lab": true, "other": false} {
+		if ok, _ := ypCall(t, s, ypProgram, ypProcDomain, domain).ReadBool(); ok != want {
+			t.Errorf("DOMAIN %s: %v", domain, ok)
+		}
+	}
+	if r := ypCall(t, s, ypProgram, ypProcDomainNonack, "other"); r != nil {
+		t.Errorf("DOMAIN_NONACK of another domain answered")
+	}
+	if r := ypCall(t, s, ypProgram, ypProcDomainNonack, "lab"); r == nil {
+		t.Errorf("DOMAIN_NONACK not answered")
+	}
+}
+
+func TestYPServMatch(t *testing.T) {
+	s := newServer(testDomain(t), nil, nil)
+	for _, tc := range []struct {
+		req  ypreqKey
+		stat int32
+		val  string
+	}{
+		{ypreqKey{"lab", "hosts.byname", []byte("sparky")}, ypTrue, "10.1.0.1\tsparky"},
+		{ypreqKey{"lab", "ethers.byaddr", []byte("8:0:20:d:e:f")}, ypTrue, "8:0:20:d:e:f\tt1000"},
+		{ypreqKey{"lab", "bootparams", []byte("sparky")}, ypTrue, "root=installer:/export/sparky"},
+		{ypreqKey{"lab", "hosts.byname", []byte("nosuchhost")}, ypNoKey, ""},
+		{ypreqKey{"lab", "passwd.byname", []byte("root")}, ypNoMap, ""},
+		{ypreqKey{"other", "hosts.byname", []byte("sparky")}, ypNoDom, ""},
+	} {
+		var res yprespVal
+		if err := ypCall(t, s, ypProgram, ypProcMatch, tc.req).Decode(&res); err != nil || res.Stat != tc.stat || string(res.Val) != tc.val {
+			t.Errorf("MATCH %s %s: %d %q %v", tc.req.Map, tc.req.Key, res.Stat, res.Val, err)
+		}
+	}
+}
+
+func TestYPServFirstNextAll(t *testing.T) {
+	s := newServer(testDomain(t), nil, nil)
+	var keys []string
+	var res yprespKeyVal
+	ypCall(t, s, ypProgram, ypProcFirst, ypreqNokey{"lab", "hosts.byaddr"}).Decode(&res)
+	for res.Stat == ypTrue {
+		keys = append(keys, string(res.Key))
+		ypCall(t, s, ypProgram, ypProcNext, ypreqKey{"lab", "hosts.byaddr", res.Key}).Decode(&res)
+	}
+	if res.Stat != ypNoMore || len(keys) != 3 || keys[0] != "10.1.0.1" || keys[2] != "10.1.0.254" {
+		t.Fatalf("FIRST/NEXT keys %q, then %d", keys, res.Stat)
+	}
+	ypCall(t, s, ypProgram, ypProcNext, ypreqKey{"lab", "hosts.byaddr", []byte("10.9.9.9")}).Decode(&res)
+	if res.Stat != ypNoKey {
+		t.Fatalf("NEXT after a missing key: %d", res.Stat)
+	}
+
+	r := ypCall(t, s, ypProgram, ypProcAll, ypreqNokey{"lab", "ethers.byname"})
+	var names []string
+	for {
+		if more, _ := r.ReadBool(); !more {
+			break
+		}
+		if err := r.Decode(&res); err != nil {
+			t.Fatalf("ALL: %v", err)
+		}
+		if res.Stat != ypTrue {
+			break
+		}
+		names = append(names, string(res.Key))
+	}
+	if res.Stat != ypNoMore || len(names) != 3 || names[1] != "sparky" {
+		t.Fatalf("ALL keys %q, then %d", names, res.Stat)
+	}
+	r = ypCall(t, s, ypProgram, ypProcAll, ypreqNokey{"lab", "passwd.byname"})
+	if more, _ := r.ReadBool(); !more || r.Decode(&res) != nil || res.Stat != ypNoMap {
+		t.Fatalf("ALL of a missing map: %d", res.Stat)
+	}
+}
+
+func TestYPServMaplistAndMaster(t *testing.T) {
+	s := newServer(testDomain(t), nil, nil)
+	var res yprespMaplist
+	if err := ypCall(t, s, ypProgram, ypProcMaplist, "lab").Decode(&res); err != nil || res.Stat != ypTrue {
+		t.Fatalf("MAPLIST: %d %v", res.Stat, err)
+	}
+	var names []string
+	for m := res.Maps; m != nil; m = m.Next {
+		names = append(names, m.Map)
+	}
+	if len(names) != 5 || names[0] != "bootparams" || names[4] != "hosts.byname" {
+		t.Fatalf("MAPLIST %q", names)
+	}
+	var master yprespMaster
+	if ypCall(t, s, ypProgram, ypProcMaster, ypreqNokey{"lab", "ethers.byaddr"}).Decode(&master); master.Stat != ypTrue || master.Peer != "installer" {
+		t.Fatalf("MASTER %+v", master)
+	}
+}
+
+func TestYPBind(t *testing.T) {
+	dom := testDomain(t)
+	reg := oncrpc.NewRegistry(dom.ServerIP)
+	pc, err := StartYPServ("127.0.0.1:0", dom, reg, nil)
+	if err != nil {
+		t.Fatalf("StartYPServ: %v", err)
+	}
+	defer pc.Close()
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+
+	c := &oncrpc.Call{XID: 9, Prog: ypbindProgram, Vers: ypbindV2, Proc: ypbindProcDomain}
+	args := xdr.NewWriter(nil)
+	args.WriteString("lab")
+	res, err := oncrpc.CallUDP(pc.LocalAddr().String(), c, args.Bytes())
+	if err != nil {
+		t.Fatalf("YPBINDPROC_DOMAIN: %v", err)
+	}
+	var resp ypbindResp
+	if err := xdr.Unmarshal(res, &resp); err != nil || resp.Status != ypbindSuccVal {
+		t.Fatalf("YPBINDPROC_DOMAIN %+v %v", resp, err)
+	}
+	if b := resp.Binding; b.Addr != [4]byte{10, 1, 0, 254} || int(b.Port[0])<<8|int(b.Port[1]) != port {
+		t.Fatalf("bound to %v, want port %d", b, port)
+	}
+	if err := ypCall(t, newServer(dom, reg, nil), ypbindProgram, ypbindProcDomain, "other").Decode(&resp); err != nil || resp.Status != ypbindFailVal || resp.Error != ypbindErrNoServ {
+		t.Fatalf("YPBINDPROC_DOMAIN of another domain %+v %v", resp, err)
+	}
+}
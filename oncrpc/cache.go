@@ -0,0 +1,119 @@
+package oncrpc
+
+import (
+	"hash/crc32"
+	"sync"
+	"time"
+)
+
+// The duplicate request cache keeps the replies of the procedures that must
+// not run twice, such as NFS CREATE or REMOVE. Clients retransmit calls
+// whose reply got lost, or was just slow, with the same xid; running a
+// REMOVE again would answer NOENT to a call that succeeded. A retransmission
+// gets the cached reply instead, or nothing while the first call still runs.
+const (
+	// cacheSize bounds the number of replies kept.
+	cacheSize = 1024
+	// cacheTTL is how long a reply is kept: longer than clients go on
+	// retransmitting a call.
+	cacheTTL = 2 * time.Minute
+)
+
+// cacheKey tells calls apart: the client's address without its port, since
+// TCP clients reconnect to retransmit, and a checksum of the call besides
+// its xid, against clients reusing xids.
+type cacheKey struct {
+	ip                    string
+	xid, prog, vers, proc uint32
+	sum                   uint32
+}
+
+type cacheEntry struct {
+	reply []byte // nil while the call runs
+	done  bool
+	at    time.Time
+}
+
+// replyCache is a duplicate request cache.
+type replyCache struct {
+	mu      sync.Mutex
+	procs   map[[3]uint32]bool // prog, vers, proc of the cached procedures
+	entries map[cacheKey]*cacheEntry
+	order   []cacheItem // oldest first
+}
+
+// cacheItem is an entry in the eviction order; it is stale once the key
+// maps to another entry.
+type cacheItem struct {
+	key   cacheKey
+	entry *cacheEntry
+}
+
+// cached reports whether the replies of c are cached.
+func (rc *replyCache) cached(c *Call) bool {
+	return rc.procs[[3]uint32{c.Prog, c.Vers, c.Proc}]
+}
+
+func callKey(c *Call, msg []byte) cacheKey {
+	k := cacheKey{xid: c.XID, prog: c.Prog, vers: c.Vers, proc: c.Proc, sum: crc32.ChecksumIEEE(msg[4:])}
+	if ip := AddrIP(c.From); ip != nil {
+		k.ip = ip.String()
+	}
+	return k
+}
+
+// start looks call k up. A new call is entered as running and start returns
+// ok; a retransmission returns the reply to answer it with, nil while the
+// first call runs.
+func (rc *replyCache) start(k cacheKey) (reply []byte, ok bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	now := time.Now()
+	if e, hit := rc.entries[k]; hit && now.Sub(e.at) < cacheTTL {
+		return e.reply, false
+	}
+	rc.expire(now)
+	if rc.entries == nil {
+		rc.entries = make(map[cacheKey]*cacheEntry)
+	}
+	e := &cacheEntry{at: now}
+	rc.entries[k] = e
+	rc.order = append(rc.order, cacheItem{k, e})
+	return nil, true
+}
+
+// finish records the reply of call k. A call that got no reply is
+// forgotten, so a retransmission runs it again.
+func (rc *replyCache) finish(k cacheKey, reply []byte) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	e, ok := rc.entries[k]
+	if !ok {
+		return
+	}
+	if reply == nil {
+		delete(rc.entries, k)
+		return
+	}
+	e.reply, e.done, e.at = reply, true, time.Now()
+}
+
+// expire drops the entries older than cacheTTL and, past cacheSize, the
+// oldest finished ones.
+func (rc *replyCache) expire(now time.Time) {
+	n := 0
+	for _, it := range rc.order {
+		e := it.entry
+		switch {
+		case rc.entries[it.key] != e:
+			continue
+		case now.Sub(e.at) >= cacheTTL, e.done && len(rc.entries) >= cacheSize:
+			delete(rc.entries, it.key)
+			continue
+		}
+		rc.order[n] = it
+		n++
+	}
+	clear(rc.order[n:])
+	rc.order = rc.order[:n]
+}
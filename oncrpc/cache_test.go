@@ -0,0 +1,105 @@
+package oncrpc
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ofw-install-server/xdr"
+)
+
+// countingServer serves program 1 v1, whose procedure 1 counts its calls,
+// with its replies cached, and procedure 2 not.
+func countingServer(runs *atomic.Int32, release <-chan struct{}) *Server {
+	s := NewServer("test", nil)
+	count := func(c *Call, w *xdr.Writer) error {
+		n := runs.Add(1)
+		if release != nil {
+			<-release
+		}
+		w.WriteUint32(uint32(n))
+		return nil
+	}
+	s.Register(1, 1, Procs{1: count, 2: count})
+	s.CacheReplies(1, 1, 1)
+	return s
+}
+
+func TestReplyCacheReplays(t *testing.T) {
+	var runs atomic.Int32
+	s := countingServer(&runs, nil)
+	from := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 800}
+	first := s.Handle(buildCall(7, 1, 1, 1), from)
+	// The retransmission comes over another connection.
+	again := s.Handle(buildCall(7, 1, 1, 1), &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 801})
+	if runs.Load() != 1 || string(first) != string(again) {
+		t.Fatalf("ran %d times, replies %x and %x", runs.Load(), first, again)
+	}
+	// Another xid, client or call is another call.
+	s.Handle(buildCall(8, 1, 1, 1), from)
+	s.Handle(buildCall(7, 1, 1, 1), &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 800})
+	other := append(buildCall(7, 1, 1, 1), 0, 0, 0, 1)
+	s.Handle(other, from)
+	if runs.Load() != 4 {
+		t.Fatalf("ran %d times, want 4", runs.Load())
+	}
+	// Procedures not cached run again.
+	s.Handle(buildCall(7, 1, 1, 2), from)
+	s.Handle(buildCall(7, 1, 1, 2), from)
+	if runs.Load() != 6 {
+		t.Fatalf("ran %d times, want 6", runs.Load())
+	}
+}
+
+func TestReplyCacheInProgress(t *testing.T) {
+	var runs atomic.Int32
+	release := make(chan struct{})
+	s := countingServer(&runs, release)
+	done := make(chan []byte)
+	go func() { done <- s.Handle(buildCall(7, 1, 1, 1), nil) }()
+	for runs.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// A retransmission while the call runs is dropped.
+	if resp := s.Handle(buildCall(7, 1, 1, 1), nil); resp != nil {
+		t.Fatalf("retransmission answered while running: %x", resp)
+	}
+	close(release)
+	first := <-done
+	if stat, r := acceptStat(t, first); stat != AcceptSuccess {
+		t.Fatalf("accept_stat %d", stat)
+	} else if n, _ := r.ReadUint32(); n != 1 {
+		t.Fatalf("reply of run %d", n)
+	}
+	if resp := s.Handle(buildCall(7, 1, 1, 1), nil); string(resp) != string(first) || runs.Load() != 1 {
+		t.Fatalf("replay %x after %d runs", resp, runs.Load())
+	}
+}
+
+func TestReplyCacheBounds(t *testing.T) {
+	var rc replyCache
+	for xid := range uint32(cacheSize + 10) {
+		k := cacheKey{xid: xid}
+		rc.start(k)
+		rc.finish(k, []byte{1})
+	}
+	if len(rc.entries) > cacheSize || len(rc.order) != len(rc.entries) {
+		t.Fatalf("%d entries, %d in order", len(rc.entries), len(rc.order))
+	}
+	if _, ok := rc.entries[cacheKey{xid: 0}]; ok {
+		t.Fatalf("oldest entry kept")
+	}
+	// Calls without a reply are forgotten, to run again.
+	k := cacheKey{xid: 1 << 20}
+	rc.start(k)
+	rc.finish(k, nil)
+	if _, ok := rc.start(k); !ok {
+		t.Fatalf("call that got no reply not run again")
+	}
+	// Expired entries go.
+	rc.entries[k].at = time.Now().Add(-cacheTTL)
+	if _, ok := rc.start(k); !ok {
+		t.Fatalf("expired entry replayed")
+	}
+}
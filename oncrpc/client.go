@@ -0,0 +1,63 @@
+package oncrpc
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"ofw-install-server/xdr"
+)
+
+// CallUDP makes call c with args to addr over UDP and returns the results
+// of a successful reply.
+func CallUDP(addr string, c *Call, args []byte) ([]byte, error) {
+	conn, err := net.Dial("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(c.Encode(args)); err != nil {
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(callTimeout))
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < 4 || binary.BigEndian.Uint32(buf) != c.XID {
+			continue // a late reply to an earlier call
+		}
+		return ParseReply(buf[:n], c.XID)
+	}
+}
+
+// SendUDP sends call c with args to addr over UDP without waiting for a
+// reply, for the one-way calls of procedures returning void that nobody
+// answers, such as the NLM _MSG and _RES callbacks.
+func SendUDP(addr string, c *Call, args []byte) error {
+	conn, err := net.Dial("udp4", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(c.Encode(args))
+	return err
+}
+
+// GetPort asks the portmapper of host for the UDP port of version vers of
+// prog, 0 when it is not registered.
+func GetPort(host net.IP, prog, vers uint32) (uint32, error) {
+	w := xdr.NewWriter(nil)
+	w.WriteUint32(prog)
+	w.WriteUint32(vers)
+	w.WriteUint32(IPProtoUDP)
+	w.WriteUint32(0)
+	c := &Call{XID: uint32(time.Now().UnixNano()), Prog: ProgramPortmap, Vers: portmapVersion2, Proc: procPMAPPROC_GETPORT}
+	res, err := CallUDP(net.JoinHostPort(host.String(), "111"), c, w.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	return xdr.NewReader(res).ReadUint32()
+}
@@ -0,0 +1,61 @@
+package oncrpc
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"ofw-install-server/xdr"
+)
+
+func TestCallUDP(t *testing.T) {
+	reg := NewRegistry(nil)
+	reg.Register(100005, &net.UDPAddr{Port: 20048}, 3)
+	pc, err := NewPortmapServer(reg, nil).ListenUDP("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer pc.Close()
+
+	w := xdr.NewWriter(nil)
+	for _, v := range []uint32{100005, 3, IPProtoUDP, 0} {
+		w.WriteUint32(v)
+	}
+	c := &Call{XID: 9, Prog: ProgramPortmap, Vers: portmapVersion2, Proc: procPMAPPROC_GETPORT}
+	res, err := CallUDP(pc.LocalAddr().String(), c, w.Bytes())
+	if err != nil {
+		t.Fatalf("CallUDP: %v", err)
+	}
+	if port, err := xdr.NewReader(res).ReadUint32(); err != nil || port != 20048 {
+		t.Fatalf("GETPORT = %d, %v", port, err)
+	}
+	// Calls the server refuses come back as errors.
+	c.Prog = 100003
+	if _, err := CallUDP(pc.LocalAddr().String(), c, nil); err == nil {
+		t.Fatalf("call of an unknown program succeeded")
+	}
+}
+
+func TestSendUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer pc.Close()
+
+	// Nobody answers: SendUDP returns once the call is sent.
+	c := &Call{XID: 7, Prog: 100021, Vers: 4, Proc: 12}
+	if err := SendUDP(pc.LocalAddr().String(), c, []byte{0, 0, 0, 1}); err != nil {
+		t.Fatalf("SendUDP: %v", err)
+	}
+	buf := make([]byte, 1500)
+	_ = pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	got, err := ParseCall(buf[:n], from)
+	if err != nil || got.XID != 7 || got.Prog != 100021 || got.Proc != 12 {
+		t.Fatalf("sent %+v, %v", got, err)
+	}
+}
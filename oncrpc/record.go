@@ -0,0 +1,138 @@
+package oncrpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// RPC over TCP frames each message with record marking (RFC 5531 section 11):
+// a record is a sequence of fragments, each preceded by a 4-byte header whose
+// top bit flags the last fragment and whose low 31 bits give its length.
+const (
+	lastFragment = 1 << 31
+	// maxRecord bounds a reassembled call; the largest we expect is an NFS
+	// v3 WRITE of 32 KB plus headers.
+	maxRecord = 1 << 20
+	// connReplies bounds the replies waiting to be written to a connection,
+	// and replyTimeout how long writing one may take. A client that leaves
+	// its replies unread past either is dropped.
+	connReplies  = 64
+	replyTimeout = 30 * time.Second
+)
+
+var errRecordTooLarge = errors.New("rpc record too large")
+
+// readRecord reads one record, reassembling its fragments.
+func readRecord(r io.Reader) ([]byte, error) {
+	var rec []byte
+	var hdr [4]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if len(rec) > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		h := binary.BigEndian.Uint32(hdr[:])
+		n := int(h &^ lastFragment)
+		if len(rec)+n > maxRecord {
+			return nil, errRecordTooLarge
+		}
+		start := len(rec)
+		rec = append(rec, make([]byte, n)...)
+		if _, err := io.ReadFull(r, rec[start:]); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if h&lastFragment != 0 {
+			return rec, nil
+		}
+	}
+}
+
+// writeRecord writes rec as a single last fragment, with one writev on a
+// connection rather than copying rec behind the header.
+func writeRecord(w io.Writer, rec []byte) error {
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], lastFragment|uint32(len(rec)))
+	bufs := net.Buffers{hdr[:], rec}
+	_, err := bufs.WriteTo(w)
+	return err
+}
+
+// ServeTCP accepts connections on l and answers the records of each one.
+// Calls that get no reply over UDP get none over TCP either.
+func (s *Server) ServeTCP(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			s.logf("accept error: %v", err)
+			return
+		}
+		go s.serveConn(c)
+	}
+}
+
+// serveConn hands the calls of one connection to the workers as they
+// arrive, so that a client may have several in progress. Their replies are
+// queued to a writer of the connection as they are ready: workers are
+// shared by every client and must not wait on one that does not read.
+func (s *Server) serveConn(c net.Conn) {
+	var pending sync.WaitGroup
+	replies := make(chan []byte, connReplies)
+	go s.writeReplies(c, replies)
+	defer func() {
+		pending.Wait()
+		close(replies)
+	}()
+	r := bufio.NewReader(c)
+	for {
+		rec, err := readRecord(r)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				s.logf("connection from %s: %v", c.RemoteAddr(), err)
+			}
+			return
+		}
+		pending.Add(1)
+		s.dispatch(job{
+			msg:  rec,
+			from: c.RemoteAddr(),
+			reply: func(resp []byte) {
+				select {
+				case replies <- bytes.Clone(resp):
+				default:
+					s.logf("connection from %s: %d replies unread, closing", c.RemoteAddr(), connReplies)
+					c.Close()
+				}
+			},
+			done: pending.Done,
+		})
+	}
+}
+
+// writeReplies writes the replies queued for c until the queue is closed,
+// then closes c. A reply that cannot be written within replyTimeout closes
+// c at once, and the rest are dropped.
+func (s *Server) writeReplies(c net.Conn, replies <-chan []byte) {
+	defer c.Close()
+	failed := false
+	for rec := range replies {
+		if failed {
+			continue
+		}
+		_ = c.SetWriteDeadline(time.Now().Add(replyTimeout))
+		if err := writeRecord(c, rec); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logf("connection from %s: %v", c.RemoteAddr(), err)
+			}
+			failed = true
+			c.Close()
+		}
+	}
+}
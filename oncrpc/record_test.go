@@ -0,0 +1,100 @@
+package oncrpc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"ofw-install-server/xdr"
+)
+
+func TestRecordMarking(t *testing.T) {
+	var stream bytes.Buffer
+	// "hello world" in two fragments, then an empty record
+	for _, frag := range []struct {
+		data string
+		last bool
+	}{{"hello ", false}, {"world", true}, {"", true}} {
+		h := uint32(len(frag.data))
+		if frag.last {
+			h |= lastFragment
+		}
+		binary.Write(&stream, binary.BigEndian, h)
+		stream.WriteString(frag.data)
+	}
+	rec, err := readRecord(&stream)
+	if err != nil || string(rec) != "hello world" {
+		t.Fatalf("readRecord = %q, %v", rec, err)
+	}
+	if rec, err := readRecord(&stream); err != nil || len(rec) != 0 {
+		t.Fatalf("empty record = %q, %v", rec, err)
+	}
+
+	var out bytes.Buffer
+	if err := writeRecord(&out, []byte("reply")); err != nil {
+		t.Fatalf("writeRecord: %v", err)
+	}
+	if h := binary.BigEndian.Uint32(out.Bytes()); h != lastFragment|5 {
+		t.Fatalf("record header %#x", h)
+	}
+
+	var huge bytes.Buffer
+	binary.Write(&huge, binary.BigEndian, uint32(lastFragment|(maxRecord+1)))
+	if _, err := readRecord(&huge); err != errRecordTooLarge {
+		t.Fatalf("oversized record err=%v", err)
+	}
+}
+
+func TestPortmapOverTCP(t *testing.T) {
+	reg := testRegistry()
+	reg.Register(testProgNFS, &net.TCPAddr{Port: 2049}, 2, 3)
+	l, err := StartPortmapTCP("127.0.0.1:0", reg, nil)
+	if err != nil {
+		t.Fatalf("StartPortmapTCP: %v", err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for _, tc := range []struct{ prot, want uint32 }{{IPProtoTCP, 2049}, {IPProtoUDP, 2049}, {99, 0}} {
+		call := buildCall(tc.prot, ProgramPortmap, portmapVersion2, procPMAPPROC_GETPORT)
+		args := xdr.NewWriter(nil)
+		args.WriteUint32(testProgNFS)
+		args.WriteUint32(3)
+		args.WriteUint32(tc.prot)
+		args.WriteUint32(0)
+		call = append(call, args.Bytes()...)
+		// send the call split across two fragments
+		var msg bytes.Buffer
+		binary.Write(&msg, binary.BigEndian, uint32(10))
+		msg.Write(call[:10])
+		if err := writeRecord(&msg, call[10:]); err != nil {
+			t.Fatalf("writeRecord: %v", err)
+		}
+		if _, err := c.Write(msg.Bytes()); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		resp, err := readRecord(r)
+		if err != nil {
+			t.Fatalf("readRecord: %v", err)
+		}
+		if binary.BigEndian.Uint32(resp) != tc.prot {
+			t.Fatalf("xid mismatch")
+		}
+		if got := binary.BigEndian.Uint32(resp[len(resp)-4:]); got != tc.want {
+			t.Fatalf("GETPORT nfs v3 prot=%d: %d, want %d", tc.prot, got, tc.want)
+		}
+	}
+
+	if port := testRegistry().Port(testProgNFS, 3, IPProtoTCP); port != 0 {
+		t.Fatalf("TCP port %d advertised without TCP", port)
+	}
+	if port := reg.Port(ProgramPortmap, rpcbindVersion4, IPProtoTCP); port != uint32(l.Addr().(*net.TCPAddr).Port) {
+		t.Fatalf("rpcbind registered on tcp port %d, listening on %v", port, l.Addr())
+	}
+}
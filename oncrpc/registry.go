@@ -0,0 +1,204 @@
+package oncrpc
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Transport protocols of a portmap mapping
+const (
+	IPProtoTCP = 6
+	IPProtoUDP = 17
+)
+
+// Mapping is one entry of the portmap table (RFC 1833 struct mapping).
+type Mapping struct {
+	Prog, Vers, Prot, Port uint32
+}
+
+// registration is one rpcbind entry (RFC 1833 struct rpcb). v2 only shows
+// the entries on udp and tcp.
+type registration struct {
+	prog, vers  uint32
+	netid, addr string // addr is a universal address, h1.h2.h3.h4.p1.p2
+	owner       string
+}
+
+// Registry is the table of programs rpcbind serves. Servers register their
+// programs in it as they start listening.
+type Registry struct {
+	// IP is advertised in the universal addresses of built-in services;
+	// 0.0.0.0 if nil.
+	IP net.IP
+
+	mu      sync.Mutex
+	entries []registration
+}
+
+// NewRegistry returns an empty registry advertising ip.
+func NewRegistry(ip net.IP) *Registry {
+	return &Registry{IP: ip}
+}
+
+// Register records prog at each of versions on the transport and port of
+// addr, as a built-in service does once it listens. Earlier entries for the
+// same program, version and transport are replaced. A nil registry ignores
+// it, so services also run without rpcbind.
+func (r *Registry) Register(prog uint32, addr net.Addr, versions ...uint32) {
+	if r == nil {
+		return
+	}
+	var netid string
+	var port int
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		netid, port = "udp", a.Port
+	case *net.TCPAddr:
+		netid, port = "tcp", a.Port
+	default:
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, vers := range versions {
+		r.remove(prog, vers, netid)
+		r.entries = append(r.entries, registration{prog: prog, vers: vers, netid: netid,
+			addr: r.uaddr(uint32(port)), owner: "superuser"})
+	}
+}
+
+// set adds reg unless its program, version and transport are taken.
+func (r *Registry) set(reg registration) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.entries {
+		if e.prog == reg.prog && e.vers == reg.vers && e.netid == reg.netid {
+			return false
+		}
+	}
+	r.entries = append(r.entries, reg)
+	return true
+}
+
+// unset removes prog/vers on netid, or on every transport if netid is
+// empty, and reports whether there was anything to remove.
+func (r *Registry) unset(prog, vers uint32, netid string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.remove(prog, vers, netid)
+}
+
+func (r *Registry) remove(prog, vers uint32, netid string) bool {
+	kept := r.entries[:0]
+	for _, e := range r.entries {
+		if e.prog != prog || e.vers != vers || (netid != "" && e.netid != netid) {
+			kept = append(kept, e)
+		}
+	}
+	removed := len(kept) != len(r.entries)
+	r.entries = kept
+	return removed
+}
+
+// Port returns the port of prog/vers over prot, or 0 when unregistered.
+func (r *Registry) Port(prog, vers, prot uint32) uint32 {
+	e, ok := r.lookup(prog, vers, protNetid(prot), true)
+	if !ok {
+		return 0
+	}
+	_, port, _ := parseUaddr(e.addr)
+	return port
+}
+
+// lookup finds prog on netid in version vers or, unless exact is set, in
+// any version as RPCBPROC_GETADDR does.
+func (r *Registry) lookup(prog, vers uint32, netid string, exact bool) (registration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var other *registration
+	for i, e := range r.entries {
+		if e.prog != prog || e.netid != netid {
+			continue
+		}
+		if e.vers == vers {
+			return e, true
+		}
+		if other == nil {
+			other = &r.entries[i]
+		}
+	}
+	if other != nil && !exact {
+		return *other, true
+	}
+	return registration{}, false
+}
+
+// Mappings returns the entries portmap v2 can express, in the order they
+// were registered.
+func (r *Registry) Mappings() []Mapping {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ms []Mapping
+	for _, e := range r.entries {
+		prot := netidProt(e.netid)
+		if _, port, ok := parseUaddr(e.addr); ok && prot != 0 {
+			ms = append(ms, Mapping{Prog: e.prog, Vers: e.vers, Prot: prot, Port: port})
+		}
+	}
+	return ms
+}
+
+func (r *Registry) list() []registration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]registration(nil), r.entries...)
+}
+
+// uaddr returns the universal address of port on the registry's IP.
+func (r *Registry) uaddr(port uint32) string {
+	ip := net.IPv4zero.To4()
+	if v4 := r.IP.To4(); v4 != nil {
+		ip = v4
+	}
+	return fmt.Sprintf("%d.%d.%d.%d.%d.%d", ip[0], ip[1], ip[2], ip[3], port>>8&0xff, port&0xff)
+}
+
+// parseUaddr splits an IPv4 universal address into address and port.
+func parseUaddr(uaddr string) (net.IP, uint32, bool) {
+	parts := strings.Split(uaddr, ".")
+	if len(parts) != 6 {
+		return nil, 0, false
+	}
+	var b [6]byte
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 8)
+		if err != nil {
+			return nil, 0, false
+		}
+		b[i] = byte(n)
+	}
+	return net.IPv4(b[0], b[1], b[2], b[3]), uint32(b[4])<<8 | uint32(b[5]), true
+}
+
+func protNetid(prot uint32) string {
+	switch prot {
+	case IPProtoUDP:
+		return "udp"
+	case IPProtoTCP:
+		return "tcp"
+	}
+	return ""
+}
+
+func netidProt(netid string) uint32 {
+	switch netid {
+	case "udp":
+		return IPProtoUDP
+	case "tcp":
+		return IPProtoTCP
+	}
+	return 0
+}
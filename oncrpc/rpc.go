@@ -0,0 +1,322 @@
+// Package oncrpc serves ONC RPC version 2 programs (RFC 5531) over UDP and
+// TCP. Programs register handlers for their procedures with a Server, which
+// decodes calls and credentials, dispatches them and encodes the replies,
+// and registers itself with rpcbind through a Registry.
+package oncrpc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"ofw-install-server/xdr"
+)
+
+// RPC message fields
+const (
+	rpcVersion2 = 2
+
+	msgCall  = 0
+	msgReply = 1
+
+	replyAccepted = 0
+	replyDenied   = 1
+
+	rejectRPCMismatch = 0
+	rejectAuthError   = 1
+)
+
+// Auth flavors
+const (
+	AuthNone = 0
+	AuthUnix = 1
+)
+
+// AUTH_UNIX limits (RFC 5531 appendix A)
+const (
+	authUnixMaxMachine = 255
+	authUnixMaxGids    = 16
+	authMaxBody        = 400
+)
+
+// accept_stat values of an accepted reply
+const (
+	AcceptSuccess      = 0
+	AcceptProgUnavail  = 1
+	AcceptProgMismatch = 2
+	AcceptProcUnavail  = 3
+	AcceptGarbageArgs  = 4
+	AcceptSystemErr    = 5
+)
+
+// Errors a Handler returns to answer with the matching accept_stat.
+// ErrNoReply drops the call instead, as servers do for broadcasts they
+// cannot answer.
+var (
+	ErrProgUnavail = errors.New("program unavailable")
+	ErrProcUnavail = errors.New("procedure unavailable")
+	ErrGarbageArgs = errors.New("garbage arguments")
+	ErrSystemErr   = errors.New("system error")
+	ErrNoReply     = errors.New("no reply")
+)
+
+// AuthError is a Handler error denying the call with an auth_stat.
+type AuthError uint32
+
+// auth_stat values
+const (
+	AuthBadCred      AuthError = 1
+	AuthRejectedCred AuthError = 2
+	AuthTooWeak      AuthError = 5
+)
+
+func (e AuthError) Error() string {
+	return fmt.Sprintf("auth_stat %d", uint32(e))
+}
+
+// OpaqueAuth is a credential or verifier as sent.
+type OpaqueAuth struct {
+	Flavor uint32
+	Body   []byte
+}
+
+// AuthUnixCred is an AUTH_UNIX (AUTH_SYS) credential.
+type AuthUnixCred struct {
+	Stamp    uint32
+	Machine  string
+	UID, GID uint32
+	GIDs     []uint32
+}
+
+// InGroup reports whether the caller has gid as primary or supplementary
+// group.
+func (c AuthUnixCred) InGroup(gid uint32) bool {
+	if c.GID == gid {
+		return true
+	}
+	for _, g := range c.GIDs {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAuthUnix decodes the body of an AUTH_UNIX credential:
+//
+//	struct authsys_parms {
+//	    unsigned int stamp;
+//	    string machinename<255>;
+//	    unsigned int uid;
+//	    unsigned int gid;
+//	    unsigned int gids<16>;
+//	};
+func ParseAuthUnix(body []byte) (AuthUnixCred, error) {
+	r := xdr.NewReader(body)
+	var c AuthUnixCred
+	var err error
+	if c.Stamp, err = r.ReadUint32(); err != nil {
+		return c, AuthBadCred
+	}
+	machine, err := r.ReadOpaque()
+	if err != nil || len(machine) > authUnixMaxMachine {
+		return c, AuthBadCred
+	}
+	c.Machine = string(machine)
+	if c.UID, err = r.ReadUint32(); err != nil {
+		return c, AuthBadCred
+	}
+	if c.GID, err = r.ReadUint32(); err != nil {
+		return c, AuthBadCred
+	}
+	n, err := r.ReadUint32()
+	if err != nil || n > authUnixMaxGids {
+		return c, AuthBadCred
+	}
+	c.GIDs = make([]uint32, n)
+	for i := range c.GIDs {
+		if c.GIDs[i], err = r.ReadUint32(); err != nil {
+			return c, AuthBadCred
+		}
+	}
+	if len(r.Remaining()) != 0 {
+		return c, AuthBadCred
+	}
+	return c, nil
+}
+
+// Call is a decoded call message.
+type Call struct {
+	XID, Prog, Vers, Proc uint32
+	Cred, Verf            OpaqueAuth
+	// Unix is the decoded credential of AUTH_UNIX calls, nil for others.
+	Unix *AuthUnixCred
+	// Args decodes the procedure arguments.
+	Args *xdr.Reader
+	// From is the peer the call came from, nil if unknown.
+	From net.Addr
+}
+
+// ParseCall decodes the header of a call message. An AUTH_UNIX credential
+// that cannot be decoded yields AuthBadCred along with the call.
+func ParseCall(msg []byte, from net.Addr) (*Call, error) {
+	r := xdr.NewReader(msg)
+	var hdr [6]uint32
+	for i := range hdr {
+		v, err := r.ReadUint32()
+		if err != nil {
+			return nil, errors.New("short rpc")
+		}
+		hdr[i] = v
+	}
+	if hdr[1] != msgCall {
+		return nil, errors.New("not call")
+	}
+	c := &Call{XID: hdr[0], Prog: hdr[3], Vers: hdr[4], Proc: hdr[5], From: from}
+	if hdr[2] != rpcVersion2 {
+		return c, errRPCMismatch
+	}
+	var err error
+	if c.Cred, err = readOpaqueAuth(r); err != nil {
+		return nil, err
+	}
+	if c.Verf, err = readOpaqueAuth(r); err != nil {
+		return nil, err
+	}
+	c.Args = xdr.NewReader(r.Remaining())
+	if c.Cred.Flavor == AuthUnix {
+		cred, err := ParseAuthUnix(c.Cred.Body)
+		if err != nil {
+			return c, err
+		}
+		c.Unix = &cred
+	}
+	return c, nil
+}
+
+var errRPCMismatch = errors.New("rpc version mismatch")
+
+func readOpaqueAuth(r *xdr.Reader) (OpaqueAuth, error) {
+	flavor, err := r.ReadUint32()
+	if err != nil {
+		return OpaqueAuth{}, err
+	}
+	body, err := r.ReadOpaque()
+	if err != nil || len(body) > authMaxBody {
+		return OpaqueAuth{}, errors.New("bad opaque_auth")
+	}
+	return OpaqueAuth{Flavor: flavor, Body: body}, nil
+}
+
+func writeOpaqueAuth(w *xdr.Writer, a OpaqueAuth) {
+	w.WriteUint32(a.Flavor)
+	w.WriteOpaque(a.Body)
+}
+
+// Encode returns the call message with args as arguments.
+func (c *Call) Encode(args []byte) []byte {
+	w := xdr.NewWriter(make([]byte, 0, 64+len(args)))
+	w.WriteUint32(c.XID)
+	w.WriteUint32(msgCall)
+	w.WriteUint32(rpcVersion2)
+	w.WriteUint32(c.Prog)
+	w.WriteUint32(c.Vers)
+	w.WriteUint32(c.Proc)
+	writeOpaqueAuth(w, c.Cred)
+	writeOpaqueAuth(w, c.Verf)
+	w.WriteFixedOpaque(args)
+	return w.Bytes()
+}
+
+// Accepted returns an accepted reply header with the given accept_stat and
+// an AUTH_NONE verifier.
+func Accepted(xid, stat uint32) []byte {
+	return appendAccepted(make([]byte, 0, 128), xid, stat)
+}
+
+// appendAccepted appends an accepted reply header to b.
+func appendAccepted(b []byte, xid, stat uint32) []byte {
+	w := xdr.NewWriter(b)
+	w.WriteUint32(xid)
+	w.WriteUint32(msgReply)
+	w.WriteUint32(replyAccepted)
+	w.WriteUint32(AuthNone) // verf
+	w.WriteUint32(0)
+	w.WriteUint32(stat)
+	return w.Bytes()
+}
+
+// ProgMismatch accepts the call but reports that only versions low through
+// high of the program are served.
+func ProgMismatch(xid, low, high uint32) []byte {
+	w := xdr.NewWriter(Accepted(xid, AcceptProgMismatch))
+	w.WriteUint32(low)
+	w.WriteUint32(high)
+	return w.Bytes()
+}
+
+// Denied returns a reply denying the call for an authentication error.
+func Denied(xid uint32, stat AuthError) []byte {
+	w := xdr.NewWriter(nil)
+	w.WriteUint32(xid)
+	w.WriteUint32(msgReply)
+	w.WriteUint32(replyDenied)
+	w.WriteUint32(rejectAuthError)
+	w.WriteUint32(uint32(stat))
+	return w.Bytes()
+}
+
+// rpcMismatch denies a call of another RPC version than 2.
+func rpcMismatch(xid uint32) []byte {
+	w := xdr.NewWriter(nil)
+	w.WriteUint32(xid)
+	w.WriteUint32(msgReply)
+	w.WriteUint32(replyDenied)
+	w.WriteUint32(rejectRPCMismatch)
+	w.WriteUint32(rpcVersion2)
+	w.WriteUint32(rpcVersion2)
+	return w.Bytes()
+}
+
+// ParseReply decodes a reply to call xid and returns the results of a
+// successful one.
+func ParseReply(msg []byte, xid uint32) ([]byte, error) {
+	r := xdr.NewReader(msg)
+	var hdr [3]uint32
+	for i := range hdr {
+		v, err := r.ReadUint32()
+		if err != nil {
+			return nil, errors.New("short reply")
+		}
+		hdr[i] = v
+	}
+	switch {
+	case hdr[0] != xid || hdr[1] != msgReply:
+		return nil, errors.New("not a reply to the call")
+	case hdr[2] != replyAccepted:
+		return nil, errors.New("call denied")
+	}
+	if _, err := readOpaqueAuth(r); err != nil {
+		return nil, err
+	}
+	stat, err := r.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	if stat != AcceptSuccess {
+		return nil, fmt.Errorf("accept_stat %d", stat)
+	}
+	return r.Remaining(), nil
+}
+
+// AddrIP returns the IP address of a UDP or TCP peer, nil for other
+// addresses.
+func AddrIP(a net.Addr) net.IP {
+	switch a := a.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package oncrpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+
+	"ofw-install-server/xdr"
+)
+
+func buildCall(xid, prog, vers, proc uint32) []byte {
+	w := xdr.NewWriter(nil)
+	for _, v := range []uint32{xid, msgCall, rpcVersion2, prog, vers, proc, AuthNone, 0, AuthNone, 0} {
+		w.WriteUint32(v)
+	}
+	return w.Bytes()
+}
+
+// buildUnixCall is buildCall with AUTH_UNIX credentials for uid/gid.
+func buildUnixCall(xid, prog, vers, proc, uid, gid uint32, gids ...uint32) []byte {
+	body := xdr.NewWriter(nil)
+	body.WriteUint32(0) // stamp
+	body.WriteOpaque([]byte("client"))
+	body.WriteUint32(uid)
+	body.WriteUint32(gid)
+	body.WriteUint32(uint32(len(gids)))
+	for _, g := range gids {
+		body.WriteUint32(g)
+	}
+	c := &Call{XID: xid, Prog: prog, Vers: vers, Proc: proc, Cred: OpaqueAuth{AuthUnix, body.Bytes()}}
+	return c.Encode(nil)
+}
+
+// acceptStat decodes an accepted reply, failing the test on MSG_DENIED.
+func acceptStat(t *testing.T, resp []byte) (stat uint32, body *xdr.Reader) {
+	t.Helper()
+	r := xdr.NewReader(resp)
+	r.Skip(8)
+	replyStat, err := r.ReadUint32()
+	if err != nil || replyStat != replyAccepted {
+		t.Fatalf("not an accepted reply: %x", resp)
+	}
+	r.Skip(8) // verf
+	stat, err = r.ReadUint32()
+	if err != nil {
+		t.Fatalf("short reply: %x", resp)
+	}
+	return stat, r
+}
+
+func TestParseCall(t *testing.T) {
+	c, err := ParseCall(buildUnixCall(0xdeadbeef, 100003, 3, 1, 1000, 100, 20, 30), nil)
+	if err != nil {
+		t.Fatalf("ParseCall: %v", err)
+	}
+	if c.XID != 0xdeadbeef || c.Prog != 100003 || c.Vers != 3 || c.Proc != 1 || c.Cred.Flavor != AuthUnix {
+		t.Fatalf("header %+v", c)
+	}
+	u := c.Unix
+	if u == nil || u.Machine != "client" || u.UID != 1000 || u.GID != 100 || len(u.GIDs) != 2 || !u.InGroup(30) || u.InGroup(40) {
+		t.Fatalf("AUTH_UNIX: %+v", u)
+	}
+	if c, err := ParseCall(buildCall(1, 100003, 3, 0), nil); err != nil || c.Unix != nil {
+		t.Fatalf("AUTH_NONE: %+v %v", c, err)
+	}
+	// Other flavors are left to the programs.
+	des := buildCall(1, 100003, 3, 0)
+	binary.BigEndian.PutUint32(des[24:28], 3) // AUTH_DES
+	if c, err := ParseCall(des, nil); err != nil || c.Cred.Flavor != 3 || c.Unix != nil {
+		t.Fatalf("AUTH_DES: %+v %v", c, err)
+	}
+
+	tooManyGids := make([]uint32, authUnixMaxGids+1)
+	if _, err := ParseCall(buildUnixCall(1, 100003, 3, 0, 0, 0, tooManyGids...), nil); !errors.Is(err, AuthBadCred) {
+		t.Errorf("too many gids: %v", err)
+	}
+	if c, err := ParseCall(buildUnixCall(1, 100003, 3, 0, 0, 0)[:40], nil); err == nil || c != nil {
+		t.Errorf("truncated: %+v", c)
+	}
+	if c, err := ParseCall(buildCall(1, 100003, 3, 0)[:20], nil); err == nil || c != nil {
+		t.Errorf("short header: %+v", c)
+	}
+}
+
+func TestServerDispatch(t *testing.T) {
+	s := NewServer("test", nil)
+	echo := func(c *Call, w *xdr.Writer) error {
+		v, err := c.Args.ReadUint32()
+		if err != nil {
+			return ErrGarbageArgs
+		}
+		w.WriteUint32(v + 1)
+		return nil
+	}
+	s.Register(300019, 1, Procs{1: echo})
+	s.Register(300019, 3, Procs{
+		1: echo,
+		2: func(c *Call, w *xdr.Writer) error { panic("boom") },
+		3: func(c *Call, w *xdr.Writer) error { return ErrNoReply },
+		4: func(c *Call, w *xdr.Writer) error {
+			if c.Unix == nil || c.Unix.UID != 0 {
+				return AuthTooWeak
+			}
+			return nil
+		},
+		5: func(c *Call, w *xdr.Writer) error { return errors.New("disk on fire") },
+	})
+
+	arg := xdr.NewWriter(buildCall(7, 300019, 3, 1))
+	arg.WriteUint32(41)
+	stat, r := acceptStat(t, s.Handle(arg.Bytes(), nil))
+	if v, _ := r.ReadUint32(); stat != AcceptSuccess || v != 42 {
+		t.Fatalf("echo: accept_stat %d result %d", stat, v)
+	}
+	for _, tc := range []struct {
+		name string
+		call []byte
+		want uint32
+	}{
+		{"NULL", buildCall(1, 300019, 1, 0), AcceptSuccess},
+		{"unknown program", buildCall(1, 300020, 1, 0), AcceptProgUnavail},
+		{"unknown version", buildCall(1, 300019, 2, 0), AcceptProgMismatch},
+		{"unknown procedure", buildCall(1, 300019, 1, 2), AcceptProcUnavail},
+		{"missing arguments", buildCall(1, 300019, 3, 1), AcceptGarbageArgs},
+		{"panic", buildCall(1, 300019, 3, 2), AcceptSystemErr},
+		{"error", buildCall(1, 300019, 3, 5), AcceptSystemErr},
+	} {
+		stat, r := acceptStat(t, s.Handle(tc.call, nil))
+		if stat != tc.want {
+			t.Errorf("%s: accept_stat %d, want %d", tc.name, stat, tc.want)
+		}
+		if stat == AcceptProgMismatch {
+			low, _ := r.ReadUint32()
+			high, _ := r.ReadUint32()
+			if low != 1 || high != 3 {
+				t.Errorf("%s: versions %d-%d, want 1-3", tc.name, low, high)
+			}
+		}
+	}
+	if resp := s.Handle(buildCall(1, 300019, 3, 3), nil); resp != nil {
+		t.Errorf("ErrNoReply answered %x", resp)
+	}
+	if stat, _ := acceptStat(t, s.Handle(buildUnixCall(1, 300019, 3, 4, 0, 0), nil)); stat != AcceptSuccess {
+		t.Errorf("root call: accept_stat %d", stat)
+	}
+	for name, call := range map[string][]byte{
+		"AuthError":           buildCall(1, 300019, 3, 4),
+		"malformed AUTH_UNIX": buildUnixCall(1, 300019, 1, 0, 0, 0, make([]uint32, authUnixMaxGids+1)...),
+	} {
+		r := xdr.NewReader(s.Handle(call, nil))
+		r.Skip(8)
+		replyStat, _ := r.ReadUint32()
+		rejectStat, _ := r.ReadUint32()
+		authStat, _ := r.ReadUint32()
+		if replyStat != replyDenied || rejectStat != rejectAuthError || authStat == 0 {
+			t.Errorf("%s: reply_stat=%d reject_stat=%d auth_stat=%d, want MSG_DENIED AUTH_ERROR", name, replyStat, rejectStat, authStat)
+		}
+	}
+	// Another RPC version is denied with the one we speak.
+	v3 := buildCall(1, 300019, 1, 0)
+	binary.BigEndian.PutUint32(v3[8:12], 3)
+	r = xdr.NewReader(s.Handle(v3, nil))
+	r.Skip(8)
+	replyStat, _ := r.ReadUint32()
+	rejectStat, _ := r.ReadUint32()
+	if low, _ := r.ReadUint32(); replyStat != replyDenied || rejectStat != rejectRPCMismatch || low != rpcVersion2 {
+		t.Errorf("RPC version 3: reply_stat=%d reject_stat=%d low=%d", replyStat, rejectStat, low)
+	}
+}
+
+func TestServerRegistersPrograms(t *testing.T) {
+	s := NewServer("test", nil)
+	s.Register(300019, 3, Procs{})
+	s.Register(300019, 1, Procs{})
+	reg := NewRegistry(nil)
+	pc, err := s.ListenUDP("127.0.0.1:0", reg)
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer pc.Close()
+	port := uint32(pc.LocalAddr().(*net.UDPAddr).Port)
+	for _, vers := range []uint32{1, 3} {
+		if got := reg.Port(300019, vers, IPProtoUDP); got != port {
+			t.Errorf("version %d registered on port %d, want %d", vers, got, port)
+		}
+	}
+	if got := reg.Port(300019, 2, IPProtoUDP); got != 0 {
+		t.Errorf("version 2 registered on port %d", got)
+	}
+
+	// A real round trip.
+	c, err := net.Dial("udp4", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Write(buildCall(9, 300019, 3, 0)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 128)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if res, err := ParseReply(buf[:n], 9); err != nil || len(res) != 0 {
+		t.Fatalf("NULL reply %x: %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,299 @@
+package oncrpc
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"ofw-install-server/xdr"
+)
+
+// rpcbind (RFC 1833): portmap v2 and rpcbind v3/v4 serving a Registry.
+// Local processes may SET and UNSET entries over the loopback interface.
+// CALLIT forwards a call to a registered UDP service and stays silent when
+// it cannot, so that only servers having the program answer a broadcast.
+
+const (
+	ProgramPortmap = 100000
+
+	portmapVersion2 = 2
+	rpcbindVersion3 = 3
+	rpcbindVersion4 = 4
+
+	// portmap v2 procedures
+	procPMAPPROC_NULL    = 0
+	procPMAPPROC_SET     = 1
+	procPMAPPROC_UNSET   = 2
+	procPMAPPROC_GETPORT = 3
+	procPMAPPROC_DUMP    = 4
+	procPMAPPROC_CALLIT  = 5
+
+	// rpcbind v3/v4 procedures; v4 calls CALLIT BCAST
+	procRPCBPROC_SET         = 1
+	procRPCBPROC_UNSET       = 2
+	procRPCBPROC_GETADDR     = 3
+	procRPCBPROC_DUMP        = 4
+	procRPCBPROC_CALLIT      = 5
+	procRPCBPROC_GETTIME     = 6
+	procRPCBPROC_GETVERSADDR = 10
+	procRPCBPROC_INDIRECT    = 11
+)
+
+// callTimeout bounds how long CALLIT and CallUDP wait for a reply.
+const callTimeout = 2 * time.Second
+
+var errUnregistered = errors.New("program not registered")
+
+// NewPortmapServer returns a Server of rpcbind v2-v4 answering from reg.
+func NewPortmapServer(reg *Registry, logger *log.Logger) *Server {
+	b := &rpcbind{reg: reg, logger: logger}
+	s := NewServer("portmap", logger)
+	s.Register(ProgramPortmap, portmapVersion2, Procs{
+		procPMAPPROC_SET:     b.pmapMapping,
+		procPMAPPROC_UNSET:   b.pmapMapping,
+		procPMAPPROC_GETPORT: b.pmapMapping,
+		procPMAPPROC_DUMP:    b.pmapDump,
+		procPMAPPROC_CALLIT:  b.callit,
+	})
+	v3 := Procs{
+		procRPCBPROC_SET:     b.rpcbEntry,
+		procRPCBPROC_UNSET:   b.rpcbEntry,
+		procRPCBPROC_GETADDR: b.rpcbEntry,
+		procRPCBPROC_DUMP:    b.rpcbDump,
+		procRPCBPROC_CALLIT:  b.callit,
+		procRPCBPROC_GETTIME: b.rpcbGettime,
+	}
+	s.Register(ProgramPortmap, rpcbindVersion3, v3)
+	v4 := Procs{
+		procRPCBPROC_GETVERSADDR: b.rpcbEntry,
+		procRPCBPROC_INDIRECT:    b.callit,
+	}
+	for proc, h := range v3 {
+		v4[proc] = h
+	}
+	s.Register(ProgramPortmap, rpcbindVersion4, v4)
+	return s
+}
+
+// StartPortmapServer starts rpcbind over UDP, serving reg and registering
+// itself in it. It listens on UDP :111 by default, unless addr specifies
+// another port.
+func StartPortmapServer(addr string, reg *Registry, logger *log.Logger) (net.PacketConn, error) {
+	if addr == "" {
+		addr = ":111"
+	}
+	return NewPortmapServer(reg, logger).ListenUDP(addr, reg)
+}
+
+// StartPortmapTCP serves rpcbind over TCP, the same as StartPortmapServer
+// does over UDP.
+func StartPortmapTCP(addr string, reg *Registry, logger *log.Logger) (net.Listener, error) {
+	if addr == "" {
+		addr = ":111"
+	}
+	return NewPortmapServer(reg, logger).ListenTCP(addr, reg)
+}
+
+type rpcbind struct {
+	reg    *Registry
+	logger *log.Logger
+}
+
+func (b *rpcbind) logf(format string, args ...any) {
+	if b.logger != nil {
+		b.logger.Printf(format, args...)
+	}
+}
+
+// pmapMapping answers v2 SET, UNSET and GETPORT, whose argument is a mapping.
+func (b *rpcbind) pmapMapping(c *Call, w *xdr.Writer) error {
+	// mapping: prog(4) vers(4) prot(4) port(4)
+	var m [4]uint32
+	for i := range m {
+		v, err := c.Args.ReadUint32()
+		if err != nil {
+			return ErrGarbageArgs
+		}
+		m[i] = v
+	}
+	b.logf("portmap v2 proc %d from %v prog=%d vers=%d prot=%d", c.Proc, c.From, m[0], m[1], m[2])
+	switch {
+	case c.Proc == procPMAPPROC_GETPORT:
+		w.WriteUint32(b.reg.Port(m[0], m[1], m[2]))
+	case !isLocal(c.From):
+		b.logf("portmap v2 proc %d refused for %v: not local", c.Proc, c.From)
+		w.WriteBool(false)
+	case c.Proc == procPMAPPROC_SET:
+		netid := protNetid(m[2])
+		w.WriteBool(netid != "" && m[3] <= 0xffff && b.reg.set(registration{prog: m[0], vers: m[1],
+			netid: netid, addr: b.reg.uaddr(m[3]), owner: "unknown"}))
+	default:
+		// v2 UNSET ignores the protocol and drops every transport.
+		w.WriteBool(b.reg.unset(m[0], m[1], ""))
+	}
+	return nil
+}
+
+func (b *rpcbind) pmapDump(c *Call, w *xdr.Writer) error {
+	// pmaplist: a mapping after each TRUE, then FALSE
+	for _, m := range b.reg.Mappings() {
+		w.WriteBool(true)
+		w.WriteUint32(m.Prog)
+		w.WriteUint32(m.Vers)
+		w.WriteUint32(m.Prot)
+		w.WriteUint32(m.Port)
+	}
+	w.WriteBool(false)
+	return nil
+}
+
+// rpcbEntry answers v3/v4 SET, UNSET, GETADDR and GETVERSADDR, whose argument
+// is an rpcb.
+func (b *rpcbind) rpcbEntry(c *Call, w *xdr.Writer) error {
+	reg, err := readRpcb(c.Args)
+	if err != nil {
+		return ErrGarbageArgs
+	}
+	b.logf("rpcbind v%d proc %d from %v prog=%d vers=%d netid=%q", c.Vers, c.Proc, c.From, reg.prog, reg.vers, reg.netid)
+	switch {
+	case c.Proc == procRPCBPROC_GETADDR, c.Proc == procRPCBPROC_GETVERSADDR:
+		if reg.netid == "" {
+			reg.netid = addrNetid(c.From)
+		}
+		// An empty address tells the program is not registered.
+		e, _ := b.reg.lookup(reg.prog, reg.vers, reg.netid, c.Proc == procRPCBPROC_GETVERSADDR)
+		w.WriteOpaque([]byte(e.addr))
+	case !isLocal(c.From):
+		b.logf("rpcbind v%d proc %d refused for %v: not local", c.Vers, c.Proc, c.From)
+		w.WriteBool(false)
+	case c.Proc == procRPCBPROC_SET:
+		reg.owner = "unknown"
+		w.WriteBool(reg.netid != "" && reg.addr != "" && b.reg.set(reg))
+	default:
+		w.WriteBool(b.reg.unset(reg.prog, reg.vers, reg.netid))
+	}
+	return nil
+}
+
+func (b *rpcbind) rpcbDump(c *Call, w *xdr.Writer) error {
+	// rpcblist: an rpcb after each TRUE, then FALSE
+	for _, e := range b.reg.list() {
+		w.WriteBool(true)
+		writeRpcb(w, e)
+	}
+	w.WriteBool(false)
+	return nil
+}
+
+func (b *rpcbind) rpcbGettime(c *Call, w *xdr.Writer) error {
+	w.WriteUint32(uint32(time.Now().Unix()))
+	return nil
+}
+
+// readRpcb decodes an rpcb: prog, vers, netid, addr and owner.
+func readRpcb(r *xdr.Reader) (registration, error) {
+	var reg registration
+	var err error
+	if reg.prog, err = r.ReadUint32(); err != nil {
+		return reg, err
+	}
+	if reg.vers, err = r.ReadUint32(); err != nil {
+		return reg, err
+	}
+	var s [3][]byte
+	for i := range s {
+		if s[i], err = r.ReadOpaque(); err != nil {
+			return reg, err
+		}
+	}
+	reg.netid, reg.addr, reg.owner = string(s[0]), string(s[1]), string(s[2])
+	return reg, nil
+}
+
+func writeRpcb(w *xdr.Writer, reg registration) {
+	w.WriteUint32(reg.prog)
+	w.WriteUint32(reg.vers)
+	w.WriteOpaque([]byte(reg.netid))
+	w.WriteOpaque([]byte(reg.addr))
+	w.WriteOpaque([]byte(reg.owner))
+}
+
+// callit answers v2 CALLIT, v3 CALLIT, v4 BCAST and v4 INDIRECT by
+// forwarding the call in the arguments (prog, vers, proc, args opaque) to
+// the UDP port of the program on the loopback interface, with the caller's
+// credentials. Only INDIRECT reports failures.
+func (b *rpcbind) callit(c *Call, w *xdr.Writer) error {
+	port, res, err := b.forward(c)
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrGarbageArgs):
+		return err
+	case c.Proc != procRPCBPROC_INDIRECT || c.Vers != rpcbindVersion4:
+		return ErrNoReply
+	case port == 0:
+		return ErrProgUnavail
+	default:
+		return ErrSystemErr
+	}
+	if c.Vers == portmapVersion2 {
+		// call_result: port(4) res opaque
+		w.WriteUint32(port)
+	} else {
+		// rpcb_rmtcallres: addr string, results opaque
+		w.WriteOpaque([]byte(b.reg.uaddr(port)))
+	}
+	w.WriteOpaque(res)
+	return nil
+}
+
+// forward makes the call CALLIT asks for and returns the port of the
+// program, 0 when it is not registered, and the results.
+func (b *rpcbind) forward(c *Call) (port uint32, res []byte, err error) {
+	var hdr [3]uint32
+	for i := range hdr {
+		if hdr[i], err = c.Args.ReadUint32(); err != nil {
+			return 0, nil, ErrGarbageArgs
+		}
+	}
+	args, err := c.Args.ReadOpaque()
+	if err != nil {
+		return 0, nil, ErrGarbageArgs
+	}
+	fwd := &Call{XID: uint32(time.Now().UnixNano()), Prog: hdr[0], Vers: hdr[1], Proc: hdr[2], Cred: c.Cred, Verf: c.Verf}
+	if fwd.Prog == ProgramPortmap {
+		// never call ourselves
+		return 0, nil, errUnregistered
+	}
+	if port = b.reg.Port(fwd.Prog, fwd.Vers, IPProtoUDP); port == 0 {
+		return 0, nil, errUnregistered
+	}
+	if res, err = callUDP(port, fwd, args); err != nil {
+		b.logf("rpcbind CALLIT prog=%d vers=%d proc=%d: %v", fwd.Prog, fwd.Vers, fwd.Proc, err)
+		return port, nil, err
+	}
+	b.logf("rpcbind CALLIT prog=%d vers=%d proc=%d from %v -> port %d", fwd.Prog, fwd.Vers, fwd.Proc, c.From, port)
+	return port, res, nil
+}
+
+// callUDP makes call c over UDP to port on the loopback interface and
+// returns the results of a successful reply.
+func callUDP(port uint32, c *Call, args []byte) ([]byte, error) {
+	return CallUDP(net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))), c, args)
+}
+
+// isLocal reports whether a call came over the loopback interface; only
+// local processes may change the registry.
+func isLocal(from net.Addr) bool {
+	ip := AddrIP(from)
+	return ip != nil && ip.IsLoopback()
+}
+
+// addrNetid returns the netid of the transport a call came over.
+func addrNetid(from net.Addr) string {
+	if _, ok := from.(*net.TCPAddr); ok {
+		return "tcp"
+	}
+	return "udp"
+}
@@ -0,0 +1,301 @@
+package oncrpc
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"ofw-install-server/xdr"
+)
+
+// testRegistry returns a registry with MOUNT on 20048 and NFS on 2049 over
+// UDP, advertised on 192.0.2.1.
+func testRegistry() *Registry {
+	reg := NewRegistry(net.IPv4(192, 0, 2, 1))
+	reg.Register(testProgMountd, &net.UDPAddr{Port: 20048}, 1, 2, 3)
+	reg.Register(testProgNFS, &net.UDPAddr{Port: 2049}, 2, 3)
+	return reg
+}
+
+// Programs the registries hold in these tests.
+const (
+	testProgNFS    = 100003
+	testProgMountd = 100005
+)
+
+var (
+	localCaller  = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 700}
+	remoteCaller = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 700}
+)
+
+func TestHandlePortmapUDP_GetPort(t *testing.T) {
+	xid := uint32(0x12345678)
+	b := buildCall(xid, ProgramPortmap, portmapVersion2, procPMAPPROC_GETPORT)
+	args := make([]byte, 16)
+	binary.BigEndian.PutUint32(args[0:4], testProgNFS)
+	binary.BigEndian.PutUint32(args[4:8], 2)
+	binary.BigEndian.PutUint32(args[8:12], 17)
+	binary.BigEndian.PutUint32(args[12:16], 0)
+	b = append(b, args...)
+	resp := NewPortmapServer(testRegistry(), nil).Handle(b, remoteCaller)
+	if len(resp) < 28 {
+		t.Fatalf("short reply")
+	}
+	if binary.BigEndian.Uint32(resp) != xid {
+		t.Fatalf("xid mismatch")
+	}
+	got := binary.BigEndian.Uint32(resp[len(resp)-4:])
+	if got != 2049 {
+		t.Fatalf("expected port 2049, got %d", got)
+	}
+}
+
+func TestHandlePortmapUDP_GetPortVersions(t *testing.T) {
+	b := NewPortmapServer(testRegistry(), nil)
+	for _, tc := range []struct{ prog, vers, want uint32 }{
+		{testProgNFS, 3, 2049},
+		{testProgNFS, 4, 0},
+		{testProgMountd, 3, 20048},
+		{testProgMountd, 1, 20048},
+	} {
+		if got := pmapGetPort(t, b, tc.prog, tc.vers, IPProtoUDP); got != tc.want {
+			t.Fatalf("GETPORT prog=%d vers=%d: port %d, want %d", tc.prog, tc.vers, got, tc.want)
+		}
+	}
+}
+
+func pmapGetPort(t *testing.T, b *Server, prog, vers, prot uint32) uint32 {
+	t.Helper()
+	w := xdr.NewWriter(buildCall(1, ProgramPortmap, portmapVersion2, procPMAPPROC_GETPORT))
+	w.WriteUint32(prog)
+	w.WriteUint32(vers)
+	w.WriteUint32(prot)
+	w.WriteUint32(0)
+	stat, r := acceptStat(t, b.Handle(w.Bytes(), remoteCaller))
+	port, err := r.ReadUint32()
+	if stat != AcceptSuccess || err != nil {
+		t.Fatalf("GETPORT: accept_stat %d, %v", stat, err)
+	}
+	return port
+}
+
+// pmapSet makes a v2 SET or UNSET call from caller and returns its result.
+func pmapSet(t *testing.T, b *Server, proc uint32, m Mapping, caller net.Addr) bool {
+	t.Helper()
+	w := xdr.NewWriter(buildCall(1, ProgramPortmap, portmapVersion2, proc))
+	w.WriteUint32(m.Prog)
+	w.WriteUint32(m.Vers)
+	w.WriteUint32(m.Prot)
+	w.WriteUint32(m.Port)
+	stat, r := acceptStat(t, b.Handle(w.Bytes(), caller))
+	ok, err := r.ReadBool()
+	if stat != AcceptSuccess || err != nil {
+		t.Fatalf("proc %d: accept_stat %d, %v", proc, stat, err)
+	}
+	return ok
+}
+
+func TestPortmapSetUnset(t *testing.T) {
+	b := NewPortmapServer(testRegistry(), nil)
+	m := Mapping{Prog: 300019, Vers: 1, Prot: IPProtoUDP, Port: 900}
+	if pmapSet(t, b, procPMAPPROC_SET, m, remoteCaller) {
+		t.Fatalf("SET from a remote host succeeded")
+	}
+	if !pmapSet(t, b, procPMAPPROC_SET, m, localCaller) {
+		t.Fatalf("local SET failed")
+	}
+	if pmapSet(t, b, procPMAPPROC_SET, m, localCaller) {
+		t.Fatalf("SET of a registered program succeeded")
+	}
+	if got := pmapGetPort(t, b, m.Prog, m.Vers, IPProtoUDP); got != 900 {
+		t.Fatalf("GETPORT after SET: %d", got)
+	}
+	if pmapSet(t, b, procPMAPPROC_UNSET, m, remoteCaller) {
+		t.Fatalf("UNSET from a remote host succeeded")
+	}
+	if !pmapSet(t, b, procPMAPPROC_UNSET, m, localCaller) {
+		t.Fatalf("local UNSET failed")
+	}
+	if got := pmapGetPort(t, b, m.Prog, m.Vers, IPProtoUDP); got != 0 {
+		t.Fatalf("GETPORT after UNSET: %d", got)
+	}
+	// Built-in services stay registered.
+	if got := pmapGetPort(t, b, testProgNFS, 3, IPProtoUDP); got != 2049 {
+		t.Fatalf("GETPORT nfs: %d", got)
+	}
+}
+
+func TestPortmapDump(t *testing.T) {
+	reg := testRegistry()
+	reg.Register(testProgNFS, &net.TCPAddr{Port: 2049}, 3)
+	reg.set(registration{prog: 100099, vers: 1, netid: "local", addr: "/run/x.sock", owner: "0"})
+	stat, r := acceptStat(t, NewPortmapServer(reg, nil).Handle(buildCall(1, ProgramPortmap, portmapVersion2, procPMAPPROC_DUMP), remoteCaller))
+	if stat != AcceptSuccess {
+		t.Fatalf("DUMP: accept_stat %d", stat)
+	}
+	var got []Mapping
+	for {
+		more, err := r.ReadBool()
+		if err != nil {
+			t.Fatalf("DUMP: %v", err)
+		}
+		if !more {
+			break
+		}
+		var m Mapping
+		m.Prog, _ = r.ReadUint32()
+		m.Vers, _ = r.ReadUint32()
+		m.Prot, _ = r.ReadUint32()
+		m.Port, _ = r.ReadUint32()
+		got = append(got, m)
+	}
+	want := []Mapping{
+		{testProgMountd, 1, IPProtoUDP, 20048},
+		{testProgMountd, 2, IPProtoUDP, 20048},
+		{testProgMountd, 3, IPProtoUDP, 20048},
+		{testProgNFS, 2, IPProtoUDP, 2049},
+		{testProgNFS, 3, IPProtoUDP, 2049},
+		{testProgNFS, 3, IPProtoTCP, 2049},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("DUMP: %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("DUMP entry %d: %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+// rpcbGetAddr makes a v3 or v4 address lookup and returns the universal
+// address.
+func rpcbGetAddr(t *testing.T, b *Server, vers, proc, prog, pvers uint32, netid string) string {
+	t.Helper()
+	w := xdr.NewWriter(buildCall(1, ProgramPortmap, vers, proc))
+	writeRpcb(w, registration{prog: prog, vers: pvers, netid: netid})
+	stat, r := acceptStat(t, b.Handle(w.Bytes(), remoteCaller))
+	addr, err := r.ReadOpaque()
+	if stat != AcceptSuccess || err != nil {
+		t.Fatalf("proc %d: accept_stat %d, %v", proc, stat, err)
+	}
+	return string(addr)
+}
+
+func TestRpcbindGetAddr(t *testing.T) {
+	b := NewPortmapServer(testRegistry(), nil)
+	for _, tc := range []struct {
+		vers, proc, prog, pvers uint32
+		netid, want             string
+	}{
+		{rpcbindVersion3, procRPCBPROC_GETADDR, testProgNFS, 3, "udp", "192.0.2.1.8.1"},
+		{rpcbindVersion4, procRPCBPROC_GETADDR, testProgMountd, 3, "udp", "192.0.2.1.78.80"},
+		// an empty netid means the transport of the call
+		{rpcbindVersion3, procRPCBPROC_GETADDR, testProgNFS, 2, "", "192.0.2.1.8.1"},
+		{rpcbindVersion3, procRPCBPROC_GETADDR, testProgNFS, 3, "tcp", ""},
+		// GETADDR falls back to any version, GETVERSADDR does not
+		{rpcbindVersion4, procRPCBPROC_GETADDR, testProgNFS, 4, "udp", "192.0.2.1.8.1"},
+		{rpcbindVersion4, procRPCBPROC_GETVERSADDR, testProgNFS, 4, "udp", ""},
+		{rpcbindVersion4, procRPCBPROC_GETVERSADDR, testProgNFS, 2, "udp", "192.0.2.1.8.1"},
+		{rpcbindVersion4, procRPCBPROC_GETADDR, 300019, 1, "udp", ""},
+	} {
+		if got := rpcbGetAddr(t, b, tc.vers, tc.proc, tc.prog, tc.pvers, tc.netid); got != tc.want {
+			t.Errorf("v%d proc %d prog=%d vers=%d netid=%q: %q, want %q", tc.vers, tc.proc, tc.prog, tc.pvers, tc.netid, got, tc.want)
+		}
+	}
+}
+
+func TestRpcbindSetAndDump(t *testing.T) {
+	reg := testRegistry()
+	b := NewPortmapServer(reg, nil)
+	set := func(caller net.Addr) bool {
+		w := xdr.NewWriter(buildCall(1, ProgramPortmap, rpcbindVersion4, procRPCBPROC_SET))
+		writeRpcb(w, registration{prog: 300019, vers: 2, netid: "tcp", addr: "0.0.0.0.3.132", owner: "0"})
+		_, r := acceptStat(t, b.Handle(w.Bytes(), caller))
+		ok, _ := r.ReadBool()
+		return ok
+	}
+	if set(remoteCaller) {
+		t.Fatalf("SET from a remote host succeeded")
+	}
+	if !set(localCaller) {
+		t.Fatalf("local SET failed")
+	}
+	if got := reg.Port(300019, 2, IPProtoTCP); got != 900 {
+		t.Fatalf("port after SET: %d", got)
+	}
+
+	stat, r := acceptStat(t, b.Handle(buildCall(1, ProgramPortmap, rpcbindVersion3, procRPCBPROC_DUMP), remoteCaller))
+	if stat != AcceptSuccess {
+		t.Fatalf("DUMP: accept_stat %d", stat)
+	}
+	var got []registration
+	for {
+		more, err := r.ReadBool()
+		if err != nil {
+			t.Fatalf("DUMP: %v", err)
+		}
+		if !more {
+			break
+		}
+		e, err := readRpcb(r)
+		if err != nil {
+			t.Fatalf("DUMP: %v", err)
+		}
+		got = append(got, e)
+	}
+	if len(got) != 6 {
+		t.Fatalf("DUMP: %d entries, want 6: %v", len(got), got)
+	}
+	want := registration{prog: testProgNFS, vers: 3, netid: "udp", addr: "192.0.2.1.8.1", owner: "superuser"}
+	if got[4] != want {
+		t.Fatalf("DUMP nfs entry %+v, want %+v", got[4], want)
+	}
+	if got[5].prog != 300019 || got[5].owner != "unknown" {
+		t.Fatalf("DUMP local entry %+v", got[5])
+	}
+}
+
+func TestPortmapCallit(t *testing.T) {
+	reg := NewRegistry(net.IPv4(192, 0, 2, 1))
+	nfs := NewServer("nfs", nil)
+	nfs.Register(testProgNFS, 2, Procs{})
+	nfs.Register(testProgNFS, 3, Procs{})
+	pc, err := nfs.ListenUDP("127.0.0.1:0", reg)
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer pc.Close()
+	b := NewPortmapServer(reg, nil)
+	port := uint32(pc.LocalAddr().(*net.UDPAddr).Port)
+
+	callit := func(vers, proc, prog uint32) []byte {
+		w := xdr.NewWriter(buildUnixCall(7, ProgramPortmap, vers, proc, 0, 0))
+		w.WriteUint32(prog)
+		w.WriteUint32(3)
+		w.WriteUint32(0) // NULL
+		w.WriteOpaque(nil)
+		return b.Handle(w.Bytes(), remoteCaller)
+	}
+	stat, r := acceptStat(t, callit(portmapVersion2, procPMAPPROC_CALLIT, testProgNFS))
+	got, _ := r.ReadUint32()
+	res, err := r.ReadOpaque()
+	if stat != AcceptSuccess || err != nil || got != port || len(res) != 0 {
+		t.Fatalf("v2 CALLIT: accept_stat %d port %d (want %d) results %x, %v", stat, got, port, res, err)
+	}
+	stat, r = acceptStat(t, callit(rpcbindVersion4, procRPCBPROC_CALLIT, testProgNFS))
+	addr, err := r.ReadOpaque()
+	if stat != AcceptSuccess || err != nil || string(addr) != reg.uaddr(port) {
+		t.Fatalf("v4 BCAST: accept_stat %d addr %q, %v", stat, addr, err)
+	}
+
+	// Broadcasts for programs we do not have go unanswered.
+	if resp := callit(portmapVersion2, procPMAPPROC_CALLIT, 300019); resp != nil {
+		t.Fatalf("CALLIT of an unregistered program answered %x", resp)
+	}
+	if resp := callit(portmapVersion2, procPMAPPROC_CALLIT, ProgramPortmap); resp != nil {
+		t.Fatalf("CALLIT of rpcbind itself answered %x", resp)
+	}
+	if stat, _ := acceptStat(t, callit(rpcbindVersion4, procRPCBPROC_INDIRECT, 300019)); stat != AcceptProgUnavail {
+		t.Fatalf("INDIRECT of an unregistered program: accept_stat %d", stat)
+	}
+}
@@ -0,0 +1,269 @@
+package oncrpc
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"sync"
+
+	"ofw-install-server/xdr"
+)
+
+// A Handler serves one procedure. It decodes the arguments from c.Args and
+// encodes the results to w, which holds the accepted reply header already.
+// Returning one of the Err values or an AuthError answers with the matching
+// status instead; any other error is a SYSTEM_ERR.
+type Handler func(c *Call, w *xdr.Writer) error
+
+// Procs maps the procedure numbers of one program version to handlers.
+// Procedure 0, NULL, answers with no results unless it has a handler.
+type Procs map[uint32]Handler
+
+// Server dispatches the calls of the programs registered with it.
+type Server struct {
+	// Name prefixes log messages.
+	Name   string
+	Logger *log.Logger
+	// Workers bounds how many calls are answered at once, over UDP and
+	// TCP together; DefaultWorkers if 0. Handlers must be safe for
+	// concurrent use, and TCP replies may come out of order, as RPC
+	// allows.
+	Workers int
+
+	progs   map[uint32]map[uint32]Procs
+	cache   replyCache
+	start   sync.Once
+	jobs    chan job
+	buffers sync.Pool // UDP calls
+	replies sync.Pool // replies being built
+}
+
+// DefaultWorkers is the number of calls a Server answers at once unless
+// told otherwise: enough to keep disks and clients busy while some calls
+// wait on I/O.
+const DefaultWorkers = 32
+
+// maxDatagram is the largest UDP call, an NFS WRITE of 32 KB or more on
+// top of the header fitting.
+const maxDatagram = 65535
+
+// job is a call waiting for a worker; reply sends the answer back, and
+// must not keep it since the buffer is reused, done releases the message.
+type job struct {
+	msg   []byte
+	from  net.Addr
+	reply func([]byte)
+	done  func()
+}
+
+// NewServer returns a Server without programs.
+func NewServer(name string, logger *log.Logger) *Server {
+	return &Server{Name: name, Logger: logger, progs: make(map[uint32]map[uint32]Procs)}
+}
+
+// CacheReplies keeps the replies of procs of version vers of prog in the
+// duplicate request cache, so retransmissions of their calls are answered
+// without running them again. It is meant for the procedures that must
+// not run twice, whose replies are small.
+func (s *Server) CacheReplies(prog, vers uint32, procs ...uint32) {
+	if s.cache.procs == nil {
+		s.cache.procs = make(map[[3]uint32]bool)
+	}
+	for _, proc := range procs {
+		s.cache.procs[[3]uint32{prog, vers, proc}] = true
+	}
+}
+
+// Register serves procs as version vers of prog.
+func (s *Server) Register(prog, vers uint32, procs Procs) {
+	if s.progs[prog] == nil {
+		s.progs[prog] = make(map[uint32]Procs)
+	}
+	s.progs[prog][vers] = procs
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.Logger != nil {
+		s.Logger.Printf(s.Name+" "+format, args...)
+	}
+}
+
+// versions returns the versions of prog in increasing order.
+func (s *Server) versions(prog uint32) []uint32 {
+	var vs []uint32
+	for v := range s.progs[prog] {
+		vs = append(vs, v)
+	}
+	sort.Slice(vs, func(i, j int) bool { return vs[i] < vs[j] })
+	return vs
+}
+
+// Handle answers one call message from a peer, returning nil when no
+// reply is to be sent.
+func (s *Server) Handle(msg []byte, from net.Addr) []byte {
+	return s.handle(msg, from, nil)
+}
+
+// handle is Handle building the reply in buf, when it is not nil and the
+// reply is not to be cached.
+func (s *Server) handle(msg []byte, from net.Addr, buf []byte) (resp []byte) {
+	c, err := ParseCall(msg, from)
+	var auth AuthError
+	switch {
+	case c == nil:
+		return nil
+	case errors.Is(err, errRPCMismatch):
+		return rpcMismatch(c.XID)
+	case errors.As(err, &auth):
+		s.logf("bad credentials from %v: %v", from, err)
+		return Denied(c.XID, auth)
+	}
+	if s.cache.cached(c) {
+		k := callKey(c, msg)
+		reply, ok := s.cache.start(k)
+		if !ok {
+			s.logf("v%d proc %d xid %#x from %v: retransmission, %d bytes replayed", c.Vers, c.Proc, c.XID, from, len(reply))
+			return reply
+		}
+		defer func() { s.cache.finish(k, resp) }()
+		buf = nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			s.logf("v%d proc %d failed: %v", c.Vers, c.Proc, r)
+			resp = Accepted(c.XID, AcceptSystemErr)
+		}
+	}()
+	versions, ok := s.progs[c.Prog]
+	if !ok {
+		return Accepted(c.XID, AcceptProgUnavail)
+	}
+	procs, ok := versions[c.Vers]
+	if !ok {
+		vs := s.versions(c.Prog)
+		return ProgMismatch(c.XID, vs[0], vs[len(vs)-1])
+	}
+	h, ok := procs[c.Proc]
+	if !ok {
+		if c.Proc == 0 {
+			return Accepted(c.XID, AcceptSuccess)
+		}
+		return Accepted(c.XID, AcceptProcUnavail)
+	}
+	if buf == nil {
+		buf = make([]byte, 0, 128)
+	}
+	w := xdr.NewWriter(appendAccepted(buf, c.XID, AcceptSuccess))
+	err = h(c, w)
+	switch {
+	case err == nil:
+		return w.Bytes()
+	case errors.As(err, &auth):
+		return Denied(c.XID, auth)
+	case errors.Is(err, ErrNoReply):
+		return nil
+	case errors.Is(err, ErrProgUnavail):
+		return Accepted(c.XID, AcceptProgUnavail)
+	case errors.Is(err, ErrProcUnavail):
+		return Accepted(c.XID, AcceptProcUnavail)
+	case errors.Is(err, ErrGarbageArgs):
+		return Accepted(c.XID, AcceptGarbageArgs)
+	default:
+		s.logf("v%d proc %d failed: %v", c.Vers, c.Proc, err)
+		return Accepted(c.XID, AcceptSystemErr)
+	}
+}
+
+// dispatch hands j to a worker, starting them on first use. It waits for
+// one to be free, which slows readers down instead of queueing without
+// bound.
+func (s *Server) dispatch(j job) {
+	s.start.Do(func() {
+		n := s.Workers
+		if n <= 0 {
+			n = DefaultWorkers
+		}
+		s.jobs = make(chan job)
+		for range n {
+			go s.work()
+		}
+	})
+	s.jobs <- j
+}
+
+// work answers calls, building the replies in pooled buffers large enough
+// for an NFS READ, so that serving a file allocates nothing per call.
+func (s *Server) work() {
+	for j := range s.jobs {
+		buf, _ := s.replies.Get().(*[]byte)
+		if buf == nil {
+			b := make([]byte, 0, maxDatagram)
+			buf = &b
+		}
+		if resp := s.handle(j.msg, j.from, (*buf)[:0]); resp != nil {
+			j.reply(resp)
+		}
+		j.done()
+		s.replies.Put(buf)
+	}
+}
+
+// ServeUDP answers the calls arriving on pc until it is closed.
+func (s *Server) ServeUDP(pc net.PacketConn) {
+	for {
+		buf, _ := s.buffers.Get().(*[]byte)
+		if buf == nil {
+			b := make([]byte, maxDatagram)
+			buf = &b
+		}
+		n, raddr, err := pc.ReadFrom(*buf)
+		if err != nil {
+			s.logf("read error: %v", err)
+			return
+		}
+		s.dispatch(job{
+			msg:   (*buf)[:n],
+			from:  raddr,
+			reply: func(resp []byte) { _, _ = pc.WriteTo(resp, raddr) },
+			done:  func() { s.buffers.Put(buf) },
+		})
+	}
+}
+
+// ListenUDP serves the programs over UDP on addr and registers them in
+// reg, unless it is nil.
+func (s *Server) ListenUDP(addr string, reg *Registry) (net.PacketConn, error) {
+	pc, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.register(reg, pc.LocalAddr())
+	s.logf("listening on udp %s", pc.LocalAddr())
+	go s.ServeUDP(pc)
+	return pc, nil
+}
+
+// ListenTCP serves the programs over TCP on addr and registers them in
+// reg, unless it is nil.
+func (s *Server) ListenTCP(addr string, reg *Registry) (net.Listener, error) {
+	l, err := net.Listen("tcp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.register(reg, l.Addr())
+	s.logf("listening on tcp %s", l.Addr())
+	go s.ServeTCP(l)
+	return l, nil
+}
+
+func (s *Server) register(reg *Registry, addr net.Addr) {
+	var progs []uint32
+	for prog := range s.progs {
+		progs = append(progs, prog)
+	}
+	sort.Slice(progs, func(i, j int) bool { return progs[i] < progs[j] })
+	for _, prog := range progs {
+		reg.Register(prog, addr, s.versions(prog)...)
+	}
+}
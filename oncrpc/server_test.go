@@ -0,0 +1,186 @@
+package oncrpc
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"ofw-install-server/xdr"
+)
+
+// slowServer serves program 1 v1 procedure 1, which takes delay to answer
+// with its argument, like a read waiting on a disk.
+func slowServer(workers int, delay time.Duration) *Server {
+	s := NewServer("test", nil)
+	s.Workers = workers
+	s.Register(1, 1, Procs{1: func(c *Call, w *xdr.Writer) error {
+		time.Sleep(delay)
+		v, err := c.Args.ReadUint32()
+		w.WriteUint32(v)
+		return err
+	}})
+	return s
+}
+
+func slowCall(xid uint32) []byte {
+	return append(buildCall(xid, 1, 1, 1), 0, 0, 0, byte(xid))
+}
+
+func TestServerScalesWithReaders(t *testing.T) {
+	const (
+		readers = 16
+		calls   = 4
+		delay   = 20 * time.Millisecond
+	)
+	pc, err := slowServer(readers, delay).ListenUDP("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer pc.Close()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make(chan error, readers)
+	for i := range readers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range calls {
+				xid := uint32(i*calls + j)
+				res, err := CallUDP(pc.LocalAddr().String(), &Call{XID: xid, Prog: 1, Vers: 1, Proc: 1}, []byte{0, 0, 0, byte(xid)})
+				if err == nil && (len(res) != 4 || res[3] != byte(xid)) {
+					t.Errorf("call %d answered %x", xid, res)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("call: %v", err)
+	}
+	// One at a time, the calls would take readers*calls*delay, 1.28s.
+	serial := readers * calls * delay
+	if elapsed := time.Since(start); elapsed > serial/4 {
+		t.Fatalf("%d readers took %v, one worker would take %v", readers, elapsed, serial)
+	}
+}
+
+func TestServerTCPPipelining(t *testing.T) {
+	const (
+		calls = 8
+		delay = 50 * time.Millisecond
+	)
+	l, err := slowServer(calls, delay).ListenTCP("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	for xid := range uint32(calls) {
+		if err := writeRecord(c, slowCall(xid)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	r := bufio.NewReader(c)
+	seen := make(map[uint32]bool)
+	for range calls {
+		rec, err := readRecord(r)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		xid := uint32(rec[3])
+		res, err := ParseReply(rec, xid)
+		if err != nil || len(res) != 4 || uint32(res[3]) != xid {
+			t.Fatalf("reply %x: %v", rec, err)
+		}
+		seen[xid] = true
+	}
+	if len(seen) != calls {
+		t.Fatalf("replies to %d calls", len(seen))
+	}
+	if elapsed := time.Since(start); elapsed > calls*delay/2 {
+		t.Fatalf("%d pipelined calls took %v", calls, elapsed)
+	}
+}
+
+func TestServerWorkersBound(t *testing.T) {
+	var mu sync.Mutex
+	running, peak := 0, 0
+	s := NewServer("test", nil)
+	s.Workers = 3
+	s.Register(1, 1, Procs{1: func(c *Call, w *xdr.Writer) error {
+		mu.Lock()
+		running++
+		peak = max(peak, running)
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	}})
+	var wg sync.WaitGroup
+	for xid := range uint32(12) {
+		wg.Add(1)
+		s.dispatch(job{msg: buildCall(xid, 1, 1, 1), reply: func([]byte) {}, done: wg.Done})
+	}
+	wg.Wait()
+	if peak != 3 {
+		t.Fatalf("%d calls ran at once, want 3", peak)
+	}
+}
+
+func TestServerTCPClientNotReading(t *testing.T) {
+	s := NewServer("test", nil)
+	s.Workers = 2
+	s.Register(1, 1, Procs{1: func(c *Call, w *xdr.Writer) error {
+		w.WriteOpaque(make([]byte, 60000)) // an NFS READ
+		return nil
+	}})
+	l, err := s.ListenTCP("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("listen tcp: %v", err)
+	}
+	defer l.Close()
+	pc, err := s.ListenUDP("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer pc.Close()
+
+	// A client pipelines far more calls than fit in the socket buffers
+	// and never reads a reply.
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	go func() {
+		for xid := range uint32(1000) {
+			if writeRecord(c, buildCall(xid, 1, 1, 1)) != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// The workers still answer everyone else.
+	for xid := range uint32(3) {
+		if _, err := CallUDP(pc.LocalAddr().String(), &Call{XID: 5000 + xid, Prog: 1, Vers: 1, Proc: 1}, nil); err != nil {
+			t.Fatalf("call while a TCP client does not read: %v", err)
+		}
+	}
+}
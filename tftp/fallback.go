@@ -0,0 +1,129 @@
+package tftp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// maxFallbackTimeout bounds how far repeated stalls stretch the timeout.
+	maxFallbackTimeout = 60 * time.Second
+	// stallTTL is how long the state of a client is kept after its last
+	// transfer: long enough to span the boot attempts of one install.
+	stallTTL = time.Hour
+	// maxStallClients bounds the number of clients tracked.
+	maxStallClients = 1024
+)
+
+// stallTracker remembers, per client, transfers that died waiting for an ACK.
+// Once a client stalls threshold times in a row at the same block, its next
+// attempts are served with more conservative options: half the blksize, no
+// windowing and twice the timeout. Each further series of stalls degrades
+// again until nothing is left to give up. Clients are forgotten stallTTL
+// after their last transfer, and the least recently seen ones past
+// maxStallClients.
+type stallTracker struct {
+	mu        sync.Mutex
+	threshold int
+	clients   map[string]*stallState
+}
+
+type stallState struct {
+	block   uint64 // block the last stall happened at
+	count   int    // consecutive stalls at block
+	level   int    // fallback steps applied so far
+	blksize int    // blksize cap once level > 0
+	timeout time.Duration
+	seen    time.Time // last transfer
+}
+
+func newStallTracker(threshold int) *stallTracker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &stallTracker{threshold: threshold, clients: make(map[string]*stallState)}
+}
+
+// adjust returns p restricted by the fallback state of client, and a
+// description of the change when one applies.
+func (st *stallTracker) adjust(client string, p Policy) (Policy, string) {
+	if st == nil {
+		return p, ""
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s, ok := st.clients[client]
+	if !ok || s.level == 0 || time.Since(s.seen) >= stallTTL {
+		return p, ""
+	}
+	p.MaxBlockSize = min(p.MaxBlockSize, s.blksize)
+	p.WindowSize = 1
+	p.HonorTimeout = false
+	p.Timeout = max(p.Timeout, s.timeout)
+	return p, fmt.Sprintf("fallback level %d: blksize<=%d windowsize=1 timeout=%s", s.level, p.MaxBlockSize, p.Timeout)
+}
+
+// stalled records a transfer to client that timed out at block with options
+// n. It returns a message explaining the fallback when one is triggered.
+func (st *stallTracker) stalled(client string, block uint64, n negotiated) string {
+	if st == nil {
+		return ""
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	s, ok := st.clients[client]
+	if !ok {
+		st.expire(now)
+		s = &stallState{}
+		st.clients[client] = s
+	}
+	s.seen = now
+	if s.count > 0 && s.block == block {
+		s.count++
+	} else {
+		s.block, s.count = block, 1
+	}
+	if s.count < st.threshold {
+		return ""
+	}
+	s.count = 0
+	if n.blksize <= minBlockSize && n.windowsize <= 1 && n.timeout >= maxFallbackTimeout {
+		return fmt.Sprintf("stalled %d times at block %d with %s; no further fallback available", st.threshold, block, n)
+	}
+	s.level++
+	s.blksize = max(minBlockSize, n.blksize/2)
+	s.timeout = min(2*n.timeout, maxFallbackTimeout)
+	return fmt.Sprintf("stalled %d times at block %d with %s; next attempt uses blksize<=%d windowsize=1 timeout=%s",
+		st.threshold, block, n, s.blksize, s.timeout)
+}
+
+// completed clears the stall count of client. The fallback level is kept
+// since the degraded options are the ones known to work.
+func (st *stallTracker) completed(client string) {
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if s, ok := st.clients[client]; ok {
+		s.count, s.seen = 0, time.Now()
+	}
+}
+
+// expire drops the clients not seen for stallTTL and, to make room for one
+// more, the least recently seen ones past maxStallClients.
+func (st *stallTracker) expire(now time.Time) {
+	var oldest string
+	for client, s := range st.clients {
+		if now.Sub(s.seen) >= stallTTL {
+			delete(st.clients, client)
+		} else if oldest == "" || s.seen.Before(st.clients[oldest].seen) {
+			oldest = client
+		}
+	}
+	if len(st.clients) >= maxStallClients {
+		delete(st.clients, oldest)
+	}
+}
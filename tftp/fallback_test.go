@@ -0,0 +1,127 @@
+package tftp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStallTrackerFallback(t *testing.T) {
+	st := newStallTracker(2)
+	base := DefaultPolicy()
+	base.WindowSize = 8
+	n := negotiate(map[string]string{"blksize": "1468", "windowsize": "8"}, base, 100000)
+
+	if msg := st.stalled("10.0.0.5", 42, n); msg != "" {
+		t.Fatalf("first stall should not trigger fallback: %q", msg)
+	}
+	if p, note := st.adjust("10.0.0.5", base); note != "" || p != base {
+		t.Fatalf("policy changed before threshold: %+v", p)
+	}
+	if msg := st.stalled("10.0.0.5", 43, n); msg != "" {
+		t.Fatalf("stall at another block should restart the count: %q", msg)
+	}
+	if msg := st.stalled("10.0.0.5", 43, n); msg == "" {
+		t.Fatalf("expected fallback after two stalls at block 43")
+	}
+	p, note := st.adjust("10.0.0.5", base)
+	if note == "" || p.MaxBlockSize != 734 || p.WindowSize != 1 || p.Timeout != 10*time.Second || p.HonorTimeout {
+		t.Fatalf("unexpected fallback policy: %+v (%s)", p, note)
+	}
+	if _, note := st.adjust("10.0.0.6", base); note != "" {
+		t.Fatalf("fallback leaked to another client")
+	}
+
+	floor := negotiated{blksize: 512, windowsize: 1, timeout: maxFallbackTimeout}
+	st.stalled("10.0.0.5", 7, floor)
+	if msg := st.stalled("10.0.0.5", 7, floor); msg == "" {
+		t.Fatalf("expected a message at the fallback floor")
+	}
+	if p, _ := st.adjust("10.0.0.5", base); p.MaxBlockSize != 734 {
+		t.Fatalf("floor stall should not change the level: %+v", p)
+	}
+
+	if newStallTracker(0) != nil {
+		t.Fatalf("threshold 0 should disable tracking")
+	}
+}
+
+func TestStallTrackerExpires(t *testing.T) {
+	st := newStallTracker(1)
+	n := negotiate(map[string]string{"blksize": "1468"}, DefaultPolicy(), 100000)
+	st.stalled("10.0.0.5", 1, n)
+	st.clients["10.0.0.5"].seen = time.Now().Add(-stallTTL)
+	if _, note := st.adjust("10.0.0.5", DefaultPolicy()); note != "" {
+		t.Fatalf("expired client still falls back: %s", note)
+	}
+	st.stalled("10.0.0.6", 1, n)
+	if _, ok := st.clients["10.0.0.5"]; ok {
+		t.Fatalf("expired client kept")
+	}
+
+	for i := range maxStallClients + 10 {
+		st.stalled(fmt.Sprintf("10.1.%d.%d", i/256, i%256), 1, n)
+	}
+	if len(st.clients) > maxStallClients {
+		t.Fatalf("tracking %d clients, want at most %d", len(st.clients), maxStallClients)
+	}
+	if _, ok := st.clients[fmt.Sprintf("10.1.%d.%d", (maxStallClients+9)/256, (maxStallClients+9)%256)]; !ok {
+		t.Fatalf("latest client evicted")
+	}
+}
+
+func TestServerFallsBackAfterStall(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ofwboot.net")
+	if err := os.WriteFile(path, make([]byte, 3000), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	policy := DefaultPolicy()
+	policy.Timeout = 20 * time.Millisecond
+	policy.Retries = 1
+	srv, err := StartTFTPServer("127.0.0.1:0", Config{
+		DefaultImage:   path,
+		Policies:       NewPolicySet(policy),
+		StallThreshold: 1,
+	}, nil)
+	if err != nil {
+		t.Fatalf("StartTFTPServer: %v", err)
+	}
+	defer srv.Shutdown()
+
+	// Acknowledge the OACK, then never acknowledge block 1.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer conn.Close()
+	rrq := binary.BigEndian.AppendUint16(nil, opRRQ)
+	rrq = append(rrq, "C0A8010A\x00octet\x00blksize\x001468\x00"...)
+	_, _ = conn.WriteTo(rrq, srv.Addr())
+	buf := make([]byte, 2048)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, raddr, err := conn.ReadFromUDP(buf)
+	if err != nil || binary.BigEndian.Uint16(buf[0:2]) != opOACK {
+		t.Fatalf("expected OACK: %v", err)
+	}
+	_, _ = conn.WriteToUDP([]byte{0, opACK, 0, 0}, raddr)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, note := srv.stalls.adjust("127.0.0.1", policy); note != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stall was not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, oack := fetch(t, srv.Addr(), "C0A8010A", "blksize", "1468")
+	if oack["blksize"] != "734" {
+		t.Fatalf("expected fallback blksize 734, got %v", oack)
+	}
+}
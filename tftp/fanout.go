@@ -0,0 +1,114 @@
+package tftp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// fanOutChunk is the unit read from disk and shared between transfers.
+const fanOutChunk = 64 << 10
+
+// fanOut merges concurrent reads of the same file: transfers opened while
+// another one of the same file is in flight share its chunks, so a boot storm
+// reads each chunk from disk once instead of once per client.
+type fanOut struct {
+	mu    sync.Mutex
+	files map[string]*sharedFile
+}
+
+func newFanOut() *fanOut {
+	return &fanOut{files: make(map[string]*sharedFile)}
+}
+
+// sharedFile is a reference-counted, lazily filled in-memory copy of a file.
+type sharedFile struct {
+	owner  *fanOut
+	key    string
+	f      *os.File
+	size   int64
+	chunks []sharedChunk
+	refs   int
+	loads  int // chunks read from disk, for tests and logging
+}
+
+type sharedChunk struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+// open returns a source for path shared with other open transfers of the
+// same file. The key includes size and mtime so a replaced file is not
+// served from a stale copy.
+func (fo *fanOut) open(path string) (*sharedFile, int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	key := fmt.Sprintf("%s:%d:%d", path, fi.Size(), fi.ModTime().UnixNano())
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+	if sf, ok := fo.files[key]; ok {
+		sf.refs++
+		return sf, sf.size, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	sf := &sharedFile{
+		owner:  fo,
+		key:    key,
+		f:      f,
+		size:   fi.Size(),
+		chunks: make([]sharedChunk, (fi.Size()+fanOutChunk-1)/fanOutChunk),
+		refs:   1,
+	}
+	fo.files[key] = sf
+	return sf, sf.size, nil
+}
+
+func (sf *sharedFile) chunk(i int64) ([]byte, error) {
+	c := &sf.chunks[i]
+	c.once.Do(func() {
+		n := min(fanOutChunk, sf.size-i*fanOutChunk)
+		c.data = make([]byte, n)
+		_, c.err = sf.f.ReadAt(c.data, i*fanOutChunk)
+		sf.owner.mu.Lock()
+		sf.loads++
+		sf.owner.mu.Unlock()
+	})
+	return c.data, c.err
+}
+
+func (sf *sharedFile) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) && off < sf.size {
+		data, err := sf.chunk(off / fanOutChunk)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], data[off%fanOutChunk:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close drops a reference; the last one frees the cached chunks.
+func (sf *sharedFile) Close() error {
+	fo := sf.owner
+	fo.mu.Lock()
+	defer fo.mu.Unlock()
+	sf.refs--
+	if sf.refs > 0 {
+		return nil
+	}
+	delete(fo.files, sf.key)
+	return sf.f.Close()
+}
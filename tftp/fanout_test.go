@@ -0,0 +1,59 @@
+package tftp
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFanOutSharesChunks(t *testing.T) {
+	content := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6, 7}, 30000) // 210000 bytes, 4 chunks
+	path := filepath.Join(t.TempDir(), "bsd.rd")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	fo := newFanOut()
+	a, size, err := fo.open(path)
+	if err != nil || size != int64(len(content)) {
+		t.Fatalf("open: size=%d err=%v", size, err)
+	}
+	b, _, err := fo.open(path)
+	if err != nil || a != b {
+		t.Fatalf("second open should share the first: %v", err)
+	}
+	for _, sf := range []*sharedFile{a, b} {
+		got, err := io.ReadAll(io.NewSectionReader(sf, 0, size))
+		if err != nil || !bytes.Equal(got, content) {
+			t.Fatalf("content mismatch: %v", err)
+		}
+	}
+	if a.loads != 4 {
+		t.Fatalf("expected 4 chunk loads for two readers, got %d", a.loads)
+	}
+	buf := make([]byte, 100)
+	if n, err := a.ReadAt(buf, size-10); n != 10 || err != io.EOF {
+		t.Fatalf("short read at end: n=%d err=%v", n, err)
+	}
+
+	a.Close()
+	b.Close()
+	if len(fo.files) != 0 {
+		t.Fatalf("last close should drop the shared copy")
+	}
+
+	c, _, _ := fo.open(path)
+	defer c.Close()
+	if err := os.WriteFile(path, content[:10], 0o644); err != nil {
+		t.Fatalf("rewrite: %v", err)
+	}
+	future := time.Now().Add(time.Hour)
+	_ = os.Chtimes(path, future, future)
+	d, size, err := fo.open(path)
+	if err != nil || d == c || size != 10 {
+		t.Fatalf("changed file should not reuse the old copy: size=%d err=%v", size, err)
+	}
+	d.Close()
+}
@@ -0,0 +1,374 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// MulticastConfig enables RFC 2090 multicast transfers for clients that
+// request the "multicast" option.
+type MulticastConfig struct {
+	// Group is the first group address and the port DATA is sent to.
+	// Concurrent sessions use the addresses following it.
+	Group *net.UDPAddr
+	// Sessions bounds the number of concurrent groups; 0 means 16.
+	Sessions int
+	// Interface, when set, is the interface multicast DATA leaves from.
+	Interface *net.Interface
+	// TTL of multicast DATA; 0 means 1 (local segment only).
+	TTL int
+}
+
+// maxMulticastBlocks keeps block numbers below the 16-bit wrap, since a
+// client that becomes master mid-session acknowledges by block number.
+const maxMulticastBlocks = 65535
+
+// multicaster tracks the multicast sessions of a server, one per file.
+type multicaster struct {
+	s        *Server
+	cfg      MulticastConfig
+	mu       sync.Mutex
+	sessions map[string]*mcastSession
+	slots    []bool
+}
+
+func newMulticaster(s *Server, cfg *MulticastConfig) *multicaster {
+	if cfg == nil || cfg.Group == nil {
+		return nil
+	}
+	c := *cfg
+	if c.Sessions <= 0 {
+		c.Sessions = 16
+	}
+	if c.TTL <= 0 {
+		c.TTL = 1
+	}
+	return &multicaster{s: s, cfg: c, sessions: make(map[string]*mcastSession), slots: make([]bool, c.Sessions)}
+}
+
+// mcastMember is one client of a session. members[0] is the master client,
+// the only one acknowledging blocks; the others listen on the group until
+// they are promoted.
+type mcastMember struct {
+	id      uint64
+	addr    *net.UDPAddr
+	blksize bool // requested blksize, so it may appear in its OACK
+	tsize   bool
+	dropped error
+}
+
+type mcastSession struct {
+	m       *multicaster
+	key     string
+	slot    int
+	group   *net.UDPAddr
+	conn    *net.UDPConn
+	src     source
+	size    int64
+	blksize int
+	timeout time.Duration
+	retries int
+	joins   chan *mcastMember
+	members []*mcastMember
+	recv    []byte
+}
+
+// join adds the client to the session serving path, starting one if needed.
+// It returns false when the request cannot be served by multicast, in which
+// case the caller falls back to a unicast transfer.
+func (m *multicaster) join(id uint64, addr *net.UDPAddr, rq request, path string, policy Policy) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, wantBlksize := rq.opts["blksize"]
+	_, wantTsize := rq.opts["tsize"]
+	mem := &mcastMember{id: id, addr: addr, blksize: wantBlksize, tsize: wantTsize && policy.HonorTsize}
+
+	ss, ok := m.sessions[path]
+	if !ok {
+		var err error
+		if ss, err = m.start(path, rq, policy); err != nil {
+			m.s.logf("RRQ %q from %s: multicast unavailable: %v", rq.filename, addr, err)
+			return false
+		}
+	}
+	if negotiate(rq.opts, policy, ss.size).blksize < ss.blksize {
+		return false
+	}
+	select {
+	case ss.joins <- mem:
+	default:
+		return false
+	}
+	m.s.stats.update(id, func(ts *TransferStats) {
+		ts.Resolved = path
+		ts.Size = ss.size
+		ts.BlockSize = ss.blksize
+		ts.WindowSize = 1
+		ts.Timeout = ss.timeout
+		ts.Multicast = ss.group.String()
+	})
+	m.s.logf("RRQ %q from %s joined multicast %s blksize=%d", rq.filename, addr, ss.group, ss.blksize)
+	return true
+}
+
+// start opens path and creates its session. Called with m.mu held.
+func (m *multicaster) start(path string, rq request, policy Policy) (*mcastSession, error) {
+	slot := -1
+	for i, used := range m.slots {
+		if !used {
+			slot = i
+			break
+		}
+	}
+	if slot < 0 {
+		return nil, errors.New("no free multicast group")
+	}
+	src, size, err := m.s.openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	n := negotiate(rq.opts, policy, size)
+	if size/int64(n.blksize)+1 > maxMulticastBlocks {
+		src.Close()
+		return nil, fmt.Errorf("%d bytes is too large at blksize %d", size, n.blksize)
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	group := &net.UDPAddr{IP: groupIP(m.cfg.Group.IP, slot), Port: m.cfg.Group.Port}
+	if group.IP.IsMulticast() {
+		pc := ipv4.NewPacketConn(conn)
+		if m.cfg.Interface != nil {
+			_ = pc.SetMulticastInterface(m.cfg.Interface)
+		}
+		_ = pc.SetMulticastTTL(m.cfg.TTL)
+	}
+	ss := &mcastSession{
+		m:       m,
+		key:     path,
+		slot:    slot,
+		group:   group,
+		conn:    conn,
+		src:     src,
+		size:    size,
+		blksize: n.blksize,
+		timeout: policy.Timeout,
+		retries: policy.Retries,
+		joins:   make(chan *mcastMember, 64),
+		recv:    make([]byte, 2048),
+	}
+	m.slots[slot] = true
+	m.sessions[path] = ss
+	go ss.run()
+	return ss, nil
+}
+
+func groupIP(base net.IP, slot int) net.IP {
+	ip := make(net.IP, 4)
+	copy(ip, base.To4())
+	for i := 3; i >= 0 && slot > 0; i-- {
+		v := int(ip[i]) + slot
+		ip[i] = byte(v)
+		slot = v >> 8
+	}
+	return ip
+}
+
+// retire removes the session once it has no members and no pending joins.
+func (m *multicaster) retire(ss *mcastSession) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(ss.joins) > 0 {
+		return false
+	}
+	delete(m.sessions, ss.key)
+	m.slots[ss.slot] = false
+	ss.conn.Close()
+	ss.src.Close()
+	return true
+}
+
+func (ss *mcastSession) run() {
+	last := uint64(ss.size/int64(ss.blksize)) + 1
+	for {
+		ss.acceptJoins()
+		if len(ss.members) == 0 {
+			if ss.m.retire(ss) {
+				return
+			}
+			continue
+		}
+		master := ss.members[0]
+		err := ss.serveMaster(master, last)
+		outcome := OutcomeCompleted
+		var se *stallError
+		switch {
+		case master.dropped != nil:
+			outcome, err = OutcomeFailed, master.dropped
+		case errors.As(err, &se):
+			outcome = OutcomeStalled
+		case err != nil:
+			outcome = OutcomeFailed
+		}
+		ss.members = ss.members[1:]
+		ss.m.s.logf("RRQ %s", ss.m.s.stats.finish(master.id, outcome, err))
+		ss.pruneDropped()
+	}
+}
+
+// acceptJoins registers pending clients. All but a new master are told they
+// are passive listeners right away.
+func (ss *mcastSession) acceptJoins() {
+	for {
+		select {
+		case mem := <-ss.joins:
+			ss.members = append(ss.members, mem)
+			if len(ss.members) > 1 {
+				ss.sendOACK(mem, false)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (ss *mcastSession) sendOACK(mem *mcastMember, master bool) {
+	mc := 0
+	if master {
+		mc = 1
+	}
+	var opts []option
+	if mem.blksize {
+		opts = append(opts, option{"blksize", fmt.Sprint(ss.blksize)})
+	}
+	if mem.tsize {
+		opts = append(opts, option{"tsize", fmt.Sprint(ss.size)})
+	}
+	opts = append(opts, option{"multicast", fmt.Sprintf("%s,%d,%d", ss.group.IP, ss.group.Port, mc)})
+	_, _ = ss.conn.WriteToUDP(packOACK(opts), mem.addr)
+}
+
+// serveMaster promotes master and multicasts blocks until it has them all.
+// A promoted client acknowledges the last block it already holds, so
+// transmission resumes right after it.
+func (ss *mcastSession) serveMaster(master *mcastMember, last uint64) error {
+	var next uint64
+	for tries := 0; ; tries++ {
+		if tries > ss.retries {
+			return &stallError{block: 0, retries: ss.retries}
+		}
+		ss.sendOACK(master, true)
+		n, err := ss.waitMaster(master)
+		if err == errTimeout {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		next = uint64(n) + 1
+		break
+	}
+	data := make([]byte, ss.blksize)
+	bs := int64(ss.blksize)
+	tries := 0
+	for next <= last {
+		n, err := ss.src.ReadAt(data, int64(next-1)*bs)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if _, err := ss.conn.WriteToUDP(packData(nil, uint16(next), data[:n]), ss.group); err != nil {
+			return err
+		}
+		if tries > 0 {
+			ss.m.s.stats.update(master.id, func(ts *TransferStats) { ts.Retransmits++ })
+		}
+		ack, err := ss.waitMaster(master)
+		if err == errTimeout {
+			if tries++; tries > ss.retries {
+				return &stallError{block: next, retries: ss.retries}
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// The master acknowledges the last block it holds in sequence, which
+		// may be ahead of next if it heard later blocks while passive.
+		if a := uint64(ack); a >= next && a <= last {
+			next = a + 1
+			tries = 0
+			ss.m.s.stats.update(master.id, func(ts *TransferStats) {
+				ts.BytesSent = min(int64(next-1)*bs, ss.size)
+			})
+		}
+		ss.acceptJoins()
+	}
+	return nil
+}
+
+// waitMaster waits for an ACK from master. ERRORs from passive members drop
+// them; anything else from them is ignored.
+func (ss *mcastSession) waitMaster(master *mcastMember) (uint16, error) {
+	if err := ss.conn.SetReadDeadline(time.Now().Add(ss.timeout)); err != nil {
+		return 0, err
+	}
+	for {
+		n, raddr, err := ss.conn.ReadFromUDP(ss.recv)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return 0, errTimeout
+			}
+			return 0, err
+		}
+		op, num, msg, err := parseReply(ss.recv[:n])
+		if err != nil {
+			continue
+		}
+		mem := ss.member(raddr)
+		if mem == nil {
+			_, _ = ss.conn.WriteToUDP(packError(errUnknownTID, "unknown transfer id"), raddr)
+			continue
+		}
+		if op == opERROR {
+			mem.dropped = fmt.Errorf("client error %d: %s", num, msg)
+			if mem == master {
+				return 0, mem.dropped
+			}
+			continue
+		}
+		if op == opACK && mem == master {
+			return num, nil
+		}
+	}
+}
+
+func (ss *mcastSession) member(addr *net.UDPAddr) *mcastMember {
+	for _, mem := range ss.members {
+		if mem.addr.IP.Equal(addr.IP) && mem.addr.Port == addr.Port {
+			return mem
+		}
+	}
+	return nil
+}
+
+// pruneDropped finishes the records of passive members that sent an ERROR.
+func (ss *mcastSession) pruneDropped() {
+	kept := ss.members[:0]
+	for _, mem := range ss.members {
+		if mem.dropped != nil {
+			ss.m.s.logf("RRQ %s", ss.m.s.stats.finish(mem.id, OutcomeFailed, mem.dropped))
+			continue
+		}
+		kept = append(kept, mem)
+	}
+	ss.members = kept
+}
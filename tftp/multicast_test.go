@@ -0,0 +1,163 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mcastClient is one simulated RFC 2090 client. The group socket is shared
+// by the test since the "group" is a unicast loopback address.
+type mcastClient struct {
+	t      *testing.T
+	conn   *net.UDPConn
+	server *net.UDPAddr // session TID, learned from the OACK
+	blocks map[uint16][]byte
+}
+
+func newMcastClient(t *testing.T, srv net.Addr) *mcastClient {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	rrq := binary.BigEndian.AppendUint16(nil, opRRQ)
+	rrq = append(rrq, "ofwboot.net\x00octet\x00multicast\x00\x00"...)
+	if _, err := conn.WriteTo(rrq, srv); err != nil {
+		t.Fatalf("rrq: %v", err)
+	}
+	return &mcastClient{t: t, conn: conn, blocks: make(map[uint16][]byte)}
+}
+
+// oack waits for an OACK and returns the mc flag of its multicast option.
+func (c *mcastClient) oack() string {
+	buf := make([]byte, 1024)
+	_ = c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, raddr, err := c.conn.ReadFromUDP(buf)
+	if err != nil || binary.BigEndian.Uint16(buf[0:2]) != opOACK {
+		c.t.Fatalf("expected OACK: %v", err)
+	}
+	c.server = raddr
+	fields := strings.Split(string(buf[2:n-1]), "\x00")
+	if len(fields) != 2 || fields[0] != "multicast" {
+		c.t.Fatalf("unexpected OACK %q", fields)
+	}
+	v := strings.Split(fields[1], ",")
+	return v[len(v)-1]
+}
+
+func (c *mcastClient) ack(block uint16) {
+	b := binary.BigEndian.AppendUint16(nil, opACK)
+	b = binary.BigEndian.AppendUint16(b, block)
+	_, _ = c.conn.WriteToUDP(b, c.server)
+}
+
+func (c *mcastClient) contiguous() uint16 {
+	var n uint16
+	for c.blocks[n+1] != nil {
+		n++
+	}
+	return n
+}
+
+func readGroup(t *testing.T, group *net.UDPConn) (uint16, []byte) {
+	buf := make([]byte, 2048)
+	_ = group.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := group.ReadFromUDP(buf)
+	if err != nil || binary.BigEndian.Uint16(buf[0:2]) != opDATA {
+		t.Fatalf("expected DATA on group: %v", err)
+	}
+	return binary.BigEndian.Uint16(buf[2:4]), append([]byte(nil), buf[4:n]...)
+}
+
+func TestMulticastSession(t *testing.T) {
+	content := bytes.Repeat([]byte("sun4u"), 240) // 1200 bytes, 3 blocks
+	path := filepath.Join(t.TempDir(), "ofwboot.net")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	group, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen group: %v", err)
+	}
+	defer group.Close()
+	srv, err := StartTFTPServer("127.0.0.1:0", Config{
+		DefaultImage: path,
+		FanOut:       true,
+		Multicast:    &MulticastConfig{Group: group.LocalAddr().(*net.UDPAddr), Sessions: 1},
+	}, nil)
+	if err != nil {
+		t.Fatalf("StartTFTPServer: %v", err)
+	}
+	defer srv.Shutdown()
+
+	a := newMcastClient(t, srv.Addr())
+	if mc := a.oack(); mc != "1" {
+		t.Fatalf("first client should be master, mc=%s", mc)
+	}
+	a.ack(0)
+	block, data := readGroup(t, group)
+	a.blocks[block] = data
+
+	// B joins while A is master; it becomes a passive listener.
+	b := newMcastClient(t, srv.Addr())
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if act := srv.Stats().Active(); len(act) == 2 && act[1].Multicast != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("second client did not join the session")
+		}
+	}
+	a.ack(1)
+	if mc := b.oack(); mc != "0" {
+		t.Fatalf("second client should be passive, mc=%s", mc)
+	}
+	for a.contiguous() < 3 {
+		block, data := readGroup(t, group)
+		a.blocks[block], b.blocks[block] = data, data
+		a.ack(block)
+	}
+
+	// A is done; B is promoted, acknowledges what it holds and gets block 1.
+	if mc := b.oack(); mc != "1" {
+		t.Fatalf("second client should be promoted, mc=%s", mc)
+	}
+	b.ack(b.contiguous())
+	block, data = readGroup(t, group)
+	if block != 1 {
+		t.Fatalf("expected block 1 for the new master, got %d", block)
+	}
+	b.blocks[block] = data
+	b.ack(b.contiguous())
+
+	for _, c := range []*mcastClient{a, b} {
+		var got []byte
+		for i := uint16(1); i <= 3; i++ {
+			got = append(got, c.blocks[i]...)
+		}
+		if !bytes.Equal(got, content) {
+			t.Fatalf("client content mismatch: %d bytes", len(got))
+		}
+	}
+	var recent []TransferStats
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if recent = srv.Stats().Recent(); len(recent) == 2 {
+			break
+		}
+	}
+	if len(recent) != 2 || recent[0].Outcome != OutcomeCompleted || recent[1].Outcome != OutcomeCompleted || recent[1].Multicast == "" {
+		t.Fatalf("unexpected records: %+v", recent)
+	}
+}
+
+func TestGroupIP(t *testing.T) {
+	if got := groupIP(net.IPv4(239, 255, 0, 254), 3).String(); got != "239.255.1.1" {
+		t.Fatalf("groupIP got=%s", got)
+	}
+}
@@ -0,0 +1,104 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// TFTP opcodes (RFC 1350, RFC 2347)
+const (
+	opRRQ   = 1
+	opWRQ   = 2
+	opDATA  = 3
+	opACK   = 4
+	opERROR = 5
+	opOACK  = 6
+)
+
+// TFTP error codes
+const (
+	errNotDefined      = 0
+	errFileNotFound    = 1
+	errAccessViolation = 2
+	errIllegalOp       = 4
+	errUnknownTID      = 5
+	errOptionRefused   = 8
+)
+
+// request is a decoded RRQ/WRQ. Option names are lower-cased.
+type request struct {
+	op       uint16
+	filename string
+	mode     string
+	opts     map[string]string
+}
+
+// option is a single name/value pair as sent in an OACK.
+type option struct {
+	name  string
+	value string
+}
+
+func parseRequest(b []byte) (request, error) {
+	var rq request
+	if len(b) < 2 {
+		return rq, errors.New("short tftp packet")
+	}
+	rq.op = binary.BigEndian.Uint16(b[0:2])
+	if rq.op != opRRQ && rq.op != opWRQ {
+		return rq, errors.New("not a request")
+	}
+	fields := bytes.Split(b[2:], []byte{0})
+	// A well-formed request ends with a NUL, so the last field is empty.
+	if len(fields) < 3 || len(fields[len(fields)-1]) != 0 {
+		return rq, errors.New("malformed request")
+	}
+	fields = fields[:len(fields)-1]
+	rq.filename = string(fields[0])
+	rq.mode = strings.ToLower(string(fields[1]))
+	rq.opts = make(map[string]string)
+	for i := 2; i+1 < len(fields); i += 2 {
+		rq.opts[strings.ToLower(string(fields[i]))] = string(fields[i+1])
+	}
+	return rq, nil
+}
+
+func packData(buf []byte, block uint16, payload []byte) []byte {
+	buf = buf[:0]
+	buf = binary.BigEndian.AppendUint16(buf, opDATA)
+	buf = binary.BigEndian.AppendUint16(buf, block)
+	return append(buf, payload...)
+}
+
+func packOACK(opts []option) []byte {
+	b := binary.BigEndian.AppendUint16(nil, opOACK)
+	for _, o := range opts {
+		b = append(b, o.name...)
+		b = append(b, 0)
+		b = append(b, o.value...)
+		b = append(b, 0)
+	}
+	return b
+}
+
+func packError(code uint16, msg string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, opERROR)
+	b = binary.BigEndian.AppendUint16(b, code)
+	b = append(b, msg...)
+	return append(b, 0)
+}
+
+// parseReply decodes an ACK or ERROR sent back by the client.
+func parseReply(b []byte) (op, num uint16, msg string, err error) {
+	if len(b) < 4 {
+		return 0, 0, "", errors.New("short tftp packet")
+	}
+	op = binary.BigEndian.Uint16(b[0:2])
+	num = binary.BigEndian.Uint16(b[2:4])
+	if op == opERROR {
+		msg = string(bytes.TrimRight(b[4:], "\x00"))
+	}
+	return op, num, msg, nil
+}
@@ -0,0 +1,240 @@
+package tftp
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Block size bounds from RFC 2348.
+const (
+	minBlockSize = 512
+	maxBlockSize = 65464
+)
+
+// Policy bounds the options negotiated with a client (RFC 2347-2349, RFC 7440).
+type Policy struct {
+	// MaxBlockSize caps the blksize option. Values <= 512 disable blksize negotiation.
+	MaxBlockSize int
+	// WindowSize caps the windowsize option. Values <= 1 disable windowed transfers.
+	WindowSize int
+	// HonorTsize answers the tsize option with the size of the served file.
+	HonorTsize bool
+	// HonorTimeout accepts the timeout the client proposes instead of Timeout.
+	HonorTimeout bool
+	// Timeout is the retransmission timeout for a single round-trip.
+	Timeout time.Duration
+	// Retries is the number of retransmissions of a window before giving up.
+	Retries int
+	// Multicast allows RFC 2090 multicast when the server has it configured.
+	Multicast bool
+}
+
+// DefaultPolicy returns the policy used for clients no rule matches.
+// 1468 bytes keeps a DATA packet within a 1500 byte Ethernet MTU.
+func DefaultPolicy() Policy {
+	return Policy{
+		MaxBlockSize: 1468,
+		WindowSize:   1,
+		HonorTsize:   true,
+		HonorTimeout: true,
+		Timeout:      5 * time.Second,
+		Retries:      5,
+		Multicast:    true,
+	}
+}
+
+func (p Policy) String() string {
+	return fmt.Sprintf("blksize<=%d windowsize<=%d tsize=%v timeout=%s honor-timeout=%v retries=%d multicast=%v",
+		p.MaxBlockSize, p.WindowSize, p.HonorTsize, p.Timeout, p.HonorTimeout, p.Retries, p.Multicast)
+}
+
+// ClientInfo carries what is known about a client when selecting a policy.
+type ClientInfo struct {
+	IP       net.IP
+	MAC      net.HardwareAddr // nil when the allocator has no lease for IP
+	Filename string
+}
+
+// HexSuffix returns the part of the requested file name after the hex IPv4
+// prefix, e.g. "SUN4U" for "C0A8010A.SUN4U". Open Firmware appends the
+// architecture this way, which makes it a handy client class.
+func (c ClientInfo) HexSuffix() string {
+	base := filepath.Base(strings.TrimSpace(c.Filename))
+	if len(base) < 10 || !isHexIPv4Name(base[:8]) || base[8] != '.' {
+		return ""
+	}
+	return strings.ToUpper(base[9:])
+}
+
+// PolicyRule applies Policy to clients matching Selector/Value.
+// Selector is one of "mac", "oui" or "suffix".
+type PolicyRule struct {
+	Selector string
+	Value    string
+	Policy   Policy
+}
+
+func (r PolicyRule) String() string { return r.Selector + "=" + r.Value }
+
+// Matches reports whether the rule selects client c.
+func (r PolicyRule) Matches(c ClientInfo) bool {
+	switch r.Selector {
+	case "mac":
+		return c.MAC != nil && c.MAC.String() == r.Value
+	case "oui":
+		return c.MAC != nil && strings.HasPrefix(c.MAC.String(), r.Value)
+	case "suffix":
+		return c.HexSuffix() == r.Value
+	}
+	return false
+}
+
+// PolicySet is an ordered list of rules; the first match wins.
+type PolicySet struct {
+	Default Policy
+	Rules   []PolicyRule
+}
+
+// NewPolicySet returns a set with def as fallback and no rules.
+func NewPolicySet(def Policy) *PolicySet {
+	return &PolicySet{Default: def}
+}
+
+// Add parses spec with ParsePolicyRule and appends it to the set.
+func (ps *PolicySet) Add(spec string) error {
+	r, err := ParsePolicyRule(spec, ps.Default)
+	if err != nil {
+		return err
+	}
+	ps.Rules = append(ps.Rules, r)
+	return nil
+}
+
+// Select returns the policy for c and a label naming the rule that matched.
+func (ps *PolicySet) Select(c ClientInfo) (Policy, string) {
+	if ps == nil {
+		return DefaultPolicy(), "default"
+	}
+	for _, r := range ps.Rules {
+		if r.Matches(c) {
+			return r.Policy, r.String()
+		}
+	}
+	return ps.Default, "default"
+}
+
+// ParsePolicyRule parses "selector=value,key=value,..." where the first pair
+// selects clients (mac=08:00:20:aa:bb:cc, oui=08:00:20 or suffix=SUN4U) and the
+// remaining pairs override base: blksize, windowsize, tsize, timeout,
+// honor-timeout, retries and multicast.
+func ParsePolicyRule(spec string, base Policy) (PolicyRule, error) {
+	r := PolicyRule{Policy: base}
+	parts := strings.Split(spec, ",")
+	sel, val, ok := strings.Cut(strings.TrimSpace(parts[0]), "=")
+	if !ok || val == "" {
+		return r, fmt.Errorf("policy %q: missing selector", spec)
+	}
+	r.Selector = strings.ToLower(sel)
+	switch r.Selector {
+	case "mac":
+		hw, err := net.ParseMAC(val)
+		if err != nil || len(hw) != 6 {
+			return r, fmt.Errorf("policy %q: invalid mac %q", spec, val)
+		}
+		r.Value = hw.String()
+	case "oui":
+		hw, err := net.ParseMAC(val + ":00:00:00")
+		if err != nil || len(hw) != 6 {
+			return r, fmt.Errorf("policy %q: invalid oui %q", spec, val)
+		}
+		r.Value = hw[:3].String()
+	case "suffix":
+		r.Value = strings.ToUpper(strings.TrimPrefix(val, "."))
+	default:
+		return r, fmt.Errorf("policy %q: unknown selector %q", spec, sel)
+	}
+	for _, kv := range parts[1:] {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return r, fmt.Errorf("policy %q: expected key=value, got %q", spec, kv)
+		}
+		var err error
+		switch strings.ToLower(k) {
+		case "blksize":
+			r.Policy.MaxBlockSize, err = strconv.Atoi(v)
+		case "windowsize":
+			r.Policy.WindowSize, err = strconv.Atoi(v)
+		case "tsize":
+			r.Policy.HonorTsize, err = strconv.ParseBool(v)
+		case "timeout":
+			r.Policy.Timeout, err = time.ParseDuration(v)
+		case "honor-timeout":
+			r.Policy.HonorTimeout, err = strconv.ParseBool(v)
+		case "retries":
+			r.Policy.Retries, err = strconv.Atoi(v)
+		case "multicast":
+			r.Policy.Multicast, err = strconv.ParseBool(v)
+		default:
+			return r, fmt.Errorf("policy %q: unknown option %q", spec, k)
+		}
+		if err != nil {
+			return r, fmt.Errorf("policy %q: %s: %v", spec, k, err)
+		}
+	}
+	return r, nil
+}
+
+// negotiated holds the options in effect for one transfer.
+type negotiated struct {
+	blksize    int
+	windowsize int
+	timeout    time.Duration
+	tsize      int64 // -1 when not negotiated
+	oack       []option
+}
+
+func (n negotiated) String() string {
+	ts := "-"
+	if n.tsize >= 0 {
+		ts = strconv.FormatInt(n.tsize, 10)
+	}
+	return fmt.Sprintf("blksize=%d windowsize=%d timeout=%s tsize=%s", n.blksize, n.windowsize, n.timeout, ts)
+}
+
+// negotiate applies p to the options requested by the client. Options the
+// policy refuses are simply left out of the OACK, as RFC 2347 allows.
+func negotiate(req map[string]string, p Policy, size int64) negotiated {
+	n := negotiated{blksize: minBlockSize, windowsize: 1, timeout: p.Timeout, tsize: -1}
+	if v, ok := req["blksize"]; ok && p.MaxBlockSize > minBlockSize {
+		if bs, err := strconv.Atoi(v); err == nil && bs >= 8 {
+			bs = min(bs, p.MaxBlockSize, maxBlockSize)
+			n.blksize = bs
+			n.oack = append(n.oack, option{"blksize", strconv.Itoa(bs)})
+		}
+	}
+	if v, ok := req["timeout"]; ok && p.HonorTimeout {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 1 && secs <= 255 {
+			n.timeout = time.Duration(secs) * time.Second
+			n.oack = append(n.oack, option{"timeout", v})
+		}
+	}
+	if _, ok := req["tsize"]; ok && p.HonorTsize && size >= 0 {
+		n.tsize = size
+		n.oack = append(n.oack, option{"tsize", strconv.FormatInt(size, 10)})
+	}
+	if v, ok := req["windowsize"]; ok && p.WindowSize > 1 {
+		if ws, err := strconv.Atoi(v); err == nil && ws >= 1 {
+			ws = min(ws, p.WindowSize, 65535)
+			n.windowsize = ws
+			n.oack = append(n.oack, option{"windowsize", strconv.Itoa(ws)})
+		}
+	}
+	if n.timeout <= 0 {
+		n.timeout = DefaultPolicy().Timeout
+	}
+	return n
+}
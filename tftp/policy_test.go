@@ -0,0 +1,58 @@
+package tftp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParsePolicyRuleAndSelect(t *testing.T) {
+	ps := NewPolicySet(DefaultPolicy())
+	for _, spec := range []string{
+		"mac=08:00:20:aa:bb:cc,blksize=8192,windowsize=8",
+		"oui=08:00:20,blksize=512,tsize=false,timeout=10s,retries=9",
+		"suffix=.sun4v,windowsize=16",
+	} {
+		if err := ps.Add(spec); err != nil {
+			t.Fatalf("Add(%q): %v", spec, err)
+		}
+	}
+	mac := func(s string) net.HardwareAddr { hw, _ := net.ParseMAC(s); return hw }
+
+	p, rule := ps.Select(ClientInfo{MAC: mac("08:00:20:aa:bb:cc")})
+	if rule != "mac=08:00:20:aa:bb:cc" || p.MaxBlockSize != 8192 || p.WindowSize != 8 {
+		t.Fatalf("mac rule: %s %+v", rule, p)
+	}
+	p, rule = ps.Select(ClientInfo{MAC: mac("08:00:20:01:02:03")})
+	if rule != "oui=08:00:20" || p.MaxBlockSize != 512 || p.HonorTsize || p.Timeout != 10*time.Second || p.Retries != 9 {
+		t.Fatalf("oui rule: %s %+v", rule, p)
+	}
+	p, rule = ps.Select(ClientInfo{Filename: "C0A8010A.SUN4V"})
+	if rule != "suffix=SUN4V" || p.WindowSize != 16 {
+		t.Fatalf("suffix rule: %s %+v", rule, p)
+	}
+	if _, rule = ps.Select(ClientInfo{Filename: "C0A8010A"}); rule != "default" {
+		t.Fatalf("expected default, got %s", rule)
+	}
+
+	for _, bad := range []string{"", "blksize=512", "ip=1.2.3.4", "oui=zz", "mac=08:00:20:aa:bb:cc,bogus=1", "suffix=X,windowsize=x"} {
+		if _, err := ParsePolicyRule(bad, DefaultPolicy()); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	p := DefaultPolicy()
+	p.WindowSize = 4
+	n := negotiate(map[string]string{"blksize": "65464", "tsize": "0", "timeout": "3", "windowsize": "32"}, p, 1000)
+	if n.blksize != 1468 || n.windowsize != 4 || n.timeout != 3*time.Second || n.tsize != 1000 || len(n.oack) != 4 {
+		t.Fatalf("unexpected negotiation: %s oack=%v", n, n.oack)
+	}
+
+	p = Policy{MaxBlockSize: 512, WindowSize: 1, Timeout: time.Second}
+	n = negotiate(map[string]string{"blksize": "1428", "tsize": "0", "timeout": "3", "windowsize": "8"}, p, 1000)
+	if n.blksize != 512 || n.windowsize != 1 || n.timeout != time.Second || n.tsize != -1 || len(n.oack) != 0 {
+		t.Fatalf("expected all options refused: %s oack=%v", n, n.oack)
+	}
+}
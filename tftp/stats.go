@@ -0,0 +1,150 @@
+package tftp
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Outcome is the state a transfer ended in.
+type Outcome string
+
+const (
+	OutcomeActive    Outcome = "active"
+	OutcomeCompleted Outcome = "completed"
+	OutcomeStalled   Outcome = "stalled" // client stopped acknowledging
+	OutcomeFailed    Outcome = "failed"  // client error, missing file, I/O error
+)
+
+// maxRecentTransfers bounds how many finished transfers Stats remembers.
+const maxRecentTransfers = 256
+
+// TransferStats is the accounting record of one read transfer.
+type TransferStats struct {
+	ID          uint64
+	Client      net.UDPAddr
+	MAC         net.HardwareAddr // nil if unknown to the allocator
+	Requested   string           // file name sent by the client
+	Resolved    string           // what was actually served
+	Policy      string           // label of the policy rule applied
+	BlockSize   int
+	WindowSize  int
+	Timeout     time.Duration
+	Multicast   string // group address for RFC 2090 transfers, "" for unicast
+	Size        int64  // bytes to send; -1 until the source is opened
+	BytesSent   int64  // bytes acknowledged by the client so far
+	Retransmits int    // packets sent more than once
+	Start       time.Time
+	Duration    time.Duration
+	Outcome     Outcome
+	Err         string
+}
+
+// Throughput returns the acknowledged bytes per second.
+func (ts TransferStats) Throughput() float64 {
+	if ts.Duration <= 0 {
+		return 0
+	}
+	return float64(ts.BytesSent) / ts.Duration.Seconds()
+}
+
+func (ts TransferStats) String() string {
+	s := fmt.Sprintf("%s %q from %s resolved=%q %d/%d bytes in %s (%.1f KiB/s) blksize=%d windowsize=%d timeout=%s retransmits=%d",
+		ts.Outcome, ts.Requested, &ts.Client, ts.Resolved, ts.BytesSent, ts.Size, ts.Duration.Round(time.Millisecond),
+		ts.Throughput()/1024, ts.BlockSize, ts.WindowSize, ts.Timeout, ts.Retransmits)
+	if ts.Multicast != "" {
+		s += " multicast=" + ts.Multicast
+	}
+	if ts.Err != "" {
+		s += ": " + ts.Err
+	}
+	return s
+}
+
+// Stats tracks active transfers and remembers the most recent finished ones.
+// It is safe for concurrent use.
+type Stats struct {
+	mu     sync.Mutex
+	nextID uint64
+	active map[uint64]*TransferStats
+	recent []TransferStats
+}
+
+func newStats() *Stats {
+	return &Stats{active: make(map[uint64]*TransferStats)}
+}
+
+func (st *Stats) begin(ts TransferStats) uint64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.nextID++
+	ts.ID = st.nextID
+	ts.Outcome = OutcomeActive
+	st.active[ts.ID] = &ts
+	return ts.ID
+}
+
+func (st *Stats) update(id uint64, fn func(*TransferStats)) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if ts, ok := st.active[id]; ok {
+		fn(ts)
+		ts.Duration = time.Since(ts.Start)
+	}
+}
+
+// finish moves transfer id to the recent list and returns its final record.
+func (st *Stats) finish(id uint64, outcome Outcome, err error) TransferStats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	ts, ok := st.active[id]
+	if !ok {
+		return TransferStats{}
+	}
+	delete(st.active, id)
+	ts.Duration = time.Since(ts.Start)
+	ts.Outcome = outcome
+	if err != nil {
+		ts.Err = err.Error()
+	}
+	st.recent = append(st.recent, *ts)
+	if len(st.recent) > maxRecentTransfers {
+		st.recent = st.recent[len(st.recent)-maxRecentTransfers:]
+	}
+	return *ts
+}
+
+// Active returns a snapshot of the transfers in progress, oldest first.
+func (st *Stats) Active() []TransferStats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out := make([]TransferStats, 0, len(st.active))
+	for _, ts := range st.active {
+		cp := *ts
+		cp.Duration = time.Since(ts.Start)
+		out = append(out, cp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Recent returns the most recently finished transfers, oldest first.
+func (st *Stats) Recent() []TransferStats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return append([]TransferStats(nil), st.recent...)
+}
+
+// Client returns the active and recent transfers of the client at ip.
+func (st *Stats) Client(ip net.IP) []TransferStats {
+	var out []TransferStats
+	for _, ts := range append(st.Recent(), st.Active()...) {
+		if ts.Client.IP.Equal(ip) {
+			out = append(out, ts)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
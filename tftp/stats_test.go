@@ -0,0 +1,61 @@
+package tftp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStatsLifecycle(t *testing.T) {
+	st := newStats()
+	client := net.UDPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 1024}
+	id := st.begin(TransferStats{Client: client, Requested: "C0A8010A", Start: time.Now()})
+	st.update(id, func(ts *TransferStats) { ts.BytesSent = 512 })
+	if act := st.Active(); len(act) != 1 || act[0].Outcome != OutcomeActive || act[0].BytesSent != 512 {
+		t.Fatalf("unexpected active: %+v", act)
+	}
+	ts := st.finish(id, OutcomeFailed, errors.New("boom"))
+	if ts.Outcome != OutcomeFailed || ts.Err != "boom" || len(st.Active()) != 0 {
+		t.Fatalf("unexpected finish: %+v", ts)
+	}
+	if got := st.Client(client.IP); len(got) != 1 || got[0].ID != id {
+		t.Fatalf("Client lookup: %+v", got)
+	}
+	for i := 0; i < maxRecentTransfers+10; i++ {
+		st.finish(st.begin(TransferStats{Start: time.Now()}), OutcomeCompleted, nil)
+	}
+	if n := len(st.Recent()); n != maxRecentTransfers {
+		t.Fatalf("recent not bounded: %d", n)
+	}
+}
+
+func TestServerRecordsTransfers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ofwboot.net")
+	if err := os.WriteFile(path, make([]byte, 5000), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	srv, err := StartTFTPServer("127.0.0.1:0", Config{DefaultImage: path}, nil)
+	if err != nil {
+		t.Fatalf("StartTFTPServer: %v", err)
+	}
+	defer srv.Shutdown()
+	fetch(t, srv.Addr(), "C0A8010A", "blksize", "1024", "tsize", "0")
+
+	var recent []TransferStats
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if recent = srv.Stats().Recent(); len(recent) == 1 {
+			break
+		}
+	}
+	if len(recent) != 1 {
+		t.Fatalf("expected one finished transfer, got %d", len(recent))
+	}
+	ts := recent[0]
+	if ts.Outcome != OutcomeCompleted || ts.Requested != "C0A8010A" || ts.Resolved != path ||
+		ts.Size != 5000 || ts.BytesSent != 5000 || ts.BlockSize != 1024 || ts.Retransmits != 0 {
+		t.Fatalf("unexpected record: %+v", ts)
+	}
+}
@@ -0,0 +1,107 @@
+package tftp
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// TemplateFacts is the data a TFTP template is rendered with.
+type TemplateFacts struct {
+	IP       string // client IPv4, dotted
+	HexIP    string // client IPv4 as 8 upper-case hex digits, as OBP requests it
+	MAC      string // "" if the allocator has no lease for IP
+	Hostname string
+	Profile  string
+	ServerIP string
+	Filename string // name requested by the client
+}
+
+// Templates maps virtual TFTP paths to templates rendered per client.
+type Templates struct {
+	byPath map[string]*template.Template
+}
+
+// NewTemplates returns an empty template set.
+func NewTemplates() *Templates {
+	return &Templates{byPath: make(map[string]*template.Template)}
+}
+
+// virtualPath normalizes a requested name so "/pxelinux.cfg/default" and
+// "pxelinux.cfg/default" resolve to the same template.
+func virtualPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(strings.TrimSpace(name), "\\", "/")), "/")
+}
+
+// Add registers text as the template served for virtual path name.
+func (ts *Templates) Add(name, text string) error {
+	vp := virtualPath(name)
+	tmpl, err := template.New(vp).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return fmt.Errorf("template %q: %w", name, err)
+	}
+	ts.byPath[vp] = tmpl
+	return nil
+}
+
+// AddFile registers the content of file as the template for name.
+func (ts *Templates) AddFile(name, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return ts.Add(name, string(data))
+}
+
+// AddDir registers every regular file below dir under its path relative to dir.
+func (ts *Templates) AddDir(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		return ts.AddFile(filepath.ToSlash(rel), p)
+	})
+}
+
+// Len returns the number of registered templates.
+func (ts *Templates) Len() int {
+	if ts == nil {
+		return 0
+	}
+	return len(ts.byPath)
+}
+
+func (ts *Templates) has(name string) bool {
+	if ts == nil {
+		return false
+	}
+	_, ok := ts.byPath[virtualPath(name)]
+	return ok
+}
+
+// render returns the output of the template for name, or ok=false when name
+// is not a virtual path.
+func (ts *Templates) render(name string, facts TemplateFacts) (out []byte, resolved string, ok bool, err error) {
+	if ts == nil {
+		return nil, "", false, nil
+	}
+	vp := virtualPath(name)
+	tmpl, ok := ts.byPath[vp]
+	if !ok {
+		return nil, "", false, nil
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, facts); err != nil {
+		return nil, "", true, err
+	}
+	return buf.Bytes(), "template:" + vp, true, nil
+}
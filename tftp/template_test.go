@@ -0,0 +1,76 @@
+package tftp
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"ofw-install-server/utils"
+)
+
+func TestTemplatesRender(t *testing.T) {
+	ts := NewTemplates()
+	if err := ts.Add("/pxelinux.cfg/default", "ip={{.IP}} hex={{.HexIP}} host={{.Hostname}}"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := ts.Add("broken", "{{.Nope"); err == nil {
+		t.Fatalf("expected parse error")
+	}
+	facts := TemplateFacts{IP: "10.0.0.5", HexIP: "0A000005", Hostname: "t1000-a"}
+	out, resolved, ok, err := ts.render("pxelinux.cfg\\default", facts)
+	if !ok || err != nil || string(out) != "ip=10.0.0.5 hex=0A000005 host=t1000-a" || resolved != "template:pxelinux.cfg/default" {
+		t.Fatalf("render: ok=%v err=%v out=%q resolved=%q", ok, err, out, resolved)
+	}
+	if _, _, ok, _ := ts.render("C0A8010A", facts); ok {
+		t.Fatalf("non-template name should not resolve")
+	}
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "etc"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "etc", "boot.conf"), []byte("set image {{.Profile}}\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := ts.AddDir(dir); err != nil {
+		t.Fatalf("AddDir: %v", err)
+	}
+	if out, _, ok, _ := ts.render("/etc/boot.conf", TemplateFacts{Profile: "bsd.rd"}); !ok || string(out) != "set image bsd.rd\n" {
+		t.Fatalf("dir template: ok=%v out=%q", ok, out)
+	}
+}
+
+func TestServerServesTemplate(t *testing.T) {
+	alloc, err := utils.NewIPv4AllocatorFromCIDR("127.0.0.0/8")
+	if err != nil {
+		t.Fatalf("allocator: %v", err)
+	}
+	mac := [6]byte{0x08, 0x00, 0x20, 0x0a, 0x0b, 0x0c}
+	if ip, ok := alloc.AllocateForMAC(mac); !ok || !net.IP(ip[:]).Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("expected lease on 127.0.0.1, got %v", ip)
+	}
+	alloc.SetHost(mac, utils.HostInfo{Hostname: "t1000-a", Profile: "openbsd"})
+
+	ts := NewTemplates()
+	if err := ts.Add("boot.conf", "{{.Hostname}} {{.MAC}} {{.Profile}} {{.ServerIP}}\n"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	srv, err := StartTFTPServer("127.0.0.1:0", Config{
+		DefaultImage: filepath.Join(t.TempDir(), "missing"),
+		Allocator:    alloc,
+		Templates:    ts,
+		ServerIP:     net.IPv4(127, 0, 0, 2),
+	}, nil)
+	if err != nil {
+		t.Fatalf("StartTFTPServer: %v", err)
+	}
+	defer srv.Shutdown()
+
+	want := "t1000-a 08:00:20:0a:0b:0c openbsd 127.0.0.2\n"
+	got, oack := fetch(t, srv.Addr(), "/boot.conf", "tsize", "0")
+	if string(got) != want || oack["tsize"] != strconv.Itoa(len(want)) {
+		t.Fatalf("got %q oack=%v", got, oack)
+	}
+}
@@ -1,14 +1,18 @@
 package tftp
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
-	tftp "github.com/pin/tftp/v3"
+	"ofw-install-server/utils"
 )
 
 func isHexIPv4Name(name string) bool {
@@ -24,37 +28,304 @@ func isHexIPv4Name(name string) bool {
 	return true
 }
 
-func serveFile(path string, rf io.ReaderFrom) error {
-	f, err := os.Open(path)
+// Config describes what the TFTP server serves and how it negotiates.
+type Config struct {
+	// DefaultImage is served for every read request.
+	DefaultImage string
+	// Allocator, when set, maps client IPs back to MACs for policy selection.
+	Allocator *utils.IPv4Allocator
+	// Policies selects negotiation limits per client; nil means DefaultPolicy.
+	Policies *PolicySet
+	// Templates maps virtual paths to per-client generated content; requests
+	// for any other name get DefaultImage.
+	Templates *Templates
+	// ServerIP is exposed to templates as .ServerIP.
+	ServerIP net.IP
+	// FanOut shares file reads between concurrent transfers of the same file.
+	FanOut bool
+	// Multicast, when set, enables RFC 2090 multicast transfers.
+	Multicast *MulticastConfig
+	// StallThreshold is how many consecutive stalls at the same block make
+	// the next attempt of that client fall back to safer options; 0 disables.
+	StallThreshold int
+}
+
+// Server is a read-only TFTP server (RFC 1350) with option negotiation
+// (RFC 2347, 2348, 2349) and windowed transfers (RFC 7440).
+type Server struct {
+	cfg    Config
+	conn   net.PacketConn
+	stalls *stallTracker
+	stats  *Stats
+	fanout *fanOut
+	mcast  *multicaster
+	logger *log.Logger
+}
+
+// StartTFTPServer serves cfg.DefaultImage for every requested path that is
+// not one of cfg.Templates.
+func StartTFTPServer(addr string, cfg Config, logger *log.Logger) (*Server, error) {
+	if addr == "" {
+		addr = ":69"
+	}
+	pc, err := net.ListenPacket("udp4", addr)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	s := &Server{cfg: cfg, conn: pc, stalls: newStallTracker(cfg.StallThreshold), stats: newStats(), logger: logger}
+	if cfg.FanOut {
+		s.fanout = newFanOut()
+	}
+	s.mcast = newMulticaster(s, cfg.Multicast)
+	go func() {
+		s.logf("TFTP server listening on %s, serving=%q templates=%d", addr, cfg.DefaultImage, cfg.Templates.Len())
+		if err := s.serve(); err != nil {
+			s.logf("TFTP server error: %v", err)
+		}
+	}()
+	return s, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() net.Addr { return s.conn.LocalAddr() }
+
+// Shutdown stops accepting requests. Transfers in flight run to completion.
+func (s *Server) Shutdown() error { return s.conn.Close() }
+
+func (s *Server) logf(format string, args ...any) {
+	if s.logger != nil {
+		s.logger.Printf(format, args...)
 	}
-	defer f.Close()
-	_, err = rf.ReadFrom(f)
-	return err
 }
 
-// TFTP server only serving the same file regardless of requested path
-func StartTFTPServer(addr, defaultImage string, logger *log.Logger) (*tftp.Server, error) {
-	readHandler := func(filename string, rf io.ReaderFrom) error {
-		base := filepath.Base(strings.TrimSpace(filename))
-		if isHexIPv4Name(base) {
-			logger.Printf("HexIPv4 '%s' form detected", base)
+func (s *Server) serve() error {
+	buf := make([]byte, 2048)
+	for {
+		n, raddr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		udpAddr, ok := raddr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		rq, err := parseRequest(buf[:n])
+		if err != nil {
+			s.logf("ignoring packet from %s: %v", raddr, err)
+			continue
 		}
-		return serveFile(defaultImage, rf)
+		if rq.op == opWRQ {
+			_, _ = s.conn.WriteTo(packError(errAccessViolation, "write not supported"), raddr)
+			continue
+		}
+		go s.handleRead(udpAddr, rq)
 	}
+}
 
-	// Write handler not used.
-	srv := tftp.NewServer(readHandler, nil)
-	srv.SetTimeout(5 * time.Second)
+func (s *Server) clientInfo(addr *net.UDPAddr, filename string) ClientInfo {
+	c := ClientInfo{IP: addr.IP, Filename: filename}
+	if s.cfg.Allocator != nil {
+		if mac, ok := s.cfg.Allocator.MACForIP(addr.IP); ok {
+			c.MAC = mac
+		}
+	}
+	return c
+}
 
-	go func() {
-		logger.Printf("TFTP server listening on %s, serving=%q", addr, defaultImage)
-		if err := srv.ListenAndServe(addr); err != nil {
-			if logger != nil {
-				logger.Printf("TFTP server error: %v", err)
+func (s *Server) handleRead(addr *net.UDPAddr, rq request) {
+	base := filepath.Base(strings.TrimSpace(rq.filename))
+	if isHexIPv4Name(base) {
+		s.logf("HexIPv4 '%s' form detected", base)
+	}
+	client := s.clientInfo(addr, rq.filename)
+	policy, rule := s.cfg.Policies.Select(client)
+	key := addr.IP.String()
+	if p, note := s.stalls.adjust(key, policy); note != "" {
+		s.logf("RRQ %q from %s: %s", rq.filename, addr, note)
+		policy = p
+	}
+	id := s.stats.begin(TransferStats{
+		Client:    *addr,
+		MAC:       client.MAC,
+		Requested: rq.filename,
+		Policy:    rule,
+		Size:      -1,
+		Start:     time.Now(),
+	})
+	if s.wantsMulticast(rq, policy) && s.mcast.join(id, addr, rq, s.cfg.DefaultImage, policy) {
+		// The session finishes the record once the client is served.
+		return
+	}
+	opts, outcome, err := s.sendFile(id, addr, rq, client, policy, rule)
+	switch outcome {
+	case OutcomeCompleted:
+		s.stalls.completed(key)
+	case OutcomeStalled:
+		var se *stallError
+		if errors.As(err, &se) {
+			if msg := s.stalls.stalled(key, se.block, opts); msg != "" {
+				s.logf("client %s %s", key, msg)
 			}
 		}
-	}()
-	return srv, nil
+	}
+	s.logf("RRQ %s", s.stats.finish(id, outcome, err))
+}
+
+func (s *Server) sendFile(id uint64, addr *net.UDPAddr, rq request, client ClientInfo, policy Policy, rule string) (negotiated, Outcome, error) {
+	var opts negotiated
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return opts, OutcomeFailed, err
+	}
+	defer conn.Close()
+
+	src, size, resolved, err := s.open(rq, client)
+	s.stats.update(id, func(ts *TransferStats) { ts.Resolved = resolved })
+	if err != nil {
+		_, _ = conn.WriteToUDP(packError(errFileNotFound, err.Error()), addr)
+		return opts, OutcomeFailed, err
+	}
+	defer src.Close()
+
+	opts = negotiate(rq.opts, policy, size)
+	s.stats.update(id, func(ts *TransferStats) {
+		ts.Size = size
+		ts.BlockSize = opts.blksize
+		ts.WindowSize = opts.windowsize
+		ts.Timeout = opts.timeout
+	})
+	s.logf("RRQ %q from %s mode=%s policy=%s: %s", rq.filename, addr, rq.mode, rule, opts)
+	t := &transfer{conn: conn, addr: addr, opts: opts, retries: policy.Retries}
+	t.progress = func(acked int64, retransmits int) {
+		s.stats.update(id, func(ts *TransferStats) {
+			ts.BytesSent = acked
+			ts.Retransmits = retransmits
+		})
+	}
+	err = t.run(src, size)
+	s.stats.update(id, func(ts *TransferStats) { ts.Retransmits = t.retransmits })
+	var se *stallError
+	switch {
+	case err == nil:
+		return opts, OutcomeCompleted, nil
+	case errors.As(err, &se):
+		return opts, OutcomeStalled, err
+	default:
+		return opts, OutcomeFailed, err
+	}
+}
+
+// Stats returns the transfer accounting of the server.
+func (s *Server) Stats() *Stats { return s.stats }
+
+// wantsMulticast reports whether rq may join a multicast session: the client
+// asked for it, the policy allows it and the content is the same for everyone.
+func (s *Server) wantsMulticast(rq request, policy Policy) bool {
+	if _, ok := rq.opts["multicast"]; !ok || s.mcast == nil || !policy.Multicast || rq.mode != "octet" {
+		return false
+	}
+	return !s.cfg.Templates.has(rq.filename)
+}
+
+// openFile opens path in octet mode, through the fan-out cache if enabled.
+func (s *Server) openFile(path string) (source, int64, error) {
+	if s.fanout != nil {
+		return s.fanout.open(path)
+	}
+	return openSource(path, "octet")
+}
+
+// open resolves the requested name to a template or to the default image.
+func (s *Server) open(rq request, client ClientInfo) (source, int64, string, error) {
+	data, resolved, ok, err := s.cfg.Templates.render(rq.filename, s.factsFor(client))
+	if !ok {
+		if rq.mode == "netascii" {
+			src, size, err := openSource(s.cfg.DefaultImage, rq.mode)
+			return src, size, s.cfg.DefaultImage, err
+		}
+		src, size, err := s.openFile(s.cfg.DefaultImage)
+		return src, size, s.cfg.DefaultImage, err
+	}
+	if err != nil {
+		return nil, 0, resolved, err
+	}
+	if rq.mode == "netascii" {
+		data = toNetascii(data)
+	}
+	return memSource{bytes.NewReader(data)}, int64(len(data)), resolved, nil
+}
+
+func (s *Server) factsFor(c ClientInfo) TemplateFacts {
+	f := TemplateFacts{Filename: c.Filename}
+	if ip4 := c.IP.To4(); ip4 != nil {
+		f.IP = ip4.String()
+		f.HexIP = fmt.Sprintf("%02X%02X%02X%02X", ip4[0], ip4[1], ip4[2], ip4[3])
+	}
+	if s.cfg.ServerIP != nil {
+		f.ServerIP = s.cfg.ServerIP.String()
+	}
+	if c.MAC != nil {
+		f.MAC = c.MAC.String()
+		if s.cfg.Allocator != nil {
+			var mac [6]byte
+			copy(mac[:], c.MAC)
+			host := s.cfg.Allocator.Host(mac)
+			f.Hostname, f.Profile = host.Hostname, host.Profile
+		}
+	}
+	return f
+}
+
+// source is the content of one transfer, addressable by block offset so a
+// window can be resent after a timeout.
+type source interface {
+	io.ReaderAt
+	io.Closer
+}
+
+type memSource struct{ *bytes.Reader }
+
+func (memSource) Close() error { return nil }
+
+// openSource opens path for a transfer in the requested mode. netascii
+// content is converted in memory since its size differs from the file's.
+func openSource(path, mode string) (source, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if mode == "netascii" {
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, 0, err
+		}
+		data = toNetascii(data)
+		return memSource{bytes.NewReader(data)}, int64(len(data)), nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+// toNetascii converts LF to CR LF and a bare CR to CR NUL (RFC 764).
+func toNetascii(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for _, c := range data {
+		switch c {
+		case '\n':
+			out = append(out, '\r', '\n')
+		case '\r':
+			out = append(out, '\r', 0)
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
 }
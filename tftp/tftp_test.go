@@ -1,7 +1,14 @@
 package tftp
 
 import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestIsHexIPv4Name(t *testing.T) {
@@ -12,3 +19,108 @@ func TestIsHexIPv4Name(t *testing.T) {
 		t.Fatalf("expected false for invalid names")
 	}
 }
+
+// fetch is a minimal RFC 1350/7440 client used to exercise the server.
+func fetch(t *testing.T, addr net.Addr, name string, opts ...string) ([]byte, map[string]string) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer conn.Close()
+	rrq := binary.BigEndian.AppendUint16(nil, opRRQ)
+	for _, f := range append([]string{name, "octet"}, opts...) {
+		rrq = append(rrq, f...)
+		rrq = append(rrq, 0)
+	}
+	if _, err := conn.WriteTo(rrq, addr); err != nil {
+		t.Fatalf("send rrq: %v", err)
+	}
+	var data []byte
+	oack := map[string]string{}
+	blksize, windowsize := 512, 1
+	buf := make([]byte, 70000)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, raddr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		ack := func(block uint16) {
+			b := binary.BigEndian.AppendUint16(nil, opACK)
+			b = binary.BigEndian.AppendUint16(b, block)
+			_, _ = conn.WriteToUDP(b, raddr)
+		}
+		switch binary.BigEndian.Uint16(buf[0:2]) {
+		case opOACK:
+			fields := bytes.Split(buf[2:n-1], []byte{0})
+			for i := 0; i+1 < len(fields); i += 2 {
+				oack[string(fields[i])] = string(fields[i+1])
+			}
+			if v, ok := oack["blksize"]; ok {
+				blksize, _ = strconv.Atoi(v)
+			}
+			if v, ok := oack["windowsize"]; ok {
+				windowsize, _ = strconv.Atoi(v)
+			}
+			ack(0)
+		case opDATA:
+			block := binary.BigEndian.Uint16(buf[2:4])
+			if int(block) != len(data)/blksize+1 {
+				continue
+			}
+			data = append(data, buf[4:n]...)
+			if n-4 < blksize {
+				ack(block)
+				return data, oack
+			}
+			if int(block)%windowsize == 0 {
+				ack(block)
+			}
+		case opERROR:
+			t.Fatalf("server error: %q", buf[4:n-1])
+		}
+	}
+}
+
+func TestServerTransfer(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 300) // 4800 bytes
+	path := filepath.Join(t.TempDir(), "ofwboot.net")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	srv, err := StartTFTPServer("127.0.0.1:0", Config{DefaultImage: path}, nil)
+	if err != nil {
+		t.Fatalf("StartTFTPServer: %v", err)
+	}
+
+	got, oack := fetch(t, srv.Addr(), "C0A8010A")
+	if !bytes.Equal(got, content) || len(oack) != 0 {
+		t.Fatalf("plain transfer mismatch: %d bytes, oack=%v", len(got), oack)
+	}
+	got, oack = fetch(t, srv.Addr(), "C0A8010A.SUN4U", "blksize", "8192", "tsize", "0", "windowsize", "4")
+	if !bytes.Equal(got, content) {
+		t.Fatalf("negotiated transfer mismatch: %d bytes", len(got))
+	}
+	if oack["blksize"] != "1468" || oack["tsize"] != "4800" {
+		t.Fatalf("unexpected oack: %v", oack)
+	}
+	if _, ok := oack["windowsize"]; ok {
+		t.Fatalf("windowsize should be refused by default policy: %v", oack)
+	}
+	srv.Shutdown()
+
+	policies := NewPolicySet(DefaultPolicy())
+	if err := policies.Add("suffix=SUN4V,blksize=1024,windowsize=2"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	srv, err = StartTFTPServer("127.0.0.1:0", Config{DefaultImage: path, Policies: policies}, nil)
+	if err != nil {
+		t.Fatalf("StartTFTPServer: %v", err)
+	}
+	defer srv.Shutdown()
+	got, oack = fetch(t, srv.Addr(), "C0A8010A.SUN4V", "blksize", "8192", "windowsize", "4")
+	if !bytes.Equal(got, content) || oack["blksize"] != "1024" || oack["windowsize"] != "2" {
+		t.Fatalf("windowed transfer mismatch: %d bytes, oack=%v", len(got), oack)
+	}
+}
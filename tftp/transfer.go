@@ -0,0 +1,154 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+var errTimeout = errors.New("timeout")
+
+// stallError reports a transfer abandoned because the client stopped
+// acknowledging; block 0 is the OACK.
+type stallError struct {
+	block   uint64
+	retries int
+}
+
+func (e *stallError) Error() string {
+	return fmt.Sprintf("block %d: no ack after %d retries", e.block, e.retries)
+}
+
+// transfer sends one file to one client from its own UDP port (the server TID).
+type transfer struct {
+	conn    *net.UDPConn
+	addr    *net.UDPAddr
+	opts    negotiated
+	retries int
+	// progress, when set, is called after each acknowledged window.
+	progress func(acked int64, retransmits int)
+
+	sent        uint64 // highest block sent so far
+	retransmits int
+	send        []byte
+	recv        []byte
+}
+
+// run sends the OACK, if any options were accepted, then the content of src.
+// Blocks are numbered from 1 and wrap at 65535 as most clients expect.
+func (t *transfer) run(src io.ReaderAt, size int64) error {
+	t.send = make([]byte, 0, 4+t.opts.blksize)
+	t.recv = make([]byte, 2048)
+	if len(t.opts.oack) > 0 {
+		if err := t.sendOACK(); err != nil {
+			return err
+		}
+	}
+	bs := int64(t.opts.blksize)
+	// The last block is always short, and empty when size is a multiple of bs.
+	last := uint64(size/bs) + 1
+	next := uint64(1)
+	data := make([]byte, bs)
+	tries := 0
+	for next <= last {
+		end := min(next+uint64(t.opts.windowsize)-1, last)
+		for b := next; b <= end; b++ {
+			n, err := src.ReadAt(data, int64(b-1)*bs)
+			if err != nil && err != io.EOF {
+				t.abort(errNotDefined, "read error")
+				return err
+			}
+			t.send = packData(t.send, uint16(b), data[:n])
+			if _, err := t.conn.WriteToUDP(t.send, t.addr); err != nil {
+				return err
+			}
+			if b <= t.sent {
+				t.retransmits++
+			}
+			t.sent = max(t.sent, b)
+		}
+		acked, err := t.waitAck(next, end)
+		if err == errTimeout {
+			tries++
+			if tries > t.retries {
+				return &stallError{block: next, retries: t.retries}
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		next = acked + 1
+		tries = 0
+		if t.progress != nil {
+			t.progress(min(int64(acked)*bs, size), t.retransmits)
+		}
+	}
+	return nil
+}
+
+func (t *transfer) sendOACK() error {
+	pkt := packOACK(t.opts.oack)
+	for tries := 0; ; tries++ {
+		if _, err := t.conn.WriteToUDP(pkt, t.addr); err != nil {
+			return err
+		}
+		if tries > 0 {
+			t.retransmits++
+		}
+		_, err := t.waitAck(0, 0)
+		if err != errTimeout {
+			return err
+		}
+		if tries >= t.retries {
+			return &stallError{block: 0, retries: t.retries}
+		}
+	}
+}
+
+// waitAck waits up to the negotiated timeout for an ACK of a block in
+// [first, end] and returns the highest such block. ACKs outside the window
+// are stale duplicates and are ignored rather than answered, which avoids
+// the Sorcerer's Apprentice bug.
+func (t *transfer) waitAck(first, end uint64) (uint64, error) {
+	if err := t.conn.SetReadDeadline(time.Now().Add(t.opts.timeout)); err != nil {
+		return 0, err
+	}
+	for {
+		n, raddr, err := t.conn.ReadFromUDP(t.recv)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				return 0, errTimeout
+			}
+			return 0, err
+		}
+		if !raddr.IP.Equal(t.addr.IP) || raddr.Port != t.addr.Port {
+			_, _ = t.conn.WriteToUDP(packError(errUnknownTID, "unknown transfer id"), raddr)
+			continue
+		}
+		op, num, msg, err := parseReply(t.recv[:n])
+		if err != nil {
+			continue
+		}
+		switch op {
+		case opACK:
+			for b := end + 1; b > first; b-- {
+				if uint16(b-1) == num {
+					return b - 1, nil
+				}
+			}
+		case opERROR:
+			return 0, fmt.Errorf("client error %d: %s", num, msg)
+		default:
+			t.abort(errIllegalOp, "unexpected opcode")
+			return 0, fmt.Errorf("unexpected opcode %d", op)
+		}
+	}
+}
+
+func (t *transfer) abort(code uint16, msg string) {
+	_, _ = t.conn.WriteToUDP(packError(code, msg), t.addr)
+}
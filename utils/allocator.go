@@ -1,16 +1,28 @@
 package utils
 
 import (
+	"bytes"
 	"fmt"
 	"net"
+	"sort"
+	"strings"
+	"sync"
 )
 
 type IPv4Allocator struct {
+	mu     sync.Mutex
 	netw   *net.IPNet
 	start  net.IP
 	end    net.IP
 	used   map[string]bool
 	leases map[[6]byte][4]byte
+	hosts  map[[6]byte]HostInfo
+}
+
+// HostInfo is what is known about a client besides its lease.
+type HostInfo struct {
+	Hostname string
+	Profile  string // free-form install profile name, "" if none
 }
 
 func NewIPv4AllocatorFromCIDR(cidr string) (*IPv4Allocator, error) {
@@ -44,6 +56,7 @@ func NewIPv4AllocatorFromCIDR(cidr string) (*IPv4Allocator, error) {
 		end:    end,
 		used:   make(map[string]bool),
 		leases: make(map[[6]byte][4]byte),
+		hosts:  make(map[[6]byte]HostInfo),
 	}, nil
 }
 
@@ -51,12 +64,16 @@ func (a *IPv4Allocator) ReserveIP(ip net.IP) {
 	if ip == nil {
 		return
 	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	if v4 := ip.To4(); v4 != nil {
 		a.used[v4.String()] = true
 	}
 }
 
 func (a *IPv4Allocator) AllocateForMAC(mac [6]byte) (out [4]byte, ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	if ip, exists := a.leases[mac]; exists {
 		return ip, true
 	}
@@ -74,6 +91,84 @@ func (a *IPv4Allocator) AllocateForMAC(mac [6]byte) (out [4]byte, ok bool) {
 	return out, false
 }
 
+// MACForIP returns the MAC address holding a lease on ip, if any.
+func (a *IPv4Allocator) MACForIP(ip net.IP) (net.HardwareAddr, bool) {
+	v4 := ip.To4()
+	if v4 == nil {
+		return nil, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for mac, leased := range a.leases {
+		if net.IP(leased[:]).Equal(v4) {
+			hw := make(net.HardwareAddr, 6)
+			copy(hw, mac[:])
+			return hw, true
+		}
+	}
+	return nil, false
+}
+
+// SetHost records the hostname and profile of the client with MAC mac.
+func (a *IPv4Allocator) SetHost(mac [6]byte, info HostInfo) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.hosts[mac] = info
+}
+
+// Host returns what is known about mac. Clients without a configured
+// hostname get one derived from their MAC, e.g. "ofw-0a0b0c".
+func (a *IPv4Allocator) Host(mac [6]byte) HostInfo {
+	a.mu.Lock()
+	info := a.hosts[mac]
+	a.mu.Unlock()
+	if info.Hostname == "" {
+		info.Hostname = defaultHostname(mac)
+	}
+	return info
+}
+
+func defaultHostname(mac [6]byte) string {
+	return fmt.Sprintf("ofw-%02x%02x%02x", mac[3], mac[4], mac[5])
+}
+
+// Client is a client known to the allocator, by its lease or its HostInfo.
+type Client struct {
+	MAC [6]byte
+	IP  net.IP // nil without a lease
+	HostInfo
+}
+
+// Clients returns the clients that have a lease or a HostInfo, sorted by
+// MAC, with hostnames as Host returns them.
+func (a *IPv4Allocator) Clients() []Client {
+	a.mu.Lock()
+	byMAC := make(map[[6]byte]*Client)
+	for mac, info := range a.hosts {
+		byMAC[mac] = &Client{MAC: mac, HostInfo: info}
+	}
+	for mac, ip := range a.leases {
+		c := byMAC[mac]
+		if c == nil {
+			c = &Client{MAC: mac}
+			byMAC[mac] = c
+		}
+		c.IP = net.IPv4(ip[0], ip[1], ip[2], ip[3]).To4()
+	}
+	a.mu.Unlock()
+	clients := make([]Client, 0, len(byMAC))
+	for mac, c := range byMAC {
+		if c.Hostname == "" {
+			c.Hostname = defaultHostname(mac)
+		}
+		clients = append(clients, *c)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return bytes.Compare(clients[i].MAC[:], clients[j].MAC[:]) < 0
+	})
+	return clients
+}
+
 func (a *IPv4Allocator) Subnet() *net.IPNet { return a.netw }
 func (a *IPv4Allocator) RangeStart() net.IP { return a.start }
 func (a *IPv4Allocator) RangeEnd() net.IP   { return a.end }
@@ -113,3 +208,22 @@ func cloneIPv4(ip net.IP) net.IP {
 	copy(dup, ip[:4])
 	return dup
 }
+
+// ParseHostSpec parses "MAC,hostname[,profile]" as used by the -host flag.
+func ParseHostSpec(spec string) ([6]byte, HostInfo, error) {
+	var mac [6]byte
+	parts := strings.Split(spec, ",")
+	if len(parts) < 2 || len(parts) > 3 || parts[1] == "" {
+		return mac, HostInfo{}, fmt.Errorf("host %q: expected MAC,hostname[,profile]", spec)
+	}
+	hw, err := net.ParseMAC(strings.TrimSpace(parts[0]))
+	if err != nil || len(hw) != 6 {
+		return mac, HostInfo{}, fmt.Errorf("host %q: invalid MAC", spec)
+	}
+	copy(mac[:], hw)
+	info := HostInfo{Hostname: strings.TrimSpace(parts[1])}
+	if len(parts) == 3 {
+		info.Profile = strings.TrimSpace(parts[2])
+	}
+	return mac, info, nil
+}
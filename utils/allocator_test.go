@@ -63,3 +63,65 @@ func TestIPv4ArithmeticHelpers(t *testing.T) {
 		t.Fatalf("cloneIPv4 got=%s want=%s", got, want)
 	}
 }
+
+func TestMACForIP(t *testing.T) {
+	alloc, err := NewIPv4AllocatorFromCIDR("10.1.0.0/24")
+	if err != nil {
+		t.Fatalf("NewIPv4AllocatorFromCIDR error: %v", err)
+	}
+	mac := [6]byte{0x08, 0x00, 0x20, 0x01, 0x02, 0x03}
+	ip, ok := alloc.AllocateForMAC(mac)
+	if !ok {
+		t.Fatalf("allocation failed")
+	}
+	got, ok := alloc.MACForIP(net.IP(ip[:]))
+	if !ok || got.String() != "08:00:20:01:02:03" {
+		t.Fatalf("MACForIP got=%v ok=%v", got, ok)
+	}
+	if _, ok := alloc.MACForIP(net.ParseIP("10.1.0.200")); ok {
+		t.Fatalf("expected no lease for unallocated ip")
+	}
+}
+
+func TestHost(t *testing.T) {
+	alloc, err := NewIPv4AllocatorFromCIDR("10.1.0.0/24")
+	if err != nil {
+		t.Fatalf("NewIPv4AllocatorFromCIDR error: %v", err)
+	}
+	mac := [6]byte{0x08, 0x00, 0x20, 0x0a, 0x0b, 0x0c}
+	if got := alloc.Host(mac); got.Hostname != "ofw-0a0b0c" || got.Profile != "" {
+		t.Fatalf("default host got=%+v", got)
+	}
+	alloc.SetHost(mac, HostInfo{Hostname: "t1000-a", Profile: "openbsd"})
+	if got := alloc.Host(mac); got.Hostname != "t1000-a" || got.Profile != "openbsd" {
+		t.Fatalf("configured host got=%+v", got)
+	}
+}
+
+func TestClients(t *testing.T) {
+	alloc, err := NewIPv4AllocatorFromCIDR("10.1.0.0/24")
+	if err != nil {
+		t.Fatalf("NewIPv4AllocatorFromCIDR error: %v", err)
+	}
+	leased := [6]byte{0x08, 0x00, 0x20, 0x0a, 0x0b, 0x0c}
+	named := [6]byte{0x08, 0x00, 0x20, 0x01, 0x02, 0x03}
+	alloc.AllocateForMAC(leased)
+	alloc.SetHost(named, HostInfo{Hostname: "t1000-a"})
+	got := alloc.Clients()
+	if len(got) != 2 || got[0].MAC != named || got[0].IP != nil || got[0].Hostname != "t1000-a" ||
+		got[1].MAC != leased || !got[1].IP.Equal(net.ParseIP("10.1.0.1")) || got[1].Hostname != "ofw-0a0b0c" {
+		t.Fatalf("Clients got=%+v", got)
+	}
+}
+
+func TestParseHostSpec(t *testing.T) {
+	mac, info, err := ParseHostSpec("08:00:20:0a:0b:0c,t1000-a,openbsd")
+	if err != nil || mac != [6]byte{8, 0, 0x20, 0x0a, 0x0b, 0x0c} || info.Hostname != "t1000-a" || info.Profile != "openbsd" {
+		t.Fatalf("ParseHostSpec got=%v %+v err=%v", mac, info, err)
+	}
+	for _, bad := range []string{"", "08:00:20:0a:0b:0c", "zz,host", "08:00:20:0a:0b:0c,,x", "a,b,c,d"} {
+		if _, _, err := ParseHostSpec(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package xdr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Errors of Encode and Decode besides those of the Reader.
+var (
+	ErrUnsupported = errors.New("xdr: unsupported type")
+	ErrBadUnion    = errors.New("xdr: no union arm for discriminant")
+	ErrBadEnum     = errors.New("xdr: invalid enum value")
+	ErrTrailing    = errors.New("xdr: trailing data")
+)
+
+// Marshaler is implemented by types that encode themselves.
+type Marshaler interface {
+	MarshalXDR(w *Writer) error
+}
+
+// Unmarshaler is implemented by types that decode themselves.
+type Unmarshaler interface {
+	UnmarshalXDR(r *Reader) error
+}
+
+// Enum is implemented by integer types that only take some values; Decode
+// refuses the others.
+type Enum interface {
+	ValidEnum() bool
+}
+
+// Marshal returns the XDR encoding of v, or of what v points to. Go types
+// map to XDR types as follows:
+//
+//	bool                      bool
+//	int32, uint32             int (enum), unsigned int
+//	int64, uint64             hyper, unsigned hyper
+//	float32, float64          float, double
+//	string                    string<>
+//	[]byte, [n]byte           opaque<>, opaque[n]
+//	[]T, [n]T                 T<>, T[n]
+//	*T                        T * (optional data)
+//	struct                    struct, or union, see below
+//
+// Tags in the "xdr" key of struct fields refine this. "max=N" (N > 0)
+// bounds a string, opaque or array field, and "-" leaves a field out. Int32
+// types implementing Enum are checked when decoded. A struct whose
+// first field is tagged "union" is a discriminated union: that field, a
+// bool or 32-bit integer, is the discriminant, and the other fields are
+// arms tagged "case=V" (several values are separated by "|") or "default".
+// Only the arm selected by the discriminant is encoded; void arms are
+// fields of type struct{}, which may be blank:
+//
+//	type postOpAttr struct {
+//		Follows bool     `xdr:"union"`
+//		Attr    fattr3   `xdr:"case=1"`
+//		_       struct{} `xdr:"case=0"`
+//	}
+//
+// Unexported fields other than void arms are skipped.
+func Marshal(v any) ([]byte, error) {
+	w := NewWriter(nil)
+	if err := w.Encode(v); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+// Unmarshal decodes b into the value v points to, as Marshal encodes it.
+// All of b must be used.
+func Unmarshal(b []byte, v any) error {
+	r := NewReader(b)
+	if err := r.Decode(v); err != nil {
+		return err
+	}
+	if len(r.Remaining()) != 0 {
+		return ErrTrailing
+	}
+	return nil
+}
+
+// Encode writes v as Marshal encodes it. A pointer passed to Encode
+// stands for the value it points to, not for optional data.
+func (w *Writer) Encode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	return encodeValue(w, rv, fieldOpts{})
+}
+
+// Decode reads the value v points to, as Marshal encodes it.
+func (r *Reader) Decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("%w: Decode needs a non-nil pointer, not %T", ErrUnsupported, v)
+	}
+	return decodeValue(r, rv.Elem(), fieldOpts{})
+}
+
+var (
+	marshalerType   = reflect.TypeFor[Marshaler]()
+	unmarshalerType = reflect.TypeFor[Unmarshaler]()
+	enumType        = reflect.TypeFor[Enum]()
+)
+
+// fieldOpts are the options of a struct field tag.
+type fieldOpts struct {
+	max       int // 0: unbounded
+	union     bool
+	cases     []int64
+	isDefault bool
+	skip      bool
+}
+
+func parseTag(tag string) (fieldOpts, error) {
+	var o fieldOpts
+	if tag == "" {
+		return o, nil
+	}
+	for _, opt := range strings.Split(tag, ",") {
+		key, val, _ := strings.Cut(strings.TrimSpace(opt), "=")
+		switch key {
+		case "-":
+			o.skip = true
+		case "max":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return o, fmt.Errorf("xdr: bad max %q", val)
+			}
+			o.max = n
+		case "union":
+			o.union = true
+		case "case":
+			for _, c := range strings.Split(val, "|") {
+				n, err := strconv.ParseInt(c, 0, 64)
+				if err != nil {
+					return o, fmt.Errorf("xdr: bad case %q", c)
+				}
+				o.cases = append(o.cases, n)
+			}
+		case "default":
+			o.isDefault = true
+		default:
+			return o, fmt.Errorf("xdr: unknown tag option %q", opt)
+		}
+	}
+	return o, nil
+}
+
+type field struct {
+	index int
+	name  string
+	opts  fieldOpts
+}
+
+// structInfo is the encoding of a struct type: its fields in order or, for a
+// union, the discriminant first and then the arms.
+type structInfo struct {
+	fields []field
+	union  bool
+}
+
+var structCache sync.Map // reflect.Type -> *structInfo
+
+func structFields(t reflect.Type) (*structInfo, error) {
+	if si, ok := structCache.Load(t); ok {
+		return si.(*structInfo), nil
+	}
+	si := &structInfo{}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		opts, err := parseTag(sf.Tag.Get("xdr"))
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", t, sf.Name, err)
+		}
+		void := sf.Type.Kind() == reflect.Struct && sf.Type.NumField() == 0
+		if opts.skip || (!sf.IsExported() && !void) {
+			continue
+		}
+		if opts.union {
+			if i != 0 {
+				return nil, fmt.Errorf("%w: %s: union discriminant %s is not the first field", ErrUnsupported, t, sf.Name)
+			}
+			switch sf.Type.Kind() {
+			case reflect.Bool, reflect.Int32, reflect.Uint32:
+			default:
+				return nil, fmt.Errorf("%w: %s: union discriminant of type %s", ErrUnsupported, t, sf.Type)
+			}
+			si.union = true
+		} else if si.union && len(opts.cases) == 0 && !opts.isDefault {
+			return nil, fmt.Errorf("%w: %s: union arm %s without case", ErrUnsupported, t, sf.Name)
+		}
+		si.fields = append(si.fields, field{index: i, name: sf.Name, opts: opts})
+	}
+	structCache.Store(t, si)
+	return si, nil
+}
+
+// arm returns the union arm selected by discriminant d.
+func (si *structInfo) arm(t reflect.Type, d int64) (field, error) {
+	var def *field
+	for i, f := range si.fields[1:] {
+		for _, c := range f.opts.cases {
+			if c == d {
+				return f, nil
+			}
+		}
+		if f.opts.isDefault {
+			def = &si.fields[1+i]
+		}
+	}
+	if def != nil {
+		return *def, nil
+	}
+	return field{}, fmt.Errorf("%w: %s discriminant %d", ErrBadUnion, t, d)
+}
+
+func discriminant(v reflect.Value) int64 {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return 1
+		}
+		return 0
+	case reflect.Int32:
+		return v.Int()
+	}
+	return int64(v.Uint())
+}
+
+func encodeValue(w *Writer, v reflect.Value, opts fieldOpts) error {
+	if !v.IsValid() {
+		return fmt.Errorf("%w: nil", ErrUnsupported)
+	}
+	// Pointers are optional data even to a Marshaler.
+	if v.Kind() != reflect.Pointer && v.Type().Implements(marshalerType) {
+		return v.Interface().(Marshaler).MarshalXDR(w)
+	}
+	if v.CanAddr() && v.Addr().Type().Implements(marshalerType) {
+		return v.Addr().Interface().(Marshaler).MarshalXDR(w)
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		w.WriteBool(v.Bool())
+	case reflect.Int32:
+		w.WriteInt32(int32(v.Int()))
+	case reflect.Uint32:
+		w.WriteUint32(uint32(v.Uint()))
+	case reflect.Int64:
+		w.WriteInt64(v.Int())
+	case reflect.Uint64:
+		w.WriteUint64(v.Uint())
+	case reflect.Float32:
+		w.WriteFloat32(float32(v.Float()))
+	case reflect.Float64:
+		w.WriteFloat64(v.Float())
+	case reflect.String:
+		if opts.max > 0 && v.Len() > opts.max {
+			return ErrTooLong
+		}
+		w.WriteString(v.String())
+	case reflect.Slice:
+		if opts.max > 0 && v.Len() > opts.max {
+			return ErrTooLong
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			w.WriteOpaque(v.Bytes())
+			return nil
+		}
+		w.WriteUint32(uint32(v.Len()))
+		return encodeElems(w, v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			p := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(p), v)
+			w.WriteFixedOpaque(p)
+			return nil
+		}
+		return encodeElems(w, v)
+	case reflect.Pointer:
+		w.WriteBool(!v.IsNil())
+		if v.IsNil() {
+			return nil
+		}
+		return encodeValue(w, v.Elem(), opts)
+	case reflect.Struct:
+		return encodeStruct(w, v)
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupported, v.Type())
+	}
+	return nil
+}
+
+func encodeElems(w *Writer, v reflect.Value) error {
+	for i := 0; i < v.Len(); i++ {
+		if err := encodeValue(w, v.Index(i), fieldOpts{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeStruct(w *Writer, v reflect.Value) error {
+	t := v.Type()
+	si, err := structFields(t)
+	if err != nil {
+		return err
+	}
+	fields := si.fields
+	if si.union {
+		d := v.Field(fields[0].index)
+		if err := encodeValue(w, d, fieldOpts{}); err != nil {
+			return err
+		}
+		arm, err := si.arm(t, discriminant(d))
+		if err != nil {
+			return err
+		}
+		fields = []field{arm}
+	}
+	for _, f := range fields {
+		if err := encodeValue(w, v.Field(f.index), f.opts); err != nil {
+			return fmt.Errorf("%s.%s: %w", t, f.name, err)
+		}
+	}
+	return nil
+}
+
+func decodeValue(r *Reader, v reflect.Value, opts fieldOpts) error {
+	if v.CanAddr() && v.Addr().Type().Implements(unmarshalerType) {
+		return v.Addr().Interface().(Unmarshaler).UnmarshalXDR(r)
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := r.ReadBool()
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int32:
+		n, err := r.ReadInt32()
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+		if v.Type().Implements(enumType) && !v.Interface().(Enum).ValidEnum() {
+			return fmt.Errorf("%w: %s %d", ErrBadEnum, v.Type(), n)
+		}
+	case reflect.Uint32:
+		n, err := r.ReadUint32()
+		if err != nil {
+			return err
+		}
+		v.SetUint(uint64(n))
+	case reflect.Int64:
+		n, err := r.ReadInt64()
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint64:
+		n, err := r.ReadUint64()
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32:
+		f, err := r.ReadFloat32()
+		if err != nil {
+			return err
+		}
+		v.SetFloat(float64(f))
+	case reflect.Float64:
+		f, err := r.ReadFloat64()
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		s, err := r.ReadString(maxLen(opts))
+		if err != nil {
+			return err
+		}
+		v.SetString(s)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			p, err := r.ReadOpaqueMax(maxLen(opts))
+			if err != nil {
+				return err
+			}
+			v.SetBytes(append(make([]byte, 0, len(p)), p...))
+			return nil
+		}
+		n, err := r.ReadArrayLen(maxLen(opts))
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+		return decodeElems(r, v)
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			p, err := r.ReadFixed(v.Len())
+			if err != nil {
+				return err
+			}
+			reflect.Copy(v, reflect.ValueOf(p))
+			return nil
+		}
+		return decodeElems(r, v)
+	case reflect.Pointer:
+		follows, err := r.ReadBool()
+		if err != nil {
+			return err
+		}
+		if !follows {
+			v.SetZero()
+			return nil
+		}
+		e := reflect.New(v.Type().Elem())
+		if err := decodeValue(r, e.Elem(), opts); err != nil {
+			return err
+		}
+		v.Set(e)
+	case reflect.Struct:
+		return decodeStruct(r, v)
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupported, v.Type())
+	}
+	return nil
+}
+
+// maxLen returns the length bound of a field: its max, or the most an XDR
+// length can tell.
+func maxLen(opts fieldOpts) int {
+	if opts.max > 0 {
+		return opts.max
+	}
+	return math.MaxInt
+}
+
+func decodeElems(r *Reader, v reflect.Value) error {
+	for i := 0; i < v.Len(); i++ {
+		if err := decodeValue(r, v.Index(i), fieldOpts{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeStruct(r *Reader, v reflect.Value) error {
+	t := v.Type()
+	si, err := structFields(t)
+	if err != nil {
+		return err
+	}
+	fields := si.fields
+	if si.union {
+		d := v.Field(fields[0].index)
+		if err := decodeValue(r, d, fieldOpts{}); err != nil {
+			return err
+		}
+		arm, err := si.arm(t, discriminant(d))
+		if err != nil {
+			return err
+		}
+		fields = []field{arm}
+	}
+	for _, f := range fields {
+		fv := v.Field(f.index)
+		if !fv.CanSet() {
+			continue // a blank void arm
+		}
+		if err := decodeValue(r, fv, f.opts); err != nil {
+			return fmt.Errorf("%s.%s: %w", t, f.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package xdr
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The file structure of RFC 4506 section 7:
+//
+//	const MAXUSERNAME = 32;
+//	const MAXFILELEN = 65535;
+//	const MAXNAMELEN = 255;
+//	enum filekind { TEXT = 0, DATA = 1, EXEC = 2 };
+//	union filetype switch (filekind kind) {
+//	case TEXT: void;
+//	case DATA: string creator<MAXNAMELEN>;
+//	case EXEC: string interpretor<MAXNAMELEN>;
+//	};
+//	struct file {
+//	    string filename<MAXNAMELEN>;
+//	    filetype type;
+//	    string owner<MAXUSERNAME>;
+//	    opaque data<MAXFILELEN>;
+//	};
+type filekind int32
+
+const (
+	fileText filekind = 0
+	fileData filekind = 1
+	fileExec filekind = 2
+)
+
+func (k filekind) ValidEnum() bool {
+	return k >= fileText && k <= fileExec
+}
+
+type filetype struct {
+	Kind        filekind `xdr:"union"`
+	_           struct{} `xdr:"case=0"`
+	Creator     string   `xdr:"case=1,max=255"`
+	Interpretor string   `xdr:"case=2,max=255"`
+}
+
+type file struct {
+	Filename string `xdr:"max=255"`
+	Type     filetype
+	Owner    string `xdr:"max=32"`
+	Data     []byte `xdr:"max=65535"`
+}
+
+// The linked list of RFC 4506 section 4.19, optional data:
+//
+//	struct stringentry {
+//	    string item<>;
+//	    stringentry *next;
+//	};
+type stringentry struct {
+	Item string
+	Next *stringentry
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatalf("bad hex %q: %v", s, err)
+	}
+	return b
+}
+
+func TestRFC4506File(t *testing.T) {
+	// The encoding of section 7.
+	want := mustHex(t, `
+		00000009 73696c6c 7970726f 67000000
+		00000002 00000004 6c697370
+		00000004 6a6f686e
+		00000006 28717569 74290000`)
+	in := file{
+		Filename: "sillyprog",
+		Type:     filetype{Kind: fileExec, Interpretor: "lisp"},
+		Owner:    "john",
+		Data:     []byte("(quit)"),
+	}
+	got, err := Marshal(in)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("Marshal = %x, %v\nwant      %x", got, err, want)
+	}
+	var out file
+	if err := Unmarshal(want, &out); err != nil || !reflect.DeepEqual(out, in) {
+		t.Fatalf("Unmarshal = %+v, %v", out, err)
+	}
+
+	// The void arm encodes nothing but the discriminant.
+	text := file{Filename: "a", Type: filetype{Kind: fileText}, Owner: "b", Data: []byte{}}
+	b, err := Marshal(&text)
+	if err != nil || !bytes.Equal(b, mustHex(t, "00000001 61000000 00000000 00000001 62000000 00000000")) {
+		t.Fatalf("TEXT file: %x, %v", b, err)
+	}
+	out = file{}
+	if err := Unmarshal(b, &out); err != nil || !reflect.DeepEqual(out, text) {
+		t.Fatalf("TEXT file round trip: %+v, %v", out, err)
+	}
+}
+
+func TestRFC4506FileErrors(t *testing.T) {
+	long := file{Filename: strings.Repeat("x", 256), Type: filetype{Kind: fileText}}
+	if _, err := Marshal(long); !errors.Is(err, ErrTooLong) {
+		t.Errorf("filename of 256 bytes: %v", err)
+	}
+	owner := mustHex(t, "00000001 61000000 00000000 00000021")
+	if err := Unmarshal(owner, &file{}); !errors.Is(err, ErrTooLong) {
+		t.Errorf("owner of 33 bytes: %v", err)
+	}
+	// filekind 3 is not in the enum, and no arm would take it.
+	if err := Unmarshal(mustHex(t, "00000001 61000000 00000003"), &file{}); !errors.Is(err, ErrBadEnum) {
+		t.Errorf("filekind 3: %v", err)
+	}
+	if _, err := Marshal(filetype{Kind: 3}); !errors.Is(err, ErrBadUnion) {
+		t.Errorf("encoding filekind 3: %v", err)
+	}
+	if err := Unmarshal(mustHex(t, "00000009 73696c6c"), &file{}); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated: %v", err)
+	}
+	var s string
+	if err := Unmarshal(mustHex(t, "00000001 61000000 00"), &s); !errors.Is(err, ErrTrailing) {
+		t.Errorf("trailing byte: %v", err)
+	}
+}
+
+func TestRFC4506OptionalData(t *testing.T) {
+	list := &stringentry{Item: "a", Next: &stringentry{Item: "bc"}}
+	// a list is a TRUE-prefixed entry, ended by FALSE
+	want := mustHex(t, "00000001 61000000 00000001 00000002 62630000 00000000")
+	got, err := Marshal(list)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("Marshal = %x, %v", got, err)
+	}
+	// The pointer Marshal is given stands for the entry; the fields'
+	// pointers are optional data.
+	if got, _ := Marshal(struct{ List *stringentry }{list}); !bytes.Equal(got, append(mustHex(t, "00000001"), want...)) {
+		t.Fatalf("Marshal of an optional list = %x", got)
+	}
+	var out stringentry
+	if err := Unmarshal(want, &out); err != nil || !reflect.DeepEqual(&out, list) {
+		t.Fatalf("Unmarshal = %+v, %v", out, err)
+	}
+}
+
+func TestRFC4506Types(t *testing.T) {
+	type fixed struct {
+		Opaque [5]byte
+		Ints   [2]int32
+		Hypers []int64
+		Names  []string `xdr:"max=2"`
+	}
+	type all struct {
+		I  int32
+		U  uint32
+		H  int64
+		UH uint64
+		F  float32
+		D  float64
+		B  bool
+		X  fixed
+	}
+	in := all{
+		I: -1, U: 0xfffffffe, H: -2, UH: 1 << 63, F: 1, D: -2, B: true,
+		X: fixed{Opaque: [5]byte{1, 2, 3, 4, 5}, Ints: [2]int32{7, -7}, Hypers: []int64{3}, Names: []string{"x", "yz"}},
+	}
+	want := mustHex(t, `
+		ffffffff fffffffe ffffffff fffffffe 80000000 00000000
+		3f800000 c0000000 00000000 00000001
+		01020304 05000000 00000007 fffffff9
+		00000001 00000000 00000003
+		00000002 00000001 78000000 00000002 797a0000`)
+	got, err := Marshal(in)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("Marshal = %x, %v\nwant      %x", got, err, want)
+	}
+	var out all
+	if err := Unmarshal(want, &out); err != nil || !reflect.DeepEqual(out, in) {
+		t.Fatalf("Unmarshal = %+v, %v", out, err)
+	}
+
+	in.X.Names = append(in.X.Names, "w")
+	if _, err := Marshal(in); !errors.Is(err, ErrTooLong) {
+		t.Errorf("three names: %v", err)
+	}
+	// A count larger than the data could hold is refused up front.
+	var h []int64
+	if err := Unmarshal(mustHex(t, "7fffffff"), &h); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("huge count: %v", err)
+	}
+	for _, v := range []any{int(1), map[string]int{}, []any{1}} {
+		if _, err := Marshal(v); !errors.Is(err, ErrUnsupported) {
+			t.Errorf("Marshal(%T): %v", v, err)
+		}
+	}
+	if err := NewReader(nil).Decode(all{}); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Decode into a value: %v", err)
+	}
+}
+
+// timeval encodes itself as seconds and microseconds.
+type timeval struct{ usec int64 }
+
+func (tv timeval) MarshalXDR(w *Writer) error {
+	w.WriteUint32(uint32(tv.usec / 1e6))
+	w.WriteUint32(uint32(tv.usec % 1e6))
+	return nil
+}
+
+func (tv *timeval) UnmarshalXDR(r *Reader) error {
+	sec, err := r.ReadUint32()
+	if err != nil {
+		return err
+	}
+	usec, err := r.ReadUint32()
+	tv.usec = int64(sec)*1e6 + int64(usec)
+	return err
+}
+
+func TestMarshaler(t *testing.T) {
+	type stamped struct {
+		When timeval
+		Was  *timeval
+	}
+	in := stamped{When: timeval{3_000_004}, Was: &timeval{5}}
+	want := mustHex(t, "00000003 00000004 00000001 00000000 00000005")
+	got, err := Marshal(in)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("Marshal = %x, %v", got, err)
+	}
+	var out stamped
+	if err := Unmarshal(want, &out); err != nil || !reflect.DeepEqual(out, in) {
+		t.Fatalf("Unmarshal = %+v, %v", out, err)
+	}
+}
@@ -0,0 +1,233 @@
+// Package xdr reads and writes External Data Representation (RFC 4506)
+// data: big-endian 4-byte units, with opaque data padded to a multiple of
+// four bytes.
+//
+// Reader and Writer handle one item at a time. Encode and Decode map Go
+// values to XDR types as a whole, following struct tags; see Marshal.
+package xdr
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// ErrTooLong reports a string, opaque or array longer than its maximum.
+var ErrTooLong = errors.New("xdr: length exceeds maximum")
+
+// pad returns the padding after n bytes of opaque data.
+func pad(n int) int {
+	return (4 - (n & 3)) & 3
+}
+
+// Reader decodes XDR data from a buffer. The slices it returns share the
+// buffer.
+type Reader struct {
+	b []byte
+	o int
+}
+
+// NewReader returns a Reader decoding b from its start.
+func NewReader(b []byte) *Reader {
+	return &Reader{b: b}
+}
+
+// Offset returns how many bytes have been decoded.
+func (r *Reader) Offset() int {
+	return r.o
+}
+
+// Remaining returns the bytes not decoded yet.
+func (r *Reader) Remaining() []byte {
+	return r.b[r.o:]
+}
+
+// Skip skips n bytes.
+func (r *Reader) Skip(n int) error {
+	if n < 0 || len(r.b)-r.o < n {
+		return io.ErrUnexpectedEOF
+	}
+	r.o += n
+	return nil
+}
+
+// ReadFixed reads fixed-length opaque data of n bytes.
+func (r *Reader) ReadFixed(n int) ([]byte, error) {
+	if n < 0 || len(r.b)-r.o < n+pad(n) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := r.b[r.o : r.o+n]
+	r.o += n + pad(n)
+	return data, nil
+}
+
+// ReadUint32 reads an unsigned integer.
+func (r *Reader) ReadUint32() (uint32, error) {
+	if len(r.b)-r.o < 4 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	v := binary.BigEndian.Uint32(r.b[r.o:])
+	r.o += 4
+	return v, nil
+}
+
+// ReadInt32 reads a signed integer or an enum.
+func (r *Reader) ReadInt32() (int32, error) {
+	v, err := r.ReadUint32()
+	return int32(v), err
+}
+
+// ReadUint64 reads an unsigned hyper integer.
+func (r *Reader) ReadUint64() (uint64, error) {
+	hi, err := r.ReadUint32()
+	if err != nil {
+		return 0, err
+	}
+	lo, err := r.ReadUint32()
+	return uint64(hi)<<32 | uint64(lo), err
+}
+
+// ReadInt64 reads a hyper integer.
+func (r *Reader) ReadInt64() (int64, error) {
+	v, err := r.ReadUint64()
+	return int64(v), err
+}
+
+// ReadFloat32 reads a single-precision floating-point number.
+func (r *Reader) ReadFloat32() (float32, error) {
+	v, err := r.ReadUint32()
+	return math.Float32frombits(v), err
+}
+
+// ReadFloat64 reads a double-precision floating-point number.
+func (r *Reader) ReadFloat64() (float64, error) {
+	v, err := r.ReadUint64()
+	return math.Float64frombits(v), err
+}
+
+// ReadBool reads a boolean, or the discriminant of optional data.
+func (r *Reader) ReadBool() (bool, error) {
+	v, err := r.ReadUint32()
+	return v != 0, err
+}
+
+// ReadOpaque reads variable-length opaque data or a string.
+func (r *Reader) ReadOpaque() ([]byte, error) {
+	return r.ReadOpaqueMax(math.MaxInt)
+}
+
+// ReadOpaqueMax reads variable-length opaque data of at most max bytes. The
+// length is checked before the data, so ErrTooLong wins over a short buffer.
+func (r *Reader) ReadOpaqueMax(max int) ([]byte, error) {
+	n, err := r.ReadUint32()
+	switch {
+	case err != nil:
+		return nil, err
+	case uint64(n) > uint64(max):
+		return nil, ErrTooLong
+	case n > uint32(len(r.b)-r.o):
+		return nil, io.ErrUnexpectedEOF
+	}
+	return r.ReadFixed(int(n))
+}
+
+// ReadString reads a string of at most max bytes.
+func (r *Reader) ReadString(max int) (string, error) {
+	p, err := r.ReadOpaqueMax(max)
+	return string(p), err
+}
+
+// ReadArrayLen reads the element count of a variable-length array of at
+// most max elements. As no element takes less than four bytes, counts the
+// remaining data cannot hold are refused before anything is allocated.
+func (r *Reader) ReadArrayLen(max int) (int, error) {
+	n, err := r.ReadUint32()
+	switch {
+	case err != nil:
+		return 0, err
+	case uint64(n) > uint64(max):
+		return 0, ErrTooLong
+	case uint64(n) > uint64(len(r.b)-r.o)/4:
+		return 0, io.ErrUnexpectedEOF
+	}
+	return int(n), nil
+}
+
+// Writer encodes XDR data, appending to a buffer.
+type Writer struct {
+	b []byte
+}
+
+// NewWriter returns a Writer appending to b.
+func NewWriter(b []byte) *Writer {
+	return &Writer{b: b}
+}
+
+// Bytes returns the encoded data.
+func (w *Writer) Bytes() []byte {
+	return w.b
+}
+
+// Len returns the number of bytes encoded.
+func (w *Writer) Len() int {
+	return len(w.b)
+}
+
+// WriteUint32 writes an unsigned integer.
+func (w *Writer) WriteUint32(v uint32) {
+	w.b = binary.BigEndian.AppendUint32(w.b, v)
+}
+
+// WriteInt32 writes a signed integer or an enum.
+func (w *Writer) WriteInt32(v int32) {
+	w.WriteUint32(uint32(v))
+}
+
+// WriteUint64 writes an unsigned hyper integer.
+func (w *Writer) WriteUint64(v uint64) {
+	w.b = binary.BigEndian.AppendUint64(w.b, v)
+}
+
+// WriteInt64 writes a hyper integer.
+func (w *Writer) WriteInt64(v int64) {
+	w.WriteUint64(uint64(v))
+}
+
+// WriteFloat32 writes a single-precision floating-point number.
+func (w *Writer) WriteFloat32(v float32) {
+	w.WriteUint32(math.Float32bits(v))
+}
+
+// WriteFloat64 writes a double-precision floating-point number.
+func (w *Writer) WriteFloat64(v float64) {
+	w.WriteUint64(math.Float64bits(v))
+}
+
+// WriteBool writes a boolean, or the discriminant of optional data.
+func (w *Writer) WriteBool(v bool) {
+	if v {
+		w.WriteUint32(1)
+	} else {
+		w.WriteUint32(0)
+	}
+}
+
+// WriteOpaque writes variable-length opaque data or a string.
+func (w *Writer) WriteOpaque(p []byte) {
+	w.WriteUint32(uint32(len(p)))
+	w.WriteFixedOpaque(p)
+}
+
+// WriteString writes a string.
+func (w *Writer) WriteString(s string) {
+	w.WriteUint32(uint32(len(s)))
+	w.b = append(w.b, s...)
+	w.b = append(w.b, make([]byte, pad(len(s)))...)
+}
+
+// WriteFixedOpaque writes fixed-length opaque data.
+func (w *Writer) WriteFixedOpaque(p []byte) {
+	w.b = append(w.b, p...)
+	w.b = append(w.b, make([]byte, pad(len(p)))...)
+}
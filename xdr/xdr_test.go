@@ -0,0 +1,93 @@
+package xdr
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestReaderWriter(t *testing.T) {
+	w := NewWriter(nil)
+	w.WriteUint32(7)
+	w.WriteUint64(1<<40 | 3)
+	w.WriteBool(true)
+	w.WriteOpaque([]byte{1, 2, 3, 4, 5})
+	w.WriteFixedOpaque([]byte("ab"))
+	if w.Len() != 4+8+4+12+4 {
+		t.Fatalf("encoded %d bytes: %x", w.Len(), w.Bytes())
+	}
+
+	r := NewReader(w.Bytes())
+	u, _ := r.ReadUint32()
+	h, _ := r.ReadUint64()
+	b, _ := r.ReadBool()
+	o, _ := r.ReadOpaque()
+	f, err := r.ReadFixed(2)
+	if err != nil || u != 7 || h != 1<<40|3 || !b || !bytes.Equal(o, []byte{1, 2, 3, 4, 5}) || string(f) != "ab" {
+		t.Fatalf("decoded %d %d %v %x %q, %v", u, h, b, o, f, err)
+	}
+	if r.Offset() != w.Len() || len(r.Remaining()) != 0 {
+		t.Fatalf("offset %d of %d", r.Offset(), w.Len())
+	}
+	if _, err := r.ReadUint32(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("read past the end: %v", err)
+	}
+}
+
+func TestReaderShort(t *testing.T) {
+	// An opaque whose length promises more than there is.
+	r := NewReader([]byte{0, 0, 0, 9, 1, 2, 3, 4})
+	if _, err := r.ReadOpaque(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("ReadOpaque: %v", err)
+	}
+	// Missing padding.
+	r = NewReader([]byte{0, 0, 0, 1, 1})
+	if _, err := r.ReadOpaque(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("ReadOpaque without padding: %v", err)
+	}
+	if err := NewReader(make([]byte, 4)).Skip(5); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Skip: %v", err)
+	}
+}
+
+func TestReaderWriterSigned(t *testing.T) {
+	w := NewWriter(nil)
+	w.WriteInt32(-1)
+	w.WriteInt64(-2)
+	w.WriteFloat32(1)
+	w.WriteFloat64(-2)
+	w.WriteString("abcde")
+	want := []byte{
+		0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe,
+		0x3f, 0x80, 0, 0,
+		0xc0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 5, 'a', 'b', 'c', 'd', 'e', 0, 0, 0,
+	}
+	if !bytes.Equal(w.Bytes(), want) {
+		t.Fatalf("encoded %x, want %x", w.Bytes(), want)
+	}
+
+	r := NewReader(w.Bytes())
+	i, _ := r.ReadInt32()
+	h, _ := r.ReadInt64()
+	f, _ := r.ReadFloat32()
+	d, _ := r.ReadFloat64()
+	s, err := r.ReadString(5)
+	if err != nil || i != -1 || h != -2 || f != 1 || d != -2 || s != "abcde" {
+		t.Fatalf("decoded %d %d %v %v %q, %v", i, h, f, d, s, err)
+	}
+	if _, err := NewReader(want[24:]).ReadString(4); err != ErrTooLong {
+		t.Fatalf("ReadString over max: %v", err)
+	}
+	// The maximum is checked before the data is.
+	if _, err := NewReader([]byte{0, 0, 1, 0}).ReadOpaqueMax(255); err != ErrTooLong {
+		t.Fatalf("ReadOpaqueMax over max: %v", err)
+	}
+	if _, err := NewReader([]byte{0, 0, 0, 3}).ReadArrayLen(10); err != io.ErrUnexpectedEOF {
+		t.Fatalf("ReadArrayLen beyond the data: %v", err)
+	}
+	if _, err := NewReader([]byte{0, 0, 0, 3, 0, 0, 0, 0}).ReadArrayLen(2); err != ErrTooLong {
+		t.Fatalf("ReadArrayLen over max: %v", err)
+	}
+}